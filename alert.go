@@ -0,0 +1,177 @@
+package dtls
+
+import (
+	"fmt"
+)
+
+type AlertLevel byte
+
+const (
+	AlertLevelWarning AlertLevel = 1
+	AlertLevelFatal   AlertLevel = 2
+)
+
+func (l AlertLevel) String() string {
+	switch l {
+	case AlertLevelWarning:
+		return "warning"
+	case AlertLevelFatal:
+		return "fatal"
+	default:
+		return "xxx"
+	}
+}
+
+type AlertDescription byte
+
+// Alert descriptions from RFC 5246, section 7.2, and its extensions.
+const (
+	AlertCloseNotify            AlertDescription = 0
+	AlertUnexpectedMessage      AlertDescription = 10
+	AlertBadRecordMAC           AlertDescription = 20
+	AlertRecordOverflow         AlertDescription = 22
+	AlertDecompressionFailure   AlertDescription = 30
+	AlertHandshakeFailure       AlertDescription = 40
+	AlertBadCertificate         AlertDescription = 42
+	AlertUnsupportedCertificate AlertDescription = 43
+	AlertCertificateRevoked     AlertDescription = 44
+	AlertCertificateExpired     AlertDescription = 45
+	AlertCertificateUnknown     AlertDescription = 46
+	AlertIllegalParameter       AlertDescription = 47
+	AlertUnknownCA              AlertDescription = 48
+	AlertAccessDenied           AlertDescription = 49
+	AlertDecodeError            AlertDescription = 50
+	AlertDecryptError           AlertDescription = 51
+	AlertProtocolVersion        AlertDescription = 70
+	AlertInsufficientSecurity   AlertDescription = 71
+	AlertInternalError          AlertDescription = 80
+	AlertUserCanceled           AlertDescription = 90
+	AlertNoRenegotiation        AlertDescription = 100
+	AlertMissingExtension       AlertDescription = 109
+	AlertUnsupportedExtension   AlertDescription = 110
+	AlertUnknownPSKIdentity     AlertDescription = 115
+)
+
+func (d AlertDescription) String() string {
+	switch d {
+	case AlertCloseNotify:
+		return "close_notify"
+	case AlertUnexpectedMessage:
+		return "unexpected_message"
+	case AlertBadRecordMAC:
+		return "bad_record_mac"
+	case AlertRecordOverflow:
+		return "record_overflow"
+	case AlertDecompressionFailure:
+		return "decompression_failure"
+	case AlertHandshakeFailure:
+		return "handshake_failure"
+	case AlertBadCertificate:
+		return "bad_certificate"
+	case AlertUnsupportedCertificate:
+		return "unsupported_certificate"
+	case AlertCertificateRevoked:
+		return "certificate_revoked"
+	case AlertCertificateExpired:
+		return "certificate_expired"
+	case AlertCertificateUnknown:
+		return "certificate_unknown"
+	case AlertIllegalParameter:
+		return "illegal_parameter"
+	case AlertUnknownCA:
+		return "unknown_ca"
+	case AlertAccessDenied:
+		return "access_denied"
+	case AlertDecodeError:
+		return "decode_error"
+	case AlertDecryptError:
+		return "decrypt_error"
+	case AlertProtocolVersion:
+		return "protocol_version"
+	case AlertInsufficientSecurity:
+		return "insufficient_security"
+	case AlertInternalError:
+		return "internal_error"
+	case AlertUserCanceled:
+		return "user_canceled"
+	case AlertNoRenegotiation:
+		return "no_renegotiation"
+	case AlertMissingExtension:
+		return "missing_extension"
+	case AlertUnsupportedExtension:
+		return "unsupported_extension"
+	case AlertUnknownPSKIdentity:
+		return "unknown_psk_identity"
+	default:
+		return fmt.Sprintf("alert(%d)", byte(d))
+	}
+}
+
+type alert struct {
+	Level       AlertLevel
+	Description AlertDescription
+}
+
+func readAlert(byts []byte) (a alert, err error) {
+	if len(byts) != 2 {
+		return a, InvalidAlertError
+	}
+	a.Level = AlertLevel(byts[0])
+	a.Description = AlertDescription(byts[1])
+	if a.Level != AlertLevelWarning && a.Level != AlertLevelFatal {
+		return a, InvalidAlertError
+	}
+	return
+}
+
+func (a alert) Bytes() []byte {
+	return []byte{byte(a.Level), byte(a.Description)}
+}
+
+func (a alert) String() string {
+	return fmt.Sprintf("Alert{ Level: %s, Description: %s }", a.Level, a.Description)
+}
+
+var InvalidAlertError = newAlertError(AlertDecodeError, "Invalid alert")
+
+// An AlertError is returned when a connection was aborted with an alert,
+// either because the peer sent one or because we sent one to the peer.
+type AlertError struct {
+	Level       AlertLevel
+	Description AlertDescription
+	// Remote is true if the alert was received from the peer.
+	Remote bool
+	// Err is the local error we sent the alert for. It is nil for
+	// received alerts.
+	Err error
+}
+
+func (e *AlertError) Error() string {
+	if e.Remote {
+		return fmt.Sprintf("Received %s alert: %s", e.Level, e.Description)
+	}
+	return fmt.Sprintf("Sent %s alert %s: %s", e.Level, e.Description, e.Err)
+}
+
+func (e *AlertError) Unwrap() error {
+	return e.Err
+}
+
+// wrapAlertError returns err unchanged if it is an *AlertError and a new
+// alert error with description otherwise.
+func wrapAlertError(err error, description AlertDescription, format string, a ...interface{}) error {
+	if alertErr, ok := err.(*AlertError); ok {
+		return alertErr
+	}
+	return newAlertError(description, format, a...)
+}
+
+// newAlertError creates the error for a local failure which aborts the
+// connection with a fatal alert.
+func newAlertError(description AlertDescription, format string, a ...interface{}) *AlertError {
+	return &AlertError{
+		Level:       AlertLevelFatal,
+		Description: description,
+		Err:         fmt.Errorf(format, a...),
+	}
+}
@@ -0,0 +1,168 @@
+package dtls
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+// ccm implements the CCM mode of RFC 3610 for a 128 bit block cipher. The
+// standard library has none and it is required by the CCM cipher suites of
+// RFC 6655 and RFC 7251.
+type ccm struct {
+	block     cipher.Block
+	tagSize   int
+	nonceSize int
+}
+
+var ccmOpenError = errors.New("CCM message authentication failed")
+
+// newCCM returns a CCM AEAD with the given tag and nonce size. Valid tag
+// sizes are 4 to 16 bytes in steps of two, valid nonce sizes are 7 to 13
+// bytes.
+func newCCM(block cipher.Block, tagSize, nonceSize int) (cipher.AEAD, error) {
+	if block.BlockSize() != 16 {
+		return nil, errors.New("CCM requires a 128 bit block cipher")
+	}
+	if tagSize < 4 || tagSize > 16 || tagSize%2 != 0 {
+		return nil, errors.New("Invalid CCM tag size")
+	}
+	if nonceSize < 7 || nonceSize > 13 {
+		return nil, errors.New("Invalid CCM nonce size")
+	}
+	return &ccm{block: block, tagSize: tagSize, nonceSize: nonceSize}, nil
+}
+
+func (c *ccm) NonceSize() int { return c.nonceSize }
+func (c *ccm) Overhead() int  { return c.tagSize }
+
+// lengthSize is the size L of the length field in the first block.
+func (c *ccm) lengthSize() int {
+	return 15 - c.nonceSize
+}
+
+func (c *ccm) maxLength() uint64 {
+	if c.lengthSize() >= 8 {
+		return ^uint64(0)
+	}
+	return 1<<(8*uint(c.lengthSize())) - 1
+}
+
+// counter returns the counter block A_i for nonce, RFC 3610 section 2.3.
+func (c *ccm) counter(nonce []byte, i uint64) []byte {
+	block := make([]byte, 16)
+	block[0] = byte(c.lengthSize() - 1)
+	copy(block[1:], nonce)
+	c.putLength(block, i)
+	return block
+}
+
+// putLength writes value to the last L bytes of block.
+func (c *ccm) putLength(block []byte, value uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], value)
+	copy(block[16-c.lengthSize():], b[8-c.lengthSize():])
+}
+
+// mac computes the CBC-MAC over the message and additional data, RFC 3610
+// section 2.2.
+func (c *ccm) mac(nonce, plaintext, additionalData []byte) []byte {
+	x := make([]byte, 16)
+	x[0] = byte((c.tagSize-2)/2<<3 | (c.lengthSize() - 1))
+	if len(additionalData) > 0 {
+		x[0] |= 1 << 6
+	}
+	copy(x[1:], nonce)
+	c.putLength(x, uint64(len(plaintext)))
+	c.block.Encrypt(x, x)
+
+	if len(additionalData) > 0 {
+		var encoded []byte
+		if len(additionalData) < 1<<16-1<<8 {
+			encoded = make([]byte, 2)
+			binary.BigEndian.PutUint16(encoded, uint16(len(additionalData)))
+		} else {
+			encoded = make([]byte, 6)
+			encoded[0], encoded[1] = 0xff, 0xfe
+			binary.BigEndian.PutUint32(encoded[2:], uint32(len(additionalData)))
+		}
+		c.macBlocks(x, append(encoded, additionalData...))
+	}
+	c.macBlocks(x, plaintext)
+	return x[:c.tagSize]
+}
+
+// macBlocks adds data, padded with zeros to full blocks, to the CBC-MAC x.
+func (c *ccm) macBlocks(x, data []byte) {
+	for len(data) > 0 {
+		// A short last block leaves the rest of x unchanged, which is the
+		// XOR with its zero padding.
+		n := subtle.XORBytes(x, x, data)
+		c.block.Encrypt(x, x)
+		data = data[n:]
+	}
+}
+
+// crypt en- or decrypts src into dst with the counter blocks A_1, A_2, ...
+func (c *ccm) crypt(dst, src, nonce []byte) {
+	ctr := cipher.NewCTR(c.block, c.counter(nonce, 1))
+	ctr.XORKeyStream(dst, src)
+}
+
+// tagMask returns S_0, which encrypts the tag.
+func (c *ccm) tagMask(nonce []byte) []byte {
+	s0 := c.counter(nonce, 0)
+	c.block.Encrypt(s0, s0)
+	return s0[:c.tagSize]
+}
+
+func (c *ccm) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != c.nonceSize {
+		panic("dtls: incorrect nonce length given to CCM")
+	}
+	if uint64(len(plaintext)) > c.maxLength() {
+		panic("dtls: message too large for CCM")
+	}
+	tag := c.mac(nonce, plaintext, additionalData)
+	subtle.XORBytes(tag, tag, c.tagMask(nonce))
+	ret, out := sliceForAppend(dst, len(plaintext)+c.tagSize)
+	c.crypt(out, plaintext, nonce)
+	copy(out[len(plaintext):], tag)
+	return ret
+}
+
+func (c *ccm) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != c.nonceSize {
+		panic("dtls: incorrect nonce length given to CCM")
+	}
+	if len(ciphertext) < c.tagSize || uint64(len(ciphertext)-c.tagSize) > c.maxLength() {
+		return nil, ccmOpenError
+	}
+	tag := ciphertext[len(ciphertext)-c.tagSize:]
+	ciphertext = ciphertext[:len(ciphertext)-c.tagSize]
+	ret, out := sliceForAppend(dst, len(ciphertext))
+	c.crypt(out, ciphertext, nonce)
+	expected := c.mac(nonce, out, additionalData)
+	subtle.XORBytes(expected, expected, c.tagMask(nonce))
+	if subtle.ConstantTimeCompare(expected, tag) != 1 {
+		for i := range out {
+			out[i] = 0
+		}
+		return nil, ccmOpenError
+	}
+	return ret, nil
+}
+
+// sliceForAppend extends in by n bytes. It returns the extended slice and
+// the part of it that was added.
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
@@ -0,0 +1,63 @@
+package dtls
+
+import (
+	"bytes"
+	"crypto/aes"
+	"testing"
+)
+
+func TestCCM(t *testing.T) {
+	tests := []struct {
+		key, nonce, additionalData, plaintext, ciphertext string
+		tagSize                                           int
+	}{
+		// RFC 3610, packet vector #1
+		{"c0c1c2c3c4c5c6c7c8c9cacbcccdcecf", "00000003020100a0a1a2a3a4a5", "0001020304050607",
+			"08090a0b0c0d0e0f101112131415161718191a1b1c1d1e",
+			"588c979a61c663d2f066d0c2c0f989806d5f6b61dac38417e8d12cfdf926e0", 8},
+		// NIST SP 800-38C, example 1
+		{"404142434445464748494a4b4c4d4e4f", "10111213141516", "0001020304050607",
+			"20212223", "7162015b4dac255d", 4},
+		// NIST SP 800-38C, example 3
+		{"404142434445464748494a4b4c4d4e4f", "101112131415161718191a1b", "000102030405060708090a0b0c0d0e0f10111213",
+			"202122232425262728292a2b2c2d2e2f3031323334353637",
+			"e3b201a9f5b71a7a9b1ceaeccd97e70b6176aad9a4428aa5484392fbc1b09951", 8},
+	}
+	for i, test := range tests {
+		block, _ := aes.NewCipher(hexToBytes(test.key))
+		nonce := hexToBytes(test.nonce)
+		ccm, err := newCCM(block, test.tagSize, len(nonce))
+		if err != nil {
+			t.Fatalf("Test %d: %s", i, err)
+		}
+		plaintext, additionalData := hexToBytes(test.plaintext), hexToBytes(test.additionalData)
+		ciphertext := ccm.Seal(nil, nonce, plaintext, additionalData)
+		if !bytes.Equal(ciphertext, hexToBytes(test.ciphertext)) {
+			t.Errorf("Test %d: expected ciphertext %x but got %x", i, hexToBytes(test.ciphertext), ciphertext)
+			continue
+		}
+		opened, err := ccm.Open(nil, nonce, ciphertext, additionalData)
+		if err != nil || !bytes.Equal(opened, plaintext) {
+			t.Errorf("Test %d: expected plaintext %x but got %x, %v", i, plaintext, opened, err)
+		}
+		ciphertext[len(ciphertext)-1] ^= 1
+		if _, err := ccm.Open(nil, nonce, ciphertext, additionalData); err != ccmOpenError {
+			t.Errorf("Test %d: expected modified tag to be rejected but got %v", i, err)
+		}
+	}
+}
+
+func TestSealRecordCCM(t *testing.T) {
+	for _, tagSize := range []int{8, 16} {
+		c := &Conn{version: DTLS_12}
+		c.currentReadState.AEAD = newAESCCM(clientKey, []byte{1, 2, 3, 4}, tagSize)
+		sealed := c.sealRecord(&c.currentReadState, typeApplicationData, 1, 5, payload)
+		if len(sealed) != 8+len(payload)+tagSize {
+			t.Fatalf("Expected explicit nonce, ciphertext and %d byte tag but got %d bytes", tagSize, len(sealed))
+		}
+		opened, err := c.openRecord(&record{Type: typeApplicationData, Epoch: 1, SequenceNumber: 5, Payload: sealed})
+		if err != nil || !bytes.Equal(opened, payload) {
+			t.Errorf("Expected to open the sealed record with a %d byte tag but got %x, %v", tagSize, opened, err)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package dtls
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+)
+
+type handshakeCertificate struct {
+	// Certificates is the DER encoded chain, starting with the leaf.
+	Certificates [][]byte
+	// RequestContext is only sent in DTLS 1.3, where a client repeats the
+	// context of the CertificateRequest. The extensions of the DTLS 1.3
+	// certificate entries are not supported and left empty.
+	RequestContext []byte
+}
+
+func readHandshakeCertificate(byts []byte, version protocolVersion) (c handshakeCertificate, err error) {
+	buffer := bytes.NewBuffer(byts)
+	if version == DTLS_13 {
+		contextLength, err := buffer.ReadByte()
+		if err != nil || buffer.Len() < int(contextLength) {
+			return c, InvalidHandshakeError
+		}
+		c.RequestContext = buffer.Next(int(contextLength))
+	}
+	if buffer.Len() < 3 {
+		return c, InvalidHandshakeError
+	}
+	if int(readUint24(buffer)) != buffer.Len() {
+		return c, InvalidHandshakeError
+	}
+	for buffer.Len() > 0 {
+		if buffer.Len() < 3 {
+			return c, InvalidHandshakeError
+		}
+		length := int(readUint24(buffer))
+		if length == 0 || buffer.Len() < length {
+			return c, InvalidHandshakeError
+		}
+		c.Certificates = append(c.Certificates, buffer.Next(length))
+		if version == DTLS_13 {
+			if _, err := readOpaque16(buffer); err != nil {
+				return c, InvalidHandshakeError
+			}
+		}
+	}
+	return
+}
+
+func (c handshakeCertificate) Bytes(version protocolVersion) []byte {
+	entryOverhead := 3
+	if version == DTLS_13 {
+		entryOverhead += 2
+	}
+	length := 0
+	for _, cert := range c.Certificates {
+		length += entryOverhead + len(cert)
+	}
+	buffer := bytes.Buffer{}
+	if version == DTLS_13 {
+		buffer.WriteByte(byte(len(c.RequestContext)))
+		buffer.Write(c.RequestContext)
+	}
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(length))
+	buffer.Write(b[1:])
+	for _, cert := range c.Certificates {
+		binary.BigEndian.PutUint32(b, uint32(len(cert)))
+		buffer.Write(b[1:])
+		buffer.Write(cert)
+		if version == DTLS_13 {
+			buffer.Write([]byte{0, 0})
+		}
+	}
+	return buffer.Bytes()
+}
+
+func (c handshakeCertificate) String() string {
+	return fmt.Sprintf("Certificate{ Certificates: %d }", len(c.Certificates))
+}
+
+// parseCertificates parses the chain of a Certificate message.
+func parseCertificates(message *handshake, version protocolVersion) ([]*x509.Certificate, error) {
+	msg, err := readHandshakeCertificate(message.Fragment, version)
+	if err != nil {
+		return nil, newAlertError(AlertDecodeError, "Error while reading certificate: %s", err)
+	}
+	certs := make([]*x509.Certificate, 0, len(msg.Certificates))
+	for _, der := range msg.Certificates {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, newAlertError(AlertBadCertificate, "Unable to parse certificate: %s", err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// verifyCertificateChain verifies that certs is a valid chain for usage
+// from its leaf to one of roots. The leaf has to be valid for dnsName
+// unless it is empty.
+func verifyCertificateChain(certs []*x509.Certificate, roots *x509.CertPool, dnsName string, usage x509.ExtKeyUsage) error {
+	if len(certs) == 0 {
+		return newAlertError(AlertBadCertificate, "Peer sent an empty certificate chain")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       dnsName,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(opts); err != nil {
+		return newAlertError(certificateAlert(err), "Unable to verify certificate: %s", err)
+	}
+	return nil
+}
+
+// certificateAlert returns the alert that reports a failed verification.
+func certificateAlert(err error) AlertDescription {
+	switch err := err.(type) {
+	case x509.UnknownAuthorityError:
+		return AlertUnknownCA
+	case x509.CertificateInvalidError:
+		if err.Reason == x509.Expired {
+			return AlertCertificateExpired
+		}
+	}
+	return AlertBadCertificate
+}
+
+// issuedByAny reports whether one of the certificates in chain was issued
+// by an authority with one of the DER encoded names.
+func issuedByAny(chain [][]byte, names [][]byte) bool {
+	for _, der := range chain {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			continue
+		}
+		for _, name := range names {
+			if bytes.Equal(cert.RawIssuer, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
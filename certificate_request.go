@@ -0,0 +1,160 @@
+package dtls
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Client certificate types from RFC 5246, section 7.4.4 and RFC 4492,
+// section 5.5.
+type clientCertificateType uint8
+
+const (
+	certificateTypeRSASign   clientCertificateType = 1
+	certificateTypeECDSASign clientCertificateType = 64
+)
+
+// certificateTypeFor returns the certificate type of keys that sign with
+// typ.
+func certificateTypeFor(typ signatureAlgorithm) clientCertificateType {
+	if typ == signatureECDSA {
+		return certificateTypeECDSASign
+	}
+	return certificateTypeRSASign
+}
+
+func containsCertificateType(types []clientCertificateType, typ clientCertificateType) bool {
+	for _, t := range types {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+type handshakeCertificateRequest struct {
+	// CertificateTypes are not sent in DTLS 1.3.
+	CertificateTypes []clientCertificateType
+	// SignatureAlgorithms is only sent since DTLS 1.2.
+	SignatureAlgorithms []signatureAndHash
+	// CertificateAuthorities are the DER encoded distinguished names of
+	// the accepted certificate authorities.
+	CertificateAuthorities [][]byte
+	// Context is only sent in DTLS 1.3, the client's Certificate
+	// repeats it.
+	Context []byte
+}
+
+func readHandshakeCertificateRequest(byts []byte, version protocolVersion) (cr handshakeCertificateRequest, err error) {
+	if version == DTLS_13 {
+		return readHandshakeCertificateRequest13(byts)
+	}
+	buffer := bytes.NewBuffer(byts)
+	typesLength, err := buffer.ReadByte()
+	if err != nil || typesLength == 0 || buffer.Len() < int(typesLength) {
+		return cr, InvalidHandshakeError
+	}
+	for _, typ := range buffer.Next(int(typesLength)) {
+		cr.CertificateTypes = append(cr.CertificateTypes, clientCertificateType(typ))
+	}
+	if version == DTLS_12 {
+		list, err := readOpaque16(buffer)
+		if err != nil || len(list) == 0 || len(list)%2 != 0 {
+			return cr, InvalidHandshakeError
+		}
+		for i := 0; i < len(list); i += 2 {
+			cr.SignatureAlgorithms = append(cr.SignatureAlgorithms, signatureAndHash{hashAlgorithm(list[i]), signatureAlgorithm(list[i+1])})
+		}
+	}
+	names, err := readOpaque16(buffer)
+	if err != nil || buffer.Len() != 0 {
+		return cr, InvalidHandshakeError
+	}
+	cr.CertificateAuthorities, err = readDistinguishedNames(names)
+	return
+}
+
+// readHandshakeCertificateRequest13 reads the CertificateRequest of DTLS
+// 1.3, which carries the signature algorithms and authorities in
+// extensions, RFC 8446 section 4.3.2.
+func readHandshakeCertificateRequest13(byts []byte) (cr handshakeCertificateRequest, err error) {
+	buffer := bytes.NewBuffer(byts)
+	contextLength, err := buffer.ReadByte()
+	if err != nil || buffer.Len() < int(contextLength) {
+		return cr, InvalidHandshakeError
+	}
+	cr.Context = buffer.Next(int(contextLength))
+	extensions, err := readExtensions(buffer)
+	if err != nil {
+		return cr, InvalidHandshakeError
+	}
+	e, ok := findExtension(extensions, ExtensionSignatureAlgorithms)
+	if !ok {
+		return cr, InvalidHandshakeError
+	}
+	if cr.SignatureAlgorithms, err = readSignatureAlgorithmsExtension(e.Data); err != nil {
+		return cr, InvalidHandshakeError
+	}
+	if e, ok := findExtension(extensions, ExtensionCertificateAuthorities); ok {
+		names, nameErr := readOpaque16(bytes.NewBuffer(e.Data))
+		if nameErr != nil || len(names)+2 != len(e.Data) {
+			return cr, InvalidHandshakeError
+		}
+		cr.CertificateAuthorities, err = readDistinguishedNames(names)
+	}
+	return
+}
+
+func readDistinguishedNames(data []byte) (names [][]byte, err error) {
+	buffer := bytes.NewBuffer(data)
+	for buffer.Len() > 0 {
+		name, err := readOpaque16(buffer)
+		if err != nil || len(name) == 0 {
+			return nil, InvalidHandshakeError
+		}
+		names = append(names, name)
+	}
+	return
+}
+
+func distinguishedNamesBytes(names [][]byte) []byte {
+	buffer := bytes.Buffer{}
+	for _, name := range names {
+		buffer.Write(opaque16(name))
+	}
+	return opaque16(buffer.Bytes())
+}
+
+func (cr handshakeCertificateRequest) Bytes(version protocolVersion) []byte {
+	buffer := bytes.Buffer{}
+	if version == DTLS_13 {
+		buffer.WriteByte(byte(len(cr.Context)))
+		buffer.Write(cr.Context)
+		extensions := []extension{newSignatureAlgorithmsExtension(cr.SignatureAlgorithms)}
+		if len(cr.CertificateAuthorities) > 0 {
+			extensions = append(extensions, extension{Type: ExtensionCertificateAuthorities, Data: distinguishedNamesBytes(cr.CertificateAuthorities)})
+		}
+		writeExtensions(&buffer, extensions)
+		return buffer.Bytes()
+	}
+	buffer.WriteByte(byte(len(cr.CertificateTypes)))
+	for _, typ := range cr.CertificateTypes {
+		buffer.WriteByte(byte(typ))
+	}
+	if version == DTLS_12 {
+		b := make([]byte, 2)
+		binary.BigEndian.PutUint16(b, uint16(2*len(cr.SignatureAlgorithms)))
+		buffer.Write(b)
+		for _, algorithm := range cr.SignatureAlgorithms {
+			buffer.Write(algorithm.Bytes())
+		}
+	}
+	buffer.Write(distinguishedNamesBytes(cr.CertificateAuthorities))
+	return buffer.Bytes()
+}
+
+func (cr handshakeCertificateRequest) String() string {
+	return fmt.Sprintf("CertificateRequest{ CertificateTypes: %v, SignatureAlgorithms: %v, CertificateAuthorities: %d }",
+		cr.CertificateTypes, cr.SignatureAlgorithms, len(cr.CertificateAuthorities))
+}
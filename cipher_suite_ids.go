@@ -136,6 +136,11 @@ const (
 	TLS_DHE_RSA_WITH_CAMELLIA_256_CBC_SHA256                    = 0x00c4
 	TLS_DH_anon_WITH_CAMELLIA_256_CBC_SHA256                    = 0x00c5
 	TLS_EMPTY_RENEGOTIATION_INFO_SCSV                           = 0x00ff
+	TLS_AES_128_GCM_SHA256                                      = 0x1301
+	TLS_AES_256_GCM_SHA384                                      = 0x1302
+	TLS_CHACHA20_POLY1305_SHA256                                = 0x1303
+	TLS_AES_128_CCM_SHA256                                      = 0x1304
+	TLS_AES_128_CCM_8_SHA256                                    = 0x1305
 	TLS_FALLBACK_SCSV                                           = 0x5600
 	TLS_ECDH_ECDSA_WITH_NULL_SHA                                = 0xc001
 	TLS_ECDH_ECDSA_WITH_3DES_EDE_CBC_SHA                        = 0xc003
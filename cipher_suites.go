@@ -11,13 +11,50 @@ import (
 	"crypto/hmac"
 	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/binary"
 	"errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/sys/cpu"
 	"hash"
 )
 
+// hasAESGCMHardwareSupport reports whether the CPU has instructions for
+// AES-GCM. Without them ChaCha20-Poly1305 is faster and preferred.
+var hasAESGCMHardwareSupport = cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ ||
+	cpu.ARM64.HasAES && cpu.ARM64.HasPMULL ||
+	cpu.S390X.HasAES && cpu.S390X.HasAESGCM
+
+const (
+	// suiteECSign indicates that the server signs with an ECDSA
+	// certificate, so the suite may only be selected if the server has one.
+	suiteECSign = 1 << iota
+	// suiteRSASign indicates that the server signs with an RSA
+	// certificate.
+	suiteRSASign
+	// suiteDefaultOff indicates that the cipher suite is not offered or
+	// accepted unless it is listed in Config.CipherSuites, e.g. because
+	// it does not authenticate the peer.
+	suiteDefaultOff
+	// suiteTLS12 indicates that the cipher suite may only be used with
+	// DTLS 1.2.
+	suiteTLS12
+	// suiteSHA384 indicates that the cipher suite uses SHA384 as the
+	// hash of the PRF.
+	suiteSHA384
+	// suiteChaCha20 indicates a ChaCha20-Poly1305 cipher suite, which is
+	// faster than AES on hardware without AES instructions.
+	suiteChaCha20
+	// suitePSK indicates that the peers authenticate with a pre-shared
+	// key, so the suite may only be used if one is configured.
+	suitePSK
+	// suiteTLS13 indicates a DTLS 1.3 cipher suite, which only names the
+	// AEAD and the hash of the key schedule. DTLS 1.3 uses no other suites.
+	suiteTLS13
+)
+
 // A cipherSuite is a specific combination of key agreement, cipher and MAC
-// function. All cipher suites currently assume RSA key agreement.
+// function.
 type cipherSuite struct {
 	id cipherSuiteId
 	// the lengths, in bytes, of the key material needed for each component.
@@ -29,13 +66,44 @@ type cipherSuite struct {
 	// the ClientHello indicated that the client supports an elliptic curve
 	// and point format that we can handle.
 	elliptic bool
-	cipher   func(key []byte) cipher.Block
-	mac      func(macKey []byte) macFunction
+	// flags is a bitmask of the suite* values above.
+	flags  int
+	cipher func(key []byte) cipher.Block
+	mac    func(macKey []byte) macFunction
+	// aead is set instead of cipher and mac for AEAD cipher suites.
+	aead func(key, fixedNonce []byte) aead
 }
 
 var cipherSuites = []*cipherSuite{
-	{TLS_DH_anon_WITH_AES_128_CBC_SHA, 16, 20, 16, dheKA, false, cipherAES, macSHA1},
-	{TLS_DH_anon_WITH_AES_256_CBC_SHA256, 32, 32, 16, dheKA, false, cipherAES, macSHA256},
+	{TLS_AES_128_GCM_SHA256, 16, 0, 12, nil, false, suiteTLS13, nil, nil, aeadAESGCMTLS13},
+	{TLS_AES_256_GCM_SHA384, 32, 0, 12, nil, false, suiteTLS13 | suiteSHA384, nil, nil, aeadAESGCMTLS13},
+	{TLS_CHACHA20_POLY1305_SHA256, 32, 0, 12, nil, false, suiteTLS13 | suiteChaCha20, nil, nil, aeadChaCha20Poly1305},
+	{TLS_AES_128_CCM_SHA256, 16, 0, 12, nil, false, suiteTLS13, nil, nil, aeadAESCCMTLS13},
+	{TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, 16, 0, 4, ecdheECDSAKA, true, suiteECSign | suiteTLS12, nil, nil, aeadAESGCM},
+	{TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, 16, 0, 4, ecdheRSAKA, true, suiteRSASign | suiteTLS12, nil, nil, aeadAESGCM},
+	{TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, 32, 0, 4, ecdheECDSAKA, true, suiteECSign | suiteTLS12 | suiteSHA384, nil, nil, aeadAESGCM},
+	{TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, 32, 0, 4, ecdheRSAKA, true, suiteRSASign | suiteTLS12 | suiteSHA384, nil, nil, aeadAESGCM},
+	{TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256, 32, 0, 12, ecdheECDSAKA, true, suiteECSign | suiteTLS12 | suiteChaCha20, nil, nil, aeadChaCha20Poly1305},
+	{TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256, 32, 0, 12, ecdheRSAKA, true, suiteRSASign | suiteTLS12 | suiteChaCha20, nil, nil, aeadChaCha20Poly1305},
+	{TLS_ECDHE_ECDSA_WITH_AES_128_CCM, 16, 0, 4, ecdheECDSAKA, true, suiteECSign | suiteTLS12, nil, nil, aeadAESCCM},
+	{TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8, 16, 0, 4, ecdheECDSAKA, true, suiteECSign | suiteTLS12, nil, nil, aeadAESCCM8},
+	{TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256, 16, 32, 16, ecdheECDSAKA, true, suiteECSign | suiteTLS12, cipherAES, macSHA256, nil},
+	{TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256, 16, 32, 16, ecdheRSAKA, true, suiteRSASign | suiteTLS12, cipherAES, macSHA256, nil},
+	{TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA, 16, 20, 16, ecdheECDSAKA, true, suiteECSign, cipherAES, macSHA1, nil},
+	{TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA, 16, 20, 16, ecdheRSAKA, true, suiteRSASign, cipherAES, macSHA1, nil},
+	{TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA, 32, 20, 16, ecdheECDSAKA, true, suiteECSign, cipherAES, macSHA1, nil},
+	{TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA, 32, 20, 16, ecdheRSAKA, true, suiteRSASign, cipherAES, macSHA1, nil},
+	{TLS_ECDHE_PSK_WITH_CHACHA20_POLY1305_SHA256, 32, 0, 12, ecdhePSKKA, true, suitePSK | suiteTLS12 | suiteChaCha20, nil, nil, aeadChaCha20Poly1305},
+	{TLS_ECDHE_PSK_WITH_AES_128_CBC_SHA256, 16, 32, 16, ecdhePSKKA, true, suitePSK | suiteTLS12, cipherAES, macSHA256, nil},
+	{TLS_ECDHE_PSK_WITH_AES_128_CBC_SHA, 16, 20, 16, ecdhePSKKA, true, suitePSK, cipherAES, macSHA1, nil},
+	{TLS_PSK_WITH_AES_128_GCM_SHA256, 16, 0, 4, pskKA, false, suitePSK | suiteTLS12, nil, nil, aeadAESGCM},
+	{TLS_PSK_WITH_CHACHA20_POLY1305_SHA256, 32, 0, 12, pskKA, false, suitePSK | suiteTLS12 | suiteChaCha20, nil, nil, aeadChaCha20Poly1305},
+	{TLS_PSK_WITH_AES_128_CCM, 16, 0, 4, pskKA, false, suitePSK | suiteTLS12, nil, nil, aeadAESCCM},
+	{TLS_PSK_WITH_AES_128_CCM_8, 16, 0, 4, pskKA, false, suitePSK | suiteTLS12, nil, nil, aeadAESCCM8},
+	{TLS_PSK_WITH_AES_128_CBC_SHA256, 16, 32, 16, pskKA, false, suitePSK | suiteTLS12, cipherAES, macSHA256, nil},
+	{TLS_PSK_WITH_AES_128_CBC_SHA, 16, 20, 16, pskKA, false, suitePSK, cipherAES, macSHA1, nil},
+	{TLS_DH_anon_WITH_AES_128_CBC_SHA, 16, 20, 16, dheKA, false, suiteDefaultOff, cipherAES, macSHA1, nil},
+	{TLS_DH_anon_WITH_AES_256_CBC_SHA256, 32, 32, 16, dheKA, false, suiteDefaultOff | suiteTLS12, cipherAES, macSHA256, nil},
 }
 
 func (cs cipherSuite) Bytes() []byte {
@@ -52,27 +120,176 @@ func (cs cipherSuite) String() string {
 		return "TLS_DH_anon_WITH_AES_128_CBC_SHA"
 	case TLS_DH_anon_WITH_AES_256_CBC_SHA256:
 		return "TLS_DH_anon_WITH_AES_256_CBC_SHA256"
+	case TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:
+		return "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA"
+	case TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:
+		return "TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA"
+	case TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA:
+		return "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA"
+	case TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA:
+		return "TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA"
+	case TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256:
+		return "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256"
+	case TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256:
+		return "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256"
+	case TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256:
+		return "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"
+	case TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:
+		return "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"
+	case TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384:
+		return "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"
+	case TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:
+		return "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"
+	case TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256:
+		return "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256"
+	case TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256:
+		return "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256"
+	case TLS_ECDHE_PSK_WITH_CHACHA20_POLY1305_SHA256:
+		return "TLS_ECDHE_PSK_WITH_CHACHA20_POLY1305_SHA256"
+	case TLS_ECDHE_PSK_WITH_AES_128_CBC_SHA256:
+		return "TLS_ECDHE_PSK_WITH_AES_128_CBC_SHA256"
+	case TLS_ECDHE_PSK_WITH_AES_128_CBC_SHA:
+		return "TLS_ECDHE_PSK_WITH_AES_128_CBC_SHA"
+	case TLS_PSK_WITH_AES_128_GCM_SHA256:
+		return "TLS_PSK_WITH_AES_128_GCM_SHA256"
+	case TLS_PSK_WITH_CHACHA20_POLY1305_SHA256:
+		return "TLS_PSK_WITH_CHACHA20_POLY1305_SHA256"
+	case TLS_PSK_WITH_AES_128_CCM:
+		return "TLS_PSK_WITH_AES_128_CCM"
+	case TLS_PSK_WITH_AES_128_CCM_8:
+		return "TLS_PSK_WITH_AES_128_CCM_8"
+	case TLS_PSK_WITH_AES_128_CBC_SHA256:
+		return "TLS_PSK_WITH_AES_128_CBC_SHA256"
+	case TLS_PSK_WITH_AES_128_CBC_SHA:
+		return "TLS_PSK_WITH_AES_128_CBC_SHA"
+	case TLS_ECDHE_ECDSA_WITH_AES_128_CCM:
+		return "TLS_ECDHE_ECDSA_WITH_AES_128_CCM"
+	case TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8:
+		return "TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8"
+	case TLS_AES_128_GCM_SHA256:
+		return "TLS_AES_128_GCM_SHA256"
+	case TLS_AES_256_GCM_SHA384:
+		return "TLS_AES_256_GCM_SHA384"
+	case TLS_CHACHA20_POLY1305_SHA256:
+		return "TLS_CHACHA20_POLY1305_SHA256"
+	case TLS_AES_128_CCM_SHA256:
+		return "TLS_AES_128_CCM_SHA256"
 	default:
 		return "UNKNOWN_CIPHER_SUITE"
 	}
 }
 
 func readCipherSuite(buffer *bytes.Buffer) (*cipherSuite, error) {
+	if buffer.Len() < 2 {
+		return &cipherSuite{}, InsufficentBytesError
+	}
 	id := binary.BigEndian.Uint16(buffer.Next(2))
+	if cs := cipherSuiteByID(cipherSuiteId(id)); cs != nil {
+		return cs, nil
+	}
+	return &cipherSuite{}, InvalidCipherSuite
+}
+
+func containsCipherSuite(suites []*cipherSuite, id cipherSuiteId) bool {
+	for _, suite := range suites {
+		if suite.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// cipherSuiteByID returns the implemented cipher suite with id, or nil.
+func cipherSuiteByID(id cipherSuiteId) *cipherSuite {
 	for _, cs := range cipherSuites {
-		if uint16(cs.id) == id {
-			return cs, nil
+		if cs.id == id {
+			return cs
 		}
 	}
-	return &cipherSuite{}, InvalidCipherSuite
+	return nil
 }
 
 var InvalidCipherSuite = errors.New("Invalid cipher suite")
 
+// signatureType returns the type of certificate the server signs its key
+// exchange with, if the suite uses certificates at all.
+func (cs *cipherSuite) signatureType() (signatureAlgorithm, bool) {
+	switch {
+	case cs.flags&suiteECSign != 0:
+		return signatureECDSA, true
+	case cs.flags&suiteRSASign != 0:
+		return signatureRSA, true
+	default:
+		return 0, false
+	}
+}
+
+// prfHash returns the hash of the DTLS 1.2 PRF or of the DTLS 1.3 key
+// schedule.
+func (cs *cipherSuite) prfHash() func() hash.Hash {
+	if cs.flags&suiteSHA384 != 0 {
+		return sha512.New384
+	}
+	return sha256.New
+}
+
+// prefersChaCha20 reports whether the first AEAD suite in suites, which
+// are in order of preference, is a ChaCha20-Poly1305 suite. Peers without
+// AES hardware put those first.
+func prefersChaCha20(suites []*cipherSuite) bool {
+	for _, suite := range suites {
+		if suite.aead != nil {
+			return suite.flags&suiteChaCha20 != 0
+		}
+	}
+	return false
+}
+
+// chaCha20First returns suites with the ChaCha20-Poly1305 suites moved to
+// the front, keeping the order otherwise.
+func chaCha20First(suites []*cipherSuite) []*cipherSuite {
+	sorted := make([]*cipherSuite, 0, len(suites))
+	for _, suite := range suites {
+		if suite.flags&suiteChaCha20 != 0 {
+			sorted = append(sorted, suite)
+		}
+	}
+	for _, suite := range suites {
+		if suite.flags&suiteChaCha20 == 0 {
+			sorted = append(sorted, suite)
+		}
+	}
+	return sorted
+}
+
+// supportsVersion reports whether the suite may be used with version.
+func (cs *cipherSuite) supportsVersion(version protocolVersion) bool {
+	if cs.flags&suiteTLS13 != 0 || version == DTLS_13 {
+		return cs.flags&suiteTLS13 != 0 && version == DTLS_13
+	}
+	return cs.flags&suiteTLS12 == 0 || version == DTLS_12
+}
+
 func dheKA() keyAgreement {
 	return new(dheKeyAgreement)
 }
 
+func ecdheECDSAKA() keyAgreement {
+	return &ecdheKeyAgreement{signatureType: signatureECDSA}
+}
+
+func ecdheRSAKA() keyAgreement {
+	return &ecdheKeyAgreement{signatureType: signatureRSA}
+}
+
+func pskKA() keyAgreement {
+	return new(pskKeyAgreement)
+}
+
+func ecdhePSKKA() keyAgreement {
+	return &pskKeyAgreement{ecdhe: new(ecdheKeyAgreement)}
+}
+
 func cipherAES(key []byte) cipher.Block {
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -81,6 +298,167 @@ func cipherAES(key []byte) cipher.Block {
 	return block
 }
 
+// An aead protects records with an AEAD cipher. The nonce passed to Seal
+// and Open is the 64 bit epoch and sequence number of the record, the
+// first explicitNonceLen bytes of it are sent in front of the ciphertext.
+type aead interface {
+	cipher.AEAD
+	explicitNonceLen() int
+}
+
+const (
+	aeadNonceLength   = 12
+	noncePrefixLength = 4
+)
+
+// prefixNonceAEAD wraps an AEAD whose nonce is a fixed prefix from the key
+// block followed by an explicit part, RFC 5288 section 3.
+type prefixNonceAEAD struct {
+	// nonce contains the fixed part of the nonce in the first four bytes.
+	nonce [aeadNonceLength]byte
+	aead  cipher.AEAD
+}
+
+func (f *prefixNonceAEAD) NonceSize() int        { return aeadNonceLength - noncePrefixLength }
+func (f *prefixNonceAEAD) Overhead() int         { return f.aead.Overhead() }
+func (f *prefixNonceAEAD) explicitNonceLen() int { return f.NonceSize() }
+
+func (f *prefixNonceAEAD) Seal(out, nonce, plaintext, additionalData []byte) []byte {
+	copy(f.nonce[noncePrefixLength:], nonce)
+	return f.aead.Seal(out, f.nonce[:], plaintext, additionalData)
+}
+
+func (f *prefixNonceAEAD) Open(out, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	copy(f.nonce[noncePrefixLength:], nonce)
+	return f.aead.Open(out, f.nonce[:], ciphertext, additionalData)
+}
+
+func aeadAESGCM(key, fixedNonce []byte) aead {
+	if len(fixedNonce) != noncePrefixLength {
+		panic("dtls: internal error: wrong nonce length")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	ret := &prefixNonceAEAD{aead: gcm}
+	copy(ret.nonce[:], fixedNonce)
+	return ret
+}
+
+// aeadAESCCM and aeadAESCCM8 use the same nonce construction as AES-GCM,
+// RFC 6655 section 3, with a 16 and an 8 byte tag.
+func aeadAESCCM(key, fixedNonce []byte) aead {
+	return newAESCCM(key, fixedNonce, 16)
+}
+
+func aeadAESCCM8(key, fixedNonce []byte) aead {
+	return newAESCCM(key, fixedNonce, 8)
+}
+
+func newAESCCM(key, fixedNonce []byte, tagSize int) aead {
+	if len(fixedNonce) != noncePrefixLength {
+		panic("dtls: internal error: wrong nonce length")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	ccm, err := newCCM(block, tagSize, aeadNonceLength)
+	if err != nil {
+		panic(err)
+	}
+	ret := &prefixNonceAEAD{aead: ccm}
+	copy(ret.nonce[:], fixedNonce)
+	return ret
+}
+
+// xorNonceAEAD wraps an AEAD whose nonce is the fixed IV from the key block
+// XORed with the epoch and sequence number, RFC 7905 section 2.
+type xorNonceAEAD struct {
+	nonceMask [aeadNonceLength]byte
+	aead      cipher.AEAD
+}
+
+func (f *xorNonceAEAD) NonceSize() int        { return 8 } // 64-bit epoch and sequence number, only the sequence number in DTLS 1.3
+func (f *xorNonceAEAD) Overhead() int         { return f.aead.Overhead() }
+func (f *xorNonceAEAD) explicitNonceLen() int { return 0 }
+
+func (f *xorNonceAEAD) Seal(out, nonce, plaintext, additionalData []byte) []byte {
+	for i, b := range nonce {
+		f.nonceMask[noncePrefixLength+i] ^= b
+	}
+	result := f.aead.Seal(out, f.nonceMask[:], plaintext, additionalData)
+	for i, b := range nonce {
+		f.nonceMask[noncePrefixLength+i] ^= b
+	}
+	return result
+}
+
+func (f *xorNonceAEAD) Open(out, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	for i, b := range nonce {
+		f.nonceMask[noncePrefixLength+i] ^= b
+	}
+	result, err := f.aead.Open(out, f.nonceMask[:], ciphertext, additionalData)
+	for i, b := range nonce {
+		f.nonceMask[noncePrefixLength+i] ^= b
+	}
+	return result, err
+}
+
+func aeadChaCha20Poly1305(key, fixedNonce []byte) aead {
+	if len(fixedNonce) != aeadNonceLength {
+		panic("dtls: internal error: wrong nonce length")
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		panic(err)
+	}
+	ret := &xorNonceAEAD{aead: aead}
+	copy(ret.nonceMask[:], fixedNonce)
+	return ret
+}
+
+// aeadAESGCMTLS13 and aeadAESCCMTLS13 use the nonce of DTLS 1.3, the IV
+// XORed with the sequence number of the record, RFC 8446 section 5.3.
+func aeadAESGCMTLS13(key, iv []byte) aead {
+	if len(iv) != aeadNonceLength {
+		panic("dtls: internal error: wrong nonce length")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	ret := &xorNonceAEAD{aead: gcm}
+	copy(ret.nonceMask[:], iv)
+	return ret
+}
+
+func aeadAESCCMTLS13(key, iv []byte) aead {
+	if len(iv) != aeadNonceLength {
+		panic("dtls: internal error: wrong nonce length")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	ccm, err := newCCM(block, 16, aeadNonceLength)
+	if err != nil {
+		panic(err)
+	}
+	ret := &xorNonceAEAD{aead: ccm}
+	copy(ret.nonceMask[:], iv)
+	return ret
+}
+
 func macSHA1(key []byte) macFunction {
 	return tls10MAC{hmac.New(sha1.New, key)}
 }
@@ -91,7 +469,9 @@ func macSHA256(key []byte) macFunction {
 
 type macFunction interface {
 	Size() int
-	MAC(seq, typ, version, length, data []byte) []byte
+	// MAC returns the MAC of a record with data as its payload. The header
+	// are the fields of the record that are authenticated before it.
+	MAC(header, data []byte) []byte
 }
 
 // tls10MAC implements the TLS 1.0 MAC function. RFC 2246, section 6.2.3.
@@ -103,12 +483,9 @@ func (s tls10MAC) Size() int {
 	return s.h.Size()
 }
 
-func (s tls10MAC) MAC(seq, typ, version, length, record []byte) []byte {
+func (s tls10MAC) MAC(header, record []byte) []byte {
 	s.h.Reset()
-	s.h.Write(seq)
-	s.h.Write(typ)
-	s.h.Write(version)
-	s.h.Write(length)
+	s.h.Write(header)
 	s.h.Write(record)
 	return s.h.Sum(nil)
 }
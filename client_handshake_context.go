@@ -2,33 +2,60 @@ package dtls
 
 import (
 	"bytes"
-	"errors"
-	"log"
+	"crypto/x509"
+	"time"
 )
 
 type clientHandshake struct {
 	baseHandshakeContext
+	// session is the cached session we offer to resume, if any.
+	session *ClientSessionState
+	// expectTicket is set if the server announced a NewSessionTicket.
+	expectTicket bool
+	// ticket is the session ticket the server issued in this handshake.
+	ticket []byte
 }
 
 func (ch *clientHandshake) beginHandshake() {
+	ch.loadSession()
 	ch.sendFlightOne()
 	ch.currentFlight = 2
 }
 
 func (ch *clientHandshake) continueHandshake(message *handshake) (complete bool, err error) {
-	if ch.currentFlight == 2 && message.MsgType == helloVerifyRequest {
+	if message.MsgType == helloRequest {
+		// We are already negotiating, RFC 5246 section 7.4.1.1.
+		return false, nil
+	}
+	if ch.currentFlight == 2 && message.MsgType == helloVerifyRequest && message.MessageSeq == ch.nextReceiveSequenceNumber {
 		helloVerifyRequest, err := readHandshakeHelloVerifyRequest(message.Fragment)
 		if err != nil {
-			panic(err)
+			return false, newAlertError(AlertDecodeError, "Error while reading hello verify request: %s", err)
 		}
 		ch.cookie = helloVerifyRequest.Cookie
-		ch.sendFlightOne()
 		ch.nextReceiveSequenceNumber += 1
+		ch.sendFlightOne()
 	} else {
 		ch.receiveMessage(message)
 	}
+	// The ServerHello decides whether the session is resumed, which
+	// changes the rest of the handshake. No key agreement is set until it
+	// was processed.
+	if ch.currentFlight == 2 && ch.serverHello != nil && ch.keyAgreement == nil && ch.Conn.version != DTLS_13 {
+		if err := ch.processServerHello(); err != nil {
+			return false, err
+		}
+	}
+	if ch.Conn.version == DTLS_13 {
+		return ch.continueHandshake13()
+	}
+	if ch.currentFlight == 2 && ch.Conn.didResume {
+		return ch.finishAbbreviatedHandshake()
+	}
 	if ch.currentFlight == 2 && ch.isFlightTwoComplete() {
-		ch.sendFlightThree()
+		if err := ch.sendFlightThree(); err != nil {
+			return false, err
+		}
 		ch.currentFlight = 4
 		return false, nil
 	}
@@ -39,86 +66,465 @@ func (ch *clientHandshake) continueHandshake(message *handshake) (complete bool,
 }
 
 func (ch *clientHandshake) prepareFlightOne() {
+	versions := ch.config.offeredVersions(ch.renegotiation)
 	cltHello := handshakeClientHello{
-		ClientVersion: ch.Conn.version,
+		ClientVersion: ch.config.helloVersion(),
 		Random:        ch.clientRandom,
 		SessionID:     ch.sessionID,
 		Cookie:        ch.cookie,
-		CipherSuites:  cipherSuites,
+		CipherSuites:  ch.offeredCipherSuites(),
 		CompressionMethods: []compressionMethod{
 			compressionNone,
 		},
 	}
+	for _, suite := range cltHello.CipherSuites {
+		if suite.elliptic || suite.supportsVersion(DTLS_13) {
+			cltHello.Extensions = append(cltHello.Extensions, newSupportedGroupsExtension(supportedCurves), newECPointFormatsExtension())
+			break
+		}
+	}
+	if algorithms := offeredSignatureAlgorithms(versions); len(algorithms) > 0 {
+		cltHello.Extensions = append(cltHello.Extensions, newSignatureAlgorithmsExtension(algorithms))
+	}
+	cltHello.Extensions = append(cltHello.Extensions, extension{Type: ExtensionExtendedMasterSecret}, extension{Type: ExtensionEncryptThenMAC})
+	if containsVersion(versions, DTLS_13) {
+		cltHello.Extensions = append(cltHello.Extensions, ch.extensions13(versions)...)
+	}
+	if containsVersion(versions, DTLS_12) && ch.Conn.connectionIDsEnabled(DTLS_12) {
+		cltHello.Extensions = append(cltHello.Extensions, newConnectionIDExtension(ch.Conn.connectionID))
+	}
+	cltHello.Extensions = append(cltHello.Extensions, ch.config.recordLimitExtensions()...)
+	if ch.renegotiation {
+		cltHello.Extensions = append(cltHello.Extensions, newRenegotiationInfoExtension(ch.Conn.renegotiatedConnection(false)))
+	} else {
+		cltHello.RenegotiationSCSV = true
+	}
+	if ch.ticketsEnabled() {
+		// An empty extension asks for a ticket without offering one.
+		ticket := extension{Type: ExtensionSessionTicket}
+		if ch.session != nil {
+			ticket.Data = ch.session.ticket
+		}
+		cltHello.Extensions = append(cltHello.Extensions, ticket)
+	}
 	ch.clientHello = ch.buildNextHandshakeMessage(clientHello, cltHello.Bytes())
 }
 
+// offeredCipherSuites returns the configured cipher suites that work with
+// one of the versions we offer, without the pre-shared key suites unless we
+// have a key.
+func (ch *clientHandshake) offeredCipherSuites() []*cipherSuite {
+	var suites []*cipherSuite
+	versions := ch.config.offeredVersions(ch.renegotiation)
+	for _, suite := range ch.config.cipherSuites() {
+		if suite.flags&suitePSK != 0 && len(ch.config.PSK) == 0 {
+			continue
+		}
+		for _, version := range versions {
+			if suite.supportsVersion(version) {
+				suites = append(suites, suite)
+				break
+			}
+		}
+	}
+	return suites
+}
+
+// offeredSignatureAlgorithms returns the signature algorithms we accept with
+// the offered versions, the DTLS 1.3 schemes first. Before DTLS 1.2 the
+// algorithms are not negotiated.
+func offeredSignatureAlgorithms(versions []protocolVersion) []signatureAndHash {
+	var algorithms []signatureAndHash
+	if containsVersion(versions, DTLS_13) {
+		algorithms = append(algorithms, signatureAlgorithms13...)
+	}
+	if containsVersion(versions, DTLS_12) {
+		for _, algorithm := range supportedSignatureAlgorithms {
+			if !isSupportedSignatureAlgorithm(algorithm, algorithms) {
+				algorithms = append(algorithms, algorithm)
+			}
+		}
+	}
+	return algorithms
+}
+
+// sessionKey is the key of our sessions in the ClientSessionCache.
+func (ch *clientHandshake) sessionKey() string {
+	if ch.config.ServerName != "" {
+		return ch.config.ServerName
+	}
+	return ch.Conn.RemoteAddr().String()
+}
+
+// ticketsEnabled reports whether we ask for and offer session tickets.
+func (ch *clientHandshake) ticketsEnabled() bool {
+	return ch.config.ClientSessionCache != nil && !ch.config.SessionTicketsDisabled && !ch.renegotiation
+}
+
+// loadSession offers a cached session that can be resumed with the current
+// config, by its ticket if it has one and tickets are enabled or else by
+// its session ID. A renegotiation is meant to replace the keys, so it
+// always runs a full handshake.
+func (ch *clientHandshake) loadSession() {
+	if ch.config.ClientSessionCache == nil || ch.renegotiation {
+		return
+	}
+	session, ok := ch.config.ClientSessionCache.Get(ch.sessionKey())
+	if !ok || session == nil {
+		return
+	}
+	useTicket := len(session.ticket) > 0 && ch.ticketsEnabled()
+	if !useTicket && len(session.sessionID) == 0 {
+		return
+	}
+	if session.session.expired() {
+		ch.config.ClientSessionCache.Put(ch.sessionKey(), nil)
+		return
+	}
+	if !ch.config.supportsVersion(session.session.version) ||
+		!session.session.extendedMasterSecret && ch.config.RequireExtendedMasterSecret ||
+		!containsCipherSuite(ch.offeredCipherSuites(), session.session.cipherSuite) {
+		return
+	}
+	ch.session = session
+	if useTicket {
+		// The server echoes the session ID we send along with the ticket
+		// if it accepts the ticket, RFC 5077 section 3.4.
+		ch.sessionID = newSessionID()
+	} else {
+		ch.sessionID = session.sessionID
+	}
+}
+
+// storeSession caches the session of a full handshake if the server
+// assigned it a session ID or issued a ticket.
+func (ch *clientHandshake) storeSession() {
+	if ch.config.ClientSessionCache == nil || len(ch.sessionID) == 0 && len(ch.ticket) == 0 {
+		return
+	}
+	ch.config.ClientSessionCache.Put(ch.sessionKey(), &ClientSessionState{
+		sessionID: ch.sessionID,
+		ticket:    ch.ticket,
+		session: sessionState{
+			version:              ch.Conn.version,
+			cipherSuite:          ch.cipherSuite.id,
+			masterSecret:         ch.masterSecret,
+			peerCertificates:     ch.peerCertificates,
+			createdAt:            time.Now(),
+			extendedMasterSecret: ch.Conn.extendedMasterSecret,
+		},
+	})
+}
+
 func (ch *clientHandshake) sendFlightOne() {
 	ch.prepareFlightOne()
-	ch.sendHandshakeMessage(ch.clientHello)
+	ch.sendFlight([]*handshake{ch.clientHello}, -1)
 }
 
+// isFlightTwoComplete reports whether the ServerHelloDone arrived. Messages
+// are processed in order, so all other messages of the flight arrived
+// before it.
 func (ch *clientHandshake) isFlightTwoComplete() bool {
 	return ch.serverHello != nil &&
-		ch.serverKeyExchange != nil &&
 		ch.serverHelloDone != nil
 }
-func (ch *clientHandshake) prepareFlightThree() {
+
+// processServerHello applies the version, cipher suite and session the
+// server selected.
+func (ch *clientHandshake) processServerHello() error {
 	serverHello, err := readHandshakeServerHello(ch.serverHello.Fragment)
-	if err != nil {
-		log.Printf("Error while reading server hello: %v", err)
-		return
+	if err == InvalidCipherSuite {
+		return newAlertError(AlertIllegalParameter, "Server selected unknown cipher suite")
+	} else if err != nil {
+		return newAlertError(AlertDecodeError, "Error while reading server hello: %v", err)
+	}
+	if e, ok := findExtension(serverHello.Extensions, ExtensionSupportedVersions); ok {
+		return ch.processServerHello13(serverHello, e)
+	}
+	if ch.offersDTLS13() && hasDowngradeSentinel(serverHello.Random) {
+		// RFC 8446 section 4.1.3.
+		return newAlertError(AlertIllegalParameter, "Server downgraded the connection from DTLS 1.3")
+	}
+	if !ch.config.supportsVersion(serverHello.ServerVersion) {
+		return newAlertError(AlertProtocolVersion, "Server selected unsupported version %s", serverHello.ServerVersion)
+	}
+	if err := ch.processRenegotiationInfo(serverHello); err != nil {
+		return err
 	}
 	ch.serverRandom = serverHello.Random
+	if findCommonCipherSuite([]*cipherSuite{serverHello.CipherSuite}, ch.offeredCipherSuites()) == nil ||
+		!serverHello.CipherSuite.supportsVersion(ch.Conn.version) {
+		return newAlertError(AlertIllegalParameter, "Server selected cipher suite %s which we did not offer", serverHello.CipherSuite)
+	}
 	cipherSuite := serverHello.CipherSuite
+	if e, ok := findExtension(serverHello.Extensions, ExtensionECPointFormats); ok {
+		if uncompressed, err := readECPointFormatsExtension(e.Data); err != nil || !uncompressed {
+			return newAlertError(AlertIllegalParameter, "Server does not support uncompressed EC points")
+		}
+	}
+	ch.cipherSuite = *cipherSuite
 	ch.keyAgreement = cipherSuite.KeyAgreement()
+	if err := ch.processEncryptThenMAC(serverHello); err != nil {
+		return err
+	}
+	if err := ch.processConnectionID(serverHello); err != nil {
+		return err
+	}
+	if err := ch.processRecordLimits(serverHello.Extensions); err != nil {
+		return err
+	}
 	ch.Conn.pendingReadState.compressionMethod = serverHello.CompressionMethod
 	ch.Conn.pendingWriteState.compressionMethod = serverHello.CompressionMethod
+	if _, ch.Conn.extendedMasterSecret = findExtension(serverHello.Extensions, ExtensionExtendedMasterSecret); !ch.Conn.extendedMasterSecret && ch.config.RequireExtendedMasterSecret {
+		return newAlertError(AlertHandshakeFailure, "Server does not support the extended master secret")
+	}
+	if _, ch.expectTicket = findExtension(serverHello.Extensions, ExtensionSessionTicket); ch.expectTicket && !ch.ticketsEnabled() {
+		return newAlertError(AlertUnsupportedExtension, "Server sent a session ticket extension we did not offer")
+	}
+	if ch.session != nil && len(ch.sessionID) > 0 && bytes.Equal(serverHello.SessionID, ch.sessionID) {
+		return ch.resumeSession()
+	}
 	ch.sessionID = serverHello.SessionID
-	serverKeyExchange, err := readHandshakeServerKeyExchange(ch.serverKeyExchange.Fragment)
+	return nil
+}
+
+// processRenegotiationInfo checks the renegotiation_info extension of the
+// server, RFC 5746 sections 3.4 and 3.5. The version of the connection
+// must not change in a renegotiation.
+func (ch *clientHandshake) processRenegotiationInfo(serverHello handshakeServerHello) error {
+	if ch.renegotiation {
+		if serverHello.ServerVersion != ch.Conn.version {
+			return newAlertError(AlertProtocolVersion, "Server changed the version in a renegotiation")
+		}
+		return checkRenegotiationInfo(serverHello.Extensions, ch.Conn.renegotiatedConnection(true))
+	}
+	if e, ok := findExtension(serverHello.Extensions, ExtensionRenegotiationInfo); ok {
+		if info, err := readRenegotiationInfoExtension(e.Data); err != nil || len(info) != 0 {
+			return newAlertError(AlertHandshakeFailure, "Server sent invalid renegotiation info")
+		}
+		ch.Conn.secureRenegotiation = true
+	}
+	ch.Conn.version = serverHello.ServerVersion
+	return nil
+}
+
+// processEncryptThenMAC checks whether the server agreed to encrypt-then-MAC,
+// which only applies to CBC cipher suites and must not be turned off in a
+// renegotiation, RFC 7366 section 3.
+func (ch *clientHandshake) processEncryptThenMAC(serverHello handshakeServerHello) error {
+	_, ch.encryptThenMAC = findExtension(serverHello.Extensions, ExtensionEncryptThenMAC)
+	if ch.encryptThenMAC && ch.cipherSuite.aead != nil {
+		return newAlertError(AlertIllegalParameter, "Server selected encrypt-then-MAC with AEAD cipher suite %s", &ch.cipherSuite)
+	}
+	if ch.renegotiation && ch.Conn.currentReadState.encryptThenMAC && ch.cipherSuite.aead == nil && !ch.encryptThenMAC {
+		return newAlertError(AlertHandshakeFailure, "Server turned off encrypt-then-MAC in a renegotiation")
+	}
+	return nil
+}
+
+// processConnectionID reads the connection ID the server wants in our
+// records, if it agreed to use connection IDs, RFC 9146 section 3.
+func (ch *clientHandshake) processConnectionID(serverHello handshakeServerHello) error {
+	e, ok := findExtension(serverHello.Extensions, ExtensionConnectionID)
+	if !ok {
+		return nil
+	}
+	if !ch.Conn.connectionIDsEnabled(ch.Conn.version) {
+		return newAlertError(AlertUnsupportedExtension, "Server sent a connection ID extension we did not offer")
+	}
+	connectionID, err := readConnectionIDExtension(e.Data)
 	if err != nil {
-		log.Printf("Error while reading server key exchange: %v", err)
-		return
+		return newAlertError(AlertDecodeError, "Invalid connection ID extension")
 	}
-	if err = ch.keyAgreement.processServerKeyExchange(ch.clientRandom, ch.serverRandom, serverKeyExchange); err != nil {
-		log.Printf("Error while processing server key exchange: %v", err)
-		return
+	ch.useConnectionID = true
+	ch.peerConnectionID = connectionID
+	return nil
+}
+
+// resumeSession continues with the abbreviated handshake after the server
+// accepted our session ID, RFC 5246 section 7.3. The server sends its
+// Finished message right after the ServerHello.
+func (ch *clientHandshake) resumeSession() error {
+	session := &ch.session.session
+	if ch.Conn.version != session.version || ch.cipherSuite.id != session.cipherSuite {
+		return newAlertError(AlertIllegalParameter, "Server resumed the session with a different version or cipher suite")
+	}
+	if ch.Conn.extendedMasterSecret != session.extendedMasterSecret {
+		// RFC 7627 section 5.3.
+		return newAlertError(AlertHandshakeFailure, "Server resumed the session with a different extended master secret setting")
+	}
+	ch.Conn.didResume = true
+	ch.peerCertificates = session.peerCertificates
+	ch.establishKeys(session.masterSecret)
+	return nil
+}
+
+// finishAbbreviatedHandshake verifies the server's Finished message of an
+// abbreviated handshake and answers with our own, which completes it.
+func (ch *clientHandshake) finishAbbreviatedHandshake() (bool, error) {
+	if ch.serverFinished == nil {
+		return false, nil
 	}
-	preMasterSecret, cltKeyExchange, err := ch.keyAgreement.generateClientKeyExchange()
+	serverFinished, err := readHandshakeFinished(ch.serverFinished.Fragment)
 	if err != nil {
-		log.Printf("Error while generating client key exchange: %v", err)
-		return
+		return true, newAlertError(AlertDecodeError, "Error while reading server finished: %s", err)
+	}
+	if err := ch.processNewSessionTicket(); err != nil {
+		return true, err
+	}
+	ch.finishedHash = newFinishedHash(&ch.cipherSuite)
+	for _, message := range presentMessages(ch.clientHello, ch.serverHello, ch.newSessionTicket) {
+		ch.finishedHash.Write(message.Bytes())
 	}
-	ch.clientKeyExchange = ch.buildNextHandshakeMessage(clientKeyExchange, cltKeyExchange.Bytes())
-	masterSecret, clientMAC, serverMAC, clientKey, serverKey :=
-		keysFromPreMasterSecret(ch.Conn.version, preMasterSecret, ch.clientRandom.Bytes(), ch.serverRandom.Bytes(),
-			cipherSuite.macLen, cipherSuite.keyLen)
-	ch.masterSecret = masterSecret
-	ch.Conn.pendingWriteState.Cipher = cipherSuite.cipher(clientKey)
-	ch.Conn.pendingWriteState.Mac = cipherSuite.mac(clientMAC)
-	ch.Conn.pendingReadState.Cipher = cipherSuite.cipher(serverKey)
-	ch.Conn.pendingReadState.Mac = cipherSuite.mac(serverMAC)
-	logMasterSecret(ch.clientRandom.Bytes(), masterSecret)
-
-	ch.finishedHash = newFinishedHash()
-	ch.finishedHash.Write(ch.clientHello.Bytes())
-	ch.finishedHash.Write(ch.serverHello.Bytes())
-	ch.finishedHash.Write(ch.serverKeyExchange.Bytes())
-	ch.finishedHash.Write(ch.serverHelloDone.Bytes())
-	ch.finishedHash.Write(ch.clientKeyExchange.Bytes())
-	finishedMessage := new(handshakeFinished)
-	if ch.Conn.version == DTLS_10 {
-		finishedMessage.VerifyData = ch.finishedHash.clientSum10(masterSecret)
-	} else if ch.Conn.version == DTLS_12 {
-		finishedMessage.VerifyData = ch.finishedHash.clientSum12(masterSecret)
+	if !bytes.Equal(serverFinished.VerifyData, ch.finishedHash.serverSum(ch.Conn.version, ch.masterSecret)) {
+		return true, newAlertError(AlertDecryptError, "Server sent incorrect verify data")
 	}
+	ch.finishedHash.Write(ch.serverFinished.Bytes())
+	finishedMessage := handshakeFinished{VerifyData: ch.finishedHash.clientSum(ch.Conn.version, ch.masterSecret)}
 	ch.clientFinished = ch.buildNextHandshakeMessage(finished, finishedMessage.Bytes())
+	ch.sendFlight([]*handshake{ch.clientFinished}, 0)
+	ch.currentFlight = 4
+	if len(ch.ticket) > 0 {
+		ch.config.ClientSessionCache.Put(ch.sessionKey(), &ClientSessionState{
+			sessionID: ch.session.sessionID,
+			ticket:    ch.ticket,
+			session:   ch.session.session,
+		})
+	}
+	return true, nil
 }
 
-func (ch *clientHandshake) sendFlightThree() {
-	ch.prepareFlightThree()
-	ch.sendHandshakeMessage(ch.clientKeyExchange)
-	ch.Conn.sendChangeCipherSpec()
-	ch.sendHandshakeMessage(ch.clientFinished)
+// processNewSessionTicket reads the NewSessionTicket the server announced
+// in its ServerHello. It arrives in front of the server's Finished message.
+func (ch *clientHandshake) processNewSessionTicket() error {
+	if ch.newSessionTicket == nil {
+		if ch.expectTicket {
+			return newAlertError(AlertUnexpectedMessage, "Server did not send the announced session ticket")
+		}
+		return nil
+	}
+	if !ch.expectTicket {
+		return newAlertError(AlertUnexpectedMessage, "Server sent a session ticket it did not announce")
+	}
+	newSessionTicket, err := readHandshakeNewSessionTicket(ch.newSessionTicket.Fragment)
+	if err != nil {
+		return newAlertError(AlertDecodeError, "Error while reading new session ticket: %s", err)
+	}
+	ch.ticket = newSessionTicket.Ticket
+	return nil
+}
+
+func (ch *clientHandshake) prepareFlightThree() error {
+	if err := ch.processServerCertificate(); err != nil {
+		return err
+	}
+	if err := ch.keyAgreement.processServerKeyExchange(&ch.baseHandshakeContext, fragmentOf(ch.serverKeyExchange)); err != nil {
+		return wrapAlertError(err, AlertIllegalParameter, "Error while processing server key exchange: %v", err)
+	}
+	if ch.certificateRequest != nil {
+		if err := ch.prepareClientCertificate(); err != nil {
+			return err
+		}
+	}
+	preMasterSecret, cltKeyExchange, err := ch.keyAgreement.generateClientKeyExchange(&ch.baseHandshakeContext)
+	if err != nil {
+		return wrapAlertError(err, AlertInternalError, "Error while generating client key exchange: %v", err)
+	}
+	ch.clientKeyExchange = ch.buildNextHandshakeMessage(clientKeyExchange, cltKeyExchange)
+	ch.establishKeys(ch.deriveMasterSecret(preMasterSecret))
+	if ch.certificate != nil {
+		if err := ch.prepareCertificateVerify(); err != nil {
+			return err
+		}
+	}
+
+	ch.finishedHash = ch.clientFinishedHash()
+	finishedMessage := handshakeFinished{VerifyData: ch.finishedHash.clientSum(ch.Conn.version, ch.masterSecret)}
+	ch.clientFinished = ch.buildNextHandshakeMessage(finished, finishedMessage.Bytes())
+	return nil
+}
+
+// processServerCertificate checks that the server sent a certificate if and
+// only if the cipher suite requires one and verifies it.
+func (ch *clientHandshake) processServerCertificate() error {
+	if _, ok := ch.cipherSuite.signatureType(); !ok {
+		if ch.serverCertificate != nil {
+			return newAlertError(AlertUnexpectedMessage, "Server sent a certificate for cipher suite %s", &ch.cipherSuite)
+		}
+		return nil
+	}
+	if ch.serverCertificate == nil {
+		return newAlertError(AlertHandshakeFailure, "Server did not send a certificate")
+	}
+	certs, err := parseCertificates(ch.serverCertificate, ch.Conn.version)
+	if err != nil {
+		return err
+	}
+	return ch.verifyServerCertificate(certs)
+}
+
+// verifyServerCertificate verifies the server's certificate chain for
+// ServerName, unless InsecureSkipVerify is set.
+func (ch *clientHandshake) verifyServerCertificate(certs []*x509.Certificate) error {
+	if len(certs) == 0 {
+		return newAlertError(AlertHandshakeFailure, "Server sent an empty certificate chain")
+	}
+	if !ch.config.InsecureSkipVerify {
+		if ch.config.ServerName == "" {
+			return newAlertError(AlertInternalError, "Either ServerName or InsecureSkipVerify must be set in the config")
+		}
+		if err := verifyCertificateChain(certs, ch.config.RootCAs, ch.config.ServerName, x509.ExtKeyUsageServerAuth); err != nil {
+			return err
+		}
+	}
+	ch.peerCertificates = certs
+	return nil
+}
+
+// prepareClientCertificate answers the server's CertificateRequest with the
+// first certificate that fits it, or with an empty chain if none does.
+func (ch *clientHandshake) prepareClientCertificate() error {
+	if ch.serverCertificate == nil {
+		return newAlertError(AlertHandshakeFailure, "Anonymous server requested a client certificate")
+	}
+	request, err := readHandshakeCertificateRequest(ch.certificateRequest.Fragment, ch.Conn.version)
+	if err != nil {
+		return newAlertError(AlertDecodeError, "Error while reading certificate request: %s", err)
+	}
+	ch.peerSignatureAlgorithms = request.SignatureAlgorithms
+	ch.certificate = ch.config.clientCertificateFor(request, ch.Conn.version)
+	var chain [][]byte
+	if ch.certificate != nil {
+		chain = ch.certificate.Certificate
+	} else {
+		ch.logf("No certificate fits the certificate request, sending an empty chain")
+	}
+	ch.clientCertificate = ch.buildNextHandshakeMessage(certificate, handshakeCertificate{RequestContext: request.Context, Certificates: chain}.Bytes(ch.Conn.version))
+	return nil
+}
+
+// prepareCertificateVerify proves that we own the key of our certificate
+// by signing the handshake messages so far.
+func (ch *clientHandshake) prepareCertificateVerify() error {
+	algorithm, err := selectSignatureAlgorithm(ch.Conn.version, certificatePublicKey(ch.certificate), ch.peerSignatureAlgorithms)
+	if err != nil {
+		return newAlertError(AlertInternalError, "No signature algorithm for our certificate: %s", err)
+	}
+	signature, err := signData(ch.Conn.version, ch.certificate.PrivateKey, algorithm, ch.certificateVerifyTranscript())
+	if err != nil {
+		return newAlertError(AlertInternalError, "Unable to sign certificate verify: %s", err)
+	}
+	ch.certificateVerify = ch.buildNextHandshakeMessage(certificateVerify, digitallySigned{Algorithm: algorithm, Signature: signature}.Bytes(ch.Conn.version))
+	return nil
+}
+
+func (ch *clientHandshake) sendFlightThree() error {
+	if err := ch.prepareFlightThree(); err != nil {
+		return err
+	}
+	messages := presentMessages(ch.clientCertificate, ch.clientKeyExchange, ch.certificateVerify, ch.clientFinished)
+	ch.sendFlight(messages, len(messages)-1)
+	return nil
 }
 
 func (ch *clientHandshake) isFlightFourComplete() (bool, error) {
@@ -127,16 +533,17 @@ func (ch *clientHandshake) isFlightFourComplete() (bool, error) {
 	}
 	serverFinished, err := readHandshakeFinished(ch.serverFinished.Fragment)
 	if err != nil {
+		return true, newAlertError(AlertDecodeError, "Error while reading server finished: %s", err)
+	}
+	if err := ch.processNewSessionTicket(); err != nil {
 		return true, err
 	}
-	ch.finishedHash.Write(ch.clientFinished.Bytes())
-	if ch.Conn.version == DTLS_10 && !bytes.Equal(serverFinished.VerifyData, ch.finishedHash.serverSum10(ch.masterSecret)) {
-		err = errors.New("Server sent incorrect verify data")
-	} else if ch.Conn.version == DTLS_12 && !bytes.Equal(serverFinished.VerifyData, ch.finishedHash.serverSum12(ch.masterSecret)) {
-		err = errors.New("Server sent incorrect verify data")
-	} else if ch.Conn.version != DTLS_10 && ch.Conn.version != DTLS_12 {
-		// TODO: This should never happen
-		err = errors.New("Unsupported version ...")
+	for _, message := range presentMessages(ch.clientFinished, ch.newSessionTicket) {
+		ch.finishedHash.Write(message.Bytes())
+	}
+	if !bytes.Equal(serverFinished.VerifyData, ch.finishedHash.serverSum(ch.Conn.version, ch.masterSecret)) {
+		return true, newAlertError(AlertDecryptError, "Server sent incorrect verify data")
 	}
-	return true, err
+	ch.storeSession()
+	return true, nil
 }
@@ -0,0 +1,187 @@
+package dtls
+
+import (
+	"bytes"
+)
+
+// offersDTLS13 reports whether our ClientHello offers DTLS 1.3.
+func (ch *clientHandshake) offersDTLS13() bool {
+	return containsVersion(ch.config.offeredVersions(ch.renegotiation), DTLS_13)
+}
+
+// extensions13 returns the extensions a ClientHello needs to offer DTLS 1.3:
+// the versions, a key share of our preferred group or of the group the
+// server asked for, and the cookie of a HelloRetryRequest.
+func (ch *clientHandshake) extensions13(versions []protocolVersion) []extension {
+	if ch.keyShare == nil {
+		if ch.curve == 0 {
+			ch.curve = supportedCurves[0]
+		}
+		ch.keyShare, _ = generateKeyShare(ch.curve)
+	}
+	share := keyShare{group: ch.curve, data: ch.keyShare.PublicKey().Bytes()}
+	extensions := []extension{newClientSupportedVersionsExtension(versions), newClientKeyShareExtension([]keyShare{share})}
+	if ch.helloRetryCookie != nil {
+		extensions = append(extensions, newCookieExtension(ch.helloRetryCookie))
+	}
+	return extensions
+}
+
+// processServerHello13 continues a handshake in which the server selected
+// DTLS 1.3 with the supported_versions extension, RFC 9147 section 5. The
+// ServerHello completes the key exchange, the rest of the server's flight
+// is read with the handshake traffic keys.
+func (ch *clientHandshake) processServerHello13(serverHello handshakeServerHello, e extension) error {
+	version, err := readServerSupportedVersionsExtension(e.Data)
+	if err != nil {
+		return newAlertError(AlertDecodeError, "Invalid supported versions extension")
+	}
+	if version != DTLS_13 || !ch.offersDTLS13() {
+		return newAlertError(AlertIllegalParameter, "Server selected version %s which we did not offer", version)
+	}
+	if serverHello.ServerVersion != DTLS_12 || !bytes.Equal(serverHello.SessionID, ch.sessionID) || serverHello.CompressionMethod != compressionNone {
+		return newAlertError(AlertIllegalParameter, "Server sent invalid legacy fields with DTLS 1.3")
+	}
+	suite := serverHello.CipherSuite
+	if !containsCipherSuite(ch.offeredCipherSuites(), suite.id) || !suite.supportsVersion(DTLS_13) {
+		return newAlertError(AlertIllegalParameter, "Server selected cipher suite %s which we did not offer", suite)
+	}
+	if ch.helloRetryRequest != nil && suite.id != ch.cipherSuite.id {
+		return newAlertError(AlertIllegalParameter, "Server changed the cipher suite after the hello retry request")
+	}
+	ch.cipherSuite = *suite
+	if isHelloRetryRequest(serverHello) {
+		return ch.processHelloRetryRequest(serverHello)
+	}
+	e, ok := findExtension(serverHello.Extensions, ExtensionKeyShare)
+	if !ok {
+		return newAlertError(AlertMissingExtension, "Server did not send a key share")
+	}
+	share, err := readServerKeyShareExtension(e.Data)
+	if err != nil {
+		return newAlertError(AlertDecodeError, "Invalid key share extension")
+	}
+	if share.group != ch.curve {
+		return newAlertError(AlertIllegalParameter, "Server sent a key share of group %d which we did not offer", share.group)
+	}
+	secret, err := sharedSecret(ch.keyShare, share)
+	if err != nil {
+		return newAlertError(AlertIllegalParameter, "Invalid server key share: %s", err)
+	}
+	ch.Conn.version = DTLS_13
+	ch.serverRandom = serverHello.Random
+	ch.establishHandshakeKeys(secret)
+	return nil
+}
+
+// processHelloRetryRequest answers a HelloRetryRequest with a new
+// ClientHello, which contains a key share of the group and the cookie the
+// server asked for, RFC 8446 section 4.1.4. The first ClientHello remains
+// in the transcript as its hash.
+func (ch *clientHandshake) processHelloRetryRequest(hrr handshakeServerHello) error {
+	if ch.helloRetryRequest != nil {
+		return newAlertError(AlertUnexpectedMessage, "Server sent a second hello retry request")
+	}
+	changed := false
+	if e, ok := findExtension(hrr.Extensions, ExtensionKeyShare); ok {
+		group, err := readHelloRetryKeyShareExtension(e.Data)
+		if err != nil {
+			return newAlertError(AlertDecodeError, "Invalid key share extension")
+		}
+		if !isSupportedCurve(group, supportedCurves) || group == ch.curve {
+			return newAlertError(AlertIllegalParameter, "Server asked for a key share of group %d", group)
+		}
+		ch.curve, ch.keyShare = group, nil
+		changed = true
+	}
+	if e, ok := findExtension(hrr.Extensions, ExtensionCookie); ok {
+		cookie, err := readCookieExtension(e.Data)
+		if err != nil {
+			return newAlertError(AlertDecodeError, "Invalid cookie extension")
+		}
+		ch.helloRetryCookie = cookie
+		changed = true
+	}
+	if !changed {
+		return newAlertError(AlertIllegalParameter, "Hello retry request does not change the client hello")
+	}
+	ch.logf("Server sent a hello retry request, sending a new client hello")
+	ch.clientHelloHash = ch.cipherSuite.messageHash(ch.clientHello)
+	ch.helloRetryRequest = ch.serverHello
+	ch.serverHello = nil
+	ch.sendFlightOne()
+	return nil
+}
+
+// continueHandshake13 completes a DTLS 1.3 handshake once the server's
+// Finished message arrived. Our last flight is protected with the handshake
+// traffic keys, the application data that follows with the application
+// traffic keys. The server acknowledges the flight, if the ACK gets lost
+// it retransmits its flight, which makes us retransmit ours.
+func (ch *clientHandshake) continueHandshake13() (bool, error) {
+	if ch.currentFlight != 2 || ch.serverFinished == nil {
+		return false, nil
+	}
+	if err := ch.processServerFlight13(); err != nil {
+		return true, err
+	}
+	if ch.certificateRequest != nil {
+		if err := ch.prepareClientCertificate(); err != nil {
+			return true, err
+		}
+		if ch.certificate != nil {
+			var err error
+			if ch.certificateVerify, err = ch.newCertificateVerify13(clientSignatureContext, ch.clientCertificate); err != nil {
+				return true, err
+			}
+		}
+	}
+	transcriptHash := ch.transcriptHash13(lastMessage(ch.serverFinished, ch.clientCertificate, ch.certificateVerify))
+	verifyData := ch.cipherSuite.finishedMAC(ch.clientHandshakeSecret, transcriptHash)
+	ch.clientFinished = ch.buildNextHandshakeMessage(finished, handshakeFinished{VerifyData: verifyData}.Bytes())
+	ch.sendFlight13(presentMessages(ch.clientCertificate, ch.certificateVerify, ch.clientFinished), 0)
+	ch.Conn.setWriteEpoch(epochApplicationData, ch.Conn.pendingWriteState)
+	ch.currentFlight = 4
+	return true, nil
+}
+
+// processServerFlight13 checks the server's messages after the
+// ServerHello: its extensions, its certificate, the signature over the
+// transcript and its Finished message. Then the application traffic keys
+// are derived and the server's application data is read with them.
+func (ch *clientHandshake) processServerFlight13() error {
+	if ch.encryptedExtensions == nil {
+		return newAlertError(AlertUnexpectedMessage, "Server did not send encrypted extensions")
+	}
+	encryptedExtensions, err := readHandshakeEncryptedExtensions(ch.encryptedExtensions.Fragment)
+	if err != nil {
+		return newAlertError(AlertDecodeError, "Error while reading encrypted extensions: %s", err)
+	}
+	for _, e := range encryptedExtensions.Extensions {
+		if e.Type != ExtensionSupportedGroups && e.Type != ExtensionRecordSizeLimit && e.Type != ExtensionMaxFragmentLength {
+			return newAlertError(AlertUnsupportedExtension, "Server sent unexpected extension %d", e.Type)
+		}
+	}
+	if err := ch.processRecordLimits(encryptedExtensions.Extensions); err != nil {
+		return err
+	}
+	if ch.serverCertificate == nil {
+		return newAlertError(AlertHandshakeFailure, "Server did not send a certificate")
+	}
+	certs, err := parseCertificates(ch.serverCertificate, DTLS_13)
+	if err != nil {
+		return err
+	}
+	if err := ch.verifyServerCertificate(certs); err != nil {
+		return err
+	}
+	if err := verifyCertificateVerify13(ch.serverCertificateVerify, certs[0].PublicKey, serverSignatureContext, ch.transcriptHash13(ch.serverCertificate)); err != nil {
+		return err
+	}
+	if err := verifyFinished13(ch.serverFinished, &ch.cipherSuite, ch.serverHandshakeSecret, ch.transcriptHash13(ch.serverCertificateVerify)); err != nil {
+		return err
+	}
+	ch.establishApplicationKeys()
+	ch.Conn.setReadEpoch(epochApplicationData, ch.Conn.pendingReadState)
+	return nil
+}
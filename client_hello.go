@@ -15,6 +15,9 @@ type handshakeClientHello struct {
 	CipherSuites       []*cipherSuite
 	CompressionMethods []compressionMethod
 	Extensions         []extension
+	// RenegotiationSCSV is set if TLS_EMPTY_RENEGOTIATION_INFO_SCSV is
+	// among the cipher suites, RFC 5746 section 3.3.
+	RenegotiationSCSV bool
 }
 
 func readHandshakeClientHello(data []byte) (clientHello handshakeClientHello, err error) {
@@ -46,10 +49,26 @@ func readHandshakeClientHello(data []byte) (clientHello handshakeClientHello, er
 	}
 	clientHello.Cookie = buffer.Next(int(cookieLength))
 
-	numCipherSuites := int(readUint16(buffer)) / 2
-	for i := 0; i < numCipherSuites; i++ {
+	if buffer.Len() < 2 {
+		err = errors.New("Insufficient data to read cipher suites")
+		return
+	}
+	cipherSuitesLength := int(readUint16(buffer))
+	if cipherSuitesLength%2 != 0 || cipherSuitesLength > buffer.Len() {
+		err = errors.New("Insufficient data to read cipher suites")
+		return
+	}
+	for i := 0; i < cipherSuitesLength/2; i++ {
+		if binary.BigEndian.Uint16(buffer.Bytes()) == TLS_EMPTY_RENEGOTIATION_INFO_SCSV {
+			clientHello.RenegotiationSCSV = true
+			buffer.Next(2)
+			continue
+		}
 		cipherSuite, err := readCipherSuite(buffer)
-		if err != nil {
+		if err == InvalidCipherSuite {
+			// Clients offer suites we do not implement.
+			continue
+		} else if err != nil {
 			return clientHello, err
 		}
 		clientHello.CipherSuites = append(clientHello.CipherSuites, cipherSuite)
@@ -59,14 +78,20 @@ func readHandshakeClientHello(data []byte) (clientHello handshakeClientHello, er
 	if err != nil {
 		return
 	}
+	if int(numCompressionMethods) > buffer.Len() {
+		err = errors.New("Insufficient data to read compression methods")
+		return
+	}
 	for i := 0; i < int(numCompressionMethods); i++ {
 		compressionMethod, err := readCompressionMethod(buffer)
-		if err != nil {
+		if err == InvalidCompressionError {
+			continue
+		} else if err != nil {
 			return clientHello, err
 		}
 		clientHello.CompressionMethods = append(clientHello.CompressionMethods, compressionMethod)
 	}
-	//TODO: Extensions
+	clientHello.Extensions, err = readExtensions(buffer)
 	return
 }
 
@@ -83,18 +108,23 @@ func (ch handshakeClientHello) Bytes() []byte {
 	buffer.Write([]byte{byte(len(ch.Cookie))})
 	buffer.Write(ch.Cookie)
 	cipherSuiteLength := len(ch.CipherSuites) * 2
+	if ch.RenegotiationSCSV {
+		cipherSuiteLength += 2
+	}
 	b := make([]byte, 2)
 	binary.BigEndian.PutUint16(b, uint16(cipherSuiteLength))
 	buffer.Write(b)
 	for _, cipherSuite := range ch.CipherSuites {
 		buffer.Write(cipherSuite.Bytes())
 	}
+	if ch.RenegotiationSCSV {
+		binary.BigEndian.PutUint16(b, TLS_EMPTY_RENEGOTIATION_INFO_SCSV)
+		buffer.Write(b)
+	}
 	buffer.Write([]byte{byte(len(ch.CompressionMethods))})
 	for _, compressionMethods := range ch.CompressionMethods {
 		buffer.Write(compressionMethods.Bytes())
 	}
-	for _, extension := range ch.Extensions {
-		buffer.Write(extension.Bytes())
-	}
+	writeExtensions(&buffer, ch.Extensions)
 	return buffer.Bytes()
 }
@@ -11,8 +11,7 @@ type clientDiffieHellmanPublic struct {
 }
 
 func readClientDiffieHellmanPublic(buffer *bytes.Buffer) (cdhp clientDiffieHellmanPublic, err error) {
-	size := readUint16(buffer)
-	cdhp.PublicKey = buffer.Next(int(size))
+	cdhp.PublicKey, err = readOpaque16(buffer)
 	return
 }
 
@@ -27,6 +26,50 @@ func (cdhp clientDiffieHellmanPublic) Bytes() []byte {
 	return buffer
 }
 
+type clientECDiffieHellmanPublic struct {
+	PublicKey []byte
+}
+
+func readClientECDiffieHellmanPublic(buffer *bytes.Buffer) (cecdhp clientECDiffieHellmanPublic, err error) {
+	publicKeyLength, err := buffer.ReadByte()
+	if err != nil {
+		return
+	}
+	if buffer.Len() < int(publicKeyLength) {
+		return cecdhp, InsufficentBytesError
+	}
+	cecdhp.PublicKey = buffer.Next(int(publicKeyLength))
+	return
+}
+
+func (cecdhp clientECDiffieHellmanPublic) String() string {
+	return fmt.Sprintf("ClientECDiffieHellmanPublic{ PublicKey: %x }", cecdhp.PublicKey)
+}
+
+func (cecdhp clientECDiffieHellmanPublic) Bytes() []byte {
+	return append([]byte{byte(len(cecdhp.PublicKey))}, cecdhp.PublicKey...)
+}
+
+// pskIdentity is the psk_identity a client sends in front of the key
+// exchange of the pre-shared key cipher suites, RFC 4279 section 2. Servers
+// send their psk_identity_hint in the same format.
+type pskIdentity struct {
+	Identity []byte
+}
+
+func readPSKIdentity(buffer *bytes.Buffer) (pi pskIdentity, err error) {
+	pi.Identity, err = readOpaque16(buffer)
+	return
+}
+
+func (pi pskIdentity) String() string {
+	return fmt.Sprintf("PSKIdentity{ Identity: %q }", pi.Identity)
+}
+
+func (pi pskIdentity) Bytes() []byte {
+	return opaque16(pi.Identity)
+}
+
 type handshakeClientKeyExchange struct {
 	clientDiffieHellmanPublic
 }
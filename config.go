@@ -0,0 +1,366 @@
+package dtls
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// Protocol versions accepted in Config.MinVersion and Config.MaxVersion.
+const (
+	VersionDTLS10 uint16 = 0xfeff
+	VersionDTLS12 uint16 = 0xfefd
+	VersionDTLS13 uint16 = 0xfefc
+)
+
+const defaultHandshakeTimeout = 60 * time.Second
+
+// ClientAuthType declares the policy a server follows for client
+// certificates.
+type ClientAuthType int
+
+const (
+	// NoClientCert means no client certificate is requested.
+	NoClientCert ClientAuthType = iota
+	// RequestClientCert requests a certificate, but the client does not
+	// have to send one and it is not verified.
+	RequestClientCert
+	// RequireAnyClientCert requires a certificate, but does not verify it.
+	RequireAnyClientCert
+	// VerifyClientCertIfGiven does not require a certificate, but verifies
+	// it against ClientCAs if the client sends one.
+	VerifyClientCertIfGiven
+	// RequireAndVerifyClientCert requires a certificate that verifies
+	// against ClientCAs.
+	RequireAndVerifyClientCert
+)
+
+// A Config structure is used to configure a DTLS client or server.
+// After one has been passed to a DTLS function it must not be modified.
+// A Config may be reused; the dtls package will also not modify it.
+type Config struct {
+	// CipherSuites is a list of supported cipher suites in order of
+	// preference. Ids this package does not implement are ignored.
+	// If CipherSuites is nil, all implemented cipher suites are used
+	// except the anonymous ones, which do not authenticate the server.
+	// ChaCha20-Poly1305 is preferred over AES then if the CPU has no AES
+	// instructions. Servers use their own order of preference, unless the
+	// client prefers ChaCha20-Poly1305.
+	CipherSuites []uint16
+
+	// MinVersion contains the minimum DTLS version that is acceptable.
+	// If zero, DTLS 1.0 is taken as the minimum.
+	MinVersion uint16
+
+	// MaxVersion contains the maximum DTLS version that is acceptable.
+	// If zero, DTLS 1.2 is taken as the maximum. DTLS 1.3 handshakes
+	// neither resume sessions nor use pre-shared keys or connection IDs.
+	MaxVersion uint16
+
+	// Certificates contains one or more certificate chains to present to
+	// the other side of the connection. A server uses the first one that
+	// fits the negotiated cipher suite, a client the first one that fits
+	// the server's CertificateRequest.
+	Certificates []tls.Certificate
+
+	// RootCAs defines the set of root certificate authorities that clients
+	// use when verifying server certificates. If RootCAs is nil, the host's
+	// root CA set is used.
+	RootCAs *x509.CertPool
+
+	// ServerName is used to verify the hostname on the server
+	// certificate unless InsecureSkipVerify is given.
+	ServerName string
+
+	// InsecureSkipVerify controls whether a client verifies the server's
+	// certificate chain and host name. If InsecureSkipVerify is true, any
+	// certificate is accepted and the connection is open to
+	// man-in-the-middle attacks. This should be used only for testing.
+	InsecureSkipVerify bool
+
+	// ClientAuth determines the server's policy for client certificates.
+	// The default is NoClientCert. Certificates are only requested in
+	// cipher suites which authenticate the server with a certificate.
+	ClientAuth ClientAuthType
+
+	// ClientCAs defines the set of root certificate authorities that
+	// servers use to verify client certificates. Their names are sent to
+	// the client in the CertificateRequest. If ClientCAs is nil, the
+	// host's root CA set is used and no names are sent.
+	ClientCAs *x509.CertPool
+
+	// PSKIdentity and PSK are the identity and the key a client uses for
+	// the pre-shared key cipher suites. Clients only offer these suites
+	// if PSK is set.
+	PSKIdentity []byte
+	PSK         []byte
+
+	// GetPSK returns the pre-shared key for the identity a client
+	// presented. It is only used by servers, which accept the pre-shared
+	// key cipher suites only if it is set.
+	GetPSK func(identity []byte) ([]byte, error)
+
+	// PSKIdentityHint is sent to clients in the ServerKeyExchange of the
+	// pre-shared key cipher suites to help them choose their identity.
+	PSKIdentityHint []byte
+
+	// ClientSessionCache stores the sessions of a client for resumption
+	// with an abbreviated handshake. If it is nil, sessions are not
+	// resumed. Servers resume the sessions of connections accepted by the
+	// same Listener and, once SetSessionTicketKeys was called, sessions
+	// from session tickets.
+	ClientSessionCache ClientSessionCache
+
+	// SessionTicketsDisabled turns off session tickets, RFC 5077. Clients
+	// then resume sessions only by session ID and servers issue no
+	// tickets.
+	SessionTicketsDisabled bool
+
+	// Renegotiation controls which renegotiations a connection starts with
+	// Conn.Renegotiate or accepts from the peer. The default is
+	// RenegotiateNever, renegotiations the policy does not allow are
+	// declined with a no_renegotiation alert.
+	Renegotiation RenegotiationSupport
+
+	// RequireExtendedMasterSecret aborts handshakes with peers that do not
+	// support the extended master secret of RFC 7627, which binds the
+	// master secret to the handshake that established it. It is always
+	// offered and used if the peer supports it.
+	RequireExtendedMasterSecret bool
+
+	// DisableConnectionIDs turns off the connection IDs of RFC 9146. With
+	// them, a Listener finds the connection of a record by the ID in its
+	// header instead of by its source address, so a client keeps its
+	// connection when its address changes, e.g. after a NAT rebinding.
+	// Clients use the ID of the server, but do not ask for one.
+	DisableConnectionIDs bool
+
+	// MaxFragmentLength makes a client ask the server to limit the
+	// plaintext of the records of both sides to 512, 1024, 2048 or 4096
+	// bytes with the max_fragment_length extension, RFC 6066 section 4.
+	// Other values ask for no limit. Servers accept the limit a client
+	// asks for, unless the client also sends a RecordSizeLimit. It is not
+	// used with DTLS 1.3.
+	MaxFragmentLength int
+
+	// RecordSizeLimit is the largest plaintext of the protected records
+	// the connection is willing to receive, announced to the peer with
+	// the record_size_limit extension, RFC 8449. In DTLS 1.3 the limit
+	// includes the content type, which leaves a byte less for the data.
+	// Values outside of 64 and 16384 are raised or lowered to them. If
+	// zero, no limit is announced, but servers still respect the limit of
+	// a client.
+	RecordSizeLimit int
+
+	// InsecureSkipHelloVerify makes a Listener create connections for
+	// every ClientHello instead of first verifying the client address with
+	// the cookie of a HelloVerifyRequest, or of a HelloRetryRequest in
+	// DTLS 1.3. This exposes the server to denial of
+	// service and amplification attacks with spoofed addresses.
+	InsecureSkipHelloVerify bool
+
+	// DisableReplayDetection turns off the anti-replay window, so that
+	// duplicated records are passed to the application. It is meant for
+	// applications which do their own deduplication.
+	DisableReplayDetection bool
+
+	// MTU is the size of the largest datagram the connection sends during
+	// the handshake, the MTU of the path without the IP and UDP headers.
+	// Larger handshake messages are split into fragments. If a flight of
+	// large datagrams is lost repeatedly, the connection falls back to
+	// smaller MTUs. If zero, 1200 bytes are used.
+	MTU int
+
+	// HandshakeTimeout is the maximum amount of time a handshake may take.
+	// If zero, a timeout of one minute is used.
+	HandshakeTimeout time.Duration
+
+	// Logger receives the debug output of the connection. If nil, the
+	// standard logger of the log package is used.
+	Logger *log.Logger
+
+	// KeyLogWriter optionally specifies a destination for master secrets
+	// in NSS key log format that can be used to allow external programs
+	// such as Wireshark to decrypt DTLS connections.
+	KeyLogWriter io.Writer
+
+	ticketKeysMutex sync.RWMutex
+	ticketKeys      []ticketKey
+}
+
+var defaultConfig = &Config{}
+
+func (c *Config) cipherSuites() []*cipherSuite {
+	if c.CipherSuites == nil {
+		suites := make([]*cipherSuite, 0, len(cipherSuites))
+		for _, suite := range cipherSuites {
+			if suite.flags&suiteDefaultOff == 0 {
+				suites = append(suites, suite)
+			}
+		}
+		if !hasAESGCMHardwareSupport {
+			return chaCha20First(suites)
+		}
+		return suites
+	}
+	suites := make([]*cipherSuite, 0, len(c.CipherSuites))
+	for _, id := range c.CipherSuites {
+		for _, suite := range cipherSuites {
+			if uint16(suite.id) == id {
+				suites = append(suites, suite)
+				break
+			}
+		}
+	}
+	return suites
+}
+
+// certificateFor returns the first certificate a server can sign the key
+// exchange of suite with, or nil if there is none.
+func (c *Config) certificateFor(suite *cipherSuite) *tls.Certificate {
+	typ, ok := suite.signatureType()
+	if !ok {
+		return nil
+	}
+	for i := range c.Certificates {
+		if certTyp, err := signatureTypeOf(certificatePublicKey(&c.Certificates[i])); err == nil && certTyp == typ {
+			return &c.Certificates[i]
+		}
+	}
+	return nil
+}
+
+// certificate13 returns the first certificate a DTLS 1.3 server can sign
+// with one of the client's signature algorithms, or nil if there is none.
+func (c *Config) certificate13(peerAlgorithms []signatureAndHash) *tls.Certificate {
+	for i := range c.Certificates {
+		if _, err := selectSignatureAlgorithm(DTLS_13, certificatePublicKey(&c.Certificates[i]), peerAlgorithms); err == nil {
+			return &c.Certificates[i]
+		}
+	}
+	return nil
+}
+
+// clientCertificateFor returns the first certificate that fits request, or
+// nil if there is none. If the server named certificate authorities, the
+// chain has to contain a certificate issued by one of them.
+func (c *Config) clientCertificateFor(request handshakeCertificateRequest, version protocolVersion) *tls.Certificate {
+	for i := range c.Certificates {
+		cert := &c.Certificates[i]
+		key := certificatePublicKey(cert)
+		typ, err := signatureTypeOf(key)
+		if err != nil || version != DTLS_13 && !containsCertificateType(request.CertificateTypes, certificateTypeFor(typ)) {
+			continue
+		}
+		if _, err := selectSignatureAlgorithm(version, key, request.SignatureAlgorithms); err != nil {
+			continue
+		}
+		if len(request.CertificateAuthorities) == 0 || issuedByAny(cert.Certificate, request.CertificateAuthorities) {
+			return cert
+		}
+	}
+	return nil
+}
+
+func certificatePublicKey(cert *tls.Certificate) crypto.PublicKey {
+	if cert.Leaf != nil {
+		return cert.Leaf.PublicKey
+	}
+	if signer, ok := cert.PrivateKey.(crypto.Signer); ok {
+		return signer.Public()
+	}
+	return nil
+}
+
+// SetSessionTicketKeys sets the keys with which servers encrypt and
+// authenticate session tickets. The first key seals new tickets, all of
+// them open tickets, so keys are rotated by adding a new key in front and
+// dropping the last one. Servers only issue tickets once keys are set, and
+// servers sharing their keys resume each other's sessions. Unlike the
+// fields, the keys may be changed while the config is in use.
+func (c *Config) SetSessionTicketKeys(keys [][32]byte) {
+	ticketKeys := make([]ticketKey, 0, len(keys))
+	for _, key := range keys {
+		ticketKeys = append(ticketKeys, newTicketKey(key))
+	}
+	c.ticketKeysMutex.Lock()
+	defer c.ticketKeysMutex.Unlock()
+	c.ticketKeys = ticketKeys
+}
+
+func (c *Config) sessionTicketKeys() []ticketKey {
+	c.ticketKeysMutex.RLock()
+	defer c.ticketKeysMutex.RUnlock()
+	return c.ticketKeys
+}
+
+func (c *Config) minVersion() protocolVersion {
+	if c.MinVersion == 0 {
+		return DTLS_10
+	}
+	return versionFromUint16(c.MinVersion)
+}
+
+func (c *Config) maxVersion() protocolVersion {
+	if c.MaxVersion == 0 {
+		return DTLS_12
+	}
+	return versionFromUint16(c.MaxVersion)
+}
+
+// helloVersion returns the version a client puts into its ClientHello, the
+// highest supported version below DTLS 1.3. DTLS 1.3 is offered in the
+// supported_versions extension instead, RFC 9147 section 5.3.
+func (c *Config) helloVersion() protocolVersion {
+	if version := c.maxVersion(); version != DTLS_13 {
+		return version
+	}
+	return DTLS_12
+}
+
+// supportsVersion reports whether version lies between MinVersion and
+// MaxVersion. DTLS version numbers count downwards, 1.2 is below 1.0.
+func (c *Config) supportsVersion(version protocolVersion) bool {
+	return version.uint16() >= c.maxVersion().uint16() &&
+		version.uint16() <= c.minVersion().uint16()
+}
+
+// mutualVersion returns the highest version supported by both the peer
+// and the config.
+func (c *Config) mutualVersion(peerVersion protocolVersion) (protocolVersion, bool) {
+	version := c.maxVersion()
+	if peerVersion.uint16() > version.uint16() {
+		version = peerVersion
+	}
+	return version, c.supportsVersion(version)
+}
+
+func (c *Config) handshakeTimeout() time.Duration {
+	if c.HandshakeTimeout == 0 {
+		return defaultHandshakeTimeout
+	}
+	return c.HandshakeTimeout
+}
+
+func (c *Config) logger() *log.Logger {
+	if c.Logger == nil {
+		return log.Default()
+	}
+	return c.Logger
+}
+
+// writeKeyLog writes a secret of the connection with the given client
+// random to the KeyLogWriter. Label is CLIENT_RANDOM for the master secret
+// of DTLS 1.0 and 1.2, DTLS 1.3 logs its traffic secrets instead.
+func (c *Config) writeKeyLog(label string, clientRandom, secret []byte) error {
+	if c.KeyLogWriter == nil {
+		return nil
+	}
+	_, err := c.KeyLogWriter.Write([]byte(fmt.Sprintf("%s %x %x\n", label, clientRandom, secret)))
+	return err
+}
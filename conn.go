@@ -2,190 +2,809 @@ package dtls
 
 import (
 	"bytes"
+	"context"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/x509"
 	"encoding/binary"
 	"errors"
 	"io"
-	"log"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const UDP_MAX_SIZE = 64 * 1024
 
+// HandshakeTimeoutError is returned when the handshake did not complete
+// within Config.HandshakeTimeout.
+var HandshakeTimeoutError net.Error = timeoutError{"DTLS handshake timed out"}
+
+// ConnClosedError is returned by reads and writes after Close and by writes
+// after the peer closed the connection.
+var ConnClosedError = errors.New("DTLS connection closed")
+
 type securityParameters struct {
 	compressionMethod
 	Cipher cipher.Block
 	Mac    macFunction
+	// AEAD is used instead of Cipher and Mac by AEAD cipher suites.
+	AEAD aead
+	// encryptThenMAC is set if the MAC is computed over the encrypted
+	// record instead of the plaintext, RFC 7366.
+	encryptThenMAC bool
+	// connectionID is the connection ID of the records, RFC 9146. Records
+	// without one have the usual format.
+	connectionID []byte
+	// sequenceNumber is the next record sequence number of the epoch the
+	// parameters are used for when writing. Every epoch starts at zero.
+	sequenceNumber uint64
+	// sequenceNumberMask computes the mask that encrypts the sequence
+	// numbers of DTLS 1.3 records, RFC 9147 section 4.2.3. trafficSecret
+	// is the secret the keys of suite were derived from, a KeyUpdate
+	// derives the keys of the next epoch from it.
+	sequenceNumberMask func(ciphertext []byte) []byte
+	trafficSecret      []byte
+	suite              *cipherSuite
+}
+
+// setKeys installs the record protection of suite with the given keys.
+func (sp *securityParameters) setKeys(suite *cipherSuite, macKey, key, iv []byte) {
+	if suite.aead != nil {
+		sp.AEAD = suite.aead(key, iv)
+		return
+	}
+	sp.Cipher = suite.cipher(key)
+	sp.Mac = suite.mac(macKey)
+}
+
+func (sp *securityParameters) hasKeys() bool {
+	return sp.Cipher != nil || sp.AEAD != nil
 }
 
+// maxNextEpochRecords is the number of records of the next epoch that are
+// buffered until the peer's ChangeCipherSpec arrives.
+const maxNextEpochRecords = 16
+
 type Conn struct {
 	net.Conn
-	sequenceNumber    uint64
-	epoch             uint16
-	version           protocolVersion
-	handshakeComplete bool
+	config    *Config
+	epoch     uint16
+	readEpoch uint16
+	version   protocolVersion
+
+	// handshakeMutex makes sure the handshake runs only once, readMutex
+	// and writeMutex serialize reads and writes after it completed.
+	handshakeMutex sync.Mutex
+	readMutex      sync.Mutex
+	writeMutex     sync.Mutex
+	// handshakeComplete is set atomically once the handshake succeeded.
+	handshakeComplete int32
+
+	deadlineMutex sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
 
 	currentReadState  securityParameters
 	currentWriteState securityParameters
 	pendingReadState  securityParameters
 	pendingWriteState securityParameters
+	// previousWriteState is kept to retransmit the part of a flight
+	// that was sent before our last ChangeCipherSpec.
+	previousWriteState securityParameters
+	// handshakeWriteState protects the handshake messages of DTLS 1.3,
+	// which are sent in epoch 2 also when they are retransmitted after
+	// the application data keys are in use.
+	handshakeWriteState securityParameters
+	// previousReadEpoch is the DTLS 1.3 epoch before readEpoch. Its records
+	// are still accepted, e.g. retransmitted handshake messages or
+	// application data which was sent before a KeyUpdate.
+	previousReadEpoch    uint16
+	previousReadState    securityParameters
+	previousReplayWindow replayWindow
 
 	handshakeContext handshakeContext
+	// connectionID is the connection ID we ask the peer to put in its
+	// records. It is set for the connections of a Listener.
+	connectionID []byte
+	// peerCertificates is the certificate chain the peer sent during the
+	// handshake.
+	peerCertificates []*x509.Certificate
+	// pskIdentity is the identity the client presented in a pre-shared
+	// key handshake.
+	pskIdentity []byte
+	// didResume is set if the handshake resumed an earlier session.
+	didResume bool
+	// extendedMasterSecret is set if the session uses the extended master
+	// secret, RFC 7627.
+	extendedMasterSecret bool
+	// secureRenegotiation is set if the peer supports secure
+	// renegotiation, RFC 5746. clientVerifyData and serverVerifyData are
+	// from the Finished messages of the last handshake, a renegotiation
+	// repeats them to prove it runs on the same connection.
+	secureRenegotiation bool
+	clientVerifyData    []byte
+	serverVerifyData    []byte
+	// renegotiations counts the completed renegotiations.
+	renegotiations int
+	// applicationData holds the application data that arrived during a
+	// renegotiation until it is read.
+	applicationData [][]byte
 
 	recordQueue []*record
+	// nextEpochRecords holds records which arrived before the
+	// ChangeCipherSpec that starts their epoch.
+	nextEpochRecords []*record
+	// replayWindow tracks the records received in readEpoch.
+	replayWindow replayWindow
+	// readSequenceNumber is the sequence number of the last record read.
+	readSequenceNumber uint64
+	// lastRecord identifies the last DTLS 1.3 record read, so it can be
+	// acknowledged.
+	lastRecord recordNumber
+	// keyUpdate is the KeyUpdate we sent, which has to be acknowledged
+	// before we switch to the next epoch, RFC 9147 section 8.
+	keyUpdate *pendingKeyUpdate
+	// mtu is the size of the largest datagram we send during the
+	// handshake. It is guarded by the writeMutex.
+	mtu int
+	// batch collects the records we write while a flight or a WriteBatch
+	// is sent, so that they share datagrams. It is guarded by the
+	// writeMutex.
+	batch *recordBatch
+	// sendLimit and receiveLimit bound the payload of the protected
+	// records we send and accept, as negotiated with the record_size_limit
+	// or max_fragment_length extensions, zero if unlimited. limitPlaintext
+	// applies them to the records of epoch 0 as well. They are guarded by
+	// the writeMutex, the reader reads them without it, as it never runs
+	// concurrently with a handshake.
+	sendLimit      int
+	receiveLimit   int
+	limitPlaintext bool
+
+	// err is set once the connection was aborted with a fatal alert or
+	// the peer closed it, all later reads and writes fail with it.
+	errMutex sync.Mutex
+	err      error
+	// closed is set atomically by Close, so that a concurrent Read can tell
+	// why the underlying connection failed.
+	closed int32
 }
 
-func NewConn(c net.Conn, server bool) net.Conn {
-	log.Printf("Opening new DTLS conenction")
-	dtlsConn := &Conn{
-		Conn:    c,
-		version: DTLS_12,
+// Client returns a new DTLS client side connection using conn as the
+// underlying transport. A nil config is equivalent to the zero Config.
+func Client(conn net.Conn, config *Config) *Conn {
+	c := newConn(conn, config)
+	c.handshakeContext = &clientHandshake{baseHandshakeContext: baseHandshakeContext{Conn: c, isServer: false, clientRandom: newRandom(), handshakeMessageBuffer: make(map[uint16]*handshakeFragmentList)}}
+	return c
+}
+
+// Server returns a new DTLS server side connection using conn as the
+// underlying transport. A nil config is equivalent to the zero Config.
+func Server(conn net.Conn, config *Config) *Conn {
+	return newServer(conn, config, nil, nil)
+}
+
+// newServer returns a server side connection which stores its sessions in
+// sessions for resumption. Without a cache sessions are not resumable.
+// cookies checks the cookies of the Listener's HelloRetryRequests.
+func newServer(conn net.Conn, config *Config, sessions *lruCache, cookies *cookieGenerator) *Conn {
+	c := newConn(conn, config)
+	c.handshakeContext = &serverHandshake{
+		baseHandshakeContext: baseHandshakeContext{Conn: c, isServer: true, handshakeMessageBuffer: make(map[uint16]*handshakeFragmentList)},
+		sessions:             sessions,
+		cookies:              cookies,
 	}
-	if server {
-		dtlsConn.handshakeContext = &serverHandshake{baseHandshakeContext{Conn: dtlsConn, isServer: true, handshakeMessageBuffer: make(map[uint16]*handshakeFragmentList)}}
-	} else {
-		random := newRandom()
-		dtlsConn.handshakeContext = &clientHandshake{baseHandshakeContext{Conn: dtlsConn, isServer: false, clientRandom: random, handshakeMessageBuffer: make(map[uint16]*handshakeFragmentList)}}
+	return c
+}
+
+func newConn(conn net.Conn, config *Config) *Conn {
+	if config == nil {
+		config = defaultConfig
 	}
-	return dtlsConn
+	c := &Conn{
+		Conn:    conn,
+		config:  config,
+		version: config.helloVersion(),
+		mtu:     config.mtu(),
+	}
+	c.logf("Opening new DTLS connection")
+	return c
+}
+
+func (c *Conn) logf(format string, v ...interface{}) {
+	c.config.logger().Printf(format, v...)
 }
 
-func (c *Conn) handshake() (err error) {
-	log.Printf("Begin handshake")
+// Handshake runs the handshake if it has not been run yet. Read and Write
+// call it automatically.
+func (c *Conn) Handshake() error {
+	return c.HandshakeContext(context.Background())
+}
+
+// HandshakeContext runs the handshake if it has not been run yet. The
+// handshake is aborted when ctx is done, when the deadline set with
+// SetDeadline passes or after Config.HandshakeTimeout. A failed handshake
+// is not retried, later calls return the same error.
+func (c *Conn) HandshakeContext(ctx context.Context) error {
+	// A renegotiation holds the handshakeMutex while it runs, which must
+	// not block the reads and writes of the established connection.
+	if c.isHandshakeComplete() {
+		return nil
+	}
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+	if c.isHandshakeComplete() {
+		return nil
+	}
+	if err := c.error(); err != nil {
+		return err
+	}
+	if err := c.runHandshake(ctx, nil); err != nil {
+		if c.isClosed() {
+			err = ConnClosedError
+		}
+		return c.abort(err)
+	}
+	atomic.StoreInt32(&c.handshakeComplete, 1)
+	return nil
+}
+
+// PeerCertificates returns the certificate chain the peer sent, starting
+// with its leaf. It returns nil before the handshake completed or if the
+// peer did not authenticate with a certificate.
+func (c *Conn) PeerCertificates() []*x509.Certificate {
+	if !c.isHandshakeComplete() {
+		return nil
+	}
+	return c.peerCertificates
+}
+
+// PSKIdentity returns the identity the client presented in a pre-shared
+// key handshake. It returns nil before the handshake completed or if no
+// pre-shared key cipher suite was negotiated.
+func (c *Conn) PSKIdentity() []byte {
+	if !c.isHandshakeComplete() {
+		return nil
+	}
+	return c.pskIdentity
+}
+
+// DidResume reports whether the handshake resumed an earlier session
+// instead of negotiating a new one.
+func (c *Conn) DidResume() bool {
+	return c.isHandshakeComplete() && c.didResume
+}
+
+func (c *Conn) isHandshakeComplete() bool {
+	return atomic.LoadInt32(&c.handshakeComplete) == 1
+}
+
+// runHandshake runs the handshake of the handshake context. A renegotiation
+// the peer started begins with its first message.
+func (c *Conn) runHandshake(ctx context.Context, first *handshake) error {
+	c.logf("Begin handshake")
+	// interrupt makes a blocked read return when ctx is done. The mutex
+	// makes sure the loop does not set a new read deadline afterwards.
+	var interruptMutex sync.Mutex
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			interruptMutex.Lock()
+			c.Conn.SetReadDeadline(time.Now())
+			interruptMutex.Unlock()
+		case <-stop:
+		}
+	}()
+	defer func() {
+		interruptMutex.Lock()
+		defer interruptMutex.Unlock()
+		c.Conn.SetReadDeadline(c.getReadDeadline())
+	}()
+	timeout := time.Now().Add(c.config.handshakeTimeout())
 	c.handshakeContext.beginHandshake()
+	if first != nil {
+		if complete, err := c.handshakeContext.continueHandshake(first); err != nil || complete {
+			return c.completeHandshake(err)
+		}
+	}
 	for {
-		log.Printf("Wait to read record")
+		deadline := c.handshakeDeadline(timeout)
+		readDeadline := time.Now().Add(c.handshakeContext.retransmitTimeout())
+		if readDeadline.After(deadline) {
+			readDeadline = deadline
+		}
+		interruptMutex.Lock()
+		err := ctx.Err()
+		if err == nil {
+			err = c.Conn.SetReadDeadline(readDeadline)
+		}
+		interruptMutex.Unlock()
+		if err != nil {
+			return err
+		}
+		c.logf("Wait to read record")
 		typ, payload, err := c.readRecord()
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !time.Now().Before(deadline) {
+				return HandshakeTimeoutError
+			}
+			c.logf("Retransmission timer expired, resending last flight")
+			c.handshakeContext.retransmitFlight()
+			continue
+		}
 		if err != nil {
 			return err
 		}
+		if c.isHandshakeComplete() {
+			// The connection stays usable during a renegotiation.
+			switch typ {
+			case typeApplicationData:
+				if len(c.applicationData) < maxRenegotiationApplicationData {
+					c.applicationData = append(c.applicationData, payload)
+				}
+			case typeAlert:
+				if a, err := readAlert(payload); err == nil && a.Description == AlertNoRenegotiation {
+					return RenegotiationRefusedError
+				}
+			}
+		}
 		if typ != typeHandshake {
 			continue
 		}
-		log.Printf("Process next handshake packet")
-		log.Printf("Handshake record is %x", payload)
+		c.logf("Process next handshake packet")
+		c.logf("Handshake record is %x", payload)
 		handshake, err := readHandshake(bytes.NewBuffer(payload))
 		if err != nil {
-			return err
+			return newAlertError(AlertDecodeError, "Unable to read handshake message: %s", err)
 		}
-		if complete, err := c.handshakeContext.continueHandshake(&handshake); err != nil {
-			return err
-		} else if complete {
-			c.handshakeComplete = true
-			return nil
+		if complete, err := c.handshakeContext.continueHandshake(&handshake); err != nil || complete {
+			return c.completeHandshake(err)
+		}
+	}
+}
+
+// completeHandshake keeps the verify data of a successful handshake for
+// the next renegotiation.
+func (c *Conn) completeHandshake(err error) error {
+	if err == nil {
+		c.clientVerifyData, c.serverVerifyData = c.handshakeContext.verifyData()
+	}
+	return err
+}
+
+// handshakeDeadline returns the earliest of timeout and the deadlines set
+// with SetDeadline, SetReadDeadline and SetWriteDeadline.
+func (c *Conn) handshakeDeadline(timeout time.Time) time.Time {
+	c.deadlineMutex.Lock()
+	defer c.deadlineMutex.Unlock()
+	deadline := timeout
+	for _, t := range []time.Time{c.readDeadline, c.writeDeadline} {
+		if !t.IsZero() && t.Before(deadline) {
+			deadline = t
 		}
 	}
+	return deadline
+}
+
+func (c *Conn) getReadDeadline() time.Time {
+	c.deadlineMutex.Lock()
+	defer c.deadlineMutex.Unlock()
+	return c.readDeadline
+}
+
+// SetDeadline sets the read and write deadlines, which also limit the
+// duration of the handshake.
+func (c *Conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.deadlineMutex.Lock()
+	c.readDeadline = t
+	c.deadlineMutex.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.deadlineMutex.Lock()
+	c.writeDeadline = t
+	c.deadlineMutex.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *Conn) error() error {
+	c.errMutex.Lock()
+	defer c.errMutex.Unlock()
+	return c.err
+}
+
+func (c *Conn) setError(err error) {
+	c.errMutex.Lock()
+	defer c.errMutex.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// abort handles an error that ends the connection. Local failures are
+// reported to the peer with a fatal alert, errors that are not tied to an
+// alert are sent as internal_error. Later reads and writes fail with err.
+func (c *Conn) abort(err error) error {
+	defer c.release()
+	var alertErr *AlertError
+	if !errors.As(err, &alertErr) && err != HandshakeTimeoutError && err != io.EOF && err != ConnClosedError &&
+		err != context.Canceled && err != context.DeadlineExceeded {
+		alertErr = &AlertError{Level: AlertLevelFatal, Description: AlertInternalError, Err: err}
+		err = alertErr
+	}
+	if alertErr != nil && !alertErr.Remote {
+		c.logf("Aborting connection: %s", err)
+		c.sendAlert(alertErr.Level, alertErr.Description)
+	}
+	c.setError(err)
+	return c.error()
+}
+
+func (c *Conn) sendAlert(level AlertLevel, description AlertDescription) error {
+	payload := alert{Level: level, Description: description}.Bytes()
+	if c.version == DTLS_13 && c.epoch == 0 && c.handshakeWriteState.AEAD != nil {
+		// The peer already reads with the handshake traffic keys.
+		_, err := c.sendHandshakeEpochRecord(typeAlert, payload)
+		return err
+	}
+	_, err := c.sendRecord(typeAlert, payload)
+	return err
+}
+
+func (c *Conn) receiveAlert(payload []byte) error {
+	a, err := readAlert(payload)
+	if err != nil {
+		return err
+	}
+	c.logf("Received %s", a)
+	if a.Description == AlertCloseNotify {
+		c.setError(io.EOF)
+		c.release()
+		return io.EOF
+	}
+	if a.Level == AlertLevelFatal {
+		return &AlertError{Level: a.Level, Description: a.Description, Remote: true}
+	}
 	return nil
 }
 
 func (c *Conn) Read(buffer []byte) (len int, err error) {
-	if !c.handshakeComplete {
-		err := c.handshake()
-		if err != nil {
-			return 0, err
-		}
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+	if c.isClosed() {
+		return 0, ConnClosedError
+	}
+	if err := c.error(); err != nil {
+		return 0, err
 	}
 	for {
+		if data, ok := c.nextApplicationData(); ok {
+			len = copy(buffer, data)
+			return len, nil
+		}
 		typ, payload, err := c.readRecord()
-		if err != nil {
+		if c.isClosed() {
+			return 0, ConnClosedError
+		} else if _, ok := err.(*AlertError); ok {
+			return 0, c.abort(err)
+		} else if err != nil {
 			return 0, err
 		}
-		if typ == typeApplicationData {
+		if c.version == DTLS_13 {
+			if data, err := c.receivePostHandshakeRecord(typ, payload); err != nil {
+				return 0, c.abort(err)
+			} else if data != nil {
+				return copy(buffer, data), nil
+			}
+			continue
+		}
+		switch typ {
+		case typeApplicationData:
 			len = copy(buffer, payload)
 			return len, nil
+		case typeHandshake:
+			handshake, err := readHandshake(bytes.NewBuffer(payload))
+			if err != nil {
+				continue
+			}
+			if c.isRenegotiationRequest(&handshake) {
+				if err := c.acceptRenegotiation(&handshake); err != nil {
+					return 0, err
+				}
+				continue
+			}
+			// The peer retransmits its last flight if ours got lost.
+			c.handshakeContext.receiveMessage(&handshake)
 		}
 	}
 }
 
-func (c *Conn) readRecord() (typ contentType, payload []byte, err error) {
-	var rec *record
-	if len(c.recordQueue) > 0 {
-		log.Printf("Poping record from queue")
-		rec = c.recordQueue[0]
-		c.recordQueue = c.recordQueue[1:]
-	} else {
+// nextApplicationData returns the oldest application data that arrived
+// during a renegotiation and was not read yet.
+func (c *Conn) nextApplicationData() ([]byte, bool) {
+	if len(c.applicationData) == 0 {
+		return nil, false
+	}
+	data := c.applicationData[0]
+	c.applicationData = c.applicationData[1:]
+	return data, true
+}
+
+func (c *Conn) nextRecord() (*record, error) {
+	for len(c.recordQueue) == 0 {
 		slice := make([]byte, UDP_MAX_SIZE)
-		n, err := c.Conn.Read(slice)
-		if err != nil {
-			return typ, payload, err
+		var n int
+		var from net.Addr
+		var err error
+		if m, ok := c.Conn.(migratingConn); ok {
+			n, from, err = m.readFrom(slice)
+		} else {
+			n, err = c.Conn.Read(slice)
 		}
-		buffer := bytes.NewBuffer(slice[:n])
-		rec, err = readRecord(buffer)
 		if err != nil {
-			return typ, payload, err
+			return nil, err
 		}
+		buffer := bytes.NewBuffer(slice[:n])
 		for buffer.Len() > 0 {
-			log.Printf("Read additional record from packet")
-			r, err := readRecord(buffer)
+			rec, err := readRecord(buffer, len(c.connectionID))
 			if err != nil {
-				return typ, nil, err
+				// Invalid records are silently discarded, RFC 6347 section 4.1.2.7.
+				c.logf("Discarding invalid record: %s", err)
+				break
 			}
-			c.recordQueue = append(c.recordQueue, r)
+			rec.from = from
+			c.recordQueue = append(c.recordQueue, rec)
+		}
+	}
+	rec := c.recordQueue[0]
+	c.recordQueue = c.recordQueue[1:]
+	return rec, nil
+}
+
+func (c *Conn) readRecord() (typ contentType, payload []byte, err error) {
+	if c.version == DTLS_13 {
+		return c.readRecord13()
+	}
+	var rec *record
+	for {
+		if rec, err = c.nextRecord(); err != nil {
+			return typ, payload, err
+		}
+		// Records of the next epoch overtook the ChangeCipherSpec and are
+		// kept until it arrives. Records of older epochs, e.g.
+		// retransmissions sent before the peer's ChangeCipherSpec, can
+		// not be decrypted with our keys any more.
+		if rec.Epoch == c.readEpoch+1 && len(c.nextEpochRecords) < maxNextEpochRecords {
+			c.logf("Buffering record of epoch %d until the epoch starts", rec.Epoch)
+			c.nextEpochRecords = append(c.nextEpochRecords, rec)
+			continue
+		}
+		if rec.Epoch != c.readEpoch {
+			c.logf("Discarding record of epoch %d, current epoch is %d", rec.Epoch, c.readEpoch)
+			continue
+		}
+		// Replayed records are silently discarded, RFC 6347 section 4.1.2.6.
+		if !c.config.DisableReplayDetection && c.replayWindow.isReplay(rec.SequenceNumber) {
+			c.logf("Discarding replayed record with sequence number %d", rec.SequenceNumber)
+			continue
+		}
+		// Once a connection ID is negotiated, the protected records carry
+		// it and only those, RFC 9146 section 6.
+		if (rec.Type == typeConnectionID) != (len(c.currentReadState.connectionID) > 0) ||
+			!bytes.Equal(rec.ConnectionID, c.currentReadState.connectionID) {
+			c.logf("Discarding record with unexpected connection ID %x", rec.ConnectionID)
+			continue
+		}
+		break
+	}
+	if rec.Type == typeConnectionID {
+		// In an epoch with connection IDs, even a ChangeCipherSpec only
+		// reveals its type after it was decrypted.
+		if payload, err = c.unprotectRecord(rec); err != nil {
+			return typ, nil, err
+		}
+		if rec.Type, payload, err = readInnerPlaintext(payload); err != nil {
+			return typ, nil, err
+		}
+		if rec.from != nil && c.replayWindow.isNewest(rec.SequenceNumber) {
+			c.migrate(rec.from)
+		}
+	} else if rec.Type != typeChangeCipherSpec {
+		if payload, err = c.unprotectRecord(rec); err != nil {
+			return typ, nil, err
 		}
 	}
 	if rec.Type == typeChangeCipherSpec {
-		log.Printf("Received change cipher spec record")
+		if !c.pendingReadState.hasKeys() {
+			// The ChangeCipherSpec overtook the handshake messages we
+			// need to compute the keys, the peer will retransmit it.
+			c.logf("Discarding change cipher spec record received before the keys are known")
+			return rec.Type, nil, nil
+		}
+		c.logf("Received change cipher spec record")
 		c.currentReadState = c.pendingReadState
 		c.pendingReadState = securityParameters{}
+		c.readEpoch += 1
+		c.replayWindow = replayWindow{}
+		c.recordQueue = append(c.nextEpochRecords, c.recordQueue...)
+		c.nextEpochRecords = nil
 		return rec.Type, nil, nil
 	}
-	authenticated, err := c.decryptRecord(rec.Payload)
-	if err != nil {
-		return typ, payload, err
+	if rec.Epoch > 0 || c.limitPlaintext {
+		if err = c.checkRecordOverflow(payload); err != nil {
+			return typ, nil, err
+		}
+	}
+	c.replayWindow.update(rec.SequenceNumber)
+	c.readSequenceNumber = rec.SequenceNumber
+	if rec.Type == typeAlert {
+		if err = c.receiveAlert(payload); err != nil {
+			return typ, nil, err
+		}
 	}
-	payload, err = c.removeMAC(rec.Type, rec.Epoch, rec.SequenceNumber, authenticated)
-	return rec.Type, payload, err
+	return rec.Type, payload, nil
 }
 
-func (c *Conn) Write(data []byte) (int, error) {
-	if !c.handshakeComplete {
-		err := c.handshake()
-		if err != nil {
-			return 0, err
+// unprotectRecord decrypts and authenticates the payload of rec with the
+// current read state.
+func (c *Conn) unprotectRecord(rec *record) (payload []byte, err error) {
+	if c.currentReadState.AEAD != nil {
+		return c.openRecord(rec)
+	}
+	if c.currentReadState.encryptThenMAC {
+		// The MAC is checked before anything is decrypted, so the padding
+		// of forged records is never looked at.
+		var encrypted []byte
+		if encrypted, err = c.removeMAC(rec.Type, rec.Epoch, rec.SequenceNumber, rec.Payload); err != nil {
+			return nil, err
 		}
+		return c.decryptRecord(encrypted)
+	}
+	var authenticated []byte
+	if authenticated, err = c.decryptRecord(rec.Payload); err != nil {
+		return nil, err
+	}
+	return c.removeMAC(rec.Type, rec.Epoch, rec.SequenceNumber, authenticated)
+}
+
+func (c *Conn) Write(data []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	err := c.error()
+	if c.isClosed() || err == io.EOF {
+		return 0, ConnClosedError
+	}
+	if err != nil {
+		return 0, err
 	}
 	return c.sendRecord(typeApplicationData, data)
 }
 
+// Close sends a close_notify alert to the peer, if the handshake completed,
+// and closes the underlying connection.
+func (c *Conn) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return ConnClosedError
+	}
+	var alertErr error
+	if c.isHandshakeComplete() && c.error() == nil {
+		alertErr = c.sendAlert(AlertLevelWarning, AlertCloseNotify)
+	}
+	if err := c.Conn.Close(); err != nil {
+		return err
+	}
+	return alertErr
+}
+
+func (c *Conn) isClosed() bool {
+	return atomic.LoadInt32(&c.closed) == 1
+}
+
+// A releaser is a transport which keeps state for the peer, like the
+// virtual connections of a Listener. The state is released as soon as the
+// DTLS connection is over, before the connection is closed.
+type releaser interface {
+	release()
+}
+
+func (c *Conn) release() {
+	if r, ok := c.Conn.(releaser); ok {
+		r.release()
+	}
+}
+
 func (c *Conn) sendRecord(typ contentType, payload []byte) (int, error) {
-	sequenceNumber := c.sequenceNumber
-	epoch := c.epoch
-	c.sequenceNumber += 1
-	authenticated := c.macRecord(typ, epoch, sequenceNumber, payload)
-	encrypted, err := c.encryptRecord(authenticated)
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.writeRecord(typ, c.epoch, &c.currentWriteState, payload)
+}
+
+// writeRecord protects and sends a record. The caller holds the writeMutex.
+func (c *Conn) writeRecord(typ contentType, epoch uint16, state *securityParameters, payload []byte) (int, error) {
+	if limit := c.sendLimitFor(epoch); limit > 0 && len(payload) > limit {
+		return 0, MessageTooLargeError
+	}
+	if c.version == DTLS_13 && epoch > 0 {
+		return c.writeRecord13(typ, epoch, state, payload)
+	}
+	sequenceNumber := state.sequenceNumber
+	state.sequenceNumber += 1
+	if len(state.connectionID) > 0 {
+		// The real content type is encrypted after the payload.
+		payload = append(append(make([]byte, 0, len(payload)+1), payload...), byte(typ))
+		typ = typeConnectionID
+	}
+	var encrypted []byte
+	var err error
+	if state.AEAD != nil {
+		encrypted = c.sealRecord(state, typ, epoch, sequenceNumber, payload)
+	} else if state.encryptThenMAC {
+		if encrypted, err = c.encryptRecord(state, payload); err == nil {
+			encrypted = c.macRecord(state, typ, epoch, sequenceNumber, encrypted)
+		}
+	} else {
+		authenticated := c.macRecord(state, typ, epoch, sequenceNumber, payload)
+		encrypted, err = c.encryptRecord(state, authenticated)
+	}
 	if err != nil {
-		log.Printf("Error while Encrypting record: %s\n", err)
+		c.logf("Error while Encrypting record: %s", err)
 		return 0, err
 	}
-	header := buildRecordHeader(typ, c.version, epoch, sequenceNumber, uint16(len(encrypted)))
+	header := buildRecordHeader(typ, c.recordVersion(), epoch, sequenceNumber, state.connectionID, uint16(len(encrypted)))
 	recordBytes := append(header, encrypted...)
-	n, err := c.Conn.Write(recordBytes)
-	if err == nil && typ == typeChangeCipherSpec {
-		c.currentWriteState = c.pendingWriteState
-		c.pendingWriteState = securityParameters{}
-	}
-	return n, err
+	return c.writeDatagram(recordBytes)
 }
 
+// sendChangeCipherSpec switches to the pending write state. Writes of the
+// application may run concurrently during a renegotiation, so the switch
+// happens under the writeMutex.
 func (c *Conn) sendChangeCipherSpec() error {
-	_, err := c.sendRecord(typeChangeCipherSpec, []byte{1})
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.writeChangeCipherSpec()
+}
+
+// writeChangeCipherSpec is sendChangeCipherSpec for callers which hold the
+// writeMutex.
+func (c *Conn) writeChangeCipherSpec() error {
+	_, err := c.writeRecord(typeChangeCipherSpec, c.epoch, &c.currentWriteState, []byte{1})
 	if err == nil {
+		c.previousWriteState = c.currentWriteState
+		c.currentWriteState = c.pendingWriteState
+		c.pendingWriteState = securityParameters{}
 		c.epoch += 1
 	}
 	return err
 }
 
-func (c *Conn) macRecord(typ contentType, epoch uint16, sequenceNumber uint64, payload []byte) []byte {
-	if c.currentWriteState.Mac == nil {
+func (c *Conn) macRecord(state *securityParameters, typ contentType, epoch uint16, sequenceNumber uint64, payload []byte) []byte {
+	if state.Mac == nil {
 		return payload
 	}
 	seq := make([]byte, 8)
 	binary.BigEndian.PutUint64(seq, sequenceNumber)
 	binary.BigEndian.PutUint16(seq, epoch)
-	length := make([]byte, 2)
-	binary.BigEndian.PutUint16(length, uint16(len(payload)))
-	mac := c.currentWriteState.Mac.MAC(seq, typ.Bytes(), c.version.Bytes(), length, payload)
+	mac := state.Mac.MAC(c.additionalData(state.connectionID, typ, seq, len(payload)), payload)
 	return append(payload, mac...)
 }
 
@@ -194,22 +813,80 @@ func (c *Conn) removeMAC(typ contentType, epoch uint16, sequenceNumber uint64, p
 		return payload, nil
 	}
 	macSize := c.currentReadState.Mac.Size()
+	if len(payload) < macSize {
+		return nil, newAlertError(AlertBadRecordMAC, "Record is shorter than its MAC")
+	}
 	suppliedMac := payload[len(payload)-macSize:]
 	payload = payload[:len(payload)-macSize]
 	seq := make([]byte, 8)
 	binary.BigEndian.PutUint64(seq, sequenceNumber)
 	binary.BigEndian.PutUint16(seq, epoch)
-	length := make([]byte, 2)
-	binary.BigEndian.PutUint16(length, uint16(len(payload)))
-	mac := c.currentReadState.Mac.MAC(seq, typ.Bytes(), c.version.Bytes(), length, payload)
-	if !bytes.Equal(suppliedMac, mac) {
-		return []byte{}, errors.New("Invalid record MAC")
+	mac := c.currentReadState.Mac.MAC(c.additionalData(c.currentReadState.connectionID, typ, seq, len(payload)), payload)
+	if !hmac.Equal(suppliedMac, mac) {
+		return nil, newAlertError(AlertBadRecordMAC, "Invalid record MAC")
+	}
+	return payload, nil
+}
+
+// additionalData returns the data the MAC or AEAD cipher authenticates
+// besides the payload, the epoch, sequence number, type, version and length
+// of the record, RFC 6347 section 4.1.2.1. Records with a connection ID
+// authenticate it as well, RFC 9146 section 5.
+func (c *Conn) additionalData(connectionID []byte, typ contentType, seq []byte, length int) []byte {
+	if len(connectionID) > 0 {
+		additionalData := make([]byte, 0, 24+len(connectionID))
+		additionalData = append(additionalData, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+		additionalData = append(additionalData, typeConnectionID, byte(len(connectionID)), typeConnectionID)
+		additionalData = append(additionalData, c.version.Bytes()...)
+		additionalData = append(additionalData, seq...)
+		additionalData = append(additionalData, connectionID...)
+		return append(additionalData, byte(length>>8), byte(length))
+	}
+	additionalData := make([]byte, 0, 13)
+	additionalData = append(additionalData, seq...)
+	additionalData = append(additionalData, byte(typ))
+	additionalData = append(additionalData, c.version.Bytes()...)
+	return append(additionalData, byte(length>>8), byte(length))
+}
+
+// sealRecord encrypts and authenticates the payload of a record with an
+// AEAD cipher. The epoch and sequence number are the nonce.
+func (c *Conn) sealRecord(state *securityParameters, typ contentType, epoch uint16, sequenceNumber uint64, payload []byte) []byte {
+	seq := make([]byte, 8)
+	binary.BigEndian.PutUint64(seq, sequenceNumber)
+	binary.BigEndian.PutUint16(seq, epoch)
+	explicitNonce := seq[:state.AEAD.explicitNonceLen()]
+	sealed := make([]byte, len(explicitNonce), len(explicitNonce)+len(payload)+state.AEAD.Overhead())
+	copy(sealed, explicitNonce)
+	return state.AEAD.Seal(sealed, seq, payload, c.additionalData(state.connectionID, typ, seq, len(payload)))
+}
+
+// openRecord decrypts and authenticates the payload of a record with an
+// AEAD cipher.
+func (c *Conn) openRecord(rec *record) ([]byte, error) {
+	aead := c.currentReadState.AEAD
+	explicitNonceLen := aead.explicitNonceLen()
+	if len(rec.Payload) < explicitNonceLen+aead.Overhead() {
+		return nil, newAlertError(AlertBadRecordMAC, "Record is shorter than the AEAD overhead")
+	}
+	seq := make([]byte, 8)
+	binary.BigEndian.PutUint64(seq, rec.SequenceNumber)
+	binary.BigEndian.PutUint16(seq, rec.Epoch)
+	nonce := seq
+	if explicitNonceLen > 0 {
+		nonce = rec.Payload[:explicitNonceLen]
+	}
+	ciphertext := rec.Payload[explicitNonceLen:]
+	additionalData := c.additionalData(c.currentReadState.connectionID, rec.Type, seq, len(ciphertext)-aead.Overhead())
+	payload, err := aead.Open(ciphertext[:0], nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, newAlertError(AlertBadRecordMAC, "Unable to decrypt record: %s", err)
 	}
 	return payload, nil
 }
 
-func (c *Conn) encryptRecord(payload []byte) ([]byte, error) {
-	ciph := c.currentWriteState.Cipher
+func (c *Conn) encryptRecord(state *securityParameters, payload []byte) ([]byte, error) {
+	ciph := state.Cipher
 	if ciph == nil {
 		return payload, nil
 	}
@@ -231,12 +908,17 @@ func (c *Conn) decryptRecord(payload []byte) ([]byte, error) {
 		return payload, nil
 	}
 	blockSize := ciph.BlockSize()
-	if len(payload)%blockSize != 0 {
-		return payload, errors.New("Encrypted payload is not multiple of block size")
+	if len(payload)%blockSize != 0 || len(payload) < 2*blockSize {
+		return nil, newAlertError(AlertBadRecordMAC, "Encrypted payload is not multiple of block size")
 	}
 	mode := cipher.NewCBCDecrypter(ciph, payload[:blockSize])
 	mode.CryptBlocks(payload[blockSize:], payload[blockSize:])
-	return checkAndRemovePadding(payload[blockSize:])
+	payload, err := checkAndRemovePadding(payload[blockSize:])
+	if err != nil {
+		// Padding errors are reported like MAC errors, RFC 5246 section 7.2.2.
+		return nil, newAlertError(AlertBadRecordMAC, "%s", err)
+	}
+	return payload, nil
 }
 
 // padToBlockSize calculates the needed padding block, if any, for a payload.
@@ -2,12 +2,30 @@ package dtls
 
 import (
 	"bytes"
+	"context"
+	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/hex"
+	"errors"
 	_ "fmt"
-	_ "log"
+	"golang.org/x/crypto/chacha20poly1305"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var clientKey []byte = hexToBytes("4429aea63f088bdfbcc832a21d0520dd")
@@ -36,6 +54,58 @@ func TestEncryptRecord(t *testing.T) {
 
 }
 
+func TestSealRecord(t *testing.T) {
+	c := &Conn{version: DTLS_12}
+	c.currentReadState.AEAD = aeadAESGCM(clientKey, []byte{1, 2, 3, 4})
+	sealed := c.sealRecord(&c.currentReadState, typeApplicationData, 1, 5, payload)
+	if len(sealed) != 8+len(payload)+16 {
+		t.Fatalf("Expected explicit nonce, ciphertext and tag but got %d bytes", len(sealed))
+	}
+	if !bytes.Equal(sealed[:8], []byte{0, 1, 0, 0, 0, 0, 0, 5}) {
+		t.Errorf("Expected epoch and sequence number as explicit nonce but got %x", sealed[:8])
+	}
+	rec := &record{Type: typeApplicationData, Epoch: 1, SequenceNumber: 5, Payload: append([]byte{}, sealed...)}
+	if opened, err := c.openRecord(rec); err != nil || !bytes.Equal(opened, payload) {
+		t.Errorf("Unable to open sealed record: %v", err)
+	}
+	// The sequence number is authenticated as part of the additional data.
+	rec = &record{Type: typeApplicationData, Epoch: 1, SequenceNumber: 6, Payload: append([]byte{}, sealed...)}
+	if _, err := c.openRecord(rec); err == nil {
+		t.Errorf("Opened record with wrong sequence number")
+	}
+	tampered := append([]byte{}, sealed...)
+	tampered[10] ^= 1
+	rec = &record{Type: typeApplicationData, Epoch: 1, SequenceNumber: 5, Payload: tampered}
+	if _, err := c.openRecord(rec); err == nil {
+		t.Errorf("Opened tampered record")
+	} else if alertErr, ok := err.(*AlertError); !ok || alertErr.Description != AlertBadRecordMAC {
+		t.Errorf("Expected bad_record_mac but got %v", err)
+	}
+}
+
+func TestSealRecordChaCha20Poly1305(t *testing.T) {
+	key := make([]byte, 32)
+	fixedNonce := hexToBytes("000102030405060708090a0b")
+	c := &Conn{version: DTLS_12}
+	c.currentReadState.AEAD = aeadChaCha20Poly1305(key, fixedNonce)
+	sealed := c.sealRecord(&c.currentReadState, typeApplicationData, 1, 5, payload)
+	if len(sealed) != len(payload)+16 {
+		t.Fatalf("Expected ciphertext and tag without explicit nonce but got %d bytes", len(sealed))
+	}
+	// The nonce is the fixed IV XORed with the padded epoch and sequence
+	// number, RFC 7905 section 2.
+	chacha, _ := chacha20poly1305.New(key)
+	nonce := hexToBytes("000102030404060708090a0e")
+	expected := chacha.Seal(nil, nonce, payload, c.additionalData(nil, typeApplicationData, []byte{0, 1, 0, 0, 0, 0, 0, 5}, len(payload)))
+	if !bytes.Equal(sealed, expected) {
+		t.Errorf("Record was not sealed with the RFC 7905 nonce")
+	}
+	rec := &record{Type: typeApplicationData, Epoch: 1, SequenceNumber: 5, Payload: sealed}
+	if opened, err := c.openRecord(rec); err != nil || !bytes.Equal(opened, payload) {
+		t.Errorf("Unable to open sealed record: %v", err)
+	}
+}
+
 func hexToBytes(h string) (b []byte) {
 	b, err := hex.DecodeString(h)
 	if err != nil {
@@ -43,3 +113,1897 @@ func hexToBytes(h string) (b []byte) {
 	}
 	return
 }
+
+var (
+	testCertificatesOnce sync.Once
+	testECDSACertificate tls.Certificate
+	testRSACertificate   tls.Certificate
+	testCertificatesPool *x509.CertPool
+)
+
+// testCertificate creates a self-signed certificate for localhost.
+func testCertificate(commonName string, key crypto.Signer) tls.Certificate {
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		panic(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func testCertificates() {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	testECDSACertificate = testCertificate("ECDSA test", ecdsaKey)
+	testRSACertificate = testCertificate("RSA test", rsaKey)
+	testCertificatesPool = x509.NewCertPool()
+	testCertificatesPool.AddCert(testECDSACertificate.Leaf)
+	testCertificatesPool.AddCert(testRSACertificate.Leaf)
+}
+
+// testConfig returns a config for both sides of a connection on the
+// loopback interface, with certificates that are trusted by each other.
+func testConfig() *Config {
+	testCertificatesOnce.Do(testCertificates)
+	return &Config{
+		Certificates:     []tls.Certificate{testECDSACertificate, testRSACertificate},
+		RootCAs:          testCertificatesPool,
+		ServerName:       "localhost",
+		PSKIdentity:      []byte("test client"),
+		PSK:              testPSK,
+		GetPSK:           testGetPSK,
+		Logger:           log.New(ioutil.Discard, "", 0),
+		HandshakeTimeout: 5 * time.Second,
+	}
+}
+
+var testPSK = []byte("0123456789abcdef")
+
+func testGetPSK(identity []byte) ([]byte, error) {
+	if string(identity) != "test client" {
+		return nil, errors.New("Unknown identity")
+	}
+	return testPSK, nil
+}
+
+// startEchoServer runs a Listener on the loopback interface which echoes
+// everything its connections read.
+func startEchoServer(t *testing.T, config *Config) *Listener {
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen on loopback: %s", err)
+	}
+	return startEchoServerOn(pc, config)
+}
+
+func startEchoServerOn(pc net.PacketConn, config *Config) *Listener {
+	listener := NewListener(pc, config)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buffer := make([]byte, UDP_MAX_SIZE)
+				for {
+					n, err := conn.Read(buffer)
+					if err != nil {
+						return
+					}
+					if _, err = conn.Write(buffer[:n]); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return listener
+}
+
+func dialLoopback(t *testing.T, addr net.Addr) *net.UDPConn {
+	conn, err := net.DialUDP("udp", nil, addr.(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Unable to dial %s: %s", addr, err)
+	}
+	return conn
+}
+
+func testEcho(t *testing.T, conn net.Conn, message string) {
+	if _, err := conn.Write([]byte(message)); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	buffer := make([]byte, UDP_MAX_SIZE)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+	if string(buffer[:n]) != message {
+		t.Errorf("Expected echo %q but read %q", message, buffer[:n])
+	}
+}
+
+func TestClientServerEcho(t *testing.T) {
+	for _, suite := range cipherSuites {
+		for _, version := range []uint16{VersionDTLS10, VersionDTLS12, VersionDTLS13} {
+			if !suite.supportsVersion(versionFromUint16(version)) {
+				continue
+			}
+			serverConfig := testConfig()
+			serverConfig.CipherSuites = []uint16{uint16(suite.id)}
+			serverConfig.MaxVersion = VersionDTLS13
+			listener := startEchoServer(t, serverConfig)
+			clientConfig := testConfig()
+			clientConfig.CipherSuites = []uint16{uint16(suite.id)}
+			clientConfig.MaxVersion = version
+			conn := Client(dialLoopback(t, listener.Addr()), clientConfig)
+			testEcho(t, conn, "Hello World")
+			if conn.version != versionFromUint16(version) {
+				t.Errorf("Expected version %s but negotiated %s", versionFromUint16(version), conn.version)
+			}
+			conn.Close()
+			listener.Close()
+		}
+	}
+}
+
+func TestVersionMismatch(t *testing.T) {
+	serverConfig := testConfig()
+	serverConfig.MinVersion = VersionDTLS12
+	listener := startEchoServer(t, serverConfig)
+	defer listener.Close()
+	clientConfig := testConfig()
+	clientConfig.MaxVersion = VersionDTLS10
+	clientConfig.HandshakeTimeout = 500 * time.Millisecond
+	conn := Client(dialLoopback(t, listener.Addr()), clientConfig)
+	defer conn.Close()
+	_, err := conn.Write([]byte("Hello World"))
+	expectAlert(t, err, AlertProtocolVersion)
+}
+
+func TestNoCommonCipherSuite(t *testing.T) {
+	serverConfig := testConfig()
+	serverConfig.CipherSuites = []uint16{TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA}
+	listener := startEchoServer(t, serverConfig)
+	defer listener.Close()
+	clientConfig := testConfig()
+	clientConfig.CipherSuites = []uint16{TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA}
+	conn := Client(dialLoopback(t, listener.Addr()), clientConfig)
+	defer conn.Close()
+	_, err := conn.Write([]byte("Hello World"))
+	expectAlert(t, err, AlertHandshakeFailure)
+	if _, readErr := conn.Read(make([]byte, 10)); readErr != err {
+		t.Errorf("Expected the alert again after a fatal alert but got %v", readErr)
+	}
+}
+
+func TestDTLS12OnlySuites(t *testing.T) {
+	serverConfig := testConfig()
+	serverConfig.CipherSuites = []uint16{uint16(TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256)}
+	listener := startEchoServer(t, serverConfig)
+	defer listener.Close()
+	clientConfig := testConfig()
+	clientConfig.MaxVersion = VersionDTLS10
+	conn := Client(dialLoopback(t, listener.Addr()), clientConfig)
+	defer conn.Close()
+	_, err := conn.Write([]byte("Hello World"))
+	expectAlert(t, err, AlertHandshakeFailure)
+}
+
+func TestCipherSuitePreference(t *testing.T) {
+	suite := func(id cipherSuiteId) *cipherSuite {
+		for _, s := range cipherSuites {
+			if s.id == id {
+				return s
+			}
+		}
+		t.Fatalf("Unknown cipher suite %s", cipherSuite{id: id})
+		return nil
+	}
+	gcm := suite(TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256)
+	chacha := suite(TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256)
+	cbc := suite(TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA)
+	server := []*cipherSuite{gcm, chacha, cbc}
+	for _, test := range []struct {
+		name     string
+		client   []*cipherSuite
+		expected *cipherSuite
+	}{
+		{"server preference", []*cipherSuite{cbc, gcm, chacha}, gcm},
+		{"client prefers AES", []*cipherSuite{gcm, chacha}, gcm},
+		{"client prefers ChaCha20", []*cipherSuite{chacha, gcm}, chacha},
+		{"client prefers ChaCha20 over other AEADs", []*cipherSuite{cbc, chacha, gcm}, chacha},
+		{"client only has CBC", []*cipherSuite{cbc}, cbc},
+	} {
+		if selected := findCommonCipherSuite(test.client, server); selected != test.expected {
+			t.Errorf("%s: expected %s but selected %s", test.name, test.expected, selected)
+		}
+	}
+}
+
+func TestCloseNotify(t *testing.T) {
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen on loopback: %s", err)
+	}
+	listener := NewListener(pc, testConfig())
+	defer listener.Close()
+	serverErrors := make(chan error, 2)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			serverErrors <- err
+			return
+		}
+		buffer := make([]byte, UDP_MAX_SIZE)
+		n, err := conn.Read(buffer)
+		if err == nil {
+			_, err = conn.Write(buffer[:n])
+		}
+		if err == nil {
+			_, err = conn.Read(buffer)
+		}
+		serverErrors <- err
+		_, err = conn.Write([]byte("Too late"))
+		serverErrors <- err
+	}()
+	conn := Client(dialLoopback(t, listener.Addr()), testConfig())
+	testEcho(t, conn, "Hello World")
+	if err := conn.Close(); err != nil {
+		t.Fatalf("Close failed: %s", err)
+	}
+	if _, err := conn.Write([]byte("Hello World")); err != ConnClosedError {
+		t.Errorf("Expected write after close to fail with ConnClosedError but got %v", err)
+	}
+	if err := <-serverErrors; err != io.EOF {
+		t.Errorf("Expected server to read io.EOF after close_notify but got %v", err)
+	}
+	if err := <-serverErrors; err != ConnClosedError {
+		t.Errorf("Expected server write after close_notify to fail with ConnClosedError but got %v", err)
+	}
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+	if len(listener.connections) != 0 {
+		t.Errorf("Listener kept the state of a closed connection")
+	}
+}
+
+func TestServerCertificateVerification(t *testing.T) {
+	listener := startEchoServer(t, testConfig())
+	defer listener.Close()
+	for _, test := range []struct {
+		name        string
+		configure   func(*Config)
+		description AlertDescription
+	}{
+		{"unknown CA", func(c *Config) { c.RootCAs = x509.NewCertPool() }, AlertUnknownCA},
+		{"wrong server name", func(c *Config) { c.ServerName = "example.com" }, AlertBadCertificate},
+		{"no server name", func(c *Config) { c.ServerName = "" }, AlertInternalError},
+	} {
+		config := testConfig()
+		test.configure(config)
+		conn := Client(dialLoopback(t, listener.Addr()), config)
+		err := conn.Handshake()
+		if alertErr, ok := err.(*AlertError); !ok || alertErr.Remote || alertErr.Description != test.description {
+			t.Errorf("%s: expected to send alert %s but got %v", test.name, test.description, err)
+		}
+		conn.Close()
+	}
+
+	config := testConfig()
+	config.RootCAs = x509.NewCertPool()
+	config.InsecureSkipVerify = true
+	conn := Client(dialLoopback(t, listener.Addr()), config)
+	defer conn.Close()
+	testEcho(t, conn, "Hello World")
+}
+
+// handshakeWithListener runs a handshake between a client with
+// clientConfig and a Listener with serverConfig and returns both sides of
+// the connection and their handshake errors.
+func handshakeWithListener(t *testing.T, clientConfig, serverConfig *Config) (client, server *Conn, clientErr, serverErr error) {
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen on loopback: %s", err)
+	}
+	listener := NewListener(pc, serverConfig)
+	defer listener.Close()
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			accepted <- err
+			return
+		}
+		server = conn.(*Conn)
+		accepted <- server.Handshake()
+	}()
+	client = Client(dialLoopback(t, listener.Addr()), clientConfig)
+	clientErr = client.Handshake()
+	serverErr = <-accepted
+	return
+}
+
+func TestClientCertificate(t *testing.T) {
+	testCertificatesOnce.Do(testCertificates)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The impostor has the name of a trusted certificate, so the client
+	// sends it, but it does not verify.
+	impostor := testCertificate("ECDSA test", key)
+	otherPool := x509.NewCertPool()
+	otherPool.AddCert(testCertificate("other", key).Leaf)
+	for _, test := range []struct {
+		name         string
+		clientAuth   ClientAuthType
+		clientCAs    *x509.CertPool
+		certificates []tls.Certificate
+		version      uint16
+		description  AlertDescription
+		authorized   bool
+	}{
+		{"not requested", NoClientCert, nil, []tls.Certificate{testECDSACertificate}, VersionDTLS12, 0, false},
+		{"requested without certificate", RequestClientCert, nil, nil, VersionDTLS12, 0, false},
+		{"requested impostor", RequestClientCert, testCertificatesPool, []tls.Certificate{impostor}, VersionDTLS12, 0, true},
+		{"required without certificate", RequireAnyClientCert, nil, nil, VersionDTLS12, AlertHandshakeFailure, false},
+		{"verified if given without certificate", VerifyClientCertIfGiven, testCertificatesPool, nil, VersionDTLS12, 0, false},
+		{"verified if given impostor", VerifyClientCertIfGiven, testCertificatesPool, []tls.Certificate{impostor}, VersionDTLS12, AlertUnknownCA, false},
+		{"verified ECDSA", RequireAndVerifyClientCert, testCertificatesPool, []tls.Certificate{testECDSACertificate}, VersionDTLS12, 0, true},
+		{"verified RSA", RequireAndVerifyClientCert, testCertificatesPool, []tls.Certificate{testRSACertificate}, VersionDTLS12, 0, true},
+		{"verified ECDSA DTLS 1.0", RequireAndVerifyClientCert, testCertificatesPool, []tls.Certificate{testECDSACertificate}, VersionDTLS10, 0, true},
+		{"verified RSA DTLS 1.0", RequireAndVerifyClientCert, testCertificatesPool, []tls.Certificate{testRSACertificate}, VersionDTLS10, 0, true},
+		{"requested without certificate DTLS 1.3", RequestClientCert, nil, nil, VersionDTLS13, 0, false},
+		{"required without certificate DTLS 1.3", RequireAnyClientCert, nil, nil, VersionDTLS13, AlertHandshakeFailure, false},
+		{"verified ECDSA DTLS 1.3", RequireAndVerifyClientCert, testCertificatesPool, []tls.Certificate{testECDSACertificate}, VersionDTLS13, 0, true},
+		{"verified RSA DTLS 1.3", RequireAndVerifyClientCert, testCertificatesPool, []tls.Certificate{testRSACertificate}, VersionDTLS13, 0, true},
+		// The client has no certificate from the CAs the server named.
+		{"other authority", RequireAndVerifyClientCert, otherPool, []tls.Certificate{testECDSACertificate}, VersionDTLS12, AlertHandshakeFailure, false},
+	} {
+		serverConfig := testConfig()
+		serverConfig.MaxVersion = VersionDTLS13
+		serverConfig.ClientAuth = test.clientAuth
+		serverConfig.ClientCAs = test.clientCAs
+		clientConfig := testConfig()
+		clientConfig.Certificates = test.certificates
+		clientConfig.MaxVersion = test.version
+		client, server, clientErr, serverErr := handshakeWithListener(t, clientConfig, serverConfig)
+		if test.description != 0 && test.version == VersionDTLS13 && clientErr == nil {
+			// A DTLS 1.3 client completes the handshake before the
+			// server checks its flight, the next read gets the alert.
+			_, clientErr = client.Read(make([]byte, 1))
+		}
+		if test.description != 0 {
+			if alertErr, ok := serverErr.(*AlertError); !ok || alertErr.Remote || alertErr.Description != test.description {
+				t.Errorf("%s: expected server to send alert %s but got %v", test.name, test.description, serverErr)
+			}
+			if alertErr, ok := clientErr.(*AlertError); !ok || !alertErr.Remote || alertErr.Description != test.description {
+				t.Errorf("%s: expected client to receive alert %s but got %v", test.name, test.description, clientErr)
+			}
+		} else if clientErr != nil || serverErr != nil {
+			t.Errorf("%s: handshake failed with %v on the client and %v on the server", test.name, clientErr, serverErr)
+		} else if peerCertificates := server.PeerCertificates(); test.authorized != (len(peerCertificates) == 1) {
+			t.Errorf("%s: expected client certificate %v but server got %d certificates", test.name, test.authorized, len(peerCertificates))
+		} else if test.authorized && !bytes.Equal(peerCertificates[0].Raw, test.certificates[0].Certificate[0]) {
+			t.Errorf("%s: server got the wrong client certificate", test.name)
+		}
+		client.Close()
+		if server != nil {
+			server.Close()
+		}
+	}
+}
+
+func TestPSK(t *testing.T) {
+	tests := []struct {
+		suite    uint16
+		hint     string
+		identity string
+		psk      []byte
+		alert    AlertDescription
+	}{
+		{TLS_PSK_WITH_AES_128_CCM_8, "", "test client", testPSK, 0},
+		{TLS_PSK_WITH_AES_128_CCM_8, "sensors", "test client", testPSK, 0},
+		{TLS_ECDHE_PSK_WITH_AES_128_CBC_SHA256, "", "test client", testPSK, 0},
+		{TLS_ECDHE_PSK_WITH_AES_128_CBC_SHA256, "sensors", "test client", testPSK, 0},
+		{TLS_PSK_WITH_AES_128_CCM_8, "", "unknown", testPSK, AlertUnknownPSKIdentity},
+		{TLS_PSK_WITH_AES_128_CCM_8, "", "test client", []byte("wrong key"), AlertBadRecordMAC},
+		{TLS_ECDHE_PSK_WITH_AES_128_CBC_SHA256, "", "test client", []byte("wrong key"), AlertBadRecordMAC},
+	}
+	for i, test := range tests {
+		serverConfig := testConfig()
+		serverConfig.CipherSuites = []uint16{test.suite}
+		serverConfig.PSKIdentityHint = []byte(test.hint)
+		clientConfig := testConfig()
+		clientConfig.CipherSuites = []uint16{test.suite}
+		clientConfig.PSKIdentity = []byte(test.identity)
+		clientConfig.PSK = test.psk
+		client, server, clientErr, serverErr := handshakeWithListener(t, clientConfig, serverConfig)
+		if test.alert != 0 {
+			if serverErr == nil {
+				t.Errorf("Test %d: expected the handshake to fail", i)
+			}
+			expectAlert(t, clientErr, test.alert)
+			continue
+		}
+		if clientErr != nil || serverErr != nil {
+			t.Errorf("Test %d: handshake failed: %v, %v", i, clientErr, serverErr)
+			continue
+		}
+		if string(server.PSKIdentity()) != test.identity {
+			t.Errorf("Test %d: expected identity %q but got %q", i, test.identity, server.PSKIdentity())
+		}
+		if len(client.PeerCertificates()) != 0 || len(server.PeerCertificates()) != 0 {
+			t.Errorf("Test %d: expected no certificates in a PSK handshake", i)
+		}
+	}
+}
+
+func TestPSKSuitesNeedKeys(t *testing.T) {
+	serverConfig := testConfig()
+	serverConfig.CipherSuites = []uint16{TLS_PSK_WITH_AES_128_CCM_8, TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8}
+	clientConfig := testConfig()
+	clientConfig.CipherSuites = serverConfig.CipherSuites
+	clientConfig.PSK = nil
+	client, server, clientErr, serverErr := handshakeWithListener(t, clientConfig, serverConfig)
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("Handshake failed: %v, %v", clientErr, serverErr)
+	}
+	if len(client.PeerCertificates()) == 0 {
+		t.Errorf("Expected a certificate suite without a client key")
+	}
+	if server.PSKIdentity() != nil {
+		t.Errorf("Expected no PSK identity but got %q", server.PSKIdentity())
+	}
+
+	serverConfig.GetPSK = nil
+	clientConfig.PSK = testPSK
+	clientConfig.CipherSuites = []uint16{TLS_PSK_WITH_AES_128_CCM_8}
+	_, _, clientErr, _ = handshakeWithListener(t, clientConfig, serverConfig)
+	expectAlert(t, clientErr, AlertHandshakeFailure)
+}
+
+func TestSessionResumption(t *testing.T) {
+	for _, test := range []struct {
+		suite   uint16
+		version uint16
+	}{
+		{TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, VersionDTLS12},
+		{TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA, VersionDTLS10},
+		{TLS_PSK_WITH_AES_128_CCM_8, VersionDTLS12},
+	} {
+		serverConfig := testConfig()
+		serverConfig.CipherSuites = []uint16{test.suite}
+		listener := startEchoServer(t, serverConfig)
+		clientConfig := testConfig()
+		clientConfig.CipherSuites = []uint16{test.suite}
+		clientConfig.MaxVersion = test.version
+		clientConfig.ClientSessionCache = NewLRUClientSessionCache(0)
+		var peerCertificates int
+		for i := 0; i < 3; i++ {
+			conn := Client(dialLoopback(t, listener.Addr()), clientConfig)
+			testEcho(t, conn, "Hello World")
+			if resumed := conn.DidResume(); resumed != (i > 0) {
+				t.Errorf("%s, connection %d: expected resumed to be %v", cipherSuite{id: cipherSuiteId(test.suite)}, i, i > 0)
+			}
+			if i == 0 {
+				peerCertificates = len(conn.PeerCertificates())
+			} else if len(conn.PeerCertificates()) != peerCertificates {
+				t.Errorf("%s: expected the peer certificates of the session", cipherSuite{id: cipherSuiteId(test.suite)})
+			}
+			conn.Close()
+		}
+		listener.Close()
+	}
+}
+
+func TestSessionResumptionUnknownSession(t *testing.T) {
+	clientConfig := testConfig()
+	clientConfig.ClientSessionCache = NewLRUClientSessionCache(0)
+	first := startEchoServer(t, testConfig())
+	conn := Client(dialLoopback(t, first.Addr()), clientConfig)
+	testEcho(t, conn, "Hello World")
+	conn.Close()
+	first.Close()
+
+	// Another server does not know the session, so the client falls back
+	// to a full handshake and caches the new session instead.
+	second := startEchoServer(t, testConfig())
+	defer second.Close()
+	for i, expected := range []bool{false, true} {
+		conn := Client(dialLoopback(t, second.Addr()), clientConfig)
+		testEcho(t, conn, "Hello World")
+		if conn.DidResume() != expected {
+			t.Errorf("Connection %d: expected resumed to be %v", i, expected)
+		}
+		conn.Close()
+	}
+}
+
+func TestSessionResumptionRetransmission(t *testing.T) {
+	defer func(timeout time.Duration) { initialRetransmitTimeout = timeout }(initialRetransmitTimeout)
+	initialRetransmitTimeout = 50 * time.Millisecond
+
+	listener := startEchoServer(t, testConfig())
+	defer listener.Close()
+	clientConfig := testConfig()
+	clientConfig.ClientSessionCache = NewLRUClientSessionCache(0)
+	conn := Client(dialLoopback(t, listener.Addr()), clientConfig)
+	testEcho(t, conn, "Hello World")
+	conn.Close()
+
+	// The last flight of the client, which completes the abbreviated
+	// handshake, is lost. The server retransmits its flight and the client
+	// answers while it reads.
+	conn = Client(&lossyConn{Conn: dialLoopback(t, listener.Addr()), drop: map[int]bool{2: true}}, clientConfig)
+	defer conn.Close()
+	if err := conn.Handshake(); err != nil {
+		t.Fatalf("Handshake failed: %s", err)
+	}
+	if !conn.DidResume() {
+		t.Fatalf("Expected the session to be resumed")
+	}
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 10)); err == nil {
+		t.Fatalf("Expected no data before the server completed the handshake")
+	}
+	conn.SetReadDeadline(time.Time{})
+	testEcho(t, conn, "Hello World")
+}
+
+func TestSessionTickets(t *testing.T) {
+	// Two servers sharing their ticket keys resume each other's sessions,
+	// although neither has the session in its cache.
+	keys := [][32]byte{{1}}
+	var listeners []*Listener
+	for i := 0; i < 2; i++ {
+		serverConfig := testConfig()
+		serverConfig.SetSessionTicketKeys(keys)
+		listener := startEchoServer(t, serverConfig)
+		defer listener.Close()
+		listeners = append(listeners, listener)
+	}
+	for _, version := range []uint16{VersionDTLS12, VersionDTLS10} {
+		clientConfig := testConfig()
+		clientConfig.MaxVersion = version
+		clientConfig.ClientSessionCache = NewLRUClientSessionCache(0)
+		for i, listener := range []*Listener{listeners[0], listeners[1], listeners[0]} {
+			conn := Client(dialLoopback(t, listener.Addr()), clientConfig)
+			testEcho(t, conn, "Hello World")
+			if resumed := conn.DidResume(); resumed != (i > 0) {
+				t.Errorf("Version %x, connection %d: expected resumed to be %v", version, i, i > 0)
+			}
+			if len(conn.PeerCertificates()) == 0 {
+				t.Errorf("Version %x, connection %d: expected the peer certificates of the session", version, i)
+			}
+			conn.Close()
+		}
+	}
+}
+
+func TestSessionTicketKeyRotation(t *testing.T) {
+	serverConfig := testConfig()
+	serverConfig.SetSessionTicketKeys([][32]byte{{1}})
+	listener := startEchoServer(t, serverConfig)
+	defer listener.Close()
+	clientConfig := testConfig()
+	clientConfig.CipherSuites = []uint16{TLS_PSK_WITH_AES_128_CCM_8}
+	clientConfig.ClientSessionCache = NewLRUClientSessionCache(0)
+	for i, test := range []struct {
+		keys    [][32]byte
+		tamper  bool
+		resumed bool
+	}{
+		{keys: [][32]byte{{1}}},
+		// The old key still opens the ticket, which is replaced by one
+		// sealed with the new key.
+		{keys: [][32]byte{{2}, {1}}, resumed: true},
+		{keys: [][32]byte{{2}}, resumed: true},
+		{keys: [][32]byte{{3}}},
+		{keys: [][32]byte{{3}}, tamper: true},
+		{keys: [][32]byte{{3}}, resumed: true},
+	} {
+		serverConfig.SetSessionTicketKeys(test.keys)
+		if test.tamper {
+			session, _ := clientConfig.ClientSessionCache.Get("localhost")
+			session.ticket[len(session.ticket)-1] ^= 1
+		}
+		conn := Client(dialLoopback(t, listener.Addr()), clientConfig)
+		testEcho(t, conn, "Hello World")
+		if conn.DidResume() != test.resumed {
+			t.Errorf("Connection %d: expected resumed to be %v", i, test.resumed)
+		}
+		conn.Close()
+	}
+}
+
+func TestExtendedMasterSecret(t *testing.T) {
+	serverConfig := testConfig()
+	serverConfig.RequireExtendedMasterSecret = true
+	listener := startEchoServer(t, serverConfig)
+	defer listener.Close()
+	clientConfig := testConfig()
+	clientConfig.ClientSessionCache = NewLRUClientSessionCache(0)
+	for i, version := range []uint16{VersionDTLS12, VersionDTLS10, VersionDTLS10} {
+		clientConfig.MaxVersion = version
+		conn := Client(dialLoopback(t, listener.Addr()), clientConfig)
+		testEcho(t, conn, "Hello World")
+		if !conn.extendedMasterSecret {
+			t.Errorf("Connection %d: expected the extended master secret", i)
+		}
+		if conn.DidResume() != (i == 2) {
+			t.Errorf("Connection %d: expected resumed to be %v", i, i == 2)
+		}
+		conn.Close()
+	}
+
+	// The server does not resume a session without the extended master
+	// secret when the client offers it.
+	session, _ := clientConfig.ClientSessionCache.Get("localhost")
+	value, _ := listener.sessions.get(string(session.sessionID))
+	serverSession := *value.(*sessionState)
+	serverSession.extendedMasterSecret = false
+	listener.sessions.put(string(session.sessionID), &serverSession)
+	conn := Client(dialLoopback(t, listener.Addr()), clientConfig)
+	testEcho(t, conn, "Hello World")
+	if conn.DidResume() {
+		t.Errorf("Expected a full handshake for a session without the extended master secret")
+	}
+	conn.Close()
+
+	// The client aborts if the server resumes a session with a different
+	// setting.
+	session, _ = clientConfig.ClientSessionCache.Get("localhost")
+	clientSession := *session
+	clientSession.session.extendedMasterSecret = false
+	clientConfig.ClientSessionCache.Put("localhost", &clientSession)
+	conn = Client(dialLoopback(t, listener.Addr()), clientConfig)
+	defer conn.Close()
+	err := conn.Handshake()
+	if alertErr, ok := err.(*AlertError); !ok || alertErr.Description != AlertHandshakeFailure {
+		t.Errorf("Expected handshake_failure but got %v", err)
+	}
+}
+
+func TestEncryptThenMAC(t *testing.T) {
+	listener := startEchoServer(t, testConfig())
+	defer listener.Close()
+	for _, test := range []struct {
+		suite          uint16
+		version        uint16
+		encryptThenMAC bool
+	}{
+		{TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256, VersionDTLS12, true},
+		{TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA, VersionDTLS10, true},
+		{TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, VersionDTLS12, false},
+	} {
+		clientConfig := testConfig()
+		clientConfig.CipherSuites = []uint16{test.suite}
+		clientConfig.MaxVersion = test.version
+		clientConfig.ClientSessionCache = NewLRUClientSessionCache(0)
+		// The resumed session negotiates it again.
+		for i := 0; i < 2; i++ {
+			conn := Client(dialLoopback(t, listener.Addr()), clientConfig)
+			testEcho(t, conn, "Hello World")
+			if conn.currentWriteState.encryptThenMAC != test.encryptThenMAC || conn.currentReadState.encryptThenMAC != test.encryptThenMAC {
+				t.Errorf("%s, connection %d: expected encrypt-then-MAC to be %v", cipherSuite{id: cipherSuiteId(test.suite)}, i, test.encryptThenMAC)
+			}
+			if conn.DidResume() != (i == 1) {
+				t.Errorf("%s, connection %d: expected resumed to be %v", cipherSuite{id: cipherSuiteId(test.suite)}, i, i == 1)
+			}
+			conn.Close()
+		}
+	}
+}
+
+// rebindingConn moves to a new local port when rebind is called, like a
+// client behind a NAT that assigned it a new binding.
+type rebindingConn struct {
+	*net.UDPConn
+	t *testing.T
+}
+
+func (c *rebindingConn) rebind() {
+	conn := dialLoopback(c.t, c.RemoteAddr())
+	c.UDPConn.Close()
+	c.UDPConn = conn
+}
+
+func TestConnectionID(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		serverConfig := testConfig()
+		serverConfig.DisableConnectionIDs = disabled
+		listener := startEchoServer(t, serverConfig)
+		rebinding := &rebindingConn{dialLoopback(t, listener.Addr()), t}
+		conn := Client(rebinding, testConfig())
+		testEcho(t, conn, "Before")
+		if (len(conn.currentWriteState.connectionID) > 0) == disabled {
+			t.Errorf("Expected connection IDs to be used %v with them disabled %v", !disabled, disabled)
+		}
+		rebinding.rebind()
+		if _, err := conn.Write([]byte("After")); err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+		// Without a connection ID the server does not know the new address.
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		buffer := make([]byte, UDP_MAX_SIZE)
+		n, err := conn.Read(buffer)
+		if disabled {
+			if err == nil {
+				t.Errorf("Expected no echo without connection IDs but read %q", buffer[:n])
+			}
+		} else if err != nil {
+			t.Errorf("Read after the move failed: %s", err)
+		} else if string(buffer[:n]) != "After" {
+			t.Errorf("Expected echo %q but read %q", "After", buffer[:n])
+		}
+		if !disabled {
+			listener.mutex.Lock()
+			_, ok := listener.connections[rebinding.LocalAddr().String()]
+			listener.mutex.Unlock()
+			if !ok {
+				t.Errorf("Expected the listener to know the new address of the client")
+			}
+		}
+		conn.Close()
+		listener.Close()
+	}
+}
+
+func TestRenegotiation(t *testing.T) {
+	serverConfig := testConfig()
+	serverConfig.Renegotiation = RenegotiateFreelyAsClient
+	listener := startEchoServer(t, serverConfig)
+	defer listener.Close()
+	for _, version := range []uint16{VersionDTLS12, VersionDTLS10} {
+		clientConfig := testConfig()
+		clientConfig.MaxVersion = version
+		clientConfig.Renegotiation = RenegotiateFreelyAsClient
+		conn := Client(dialLoopback(t, listener.Addr()), clientConfig)
+		testEcho(t, conn, "Before renegotiation")
+		for i := 0; i < 2; i++ {
+			if err := conn.Renegotiate(); err != nil {
+				t.Fatalf("Version %x: renegotiation %d failed: %s", version, i, err)
+			}
+			testEcho(t, conn, "After renegotiation")
+		}
+		if conn.epoch != 3 || conn.readEpoch != 3 {
+			t.Errorf("Version %x: expected epoch 3 after two renegotiations, got %d and %d", version, conn.epoch, conn.readEpoch)
+		}
+		conn.Close()
+	}
+}
+
+func TestRenegotiationPolicy(t *testing.T) {
+	for _, test := range []struct {
+		client, server RenegotiationSupport
+		expected       []error
+	}{
+		{RenegotiateNever, RenegotiateFreelyAsClient, []error{RenegotiationNotAllowedError}},
+		{RenegotiateFreelyAsClient, RenegotiateNever, []error{RenegotiationRefusedError}},
+		{RenegotiateOnceAsClient, RenegotiateFreelyAsClient, []error{nil, RenegotiationNotAllowedError}},
+		{RenegotiateFreelyAsClient, RenegotiateOnceAsClient, []error{nil, RenegotiationRefusedError, RenegotiationRefusedError}},
+	} {
+		serverConfig := testConfig()
+		serverConfig.Renegotiation = test.server
+		listener := startEchoServer(t, serverConfig)
+		clientConfig := testConfig()
+		clientConfig.Renegotiation = test.client
+		conn := Client(dialLoopback(t, listener.Addr()), clientConfig)
+		testEcho(t, conn, "Hello World")
+		for i, expected := range test.expected {
+			if err := conn.Renegotiate(); err != expected {
+				t.Errorf("Client policy %d, server policy %d, renegotiation %d: expected %v but got %v", test.client, test.server, i, expected, err)
+			}
+			// A declined renegotiation keeps the connection.
+			testEcho(t, conn, "Hello World")
+		}
+		conn.Close()
+		listener.Close()
+	}
+}
+
+func TestServerRenegotiation(t *testing.T) {
+	for _, test := range []struct {
+		client   RenegotiationSupport
+		expected error
+	}{
+		{RenegotiateOnceAsClient, nil},
+		{RenegotiateNever, RenegotiationRefusedError},
+	} {
+		pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("Unable to listen on loopback: %s", err)
+		}
+		serverConfig := testConfig()
+		serverConfig.Renegotiation = RenegotiateFreelyAsClient
+		listener := NewListener(pc, serverConfig)
+		accepted := make(chan *Conn, 1)
+		go func() {
+			if conn, err := listener.Accept(); err == nil && conn.(*Conn).Handshake() == nil {
+				accepted <- conn.(*Conn)
+			}
+			close(accepted)
+		}()
+		clientConfig := testConfig()
+		clientConfig.Renegotiation = test.client
+		client := Client(dialLoopback(t, listener.Addr()), clientConfig)
+		if err := client.Handshake(); err != nil {
+			t.Fatalf("Handshake failed: %s", err)
+		}
+		server, ok := <-accepted
+		if !ok {
+			t.Fatalf("Server handshake failed")
+		}
+
+		// The client answers the HelloRequest while it reads.
+		read := make(chan string, 1)
+		go func() {
+			buffer := make([]byte, UDP_MAX_SIZE)
+			n, _ := client.Read(buffer)
+			read <- string(buffer[:n])
+		}()
+		if err := server.Renegotiate(); err != test.expected {
+			t.Errorf("Client policy %d: expected %v but got %v", test.client, test.expected, err)
+		}
+		if _, err := server.Write([]byte("Hello World")); err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+		if message := <-read; message != "Hello World" {
+			t.Errorf("Client policy %d: expected to read the message after the renegotiation, got %q", test.client, message)
+		}
+		expectedEpoch := uint16(2)
+		if test.expected != nil {
+			expectedEpoch = 1
+		}
+		if client.readEpoch != expectedEpoch {
+			t.Errorf("Client policy %d: expected epoch %d, got %d", test.client, expectedEpoch, client.readEpoch)
+		}
+		client.Close()
+		listener.Close()
+	}
+}
+
+func TestWriteDuringRenegotiation(t *testing.T) {
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen on loopback: %s", err)
+	}
+	serverConfig := testConfig()
+	serverConfig.Renegotiation = RenegotiateFreelyAsClient
+	serverConfig.HandshakeTimeout = 3 * time.Second
+	listener := NewListener(pc, serverConfig)
+	defer listener.Close()
+	accepted := make(chan *Conn, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil && conn.(*Conn).Handshake() == nil {
+			accepted <- conn.(*Conn)
+		}
+		close(accepted)
+	}()
+	client := Client(dialLoopback(t, listener.Addr()), testConfig())
+	defer client.Close()
+	if err := client.Handshake(); err != nil {
+		t.Fatalf("Handshake failed: %s", err)
+	}
+	server, ok := <-accepted
+	if !ok {
+		t.Fatalf("Server handshake failed")
+	}
+
+	// The renegotiation stalls until the client reads the HelloRequest.
+	renegotiated := make(chan error, 1)
+	go func() {
+		renegotiated <- server.Renegotiate()
+	}()
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	if _, err := server.Write([]byte("Hello World")); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Write waited %s for the renegotiation", elapsed)
+	}
+	buffer := make([]byte, UDP_MAX_SIZE)
+	if n, err := client.Read(buffer); err != nil || string(buffer[:n]) != "Hello World" {
+		t.Errorf("Expected to read the message written during the renegotiation, got %q, %v", buffer[:n], err)
+	}
+	if client.readEpoch != 1 {
+		t.Errorf("Expected the message in epoch 1, got %d", client.readEpoch)
+	}
+	if err := <-renegotiated; err != RenegotiationRefusedError {
+		t.Errorf("Expected the client to refuse the renegotiation, got %v", err)
+	}
+}
+
+func TestDTLS13VersionNegotiation(t *testing.T) {
+	for _, test := range []struct {
+		client, server uint16
+		expected       protocolVersion
+	}{
+		{VersionDTLS13, VersionDTLS13, DTLS_13},
+		{VersionDTLS13, VersionDTLS12, DTLS_12},
+		{VersionDTLS12, VersionDTLS13, DTLS_12},
+	} {
+		clientConfig := testConfig()
+		clientConfig.MaxVersion = test.client
+		serverConfig := testConfig()
+		serverConfig.MaxVersion = test.server
+		client, server, clientErr, serverErr := handshakeWithListener(t, clientConfig, serverConfig)
+		if clientErr != nil || serverErr != nil {
+			t.Fatalf("Versions %x and %x: handshake failed with %v on the client and %v on the server", test.client, test.server, clientErr, serverErr)
+		}
+		if client.version != test.expected || server.version != test.expected {
+			t.Errorf("Versions %x and %x: expected %s but negotiated %s and %s", test.client, test.server, test.expected, client.version, server.version)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+// versionStrippingConn removes the supported versions extension from the
+// ClientHellos it writes, like an attacker who wants to downgrade the
+// connection would.
+type versionStrippingConn struct {
+	net.Conn
+}
+
+func (c *versionStrippingConn) Write(b []byte) (int, error) {
+	rec, err := readRecord(bytes.NewBuffer(b), 0)
+	if err != nil || rec.Type != typeHandshake || rec.Epoch != 0 {
+		return c.Conn.Write(b)
+	}
+	message, err := readHandshake(bytes.NewBuffer(rec.Payload))
+	if err != nil || message.MsgType != clientHello {
+		return c.Conn.Write(b)
+	}
+	hello, err := readHandshakeClientHello(message.Fragment)
+	if err != nil {
+		return c.Conn.Write(b)
+	}
+	var extensions []extension
+	for _, e := range hello.Extensions {
+		if e.Type != ExtensionSupportedVersions {
+			extensions = append(extensions, e)
+		}
+	}
+	hello.Extensions = extensions
+	message.Fragment = hello.Bytes()
+	message.Length, message.FragmentLength = uint32(len(message.Fragment)), uint32(len(message.Fragment))
+	payload := message.Bytes()
+	header := buildRecordHeader(rec.Type, rec.Version, rec.Epoch, rec.SequenceNumber, nil, uint16(len(payload)))
+	if _, err := c.Conn.Write(append(header, payload...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func TestDTLS13DowngradeProtection(t *testing.T) {
+	serverConfig := testConfig()
+	serverConfig.MaxVersion = VersionDTLS13
+	listener := startEchoServer(t, serverConfig)
+	defer listener.Close()
+	clientConfig := testConfig()
+	clientConfig.MaxVersion = VersionDTLS13
+	conn := Client(&versionStrippingConn{dialLoopback(t, listener.Addr())}, clientConfig)
+	defer conn.Close()
+	err := conn.Handshake()
+	alertErr, ok := err.(*AlertError)
+	if !ok || alertErr.Remote || alertErr.Description != AlertIllegalParameter {
+		t.Errorf("Expected the client to detect the downgrade but got %v", err)
+	}
+}
+
+func TestKeyUpdate(t *testing.T) {
+	serverConfig := testConfig()
+	serverConfig.MaxVersion = VersionDTLS13
+	listener := startEchoServer(t, serverConfig)
+	defer listener.Close()
+	clientConfig := testConfig()
+	clientConfig.MaxVersion = VersionDTLS13
+	conn := Client(dialLoopback(t, listener.Addr()), clientConfig)
+	defer conn.Close()
+	testEcho(t, conn, "Before the key update")
+	for i := 0; i < 2; i++ {
+		if err := conn.UpdateKeys(); err != nil {
+			t.Fatalf("Key update %d failed: %s", i, err)
+		}
+		testEcho(t, conn, "After the key update")
+		// The server updates its keys as well, since we asked it to.
+		if expected := uint16(epochApplicationData) + uint16(i) + 1; conn.epoch != expected || conn.readEpoch != expected {
+			t.Errorf("Expected epoch %d after key update %d, got %d and %d", expected, i, conn.epoch, conn.readEpoch)
+		}
+	}
+
+	legacyConfig := testConfig()
+	legacyConfig.MaxVersion = VersionDTLS12
+	legacy := Client(dialLoopback(t, listener.Addr()), legacyConfig)
+	defer legacy.Close()
+	if err := legacy.UpdateKeys(); err != KeyUpdateNotSupportedError {
+		t.Errorf("Expected key updates to need DTLS 1.3 but got %v", err)
+	}
+}
+
+func TestServerKeyUpdate(t *testing.T) {
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen on loopback: %s", err)
+	}
+	config := testConfig()
+	config.MaxVersion = VersionDTLS13
+	listener := NewListener(pc, config)
+	defer listener.Close()
+	accepted := make(chan *Conn, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil && conn.(*Conn).Handshake() == nil {
+			accepted <- conn.(*Conn)
+		}
+		close(accepted)
+	}()
+	client := Client(dialLoopback(t, listener.Addr()), config)
+	defer client.Close()
+	if err := client.Handshake(); err != nil {
+		t.Fatalf("Handshake failed: %s", err)
+	}
+	server, ok := <-accepted
+	if !ok {
+		t.Fatalf("Server handshake failed")
+	}
+
+	// The client answers the KeyUpdate while it reads.
+	read := make(chan string, 1)
+	go func() {
+		buffer := make([]byte, UDP_MAX_SIZE)
+		n, _ := client.Read(buffer)
+		read <- string(buffer[:n])
+	}()
+	if err := server.UpdateKeys(); err != nil {
+		t.Fatalf("Key update failed: %s", err)
+	}
+	if _, err := server.Write([]byte("Hello World")); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	if message := <-read; message != "Hello World" {
+		t.Errorf("Expected to read the message after the key update, got %q", message)
+	}
+	if server.epoch != 4 || client.readEpoch != 4 {
+		t.Errorf("Expected epoch 4 after the key update, got %d and %d", server.epoch, client.readEpoch)
+	}
+}
+
+// expectAlert checks that err is a fatal alert with description that was
+// sent by the peer.
+func expectAlert(t *testing.T, err error, description AlertDescription) {
+	alertErr, ok := err.(*AlertError)
+	if !ok {
+		t.Fatalf("Expected alert %s but got %v", description, err)
+	}
+	if !alertErr.Remote || alertErr.Level != AlertLevelFatal || alertErr.Description != description {
+		t.Errorf("Expected fatal alert %s from peer but got %s", description, alertErr)
+	}
+}
+
+// lossyConn drops the datagrams whose index is in drop.
+type lossyConn struct {
+	net.Conn
+	writes int
+	drop   map[int]bool
+}
+
+func (c *lossyConn) Write(b []byte) (int, error) {
+	c.writes += 1
+	if c.drop[c.writes-1] {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+// lossyPacketConn drops the datagrams whose index is in drop.
+type lossyPacketConn struct {
+	net.PacketConn
+	mutex  sync.Mutex
+	writes int
+	drop   map[int]bool
+}
+
+func (c *lossyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mutex.Lock()
+	c.writes += 1
+	drop := c.drop[c.writes-1]
+	c.mutex.Unlock()
+	if drop {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+// duplicatingConn sends every datagram twice.
+type duplicatingConn struct {
+	net.Conn
+}
+
+func (c *duplicatingConn) Write(b []byte) (int, error) {
+	if _, err := c.Conn.Write(b); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+func TestReplayDetection(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		serverConfig := testConfig()
+		serverConfig.DisableReplayDetection = disabled
+		listener := startEchoServer(t, serverConfig)
+		conn := Client(&duplicatingConn{dialLoopback(t, listener.Addr())}, testConfig())
+		testEcho(t, conn, "First")
+		// If the server does not drop the duplicate of the first message,
+		// it echoes it twice.
+		if _, err := conn.Write([]byte("Second")); err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+		buffer := make([]byte, UDP_MAX_SIZE)
+		n, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatalf("Read failed: %s", err)
+		}
+		expected := "Second"
+		if disabled {
+			expected = "First"
+		}
+		if string(buffer[:n]) != expected {
+			t.Errorf("Expected %q with replay detection disabled %v but read %q", expected, disabled, buffer[:n])
+		}
+		conn.Close()
+		listener.Close()
+	}
+}
+
+// splitRecords returns the records of a datagram.
+func splitRecords(datagram []byte) (records [][]byte) {
+	buffer := bytes.NewBuffer(datagram)
+	for buffer.Len() > 0 {
+		length := buffer.Len()
+		if _, err := readRecord(buffer, connectionIDLength); err != nil {
+			return append(records, datagram)
+		}
+		records = append(records, datagram[:length-buffer.Len()])
+		datagram = datagram[length-buffer.Len():]
+	}
+	return records
+}
+
+// reorderingConn sends every record in its own datagram, holds back the
+// records whose index is in delay and sends them after the next one.
+type reorderingConn struct {
+	net.Conn
+	writes  int
+	delay   map[int]bool
+	delayed []byte
+}
+
+func (c *reorderingConn) Write(b []byte) (int, error) {
+	for _, record := range splitRecords(b) {
+		c.writes += 1
+		if c.delay[c.writes-1] {
+			c.delayed = append([]byte{}, record...)
+			continue
+		}
+		if _, err := c.Conn.Write(record); err != nil {
+			return 0, err
+		}
+		if c.delayed != nil {
+			if _, err := c.Conn.Write(c.delayed); err != nil {
+				return 0, err
+			}
+			c.delayed = nil
+		}
+	}
+	return len(b), nil
+}
+
+// reorderingPacketConn is the reorderingConn of a server.
+type reorderingPacketConn struct {
+	net.PacketConn
+	mutex   sync.Mutex
+	writes  int
+	delay   map[int]bool
+	delayed []byte
+}
+
+func (c *reorderingPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, record := range splitRecords(b) {
+		c.writes += 1
+		if c.delay[c.writes-1] {
+			c.delayed = append([]byte{}, record...)
+			continue
+		}
+		if _, err := c.PacketConn.WriteTo(record, addr); err != nil {
+			return 0, err
+		}
+		if c.delayed != nil {
+			if _, err := c.PacketConn.WriteTo(c.delayed, addr); err != nil {
+				return 0, err
+			}
+			c.delayed = nil
+		}
+	}
+	return len(b), nil
+}
+
+func TestReorderedChangeCipherSpec(t *testing.T) {
+	defer func(timeout time.Duration) { initialRetransmitTimeout = timeout }(initialRetransmitTimeout)
+	initialRetransmitTimeout = 10 * time.Second
+
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen on loopback: %s", err)
+	}
+	// Both Finished messages overtake the ChangeCipherSpec, so the
+	// handshake only completes in time if they are buffered.
+	listener := startEchoServerOn(&reorderingPacketConn{PacketConn: pc, delay: map[int]bool{5: true}}, testConfig())
+	defer listener.Close()
+	config := testConfig()
+	config.HandshakeTimeout = 2 * time.Second
+	conn := Client(&reorderingConn{Conn: dialLoopback(t, listener.Addr()), delay: map[int]bool{3: true}}, config)
+	defer conn.Close()
+	testEcho(t, conn, "Hello World")
+	testEcho(t, conn, "Hello again")
+	// Finished and two application data records were sent in epoch 1.
+	if conn.currentWriteState.sequenceNumber != 3 {
+		t.Errorf("Expected sequence number 3 in the new epoch but got %d", conn.currentWriteState.sequenceNumber)
+	}
+}
+
+func TestHandshakeRetransmission(t *testing.T) {
+	defer func(timeout time.Duration) { initialRetransmitTimeout = timeout }(initialRetransmitTimeout)
+	initialRetransmitTimeout = 50 * time.Millisecond
+
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen on loopback: %s", err)
+	}
+	// Both sides lose datagrams during the handshake, so it only completes
+	// if lost flights are retransmitted.
+	listener := startEchoServerOn(&lossyPacketConn{PacketConn: pc, drop: map[int]bool{1: true, 3: true}}, testConfig())
+	defer listener.Close()
+	conn := Client(&lossyConn{Conn: dialLoopback(t, listener.Addr()), drop: map[int]bool{0: true, 3: true}}, testConfig())
+	defer conn.Close()
+	testEcho(t, conn, "Hello World")
+}
+
+func TestDTLS13HandshakeRetransmission(t *testing.T) {
+	defer func(timeout time.Duration) { initialRetransmitTimeout = timeout }(initialRetransmitTimeout)
+	initialRetransmitTimeout = 50 * time.Millisecond
+
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen on loopback: %s", err)
+	}
+	config := testConfig()
+	config.MaxVersion = VersionDTLS13
+	// The server loses its ACK, the client its first ClientHello and a
+	// datagram of its last flight.
+	listener := startEchoServerOn(&lossyPacketConn{PacketConn: pc, drop: map[int]bool{3: true}}, config)
+	defer listener.Close()
+	conn := Client(&lossyConn{Conn: dialLoopback(t, listener.Addr()), drop: map[int]bool{0: true, 3: true}}, config)
+	defer conn.Close()
+	testEcho(t, conn, "Hello World")
+}
+
+// sizeLimitConn drops the datagrams larger than limit, like a path with a
+// small MTU which does not fragment.
+type sizeLimitConn struct {
+	net.Conn
+	limit int
+}
+
+func (c *sizeLimitConn) Write(b []byte) (int, error) {
+	if len(b) > c.limit {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+// sizeLimitPacketConn is the sizeLimitConn of a server.
+type sizeLimitPacketConn struct {
+	net.PacketConn
+	limit int
+}
+
+func (c *sizeLimitPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if len(b) > c.limit {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+// largeCertificateConfig returns a config whose certificate message does
+// not fit into a single datagram of the default MTU.
+func largeCertificateConfig() *Config {
+	config := testConfig()
+	chain := [][]byte{testRSACertificate.Certificate[0], testECDSACertificate.Certificate[0], testRSACertificate.Certificate[0]}
+	config.Certificates = []tls.Certificate{{Certificate: chain, PrivateKey: testRSACertificate.PrivateKey, Leaf: testRSACertificate.Leaf}}
+	return config
+}
+
+func TestHandshakeFragmentation(t *testing.T) {
+	for _, version := range []uint16{VersionDTLS12, VersionDTLS13} {
+		pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("Unable to listen on loopback: %s", err)
+		}
+		serverConfig := largeCertificateConfig()
+		serverConfig.MaxVersion = VersionDTLS13
+		serverConfig.ClientAuth = RequireAnyClientCert
+		serverConfig.MTU = 500
+		listener := startEchoServerOn(&sizeLimitPacketConn{PacketConn: pc, limit: 500}, serverConfig)
+		clientConfig := largeCertificateConfig()
+		clientConfig.MaxVersion = version
+		clientConfig.MTU = 500
+		conn := Client(&sizeLimitConn{Conn: dialLoopback(t, listener.Addr()), limit: 500}, clientConfig)
+		testEcho(t, conn, "Hello World")
+		conn.Close()
+		listener.Close()
+	}
+}
+
+func TestMTUReduction(t *testing.T) {
+	defer func(timeout time.Duration) { initialRetransmitTimeout = timeout }(initialRetransmitTimeout)
+	initialRetransmitTimeout = 20 * time.Millisecond
+
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen on loopback: %s", err)
+	}
+	serverConfig := largeCertificateConfig()
+	serverConfig.MTU = 1400
+	// The path drops the datagrams of the server that do not fit into the
+	// second fallback MTU.
+	listener := NewListener(&sizeLimitPacketConn{PacketConn: pc, limit: 1100}, serverConfig)
+	defer listener.Close()
+	accepted := make(chan *Conn, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil && conn.(*Conn).Handshake() == nil {
+			accepted <- conn.(*Conn)
+		}
+		close(accepted)
+	}()
+	client := Client(dialLoopback(t, listener.Addr()), testConfig())
+	defer client.Close()
+	if err := client.Handshake(); err != nil {
+		t.Fatalf("Handshake failed: %s", err)
+	}
+	server, ok := <-accepted
+	if !ok {
+		t.Fatalf("Server handshake failed")
+	}
+	if server.mtu != 1024 {
+		t.Errorf("Expected the server to fall back to an MTU of 1024, got %d", server.mtu)
+	}
+	if client.mtu != defaultMTU {
+		t.Errorf("Expected the client to keep the MTU of %d, got %d", defaultMTU, client.mtu)
+	}
+}
+
+func TestMaxPayloadSize(t *testing.T) {
+	serverConfig := testConfig()
+	serverConfig.MaxVersion = VersionDTLS13
+	listener := startEchoServer(t, serverConfig)
+	defer listener.Close()
+	for _, test := range []struct {
+		suite    uint16
+		version  uint16
+		expected int
+	}{
+		// Header, explicit nonce and tag.
+		{TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, VersionDTLS12, 1000 - 13 - 8 - 16},
+		// Header, IV, padding and MAC.
+		{TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA, VersionDTLS12, 1000 - 13 - 16 - 16 - 20},
+		// Unified header, content type and tag.
+		{TLS_AES_128_GCM_SHA256, VersionDTLS13, 1000 - 5 - 1 - 16},
+	} {
+		config := testConfig()
+		config.CipherSuites = []uint16{test.suite}
+		config.MaxVersion = test.version
+		config.MTU = 1000
+		config.DisableConnectionIDs = true
+		conn := Client(dialLoopback(t, listener.Addr()), config)
+		if size := conn.MaxPayloadSize(); size != 1000-13 {
+			t.Errorf("Suite %x: expected a payload size of %d before the handshake, got %d", test.suite, 1000-13, size)
+		}
+		testEcho(t, conn, "Hello World")
+		if size := conn.MaxPayloadSize(); size != test.expected {
+			t.Errorf("Suite %x: expected a payload size of %d, got %d", test.suite, test.expected, size)
+		}
+		testEcho(t, conn, string(make([]byte, test.expected)))
+		conn.Close()
+	}
+}
+
+// recordSizePacketConn records the size of the largest record a server
+// sends.
+type recordSizePacketConn struct {
+	net.PacketConn
+	largest int32
+}
+
+func (c *recordSizePacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	for _, record := range splitRecords(b) {
+		if size := int32(len(record)); size > atomic.LoadInt32(&c.largest) {
+			atomic.StoreInt32(&c.largest, size)
+		}
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func TestMaxFragmentLength(t *testing.T) {
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen on loopback: %s", err)
+	}
+	serverConn := &recordSizePacketConn{PacketConn: pc}
+	serverConfig := largeCertificateConfig()
+	serverConfig.MTU = 1400
+	listener := startEchoServerOn(serverConn, serverConfig)
+	defer listener.Close()
+	config := testConfig()
+	config.CipherSuites = []uint16{TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	config.MaxFragmentLength = 512
+	config.DisableConnectionIDs = true
+	conn := Client(dialLoopback(t, listener.Addr()), config)
+	defer conn.Close()
+	testEcho(t, conn, string(make([]byte, 512)))
+	if conn.sendLimit != 512 || conn.receiveLimit != 512 {
+		t.Errorf("Expected limits of 512 bytes, got %d and %d", conn.sendLimit, conn.receiveLimit)
+	}
+	if size := conn.MaxPayloadSize(); size != 512 {
+		t.Errorf("Expected a payload size of 512, got %d", size)
+	}
+	if _, err := conn.Write(make([]byte, 513)); err != MessageTooLargeError {
+		t.Errorf("Expected the write to exceed the limit, got %v", err)
+	}
+	// The header, explicit nonce and tag of the records of the server.
+	if largest := atomic.LoadInt32(&serverConn.largest); largest > 512+13+8+16 {
+		t.Errorf("Server sent a record of %d bytes", largest)
+	}
+}
+
+// oversizedRecordPacketConn appends a plaintext handshake record of size
+// bytes to the datagram of a server with its ServerHello.
+type oversizedRecordPacketConn struct {
+	net.PacketConn
+	size int
+	sent int32
+}
+
+func (c *oversizedRecordPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if len(b) > 13 && contentType(b[0]) == typeHandshake && handshakeType(b[13]) == serverHello && atomic.CompareAndSwapInt32(&c.sent, 0, 1) {
+		header := buildRecordHeader(typeHandshake, DTLS_12, 0, 100, nil, uint16(c.size))
+		b = append(append(append([]byte{}, b...), header...), make([]byte, c.size)...)
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func TestMaxFragmentLengthOverflow(t *testing.T) {
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen on loopback: %s", err)
+	}
+	listener := startEchoServerOn(&oversizedRecordPacketConn{PacketConn: pc, size: 513}, testConfig())
+	defer listener.Close()
+	config := testConfig()
+	config.MaxFragmentLength = 512
+	conn := Client(dialLoopback(t, listener.Addr()), config)
+	defer conn.Close()
+	// The limit covers the plaintext records after the ServerHello.
+	err = conn.Handshake()
+	if alertErr, ok := err.(*AlertError); !ok || alertErr.Remote || alertErr.Description != AlertRecordOverflow {
+		t.Errorf("Expected to send a record_overflow alert, got %v", err)
+	}
+}
+
+func TestRecordSizeLimit(t *testing.T) {
+	for _, version := range []uint16{VersionDTLS12, VersionDTLS13} {
+		pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("Unable to listen on loopback: %s", err)
+		}
+		serverConfig := testConfig()
+		serverConfig.MaxVersion = VersionDTLS13
+		serverConfig.RecordSizeLimit = 1000
+		listener := NewListener(pc, serverConfig)
+		accepted := make(chan *Conn, 1)
+		go func() {
+			if conn, err := listener.Accept(); err == nil && conn.(*Conn).Handshake() == nil {
+				accepted <- conn.(*Conn)
+			}
+			close(accepted)
+		}()
+		config := testConfig()
+		config.MaxVersion = version
+		config.RecordSizeLimit = 256
+		// The limit of the client is ignored in favor of the record size
+		// limit.
+		config.MaxFragmentLength = 512
+		client := Client(dialLoopback(t, listener.Addr()), config)
+		if err := client.Handshake(); err != nil {
+			t.Fatalf("Handshake failed: %s", err)
+		}
+		server, ok := <-accepted
+		if !ok {
+			t.Fatalf("Server handshake failed")
+		}
+		// The limits of DTLS 1.3 include the content type.
+		limit, serverLimit := 256, 1000
+		if version == VersionDTLS13 {
+			limit, serverLimit = 255, 999
+		}
+		if client.sendLimit != serverLimit || client.receiveLimit != limit {
+			t.Errorf("Version %x: expected client limits of %d and %d, got %d and %d", version, serverLimit, limit, client.sendLimit, client.receiveLimit)
+		}
+		if server.sendLimit != limit || server.receiveLimit != serverLimit {
+			t.Errorf("Version %x: expected server limits of %d and %d, got %d and %d", version, limit, serverLimit, server.sendLimit, server.receiveLimit)
+		}
+		if _, err := server.Write(make([]byte, limit+1)); err != MessageTooLargeError {
+			t.Errorf("Version %x: expected the write to exceed the limit, got %v", version, err)
+		}
+
+		// A peer which ignores the limit gets a record_overflow alert.
+		server.writeMutex.Lock()
+		server.sendLimit = 0
+		server.writeMutex.Unlock()
+		if _, err := server.Write(make([]byte, limit+1)); err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+		if _, err := client.Read(make([]byte, UDP_MAX_SIZE)); err == nil {
+			t.Errorf("Version %x: expected the oversized record to be rejected", version)
+		}
+		_, err = server.Read(make([]byte, UDP_MAX_SIZE))
+		expectAlert(t, err, AlertRecordOverflow)
+		client.Close()
+		listener.Close()
+	}
+}
+
+func TestRecordSizeLimitPlaintext(t *testing.T) {
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen on loopback: %s", err)
+	}
+	serverConn := &recordSizePacketConn{PacketConn: pc}
+	listener := startEchoServerOn(serverConn, largeCertificateConfig())
+	defer listener.Close()
+	config := testConfig()
+	config.CipherSuites = []uint16{TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	config.RecordSizeLimit = 64
+	config.DisableConnectionIDs = true
+	conn := Client(dialLoopback(t, listener.Addr()), config)
+	defer conn.Close()
+	testEcho(t, conn, string(make([]byte, 64)))
+	// Only the protected records are limited, the fragments of the
+	// plaintext Certificate fill the datagrams.
+	if largest := atomic.LoadInt32(&serverConn.largest); largest <= 64+13+8+16 {
+		t.Errorf("Expected the plaintext records of the server to exceed the limit, the largest has %d bytes", largest)
+	}
+	if _, err := conn.Write(make([]byte, 65)); err != nil {
+		t.Errorf("Expected the client to ignore its own limit, got %v", err)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen on loopback: %s", err)
+	}
+	defer pc.Close()
+	config := testConfig()
+	config.HandshakeTimeout = 200 * time.Millisecond
+	conn := Client(dialLoopback(t, pc.LocalAddr()), config)
+	defer conn.Close()
+	if _, err := conn.Write([]byte("Hello World")); err != HandshakeTimeoutError {
+		t.Errorf("Expected handshake timeout but got %v", err)
+	}
+}
+
+// countingConn counts the datagrams written.
+type countingConn struct {
+	net.Conn
+	writes int32
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	atomic.AddInt32(&c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+func TestHandshakeOnce(t *testing.T) {
+	listener := startEchoServer(t, testConfig())
+	defer listener.Close()
+	transport := &countingConn{Conn: dialLoopback(t, listener.Addr())}
+	conn := Client(transport, testConfig())
+	defer conn.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := conn.Handshake(); err != nil {
+				t.Errorf("Handshake failed: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	// ClientHello twice because of the cookie, then ClientKeyExchange,
+	// ChangeCipherSpec and Finished in one datagram.
+	if writes := atomic.LoadInt32(&transport.writes); writes != 3 {
+		t.Errorf("Expected one handshake with 3 datagrams but %d were sent", writes)
+	}
+	testEcho(t, conn, "Hello World")
+}
+
+// countingPacketConn counts the datagrams a server writes.
+type countingPacketConn struct {
+	net.PacketConn
+	writes int32
+}
+
+func (c *countingPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	atomic.AddInt32(&c.writes, 1)
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func TestFlightBatching(t *testing.T) {
+	for _, version := range []uint16{VersionDTLS12, VersionDTLS13} {
+		pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("Unable to listen on loopback: %s", err)
+		}
+		serverTransport := &countingPacketConn{PacketConn: pc}
+		config := testConfig()
+		config.MaxVersion = version
+		listener := startEchoServerOn(serverTransport, config)
+		transport := &countingConn{Conn: dialLoopback(t, listener.Addr())}
+		conn := Client(transport, config)
+		if err := conn.Handshake(); err != nil {
+			t.Fatalf("Version %x: handshake failed: %s", version, err)
+		}
+		// Both send the ClientHello twice, DTLS 1.2 answers the first one
+		// with a HelloVerifyRequest and DTLS 1.3 with a
+		// HelloRetryRequest. Then each flight fits into one datagram.
+		// The last datagram of the server completes the handshake of DTLS
+		// 1.2 and acknowledges it with DTLS 1.3.
+		testEcho(t, conn, "Hello World")
+		if writes := atomic.LoadInt32(&transport.writes); writes != 4 {
+			t.Errorf("Version %x: expected the client to send 4 datagrams but it sent %d", version, writes)
+		}
+		if writes := atomic.LoadInt32(&serverTransport.writes); writes != 4 {
+			t.Errorf("Version %x: expected the server to send 4 datagrams but it sent %d", version, writes)
+		}
+		conn.Close()
+		listener.Close()
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	listener := startEchoServer(t, testConfig())
+	defer listener.Close()
+	transport := &countingConn{Conn: dialLoopback(t, listener.Addr())}
+	conn := Client(transport, testConfig())
+	defer conn.Close()
+	if err := conn.Handshake(); err != nil {
+		t.Fatalf("Handshake failed: %s", err)
+	}
+	for _, test := range []struct {
+		sizes     []int
+		datagrams int32
+	}{
+		{[]int{10, 20, 30, 40, 50}, 1},
+		// A message larger than the MTU is sent on its own.
+		{[]int{10, 2000, 10}, 3},
+		{[]int{500, 500, 500}, 2},
+	} {
+		var messages [][]byte
+		for i, size := range test.sizes {
+			messages = append(messages, bytes.Repeat([]byte{byte('a' + i)}, size))
+		}
+		before := atomic.LoadInt32(&transport.writes)
+		if n, err := conn.WriteBatch(messages); n != len(messages) || err != nil {
+			t.Fatalf("Sizes %v: WriteBatch wrote %d messages: %v", test.sizes, n, err)
+		}
+		if datagrams := atomic.LoadInt32(&transport.writes) - before; datagrams != test.datagrams {
+			t.Errorf("Sizes %v: expected %d datagrams but %d were sent", test.sizes, test.datagrams, datagrams)
+		}
+		// The server reads and echoes every message on its own.
+		buffer := make([]byte, UDP_MAX_SIZE)
+		for _, message := range messages {
+			n, err := conn.Read(buffer)
+			if err != nil {
+				t.Fatalf("Read failed: %s", err)
+			}
+			if !bytes.Equal(buffer[:n], message) {
+				t.Errorf("Sizes %v: expected echo of %d bytes of %q but read %d bytes", test.sizes, len(message), message[0], n)
+			}
+		}
+	}
+}
+
+func TestHandshakeContextCancel(t *testing.T) {
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen on loopback: %s", err)
+	}
+	defer pc.Close()
+	conn := Client(dialLoopback(t, pc.LocalAddr()), testConfig())
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	if err := conn.HandshakeContext(ctx); err != context.Canceled {
+		t.Errorf("Expected context.Canceled but got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Handshake returned %s after it was canceled", elapsed)
+	}
+	if err := conn.Handshake(); err != context.Canceled {
+		t.Errorf("Expected the handshake not to run again but got %v", err)
+	}
+}
+
+func TestHandshakeDeadline(t *testing.T) {
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen on loopback: %s", err)
+	}
+	defer pc.Close()
+	conn := Client(dialLoopback(t, pc.LocalAddr()), testConfig())
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(200 * time.Millisecond))
+	err = conn.Handshake()
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("Expected a timeout but got %v", err)
+	}
+}
+
+func TestHelloVerifyRequest(t *testing.T) {
+	listener := startEchoServer(t, testConfig())
+	defer listener.Close()
+	conn := dialLoopback(t, listener.Addr())
+	defer conn.Close()
+
+	hello := handshakeClientHello{
+		ClientVersion:      DTLS_12,
+		Random:             newRandom(),
+		CipherSuites:       cipherSuites,
+		CompressionMethods: []compressionMethod{compressionNone},
+	}
+	fragment := hello.Bytes()
+	message := handshake{MsgType: clientHello, Length: uint32(len(fragment)), FragmentLength: uint32(len(fragment)), Fragment: fragment}
+	payload := message.Bytes()
+	datagram := append(buildRecordHeader(typeHandshake, DTLS_12, 0, 7, nil, uint16(len(payload))), payload...)
+	if _, err := conn.Write(datagram); err != nil {
+		t.Fatalf("Unable to send client hello: %s", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buffer := make([]byte, UDP_MAX_SIZE)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		t.Fatalf("Did not receive hello verify request: %s", err)
+	}
+	rec, err := readRecord(bytes.NewBuffer(buffer[:n]), 0)
+	if err != nil {
+		t.Fatalf("Unable to read record: %s", err)
+	}
+	if rec.SequenceNumber != 7 {
+		t.Errorf("Expected record sequence number 7 but got %d", rec.SequenceNumber)
+	}
+	response, err := readHandshake(bytes.NewBuffer(rec.Payload))
+	if err != nil || response.MsgType != helloVerifyRequest {
+		t.Fatalf("Expected hello verify request but got %s, %v", response, err)
+	}
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+	if len(listener.connections) != 0 {
+		t.Errorf("Listener created connection state before the cookie exchange")
+	}
+}
+
+func TestCurveNegotiation(t *testing.T) {
+	defer func(curves []namedCurve) { supportedCurves = curves }(supportedCurves)
+	for _, curve := range []namedCurve{curveX25519, curveP256, curveP384} {
+		supportedCurves = []namedCurve{curve}
+		client, server, clientErr, serverErr := handshakeWithListener(t, testConfig(), testConfig())
+		if clientErr != nil || serverErr != nil {
+			t.Fatalf("Handshake with curve %d failed with %v on the client and %v on the server", curve, clientErr, serverErr)
+		}
+		if selected := server.handshakeContext.(*serverHandshake).curve; selected != curve {
+			t.Errorf("Expected curve %d but server selected %d", curve, selected)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+// serverHelloFor sends a ClientHello with extensions and returns the
+// cipher suite the server selected.
+func serverHelloFor(t *testing.T, addr net.Addr, suites []*cipherSuite, extensions []extension) *cipherSuite {
+	conn := dialLoopback(t, addr)
+	defer conn.Close()
+	hello := handshakeClientHello{
+		ClientVersion:      DTLS_12,
+		Random:             newRandom(),
+		CipherSuites:       suites,
+		CompressionMethods: []compressionMethod{compressionNone},
+		Extensions:         extensions,
+	}
+	fragment := hello.Bytes()
+	message := handshake{MsgType: clientHello, Length: uint32(len(fragment)), FragmentLength: uint32(len(fragment)), Fragment: fragment}
+	payload := message.Bytes()
+	if _, err := conn.Write(append(buildRecordHeader(typeHandshake, DTLS_12, 0, 0, nil, uint16(len(payload))), payload...)); err != nil {
+		t.Fatalf("Unable to send client hello: %s", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buffer := make([]byte, UDP_MAX_SIZE)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		t.Fatalf("Did not receive server hello: %s", err)
+	}
+	rec, err := readRecord(bytes.NewBuffer(buffer[:n]), 0)
+	if err != nil {
+		t.Fatalf("Unable to read record: %s", err)
+	}
+	response, err := readHandshake(bytes.NewBuffer(rec.Payload))
+	if err != nil || response.MsgType != serverHello {
+		t.Fatalf("Expected server hello but got %s, %v", response, err)
+	}
+	srvHello, err := readHandshakeServerHello(response.Fragment)
+	if err != nil {
+		t.Fatalf("Unable to read server hello: %s", err)
+	}
+	return srvHello.CipherSuite
+}
+
+func TestEllipticSuitesNeedCurves(t *testing.T) {
+	config := testConfig()
+	config.InsecureSkipHelloVerify = true
+	config.CipherSuites = []uint16{uint16(TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA), uint16(TLS_DH_anon_WITH_AES_128_CBC_SHA)}
+	listener := startEchoServer(t, config)
+	defer listener.Close()
+	suites := config.cipherSuites()
+	for _, test := range []struct {
+		name       string
+		extensions []extension
+		expected   cipherSuiteId
+	}{
+		{"no curves", nil, TLS_DH_anon_WITH_AES_128_CBC_SHA},
+		{"unknown curve", []extension{newSupportedGroupsExtension([]namedCurve{25})}, TLS_DH_anon_WITH_AES_128_CBC_SHA},
+		{"compressed points", []extension{newSupportedGroupsExtension([]namedCurve{curveP256}), {Type: ExtensionECPointFormats, Data: []byte{1, 1}}}, TLS_DH_anon_WITH_AES_128_CBC_SHA},
+		{"X25519", []extension{newSupportedGroupsExtension([]namedCurve{curveX25519}), newECPointFormatsExtension()}, TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA},
+	} {
+		if suite := serverHelloFor(t, listener.Addr(), suites, test.extensions); suite.id != test.expected {
+			t.Errorf("%s: expected %s but server selected %s", test.name, cipherSuite{id: test.expected}, suite)
+		}
+	}
+}
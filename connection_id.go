@@ -0,0 +1,64 @@
+package dtls
+
+import (
+	"crypto/rand"
+	"net"
+)
+
+// connectionIDLength is the length of the connection IDs a Listener assigns.
+// All its connection IDs have the same length, so that it finds them in the
+// record header without knowing the connection.
+const connectionIDLength = 8
+
+// newConnectionID returns a random connection ID for a Listener connection.
+func newConnectionID() []byte {
+	id := make([]byte, connectionIDLength)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return id
+}
+
+// newConnectionIDExtension returns the connection_id extension, which
+// carries the connection ID the sender wants to find in the records it
+// receives, RFC 9146 section 3. An empty one means the sender does not
+// need connection IDs but uses the peer's.
+func newConnectionIDExtension(connectionID []byte) extension {
+	return extension{Type: ExtensionConnectionID, Data: append([]byte{byte(len(connectionID))}, connectionID...)}
+}
+
+func readConnectionIDExtension(data []byte) ([]byte, error) {
+	if len(data) == 0 || int(data[0]) != len(data)-1 {
+		return nil, InvalidExtensionError
+	}
+	return data[1:], nil
+}
+
+// connectionIDsEnabled reports whether the connection_id extension is
+// offered or accepted. It is only defined for DTLS 1.2.
+func (c *Conn) connectionIDsEnabled(version protocolVersion) bool {
+	return !c.config.DisableConnectionIDs && version == DTLS_12
+}
+
+// A migratingConn is a transport whose peer may move to another address,
+// like the virtual connections of a Listener, which routes records by
+// connection ID.
+type migratingConn interface {
+	// readFrom reads a datagram like Read and returns its source.
+	readFrom(b []byte) (int, net.Addr, error)
+	// setRemoteAddr sends all further datagrams to addr.
+	setRemoteAddr(addr net.Addr)
+}
+
+// migrate follows the peer to addr, the source of an authenticated record
+// with our connection ID, RFC 9146 section 6. The caller makes sure that the
+// record is the newest of its epoch, so delayed records from the old
+// address do not move the peer back.
+func (c *Conn) migrate(addr net.Addr) {
+	m, ok := c.Conn.(migratingConn)
+	if !ok || addr.String() == c.Conn.RemoteAddr().String() {
+		return
+	}
+	c.logf("Peer moved from %s to %s", c.Conn.RemoteAddr(), addr)
+	m.setRemoteAddr(addr)
+}
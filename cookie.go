@@ -0,0 +1,139 @@
+package dtls
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// cookieSecretLifetime is the time after which the cookie secret is
+// replaced. Cookies made with the previous secret are still accepted, so a
+// cookie stays valid for at least this long.
+const cookieSecretLifetime = 5 * time.Minute
+
+// A cookieGenerator creates and checks the stateless cookies a server sends
+// in a HelloVerifyRequest, RFC 6347 section 4.2.1. A cookie is a MAC over the
+// client address and the ClientHello parameters. The cookies of a DTLS 1.3
+// HelloRetryRequest also carry the state the server needs to continue the
+// handshake.
+type cookieGenerator struct {
+	mutex          sync.Mutex
+	secret         []byte
+	previousSecret []byte
+	rotated        time.Time
+}
+
+func (g *cookieGenerator) rotate() {
+	if g.secret != nil && time.Since(g.rotated) < cookieSecretLifetime {
+		return
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	g.previousSecret = g.secret
+	g.secret = secret
+	g.rotated = time.Now()
+}
+
+func (g *cookieGenerator) generate(addr net.Addr, hello *handshakeClientHello) []byte {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.rotate()
+	return computeCookie(g.secret, addr, hello)
+}
+
+func (g *cookieGenerator) verify(addr net.Addr, hello *handshakeClientHello) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.rotate()
+	for _, secret := range [][]byte{g.secret, g.previousSecret} {
+		if secret != nil && hmac.Equal(hello.Cookie, computeCookie(secret, addr, hello)) {
+			return true
+		}
+	}
+	return false
+}
+
+func computeCookie(secret []byte, addr net.Addr, hello *handshakeClientHello) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(addr.String()))
+	mac.Write(hello.ClientVersion.Bytes())
+	mac.Write(hello.Random.Bytes())
+	mac.Write([]byte{byte(len(hello.SessionID))})
+	mac.Write(hello.SessionID)
+	for _, cipherSuite := range hello.CipherSuites {
+		mac.Write(cipherSuite.Bytes())
+	}
+	for _, compressionMethod := range hello.CompressionMethods {
+		mac.Write(compressionMethod.Bytes())
+	}
+	return mac.Sum(nil)
+}
+
+// generateRetry returns the cookie of a stateless HelloRetryRequest, RFC 9147
+// section 5.1. It holds the selected cipher suite, the group the client is
+// asked for, zero if none, and the hash of the first ClientHello, followed
+// by a MAC over them and the client address.
+func (g *cookieGenerator) generateRetry(addr net.Addr, suite *cipherSuite, group namedCurve, clientHelloHash []byte) []byte {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.rotate()
+	state := append(append(suite.Bytes(), group.Bytes()...), clientHelloHash...)
+	return append(state, computeRetryCookie(g.secret, addr, state)...)
+}
+
+// verifyRetry checks the cookie of a HelloRetryRequest and returns the state
+// it holds.
+func (g *cookieGenerator) verifyRetry(addr net.Addr, cookie []byte) (suite *cipherSuite, group namedCurve, clientHelloHash []byte, ok bool) {
+	if len(cookie) < 4+sha256.Size {
+		return nil, 0, nil, false
+	}
+	state, mac := cookie[:len(cookie)-sha256.Size], cookie[len(cookie)-sha256.Size:]
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.rotate()
+	for _, secret := range [][]byte{g.secret, g.previousSecret} {
+		if secret != nil && hmac.Equal(mac, computeRetryCookie(secret, addr, state)) {
+			ok = true
+		}
+	}
+	if !ok {
+		return nil, 0, nil, false
+	}
+	suite = cipherSuiteByID(cipherSuiteId(binary.BigEndian.Uint16(state)))
+	if suite == nil || !suite.supportsVersion(DTLS_13) || len(state)-4 != suite.prfHash()().Size() {
+		return nil, 0, nil, false
+	}
+	return suite, namedCurve(binary.BigEndian.Uint16(state[2:])), state[4:], true
+}
+
+// computeRetryCookie returns the MAC of a HelloRetryRequest cookie. The label
+// keeps it apart from the MACs of HelloVerifyRequest cookies.
+func computeRetryCookie(secret []byte, addr net.Addr, state []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("hello retry"))
+	mac.Write([]byte(addr.String()))
+	mac.Write(state)
+	return mac.Sum(nil)
+}
+
+// newCookieExtension returns the cookie extension of a HelloRetryRequest and
+// of the ClientHello that answers it, RFC 8446 section 4.2.2.
+func newCookieExtension(cookie []byte) extension {
+	return extension{Type: ExtensionCookie, Data: opaque16(cookie)}
+}
+
+func readCookieExtension(data []byte) ([]byte, error) {
+	buffer := bytes.NewBuffer(data)
+	cookie, err := readOpaque16(buffer)
+	if err != nil || len(cookie) == 0 || buffer.Len() != 0 {
+		return nil, InvalidExtensionError
+	}
+	return cookie, nil
+}
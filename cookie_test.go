@@ -0,0 +1,40 @@
+package dtls
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCookie(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5684}
+	otherAddr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5685}
+	hello := handshakeClientHello{
+		ClientVersion:      DTLS_12,
+		Random:             newRandom(),
+		CipherSuites:       cipherSuites,
+		CompressionMethods: []compressionMethod{compressionNone},
+	}
+	generator := &cookieGenerator{}
+	hello.Cookie = generator.generate(addr, &hello)
+	if !generator.verify(addr, &hello) {
+		t.Errorf("Cookie was not accepted for the address it was generated for")
+	}
+	if generator.verify(otherAddr, &hello) {
+		t.Errorf("Cookie was accepted for a different address")
+	}
+	otherHello := hello
+	otherHello.Random = newRandom()
+	if generator.verify(addr, &otherHello) {
+		t.Errorf("Cookie was accepted for a different client hello")
+	}
+
+	generator.rotated = time.Now().Add(-cookieSecretLifetime)
+	if !generator.verify(addr, &hello) {
+		t.Errorf("Cookie was not accepted after one secret rotation")
+	}
+	generator.rotated = time.Now().Add(-cookieSecretLifetime)
+	if generator.verify(addr, &hello) {
+		t.Errorf("Cookie was accepted after two secret rotations")
+	}
+}
@@ -0,0 +1,99 @@
+package dtls
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/binary"
+	"errors"
+)
+
+// namedCurve is an elliptic curve from the TLS Supported Groups registry.
+type namedCurve uint16
+
+const (
+	curveP256   namedCurve = 23
+	curveP384   namedCurve = 24
+	curveX25519 namedCurve = 29
+)
+
+// supportedCurves are the curves we offer and accept, in order of
+// preference.
+var supportedCurves = []namedCurve{curveX25519, curveP256, curveP384}
+
+// pointFormatUncompressed is the only EC point format we support, RFC 4492
+// section 5.1.2.
+const pointFormatUncompressed uint8 = 0
+
+var UnsupportedCurveError = errors.New("Unsupported elliptic curve")
+
+func (nc namedCurve) Bytes() []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(nc))
+	return b
+}
+
+func (nc namedCurve) curve() (ecdh.Curve, error) {
+	switch nc {
+	case curveP256:
+		return ecdh.P256(), nil
+	case curveP384:
+		return ecdh.P384(), nil
+	case curveX25519:
+		return ecdh.X25519(), nil
+	default:
+		return nil, UnsupportedCurveError
+	}
+}
+
+func isSupportedCurve(curve namedCurve, curves []namedCurve) bool {
+	for _, c := range curves {
+		if c == curve {
+			return true
+		}
+	}
+	return false
+}
+
+// selectCurve returns the first of our curves the peer supports.
+func selectCurve(peerCurves []namedCurve) (namedCurve, bool) {
+	for _, curve := range supportedCurves {
+		if isSupportedCurve(curve, peerCurves) {
+			return curve, true
+		}
+	}
+	return 0, false
+}
+
+func newSupportedGroupsExtension(curves []namedCurve) extension {
+	data := make([]byte, 2, 2+2*len(curves))
+	binary.BigEndian.PutUint16(data, uint16(2*len(curves)))
+	for _, curve := range curves {
+		data = append(data, curve.Bytes()...)
+	}
+	return extension{Type: ExtensionSupportedGroups, Data: data}
+}
+
+func readSupportedGroupsExtension(data []byte) (curves []namedCurve, err error) {
+	buffer := bytes.NewBuffer(data)
+	list, err := readOpaque16(buffer)
+	if err != nil || len(list) == 0 || len(list)%2 != 0 || buffer.Len() != 0 {
+		return nil, InvalidExtensionError
+	}
+	for i := 0; i < len(list); i += 2 {
+		curves = append(curves, namedCurve(binary.BigEndian.Uint16(list[i:])))
+	}
+	return
+}
+
+func newECPointFormatsExtension() extension {
+	return extension{Type: ExtensionECPointFormats, Data: []byte{1, pointFormatUncompressed}}
+}
+
+// readECPointFormatsExtension reports whether the extension lists the
+// uncompressed point format.
+func readECPointFormatsExtension(data []byte) (uncompressed bool, err error) {
+	if len(data) < 2 || int(data[0]) != len(data)-1 {
+		return false, InvalidExtensionError
+	}
+	return bytes.IndexByte(data[1:], pointFormatUncompressed) >= 0, nil
+}
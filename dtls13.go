@@ -0,0 +1,222 @@
+package dtls
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// A recordNumber identifies a DTLS 1.3 record in an ACK, RFC 9147 section 7.
+type recordNumber struct {
+	epoch          uint64
+	sequenceNumber uint64
+}
+
+// ackBytes returns the content of an ACK record for numbers.
+func ackBytes(numbers []recordNumber) []byte {
+	ack := make([]byte, 2, 2+16*len(numbers))
+	binary.BigEndian.PutUint16(ack, uint16(16*len(numbers)))
+	for _, number := range numbers {
+		ack = binary.BigEndian.AppendUint64(ack, number.epoch)
+		ack = binary.BigEndian.AppendUint64(ack, number.sequenceNumber)
+	}
+	return ack
+}
+
+func readACK(payload []byte) ([]recordNumber, error) {
+	buffer := bytes.NewBuffer(payload)
+	if buffer.Len() < 2 {
+		return nil, InsufficentBytesError
+	}
+	length := int(readUint16(buffer))
+	if length%16 != 0 || length != buffer.Len() {
+		return nil, newAlertError(AlertDecodeError, "Invalid ACK record")
+	}
+	numbers := make([]recordNumber, 0, length/16)
+	for buffer.Len() > 0 {
+		numbers = append(numbers, recordNumber{epoch: binary.BigEndian.Uint64(buffer.Next(8)), sequenceNumber: binary.BigEndian.Uint64(buffer.Next(8))})
+	}
+	return numbers, nil
+}
+
+// recordVersion returns the version in the header of records with the
+// DTLS 1.2 format. DTLS 1.3 sends its plaintext records with DTLS 1.2,
+// RFC 9147 section 4.
+func (c *Conn) recordVersion() protocolVersion {
+	if c.version == DTLS_13 {
+		return DTLS_12
+	}
+	return c.version
+}
+
+// writeRecord13 protects and sends a DTLS 1.3 record with the unified
+// header. The content type is encrypted after the payload and the sequence
+// number in the header is masked once the record is sealed, RFC 9147
+// section 4.2.3. The caller holds the writeMutex.
+func (c *Conn) writeRecord13(typ contentType, epoch uint16, state *securityParameters, payload []byte) (int, error) {
+	sequenceNumber := state.sequenceNumber
+	state.sequenceNumber += 1
+	inner := append(append(make([]byte, 0, len(payload)+1), payload...), byte(typ))
+	header := buildUnifiedHeader(epoch, sequenceNumber, len(inner)+state.AEAD.Overhead())
+	nonce := make([]byte, 8)
+	binary.BigEndian.PutUint64(nonce, sequenceNumber)
+	encrypted := state.AEAD.Seal(nil, nonce, inner, header)
+	mask := state.sequenceNumberMask(encrypted)
+	header[1] ^= mask[0]
+	header[2] ^= mask[1]
+	return c.writeDatagram(append(header, encrypted...))
+}
+
+// sendHandshakeEpochRecord sends a record with the DTLS 1.3 handshake
+// traffic keys.
+func (c *Conn) sendHandshakeEpochRecord(typ contentType, payload []byte) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.writeRecord(typ, epochHandshake, &c.handshakeWriteState, payload)
+}
+
+// sendACK acknowledges the DTLS 1.3 records with numbers.
+func (c *Conn) sendACK(numbers []recordNumber) error {
+	_, err := c.sendRecord(typeACK, ackBytes(numbers))
+	return err
+}
+
+// readRecord13 is readRecord for DTLS 1.3. Until the application data keys
+// are in use, the peer may still send plaintext records in the DTLS 1.2
+// format. All other records have the unified header and are read with the
+// keys of their epoch. Records which can not be decrypted are silently
+// discarded, RFC 9147 section 4.5.2.
+func (c *Conn) readRecord13() (typ contentType, payload []byte, err error) {
+	for {
+		rec, err := c.nextRecord()
+		if err != nil {
+			return typ, nil, err
+		}
+		var number recordNumber
+		if rec.Header == nil {
+			_, window, ok := c.readState13(0)
+			if !ok || rec.Epoch != 0 || rec.Type == typeApplicationData || rec.Type == typeChangeCipherSpec {
+				c.logf("Discarding plaintext %s record of epoch %d", rec.Type, rec.Epoch)
+				continue
+			}
+			if !c.config.DisableReplayDetection && window.isReplay(rec.SequenceNumber) {
+				c.logf("Discarding replayed record with sequence number %d", rec.SequenceNumber)
+				continue
+			}
+			window.update(rec.SequenceNumber)
+			typ, payload = rec.Type, rec.Payload
+			number = recordNumber{sequenceNumber: rec.SequenceNumber}
+		} else {
+			epoch, ok := c.unifiedEpoch(rec.Epoch)
+			if !ok {
+				c.logf("Discarding record of unknown epoch %d", rec.Epoch)
+				continue
+			}
+			state, window, ok := c.readState13(epoch)
+			if !ok {
+				if len(c.nextEpochRecords) < maxNextEpochRecords {
+					c.logf("Buffering record of epoch %d until the epoch starts", epoch)
+					c.nextEpochRecords = append(c.nextEpochRecords, rec)
+				}
+				continue
+			}
+			var inner []byte
+			if inner, number, ok = c.openRecord13(rec, epoch, state, window); !ok {
+				continue
+			}
+			if typ, payload, err = readInnerPlaintext(inner); err != nil {
+				return typ, nil, err
+			}
+			if err = c.checkRecordOverflow(payload); err != nil {
+				return typ, nil, err
+			}
+			window.update(number.sequenceNumber)
+		}
+		c.lastRecord = number
+		c.readSequenceNumber = number.sequenceNumber
+		if typ == typeAlert {
+			if err = c.receiveAlert(payload); err != nil {
+				return typ, nil, err
+			}
+		}
+		return typ, payload, nil
+	}
+}
+
+// openRecord13 decrypts the sequence number and the payload of a record
+// with the unified header. It reports false if the record is replayed or
+// can not be authenticated.
+func (c *Conn) openRecord13(rec *record, epoch uint16, state *securityParameters, window *replayWindow) ([]byte, recordNumber, bool) {
+	if state.AEAD == nil || len(rec.Payload) < 16 || len(rec.Payload) < state.AEAD.Overhead() {
+		c.logf("Discarding record of epoch %d without keys or too short", epoch)
+		return nil, recordNumber{}, false
+	}
+	header := append([]byte(nil), rec.Header...)
+	mask := state.sequenceNumberMask(rec.Payload)
+	bits := uint(8)
+	header[1] ^= mask[0]
+	truncated := uint64(header[1])
+	if header[0]&unifiedHeaderSequence16 != 0 {
+		bits = 16
+		header[2] ^= mask[1]
+		truncated = uint64(binary.BigEndian.Uint16(header[1:]))
+	}
+	sequenceNumber := window.expand(truncated, bits)
+	if !c.config.DisableReplayDetection && window.isReplay(sequenceNumber) {
+		c.logf("Discarding replayed record with sequence number %d", sequenceNumber)
+		return nil, recordNumber{}, false
+	}
+	nonce := make([]byte, 8)
+	binary.BigEndian.PutUint64(nonce, sequenceNumber)
+	inner, err := state.AEAD.Open(nil, nonce, rec.Payload, header)
+	if err != nil {
+		c.logf("Discarding record of epoch %d which failed to decrypt: %s", epoch, err)
+		return nil, recordNumber{}, false
+	}
+	return inner, recordNumber{epoch: uint64(epoch), sequenceNumber: sequenceNumber}, true
+}
+
+// unifiedEpoch returns the epoch of a record whose unified header carries
+// the low two bits of it. Only the epochs we read and the next one are
+// considered.
+func (c *Conn) unifiedEpoch(bits uint16) (uint16, bool) {
+	next := c.readEpoch + 1
+	if c.readEpoch == 0 {
+		next = epochHandshake
+	}
+	for _, epoch := range []uint16{c.readEpoch, c.previousReadEpoch, next} {
+		if epoch > 0 && epoch&unifiedHeaderEpoch == bits {
+			return epoch, true
+		}
+	}
+	return 0, false
+}
+
+// readState13 returns the read state and replay window of a DTLS 1.3
+// epoch, if it is readEpoch or the one before.
+func (c *Conn) readState13(epoch uint16) (*securityParameters, *replayWindow, bool) {
+	switch epoch {
+	case c.readEpoch:
+		return &c.currentReadState, &c.replayWindow, true
+	case c.previousReadEpoch:
+		return &c.previousReadState, &c.previousReplayWindow, true
+	}
+	return nil, nil, false
+}
+
+// setReadEpoch starts reading a DTLS 1.3 epoch with state. The previous
+// epoch stays readable for retransmissions and reordered records.
+func (c *Conn) setReadEpoch(epoch uint16, state securityParameters) {
+	c.previousReadEpoch, c.previousReadState, c.previousReplayWindow = c.readEpoch, c.currentReadState, c.replayWindow
+	c.readEpoch, c.currentReadState, c.replayWindow = epoch, state, replayWindow{}
+	c.recordQueue = append(c.nextEpochRecords, c.recordQueue...)
+	c.nextEpochRecords = nil
+}
+
+// setWriteEpoch starts writing a DTLS 1.3 epoch with state. Writes of the
+// application may run concurrently after the handshake, so the switch
+// happens under the writeMutex.
+func (c *Conn) setWriteEpoch(epoch uint16, state securityParameters) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.epoch, c.currentWriteState = epoch, state
+}
@@ -0,0 +1,35 @@
+package dtls
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// handshakeEncryptedExtensions carries the extensions of a DTLS 1.3 server
+// which are not needed to establish the handshake keys, RFC 8446 section
+// 4.3.1.
+type handshakeEncryptedExtensions struct {
+	Extensions []extension
+}
+
+func (ee handshakeEncryptedExtensions) Bytes() []byte {
+	data := bytes.Buffer{}
+	for _, extension := range ee.Extensions {
+		data.Write(extension.Bytes())
+	}
+	return opaque16(data.Bytes())
+}
+
+func (ee handshakeEncryptedExtensions) String() string {
+	return fmt.Sprintf("EncryptedExtensions{ Extensions: %d }", len(ee.Extensions))
+}
+
+func readHandshakeEncryptedExtensions(byts []byte) (ee handshakeEncryptedExtensions, err error) {
+	if len(byts) < 2 {
+		return ee, InvalidHandshakeError
+	}
+	if ee.Extensions, err = readExtensions(bytes.NewBuffer(byts)); err != nil {
+		return ee, InvalidHandshakeError
+	}
+	return
+}
@@ -14,20 +14,32 @@ func (et extensionType) Bytes() []byte {
 	return buffer
 }
 
+// readExtensionType reads the type of an extension. Unknown types are
+// returned as well, the caller ignores the extensions it does not know.
 func readExtensionType(buffer *bytes.Buffer) (extensionType, error) {
-	n := readUint16(buffer)
-	switch n {
-	case 13:
-		return ExtensionSignatureAlgorithms, nil
-	default:
+	if buffer.Len() < 2 {
 		return 0, InvalidExtensionTypeError
 	}
+	return extensionType(readUint16(buffer)), nil
 }
 
 var InvalidExtensionTypeError = errors.New("Invalid extension type")
 
 const (
-	ExtensionSignatureAlgorithms extensionType = 13
+	ExtensionMaxFragmentLength      extensionType = 1
+	ExtensionSupportedGroups        extensionType = 10
+	ExtensionECPointFormats         extensionType = 11
+	ExtensionSignatureAlgorithms    extensionType = 13
+	ExtensionEncryptThenMAC         extensionType = 22
+	ExtensionExtendedMasterSecret   extensionType = 23
+	ExtensionRecordSizeLimit        extensionType = 28
+	ExtensionSessionTicket          extensionType = 35
+	ExtensionSupportedVersions      extensionType = 43
+	ExtensionCookie                 extensionType = 44
+	ExtensionCertificateAuthorities extensionType = 47
+	ExtensionKeyShare               extensionType = 51
+	ExtensionConnectionID           extensionType = 54
+	ExtensionRenegotiationInfo      extensionType = 0xff01
 )
 
 type extension struct {
@@ -52,6 +64,53 @@ func readExtension(buffer *bytes.Buffer) (e extension, err error) {
 	return
 }
 
+// readExtensions reads the extensions block at the end of a hello message.
+// The block is optional, so an empty buffer yields no extensions.
+func readExtensions(buffer *bytes.Buffer) (extensions []extension, err error) {
+	if buffer.Len() == 0 {
+		return nil, nil
+	}
+	data, err := readOpaque16(buffer)
+	if err != nil || buffer.Len() != 0 {
+		return nil, InvalidExtensionError
+	}
+	extensionBuffer := bytes.NewBuffer(data)
+	for extensionBuffer.Len() > 0 {
+		e, err := readExtension(extensionBuffer)
+		if err != nil {
+			return nil, err
+		}
+		extensions = append(extensions, e)
+	}
+	return
+}
+
+// writeExtensions writes the extensions block of a hello message. It is
+// left out if there are no extensions.
+func writeExtensions(buffer *bytes.Buffer, extensions []extension) {
+	if len(extensions) == 0 {
+		return
+	}
+	data := bytes.Buffer{}
+	for _, extension := range extensions {
+		data.Write(extension.Bytes())
+	}
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(data.Len()))
+	buffer.Write(b)
+	buffer.Write(data.Bytes())
+}
+
+// findExtension returns the extension of type typ, if present.
+func findExtension(extensions []extension, typ extensionType) (extension, bool) {
+	for _, e := range extensions {
+		if e.Type == typ {
+			return e, true
+		}
+	}
+	return extension{}, false
+}
+
 func (e extension) Bytes() []byte {
 	buffer := bytes.Buffer{}
 	buffer.Write(e.Type.Bytes())
@@ -10,17 +10,23 @@ import (
 type handshakeType byte
 
 const (
-	helloRequest       handshakeType = 0
-	clientHello                      = 1
-	serverHello                      = 2
-	helloVerifyRequest               = 3
-	certificate                      = 11
-	serverKeyExchange                = 12
-	certificateRequest               = 13
-	serverHelloDone                  = 14
-	certificateVerify                = 15
-	clientKeyExchange                = 16
-	finished                         = 20
+	helloRequest        handshakeType = 0
+	clientHello                       = 1
+	serverHello                       = 2
+	helloVerifyRequest                = 3
+	newSessionTicket                  = 4
+	encryptedExtensions               = 8
+	certificate                       = 11
+	serverKeyExchange                 = 12
+	certificateRequest                = 13
+	serverHelloDone                   = 14
+	certificateVerify                 = 15
+	clientKeyExchange                 = 16
+	finished                          = 20
+	keyUpdate                         = 24
+	// messageHash replaces the first ClientHello in the transcript of a
+	// DTLS 1.3 handshake with a HelloRetryRequest, it is never sent.
+	messageHash = 254
 )
 
 func (ht handshakeType) Bytes() []byte {
@@ -37,6 +43,10 @@ func (ht handshakeType) String() string {
 		return "ServerHello"
 	case helloVerifyRequest:
 		return "HelloVerifyRequest"
+	case newSessionTicket:
+		return "NewSessionTicket"
+	case encryptedExtensions:
+		return "EncryptedExtensions"
 	case certificate:
 		return "Certificate"
 	case serverKeyExchange:
@@ -51,6 +61,8 @@ func (ht handshakeType) String() string {
 		return "ClientKeyExchange"
 	case finished:
 		return "Finished"
+	case keyUpdate:
+		return "KeyUpdate"
 	default:
 		return "xxx"
 	}
@@ -72,6 +84,10 @@ func readHandshakeType(buffer *bytes.Buffer) (handshakeType, error) {
 		return serverHello, nil
 	case 3:
 		return helloVerifyRequest, nil
+	case 4:
+		return newSessionTicket, nil
+	case 8:
+		return encryptedExtensions, nil
 	case 11:
 		return certificate, nil
 	case 12:
@@ -86,6 +102,8 @@ func readHandshakeType(buffer *bytes.Buffer) (handshakeType, error) {
 		return clientKeyExchange, nil
 	case 20:
 		return finished, nil
+	case 24:
+		return keyUpdate, nil
 	default:
 		return 0, InvalidHandshakeType
 	}
@@ -116,6 +134,9 @@ func readHandshake(buffer *bytes.Buffer) (h handshake, err error) {
 	if buffer.Len() < int(h.FragmentLength) {
 		return h, errors.New("Buffer does not contain all bytes of fragment")
 	}
+	if h.FragmentOffset+h.FragmentLength > h.Length {
+		return h, errors.New("Fragment exceeds the length of the handshake message")
+	}
 	h.Fragment = buffer.Next(int(h.FragmentLength))
 	return
 }
@@ -139,6 +160,13 @@ func (h handshake) Bytes() []byte {
 	return buffer.Bytes()
 }
 
+// transcriptBytes returns the message with the header of TLS 1.3, which
+// lacks the sequence number and fragment fields. DTLS 1.3 hashes its
+// transcript in this form, RFC 9147 section 5.2.
+func (h handshake) transcriptBytes() []byte {
+	return append([]byte{byte(h.MsgType), byte(h.Length >> 16), byte(h.Length >> 8), byte(h.Length)}, h.Fragment...)
+}
+
 func (h handshake) String() string {
 	return fmt.Sprintf("Handshake{ Type: %s, Length: %d, MessageSeq: %d, FragmentOffset: %d, FragmentLength: %d, Fragment: %x }", h.MsgType, h.Length, h.MessageSeq, h.FragmentOffset, h.FragmentLength, h.Fragment)
 }
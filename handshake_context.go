@@ -1,20 +1,55 @@
 package dtls
 
 import (
-	"fmt"
-	"log"
-	"os"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/tls"
+	"time"
 )
 
+// Retransmission timer bounds from RFC 6347, section 4.2.4.1. The initial
+// timeout is a variable so tests can shorten it.
+var initialRetransmitTimeout = 1 * time.Second
+
+const maxRetransmitTimeout = 60 * time.Second
+
 type handshakeContext interface {
+	base() *baseHandshakeContext
 	beginHandshake()
 	continueHandshake(*handshake) (bool, error)
+	receiveMessage(*handshake)
+	retransmitFlight()
+	retransmitTimeout() time.Duration
+	verifyData() (client, server []byte)
+}
+
+// A flight is the group of handshake messages one side sends before it
+// waits for the peer. It is kept so it can be retransmitted if the peer
+// does not answer.
+type flight struct {
+	messages []*handshake
+	// changeCipherSpec is the index of the message in front of which a
+	// ChangeCipherSpec is sent, or -1 if the flight contains none.
+	changeCipherSpec int
+	// handshakeKeys is the index of the first message of a DTLS 1.3 flight
+	// that is protected with the handshake traffic keys, or -1.
+	handshakeKeys int
+	// answered is the sequence number of the first peer message the
+	// flight does not answer. The peer's retransmission of the flight
+	// that it answers ends with the message before.
+	answered uint16
+	// retransmissions counts how often the flight was retransmitted and
+	// largestDatagram is the size of the largest datagram of its last
+	// transmission.
+	retransmissions int
+	largestDatagram int
 }
 
 type baseHandshakeContext struct {
 	*Conn
 
 	isServer                  bool
+	renegotiation             bool
 	nextReceiveSequenceNumber uint16
 	sequenceNumber            uint16
 	currentFlight             int
@@ -26,6 +61,41 @@ type baseHandshakeContext struct {
 	keyAgreement              keyAgreement
 	masterSecret              []byte
 	finishedHash              finishedHash
+	lastFlight                *flight
+	currentTimeout            time.Duration
+
+	// certificate is the certificate we authenticate with, if any.
+	certificate *tls.Certificate
+	// curve is the curve the server selected for an ECDHE key exchange.
+	curve namedCurve
+	// peerSignatureAlgorithms are the algorithms offered in the client's
+	// signature_algorithms extension or in the server's
+	// CertificateRequest, nil if the peer sent none.
+	peerSignatureAlgorithms []signatureAndHash
+	// encryptThenMAC is set if the records of the new keys are protected
+	// with encrypt-then-MAC, RFC 7366.
+	encryptThenMAC bool
+	// useConnectionID is set if both sides agreed on connection IDs, RFC
+	// 9146. The records we send then carry peerConnectionID.
+	useConnectionID  bool
+	peerConnectionID []byte
+
+	// keyShare is our key of the DTLS 1.3 key exchange in the group curve.
+	keyShare *ecdh.PrivateKey
+	// helloRetryRequest is the HelloRetryRequest of a DTLS 1.3 handshake
+	// and clientHelloHash the hash of the ClientHello it answered. Both
+	// start the transcript, RFC 8446 section 4.4.1.
+	helloRetryRequest *handshake
+	clientHelloHash   []byte
+	// helloRetryCookie is the cookie a client repeats from the
+	// HelloRetryRequest.
+	helloRetryCookie []byte
+	// clientHandshakeSecret and serverHandshakeSecret are the DTLS 1.3
+	// handshake traffic secrets, handshakeSecret the secret they are
+	// derived from.
+	handshakeSecret       []byte
+	clientHandshakeSecret []byte
+	serverHandshakeSecret []byte
 
 	//We omit the pre-flight, i.e. HelloVerify because otherwise we would need to keep state
 	//defeating the purpose of HelloVerify
@@ -33,11 +103,13 @@ type baseHandshakeContext struct {
 	clientHello *handshake
 
 	//Flight 2
-	serverHello        *handshake
-	serverCertificate  *handshake
-	serverKeyExchange  *handshake
-	certificateRequest *handshake
-	serverHelloDone    *handshake
+	serverHello             *handshake
+	encryptedExtensions     *handshake
+	serverCertificate       *handshake
+	serverCertificateVerify *handshake
+	serverKeyExchange       *handshake
+	certificateRequest      *handshake
+	serverHelloDone         *handshake
 
 	//Flight 3
 	clientCertificate *handshake
@@ -45,15 +117,29 @@ type baseHandshakeContext struct {
 	certificateVerify *handshake
 	clientFinished    *handshake
 
-	//Flight 4
-	serverFinished *handshake
+	//Flight 4, the NewSessionTicket is sent in flight 2 of an abbreviated
+	//handshake
+	newSessionTicket *handshake
+	serverFinished   *handshake
 
 	handshakeMessageBuffer map[uint16]*handshakeFragmentList
 }
 
+func (hc *baseHandshakeContext) base() *baseHandshakeContext {
+	return hc
+}
+
 func (hc *baseHandshakeContext) receiveMessage(message *handshake) {
 	if message.MessageSeq < hc.nextReceiveSequenceNumber {
-		log.Printf("Received handshake message with lower sequence number than next expected")
+		hc.logf("Received handshake message with lower sequence number than next expected")
+		// The peer retransmitted the flight we answered last, so ours got
+		// lost. Only the final fragment of the flight triggers a resend to
+		// avoid resending once per retransmitted message. Messages of the
+		// peer's current flight, which arrived only in part, do not.
+		if hc.lastFlight != nil && message.MessageSeq == hc.lastFlight.answered-1 &&
+			message.FragmentOffset+message.FragmentLength == message.Length {
+			hc.writeFlight(true)
+		}
 		return
 	}
 	if message.MessageSeq == hc.nextReceiveSequenceNumber &&
@@ -95,16 +181,26 @@ func (hc *baseHandshakeContext) storeMessage(message *handshake) {
 		switch message.MsgType {
 		case serverHello:
 			hc.serverHello = message
+		case encryptedExtensions:
+			hc.encryptedExtensions = message
 		case certificate:
 			hc.serverCertificate = message
+		case certificateVerify:
+			hc.serverCertificateVerify = message
 		case serverKeyExchange:
 			hc.serverKeyExchange = message
 		case certificateRequest:
 			hc.certificateRequest = message
 		case serverHelloDone:
 			hc.serverHelloDone = message
+		case newSessionTicket:
+			hc.newSessionTicket = message
+		case finished:
+			// The server finishes an abbreviated handshake right
+			// after the ServerHello.
+			hc.serverFinished = message
 		default:
-			log.Printf("Unable to store received handshake message!")
+			hc.logf("Unable to store received handshake message!")
 			//TODO: how do we handle invalid handshake messages?
 		}
 		return
@@ -120,17 +216,104 @@ func (hc *baseHandshakeContext) storeMessage(message *handshake) {
 		case finished:
 			hc.clientFinished = message
 		default:
-			log.Printf("Unable to store received handshake message!")
+			hc.logf("Unable to store received handshake message!")
 			//TODO: how do we handle invalid handshake messages?
 		}
 		return
 	}
-	if hc.currentFlight == 4 && message.MsgType == finished {
-		hc.serverFinished = message
-		//TODO: handle out of order handshake messages?
+	if hc.currentFlight == 4 {
+		switch message.MsgType {
+		case newSessionTicket:
+			hc.newSessionTicket = message
+		case finished:
+			hc.serverFinished = message
+		default:
+			hc.logf("Unable to store received handshake message!")
+		}
 		return
 	}
-	log.Printf("Unable to store received handshake message!")
+	hc.logf("Unable to store received handshake message!")
+}
+
+// establishKeys derives the connection keys from masterSecret and installs
+// them in the pending read and write states.
+func (hc *baseHandshakeContext) establishKeys(masterSecret []byte) {
+	hc.masterSecret = masterSecret
+	clientMAC, serverMAC, clientKey, serverKey, clientIV, serverIV :=
+		keysFromMasterSecret(hc.Conn.version, &hc.cipherSuite, masterSecret, hc.clientRandom.Bytes(), hc.serverRandom.Bytes())
+	if hc.isServer {
+		hc.Conn.pendingWriteState.setKeys(&hc.cipherSuite, serverMAC, serverKey, serverIV)
+		hc.Conn.pendingReadState.setKeys(&hc.cipherSuite, clientMAC, clientKey, clientIV)
+	} else {
+		hc.Conn.pendingWriteState.setKeys(&hc.cipherSuite, clientMAC, clientKey, clientIV)
+		hc.Conn.pendingReadState.setKeys(&hc.cipherSuite, serverMAC, serverKey, serverIV)
+	}
+	hc.Conn.pendingWriteState.encryptThenMAC = hc.encryptThenMAC
+	hc.Conn.pendingReadState.encryptThenMAC = hc.encryptThenMAC
+	if hc.useConnectionID {
+		hc.Conn.pendingWriteState.connectionID = hc.peerConnectionID
+		hc.Conn.pendingReadState.connectionID = hc.Conn.connectionID
+	}
+	if err := hc.config.writeKeyLog(keyLogLabelMasterSecret, hc.clientRandom.Bytes(), masterSecret); err != nil {
+		hc.logf("Unable to write master secret to key log: %s", err)
+	}
+}
+
+// deriveMasterSecret derives the master secret of a full handshake from
+// preMasterSecret. The extended master secret is derived from the session
+// hash, the hash of the messages up to the ClientKeyExchange, RFC 7627
+// section 4.
+func (hc *baseHandshakeContext) deriveMasterSecret(preMasterSecret []byte) []byte {
+	if !hc.Conn.extendedMasterSecret {
+		return masterFromPreMasterSecret(hc.Conn.version, &hc.cipherSuite, preMasterSecret, hc.clientRandom.Bytes(), hc.serverRandom.Bytes())
+	}
+	sessionHash := newFinishedHash(&hc.cipherSuite)
+	sessionHash.Write(hc.certificateVerifyTranscript())
+	return extendedMasterFromPreMasterSecret(hc.Conn.version, &hc.cipherSuite, preMasterSecret, sessionHash.sum(hc.Conn.version))
+}
+
+// clientFinishedHash returns the hash over the messages up to the client's
+// Finished message, leaving out the optional ones that were not sent.
+func (hc *baseHandshakeContext) clientFinishedHash() finishedHash {
+	hash := newFinishedHash(&hc.cipherSuite)
+	for _, message := range presentMessages(hc.clientHello, hc.serverHello, hc.serverCertificate,
+		hc.serverKeyExchange, hc.certificateRequest, hc.serverHelloDone, hc.clientCertificate,
+		hc.clientKeyExchange, hc.certificateVerify) {
+		hash.Write(message.Bytes())
+	}
+	return hash
+}
+
+// certificateVerifyTranscript returns the messages a client signs in its
+// CertificateVerify message, all messages up to its ClientKeyExchange.
+func (hc *baseHandshakeContext) certificateVerifyTranscript() []byte {
+	transcript := bytes.Buffer{}
+	for _, message := range presentMessages(hc.clientHello, hc.serverHello, hc.serverCertificate,
+		hc.serverKeyExchange, hc.certificateRequest, hc.serverHelloDone, hc.clientCertificate,
+		hc.clientKeyExchange) {
+		transcript.Write(message.Bytes())
+	}
+	return transcript.Bytes()
+}
+
+// presentMessages returns messages without the nil ones, i.e. without the
+// optional messages that are not part of this handshake.
+func presentMessages(messages ...*handshake) []*handshake {
+	present := make([]*handshake, 0, len(messages))
+	for _, message := range messages {
+		if message != nil {
+			present = append(present, message)
+		}
+	}
+	return present
+}
+
+// fragmentOf returns the body of message or nil if it was not received.
+func fragmentOf(message *handshake) []byte {
+	if message == nil {
+		return nil
+	}
+	return message.Fragment
 }
 
 func (hc *baseHandshakeContext) buildNextHandshakeMessage(typ handshakeType, handshakeMessage []byte) *handshake {
@@ -146,18 +329,81 @@ func (hc *baseHandshakeContext) buildNextHandshakeMessage(typ handshakeType, han
 	return hdshk
 }
 
-func (hc *baseHandshakeContext) sendHandshakeMessage(message *handshake) {
-	hc.Conn.sendRecord(typeHandshake, message.Bytes())
+// sendFlight sends messages as a new flight and restarts the
+// retransmission timer.
+func (hc *baseHandshakeContext) sendFlight(messages []*handshake, changeCipherSpec int) {
+	hc.lastFlight = &flight{messages: messages, changeCipherSpec: changeCipherSpec, handshakeKeys: -1, answered: hc.nextReceiveSequenceNumber}
+	hc.currentTimeout = initialRetransmitTimeout
+	hc.writeFlight(false)
+}
+
+// sendFlight13 sends messages as a new DTLS 1.3 flight, the messages from
+// handshakeKeys on are protected with the handshake traffic keys.
+func (hc *baseHandshakeContext) sendFlight13(messages []*handshake, handshakeKeys int) {
+	hc.lastFlight = &flight{messages: messages, changeCipherSpec: -1, handshakeKeys: handshakeKeys, answered: hc.nextReceiveSequenceNumber}
+	hc.currentTimeout = initialRetransmitTimeout
+	hc.writeFlight(false)
 }
 
-func logMasterSecret(clientRandom, masterSecret []byte) {
-	f, err := os.OpenFile("/home/maufl/.dtls-secrets", os.O_APPEND|os.O_WRONLY, 0600)
-	if err != nil {
-		log.Printf("Unable to open log file for DTLS master secret: %s", err)
+// writeFlight writes the last flight to the peer, packed into as few
+// datagrams as the MTU allows. A retransmitted flight reuses the epoch of
+// the original transmission, so messages in front of the ChangeCipherSpec
+// are protected with the previous write state.
+func (hc *baseHandshakeContext) writeFlight(retransmit bool) {
+	if hc.lastFlight == nil {
 		return
 	}
-	defer f.Close()
-	if _, err = f.WriteString(fmt.Sprintf("CLIENT_RANDOM %x %x\n", clientRandom, masterSecret)); err != nil {
-		log.Printf("Unable to write master secret to log file: %s", err)
+	c := hc.Conn
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.batch = &recordBatch{}
+	defer func() { c.batch = nil }()
+	beforeChangeCipherSpec := retransmit && hc.lastFlight.changeCipherSpec >= 0
+	for i, message := range hc.lastFlight.messages {
+		if i == hc.lastFlight.changeCipherSpec {
+			if retransmit {
+				c.writeRecord(typeChangeCipherSpec, c.epoch-1, &c.previousWriteState, []byte{1})
+			} else {
+				c.writeChangeCipherSpec()
+			}
+			beforeChangeCipherSpec = false
+		}
+		epoch, state := c.epoch, &c.currentWriteState
+		if hc.lastFlight.handshakeKeys >= 0 && i >= hc.lastFlight.handshakeKeys {
+			epoch, state = epochHandshake, &c.handshakeWriteState
+		} else if beforeChangeCipherSpec {
+			epoch, state = c.epoch-1, &c.previousWriteState
+		}
+		c.writeHandshake(message, epoch, state)
+	}
+	c.flushBatch()
+	hc.lastFlight.largestDatagram = c.batch.largest
+}
+
+// retransmitFlight resends the last flight after the retransmission timer
+// expired and doubles the timeout. A flight that keeps getting lost is
+// resent with a smaller MTU.
+func (hc *baseHandshakeContext) retransmitFlight() {
+	if hc.lastFlight != nil {
+		if hc.lastFlight.retransmissions += 1; hc.lastFlight.retransmissions >= mtuRetransmissions {
+			hc.Conn.reduceMTU(hc.lastFlight.largestDatagram)
+		}
+	}
+	hc.writeFlight(true)
+	hc.currentTimeout *= 2
+	if hc.currentTimeout > maxRetransmitTimeout {
+		hc.currentTimeout = maxRetransmitTimeout
+	}
+}
+
+// verifyData returns the verify data of both Finished messages.
+func (hc *baseHandshakeContext) verifyData() (client, server []byte) {
+	return fragmentOf(hc.clientFinished), fragmentOf(hc.serverFinished)
+}
+
+func (hc *baseHandshakeContext) retransmitTimeout() time.Duration {
+	if hc.currentTimeout == 0 {
+		return initialRetransmitTimeout
 	}
+	return hc.currentTimeout
 }
@@ -0,0 +1,129 @@
+package dtls
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+)
+
+// transcriptHash13 returns the hash of the DTLS 1.3 transcript up to and
+// including last. The transcript contains the messages without the DTLS
+// fields of their header and after a HelloRetryRequest starts with the
+// hash of the first ClientHello, RFC 9147 section 5.2.
+func (hc *baseHandshakeContext) transcriptHash13(last *handshake) []byte {
+	hash := hc.cipherSuite.prfHash()()
+	if hc.helloRetryRequest != nil {
+		hash.Write(messageHashOf(hc.clientHelloHash).transcriptBytes())
+		hash.Write(hc.helloRetryRequest.transcriptBytes())
+	}
+	for _, message := range presentMessages(hc.clientHello, hc.serverHello, hc.encryptedExtensions,
+		hc.certificateRequest, hc.serverCertificate, hc.serverCertificateVerify, hc.serverFinished,
+		hc.clientCertificate, hc.certificateVerify, hc.clientFinished) {
+		hash.Write(message.transcriptBytes())
+		if message == last {
+			break
+		}
+	}
+	return hash.Sum(nil)
+}
+
+// lastMessage returns the last of messages that is not nil.
+func lastMessage(messages ...*handshake) *handshake {
+	present := presentMessages(messages...)
+	return present[len(present)-1]
+}
+
+// establishHandshakeKeys derives the handshake traffic secrets from the
+// shared secret of the key exchange once the ServerHello is known. The
+// peer's handshake messages are read with them right away, ours are sent
+// with them from the EncryptedExtensions on.
+func (hc *baseHandshakeContext) establishHandshakeKeys(sharedSecret []byte) {
+	suite := &hc.cipherSuite
+	transcriptHash := hc.transcriptHash13(hc.serverHello)
+	hc.handshakeSecret = suite.handshakeSecret(sharedSecret)
+	hc.clientHandshakeSecret = suite.deriveSecret(hc.handshakeSecret, labelClientHandshakeTraffic, transcriptHash)
+	hc.serverHandshakeSecret = suite.deriveSecret(hc.handshakeSecret, labelServerHandshakeTraffic, transcriptHash)
+	var readState securityParameters
+	if hc.isServer {
+		readState.setTrafficSecret(suite, hc.clientHandshakeSecret)
+		hc.Conn.handshakeWriteState.setTrafficSecret(suite, hc.serverHandshakeSecret)
+	} else {
+		readState.setTrafficSecret(suite, hc.serverHandshakeSecret)
+		hc.Conn.handshakeWriteState.setTrafficSecret(suite, hc.clientHandshakeSecret)
+	}
+	hc.Conn.setReadEpoch(epochHandshake, readState)
+	hc.writeKeyLog13(keyLogLabelClientHandshakeSecret, hc.clientHandshakeSecret)
+	hc.writeKeyLog13(keyLogLabelServerHandshakeSecret, hc.serverHandshakeSecret)
+}
+
+// establishApplicationKeys derives the application traffic secrets once
+// the server's Finished message is known and installs them in the pending
+// read and write states.
+func (hc *baseHandshakeContext) establishApplicationKeys() {
+	suite := &hc.cipherSuite
+	transcriptHash := hc.transcriptHash13(hc.serverFinished)
+	masterSecret := suite.masterSecret13(hc.handshakeSecret)
+	clientSecret := suite.deriveSecret(masterSecret, labelClientTraffic, transcriptHash)
+	serverSecret := suite.deriveSecret(masterSecret, labelServerTraffic, transcriptHash)
+	if hc.isServer {
+		hc.Conn.pendingWriteState.setTrafficSecret(suite, serverSecret)
+		hc.Conn.pendingReadState.setTrafficSecret(suite, clientSecret)
+	} else {
+		hc.Conn.pendingWriteState.setTrafficSecret(suite, clientSecret)
+		hc.Conn.pendingReadState.setTrafficSecret(suite, serverSecret)
+	}
+	hc.writeKeyLog13(keyLogLabelClientTrafficSecret, clientSecret)
+	hc.writeKeyLog13(keyLogLabelServerTrafficSecret, serverSecret)
+}
+
+func (hc *baseHandshakeContext) writeKeyLog13(label string, secret []byte) {
+	if err := hc.config.writeKeyLog(label, hc.clientRandom.Bytes(), secret); err != nil {
+		hc.logf("Unable to write %s to key log: %s", label, err)
+	}
+}
+
+// newCertificateVerify13 signs the transcript up to our certificate
+// message, RFC 8446 section 4.4.3.
+func (hc *baseHandshakeContext) newCertificateVerify13(context string, certificateMessage *handshake) (*handshake, error) {
+	algorithm, err := selectSignatureAlgorithm(DTLS_13, certificatePublicKey(hc.certificate), hc.peerSignatureAlgorithms)
+	if err != nil {
+		return nil, newAlertError(AlertHandshakeFailure, "No signature algorithm for our certificate: %s", err)
+	}
+	signature, err := signData(DTLS_13, hc.certificate.PrivateKey, algorithm, signedContent13(context, hc.transcriptHash13(certificateMessage)))
+	if err != nil {
+		return nil, newAlertError(AlertInternalError, "Unable to sign certificate verify: %s", err)
+	}
+	return hc.buildNextHandshakeMessage(certificateVerify, digitallySigned{Algorithm: algorithm, Signature: signature}.Bytes(DTLS_13)), nil
+}
+
+// verifyCertificateVerify13 checks the peer's signature over the transcript
+// hash, which must be made with one of our signature algorithms.
+func verifyCertificateVerify13(message *handshake, key crypto.PublicKey, context string, transcriptHash []byte) error {
+	if message == nil {
+		return newAlertError(AlertUnexpectedMessage, "Peer did not send certificate verify")
+	}
+	signed, err := readDigitallySigned(bytes.NewBuffer(message.Fragment), DTLS_13)
+	if err != nil {
+		return newAlertError(AlertDecodeError, "Error while reading certificate verify: %s", err)
+	}
+	if !isSupportedSignatureAlgorithm(signed.Algorithm, signatureAlgorithms13) {
+		return newAlertError(AlertIllegalParameter, "Peer signed with unsupported algorithm %s", signed.Algorithm)
+	}
+	if err := verifySignature(DTLS_13, key, signed.Algorithm, signed.Signature, signedContent13(context, transcriptHash)); err != nil {
+		return newAlertError(AlertDecryptError, "Invalid certificate verify signature: %s", err)
+	}
+	return nil
+}
+
+// verifyFinished13 checks the verify data of a Finished message sent with
+// trafficSecret.
+func verifyFinished13(message *handshake, suite *cipherSuite, trafficSecret, transcriptHash []byte) error {
+	finished, err := readHandshakeFinished(message.Fragment)
+	if err != nil {
+		return newAlertError(AlertDecodeError, "Error while reading finished: %s", err)
+	}
+	if !hmac.Equal(finished.VerifyData, suite.finishedMAC(trafficSecret, transcriptHash)) {
+		return newAlertError(AlertDecryptError, "Peer sent incorrect verify data")
+	}
+	return nil
+}
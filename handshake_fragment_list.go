@@ -48,13 +48,16 @@ func (hfl *handshakeFragmentList) IsComplete() bool {
 		hfl.Fragments[0].FragmentLength == hfl.Fragments[0].Length {
 		return true
 	}
+	// Fragments may overlap, e.g. if the peer retransmitted the message
+	// with a smaller MTU.
 	offset := uint32(0)
 	for _, handshake := range hfl.Fragments {
-		if handshake.FragmentOffset <= offset {
-			offset = handshake.FragmentOffset + handshake.FragmentLength
-		} else {
+		if handshake.FragmentOffset > offset {
 			return false
 		}
+		if end := handshake.FragmentOffset + handshake.FragmentLength; end > offset {
+			offset = end
+		}
 	}
 	if offset == hfl.Length {
 		return true
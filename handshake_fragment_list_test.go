@@ -35,10 +35,10 @@ func TestHandshakeFragmentList(t *testing.T) {
 	}
 	h := hfl.GetCompleteHandshake()
 	if h.MsgType != serverKeyExchange {
-		t.Errorf("Completed handshake has unexpected msg type %+v, expected is", h.MsgType, serverKeyExchange)
+		t.Errorf("Completed handshake has unexpected msg type %+v, expected is %+v", h.MsgType, serverKeyExchange)
 	}
 	if h.Length != 30 {
-		t.Errorf("Completed handshake has unexpected length %d, expected is 30", h.Length, 30)
+		t.Errorf("Completed handshake has unexpected length %d, expected is %d", h.Length, 30)
 	}
 	if h.MessageSeq != 2 {
 		t.Errorf("Completed handshake has unexpected message seq %d, expected is %d", h.MessageSeq, 2)
@@ -54,3 +54,29 @@ func TestHandshakeFragmentList(t *testing.T) {
 		t.Errorf("Completed handshake has unexpected fragment content %x,\nexpected is %x", h.Fragment, expected)
 	}
 }
+
+func TestHandshakeFragmentListOverlap(t *testing.T) {
+	// The message was first sent in fragments of 20 bytes and then
+	// retransmitted in fragments of 10 bytes.
+	h1 := &handshake{serverKeyExchange, 30, 2, 0, 20, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19}}
+	h2 := &handshake{serverKeyExchange, 30, 2, 0, 10, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}}
+	h3 := &handshake{serverKeyExchange, 30, 2, 20, 10, []byte{20, 21, 22, 23, 24, 25, 26, 27, 28, 29}}
+
+	hfl := newHandshakeFragmentList(h1)
+	if err := hfl.InsertFragment(h2); err != nil {
+		t.Errorf("Insert handshake %+v failed: %s", h2, err)
+	}
+	if hfl.IsComplete() {
+		t.Errorf("Handshake fragment list reports completion, but thats not possible")
+	}
+	if err := hfl.InsertFragment(h3); err != nil {
+		t.Errorf("Insert handshake %+v failed: %s", h3, err)
+	}
+	if !hfl.IsComplete() {
+		t.Errorf("Handshake fragment list reports not complete, but should be complete")
+	}
+	expected := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29}
+	if h := hfl.GetCompleteHandshake(); !bytes.Equal(h.Fragment, expected) {
+		t.Errorf("Completed handshake has unexpected fragment content %x,\nexpected is %x", h.Fragment, expected)
+	}
+}
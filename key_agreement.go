@@ -1,24 +1,43 @@
 package dtls
 
 import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
 	"github.com/maufl/dhkx"
 	"math/big"
 )
 
+// A keyAgreement implements the key exchange of a cipher suite. The methods
+// get the handshake context for the parameters negotiated so far. Errors
+// that are not *AlertError are reported with an illegal_parameter alert.
 type keyAgreement interface {
-	processServerKeyExchange(clientRandom, serverRandom random, serverKeyExchange handshakeServerKeyExchange) error
-	generateClientKeyExchange() ([]byte, handshakeClientKeyExchange, error)
-	generateServerKeyExchange() ([]byte, error)
-	processClientKeyExchange(handshakeClientKeyExchange) ([]byte, error)
+	// generateServerKeyExchange returns the body of the ServerKeyExchange
+	// message, or nil if the key exchange does not use one.
+	generateServerKeyExchange(hc *baseHandshakeContext) ([]byte, error)
+	processClientKeyExchange(hc *baseHandshakeContext, data []byte) (preMasterSecret []byte, err error)
+	// processServerKeyExchange gets a nil body if the server did not send
+	// a ServerKeyExchange message.
+	processServerKeyExchange(hc *baseHandshakeContext, data []byte) error
+	generateClientKeyExchange(hc *baseHandshakeContext) (preMasterSecret, clientKeyExchange []byte, err error)
 }
 
+var missingServerKeyExchangeError = newAlertError(AlertUnexpectedMessage, "Server did not send a ServerKeyExchange message")
+
 type dheKeyAgreement struct {
 	PrivateKey *dhkx.DHKey
 	PublicKey  *dhkx.DHKey
 	Group      *dhkx.DHGroup
 }
 
-func (ka *dheKeyAgreement) processServerKeyExchange(clientRandom, serverRandom random, serverKeyExchange handshakeServerKeyExchange) (err error) {
+func (ka *dheKeyAgreement) processServerKeyExchange(hc *baseHandshakeContext, data []byte) (err error) {
+	if data == nil {
+		return missingServerKeyExchangeError
+	}
+	serverKeyExchange, err := readHandshakeServerKeyExchange(data)
+	if err != nil {
+		return newAlertError(AlertDecodeError, "Error while reading server key exchange: %s", err)
+	}
 	ka.PublicKey = dhkx.NewPublicKey(serverKeyExchange.Params.PublicKey)
 
 	var p, g big.Int
@@ -30,15 +49,15 @@ func (ka *dheKeyAgreement) processServerKeyExchange(clientRandom, serverRandom r
 	return
 }
 
-func (ka *dheKeyAgreement) generateClientKeyExchange() (preMasterSecret []byte, clientKeyExchange handshakeClientKeyExchange, err error) {
-	clientKeyExchange.clientDiffieHellmanPublic.PublicKey = ka.PrivateKey.Bytes()
+func (ka *dheKeyAgreement) generateClientKeyExchange(hc *baseHandshakeContext) (preMasterSecret []byte, clientKeyExchange []byte, err error) {
+	clientKeyExchange = clientDiffieHellmanPublic{PublicKey: ka.PrivateKey.Bytes()}.Bytes()
 	if key, err := ka.Group.ComputeKey(ka.PublicKey, ka.PrivateKey); err == nil {
 		preMasterSecret = key.Bytes()
 	}
 	return
 }
 
-func (ka *dheKeyAgreement) generateServerKeyExchange() (serverKeyExchange []byte, err error) {
+func (ka *dheKeyAgreement) generateServerKeyExchange(hc *baseHandshakeContext) (serverKeyExchange []byte, err error) {
 	if ka.Group, err = dhkx.GetGroup(0); err != nil {
 		return
 	}
@@ -48,10 +67,240 @@ func (ka *dheKeyAgreement) generateServerKeyExchange() (serverKeyExchange []byte
 	return handshakeServerKeyExchange{Params: serverDHParams{P: ka.Group.P().Bytes(), G: ka.Group.G().Bytes(), PublicKey: ka.PrivateKey.Bytes()}}.Bytes(), nil
 }
 
-func (ka *dheKeyAgreement) processClientKeyExchange(clientKeyExchange handshakeClientKeyExchange) (preMasterSecret []byte, err error) {
+func (ka *dheKeyAgreement) processClientKeyExchange(hc *baseHandshakeContext, data []byte) (preMasterSecret []byte, err error) {
+	clientKeyExchange, err := readClientKeyExchange(data)
+	if err != nil {
+		return nil, newAlertError(AlertDecodeError, "Error while reading client key exchange: %s", err)
+	}
 	ka.PublicKey = dhkx.NewPublicKey(clientKeyExchange.PublicKey)
 	if key, err := ka.Group.ComputeKey(ka.PublicKey, ka.PrivateKey); err == nil {
 		preMasterSecret = key.Bytes()
 	}
 	return
 }
+
+// ecdheKeyAgreement implements ECDHE key exchanges where the server signs
+// its ephemeral key with its certificate, RFC 4492 section 2.2.
+type ecdheKeyAgreement struct {
+	signatureType signatureAlgorithm
+	curve         namedCurve
+	privateKey    *ecdh.PrivateKey
+	peerKey       *ecdh.PublicKey
+}
+
+func (ka *ecdheKeyAgreement) generateServerKeyExchange(hc *baseHandshakeContext) ([]byte, error) {
+	params, err := ka.generateServerParams(hc)
+	if err != nil {
+		return nil, err
+	}
+	if hc.certificate == nil {
+		return nil, newAlertError(AlertInternalError, "No certificate to sign the key exchange")
+	}
+	algorithm, err := selectSignatureAlgorithm(hc.Conn.version, certificatePublicKey(hc.certificate), hc.peerSignatureAlgorithms)
+	if err != nil {
+		return nil, newAlertError(AlertHandshakeFailure, "Client does not support a signature algorithm for our certificate")
+	}
+	signature, err := signData(hc.Conn.version, hc.certificate.PrivateKey, algorithm, hc.clientRandom.Bytes(), hc.serverRandom.Bytes(), params)
+	if err != nil {
+		return nil, newAlertError(AlertInternalError, "Unable to sign key exchange: %s", err)
+	}
+	return append(params, digitallySigned{Algorithm: algorithm, Signature: signature}.Bytes(hc.Conn.version)...), nil
+}
+
+// generateServerParams generates our ephemeral key on the negotiated curve
+// and returns the encoded ServerECDHParams.
+func (ka *ecdheKeyAgreement) generateServerParams(hc *baseHandshakeContext) ([]byte, error) {
+	ka.curve = hc.curve
+	curve, err := ka.curve.curve()
+	if err != nil {
+		return nil, err
+	}
+	if ka.privateKey, err = curve.GenerateKey(rand.Reader); err != nil {
+		return nil, err
+	}
+	return serverECDHParams{NamedCurve: ka.curve, PublicKey: ka.privateKey.PublicKey().Bytes()}.Bytes(), nil
+}
+
+func (ka *ecdheKeyAgreement) processClientKeyExchange(hc *baseHandshakeContext, data []byte) ([]byte, error) {
+	return ka.processClientPublic(bytes.NewBuffer(data))
+}
+
+// processClientPublic reads the client's ephemeral key, which has to fill
+// the rest of buffer, and returns the shared secret.
+func (ka *ecdheKeyAgreement) processClientPublic(buffer *bytes.Buffer) ([]byte, error) {
+	publicKey, err := readClientECDiffieHellmanPublic(buffer)
+	if err != nil || buffer.Len() != 0 {
+		return nil, newAlertError(AlertDecodeError, "Error while reading client key exchange")
+	}
+	curve, err := ka.curve.curve()
+	if err != nil {
+		return nil, err
+	}
+	peerKey, err := curve.NewPublicKey(publicKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return ka.privateKey.ECDH(peerKey)
+}
+
+func (ka *ecdheKeyAgreement) processServerKeyExchange(hc *baseHandshakeContext, data []byte) error {
+	if data == nil {
+		return missingServerKeyExchangeError
+	}
+	buffer := bytes.NewBuffer(data)
+	if err := ka.processServerParams(buffer); err != nil {
+		return err
+	}
+	signedParams := data[:len(data)-buffer.Len()]
+	signature, err := readDigitallySigned(buffer, hc.Conn.version)
+	if err != nil || buffer.Len() != 0 {
+		return newAlertError(AlertDecodeError, "Error while reading server key exchange signature")
+	}
+
+	if len(hc.peerCertificates) == 0 {
+		return newAlertError(AlertHandshakeFailure, "Server did not send a certificate")
+	}
+	publicKey := hc.peerCertificates[0].PublicKey
+	if typ, err := signatureTypeOf(publicKey); err != nil || typ != ka.signatureType {
+		return newAlertError(AlertUnsupportedCertificate, "Server certificate does not fit the cipher suite")
+	}
+	if hc.Conn.version == DTLS_12 && !isSupportedSignatureAlgorithm(signature.Algorithm, supportedSignatureAlgorithms) {
+		return newAlertError(AlertIllegalParameter, "Server used signature algorithm %s which we did not offer", signature.Algorithm)
+	}
+	if err := verifySignature(hc.Conn.version, publicKey, signature.Algorithm, signature.Signature, hc.clientRandom.Bytes(), hc.serverRandom.Bytes(), signedParams); err != nil {
+		return newAlertError(AlertDecryptError, "Invalid server key exchange signature: %s", err)
+	}
+	return nil
+}
+
+// processServerParams reads the server's ServerECDHParams from buffer.
+func (ka *ecdheKeyAgreement) processServerParams(buffer *bytes.Buffer) error {
+	params, err := readServerECDHParams(buffer)
+	if err == UnsupportedCurveError {
+		return err
+	} else if err != nil {
+		return newAlertError(AlertDecodeError, "Error while reading server key exchange: %s", err)
+	}
+	curve, err := params.NamedCurve.curve()
+	if err != nil {
+		return err
+	}
+	if ka.peerKey, err = curve.NewPublicKey(params.PublicKey); err != nil {
+		return err
+	}
+	ka.curve = params.NamedCurve
+	return nil
+}
+
+func (ka *ecdheKeyAgreement) generateClientKeyExchange(hc *baseHandshakeContext) ([]byte, []byte, error) {
+	curve, err := ka.curve.curve()
+	if err != nil {
+		return nil, nil, err
+	}
+	privateKey, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	preMasterSecret, err := privateKey.ECDH(ka.peerKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return preMasterSecret, clientECDiffieHellmanPublic{PublicKey: privateKey.PublicKey().Bytes()}.Bytes(), nil
+}
+
+// pskKeyAgreement implements the PSK key exchange of RFC 4279 section 2 and,
+// if ecdhe is set, the ECDHE_PSK key exchange of RFC 5489 section 2. The
+// server's ephemeral key is not signed, the pre-shared key authenticates
+// both sides.
+type pskKeyAgreement struct {
+	ecdhe *ecdheKeyAgreement
+}
+
+func (ka *pskKeyAgreement) generateServerKeyExchange(hc *baseHandshakeContext) ([]byte, error) {
+	hint := pskIdentity{Identity: hc.config.PSKIdentityHint}
+	if ka.ecdhe == nil {
+		// Without a hint the ServerKeyExchange is omitted.
+		if len(hint.Identity) == 0 {
+			return nil, nil
+		}
+		return hint.Bytes(), nil
+	}
+	params, err := ka.ecdhe.generateServerParams(hc)
+	if err != nil {
+		return nil, err
+	}
+	return append(hint.Bytes(), params...), nil
+}
+
+func (ka *pskKeyAgreement) processClientKeyExchange(hc *baseHandshakeContext, data []byte) ([]byte, error) {
+	buffer := bytes.NewBuffer(data)
+	identity, err := readPSKIdentity(buffer)
+	if err != nil {
+		return nil, newAlertError(AlertDecodeError, "Error while reading client key exchange: %s", err)
+	}
+	var otherSecret []byte
+	if ka.ecdhe != nil {
+		if otherSecret, err = ka.ecdhe.processClientPublic(buffer); err != nil {
+			return nil, err
+		}
+	} else if buffer.Len() != 0 {
+		return nil, newAlertError(AlertDecodeError, "Error while reading client key exchange")
+	}
+	psk, err := hc.config.GetPSK(identity.Identity)
+	if err != nil || len(psk) == 0 {
+		return nil, newAlertError(AlertUnknownPSKIdentity, "No pre-shared key for identity %q", identity.Identity)
+	}
+	hc.Conn.pskIdentity = append([]byte{}, identity.Identity...)
+	return pskPreMasterSecret(otherSecret, psk), nil
+}
+
+func (ka *pskKeyAgreement) processServerKeyExchange(hc *baseHandshakeContext, data []byte) error {
+	if data == nil {
+		if ka.ecdhe != nil {
+			return missingServerKeyExchangeError
+		}
+		return nil
+	}
+	buffer := bytes.NewBuffer(data)
+	hint, err := readPSKIdentity(buffer)
+	if err != nil {
+		return newAlertError(AlertDecodeError, "Error while reading server key exchange: %s", err)
+	}
+	if len(hint.Identity) > 0 {
+		hc.logf("Server sent PSK identity hint %q", hint.Identity)
+	}
+	if ka.ecdhe != nil {
+		if err := ka.ecdhe.processServerParams(buffer); err != nil {
+			return err
+		}
+	}
+	if buffer.Len() != 0 {
+		return newAlertError(AlertDecodeError, "Error while reading server key exchange")
+	}
+	return nil
+}
+
+func (ka *pskKeyAgreement) generateClientKeyExchange(hc *baseHandshakeContext) ([]byte, []byte, error) {
+	if len(hc.config.PSK) == 0 {
+		return nil, nil, newAlertError(AlertInternalError, "No pre-shared key configured")
+	}
+	identity := pskIdentity{Identity: hc.config.PSKIdentity}.Bytes()
+	if ka.ecdhe == nil {
+		return pskPreMasterSecret(nil, hc.config.PSK), identity, nil
+	}
+	otherSecret, clientKeyExchange, err := ka.ecdhe.generateClientKeyExchange(hc)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pskPreMasterSecret(otherSecret, hc.config.PSK), append(identity, clientKeyExchange...), nil
+}
+
+// pskPreMasterSecret combines the pre-shared key with the secret of the
+// other key exchange, or with as many zeros as the key is long for plain
+// PSK, RFC 4279 section 2.
+func pskPreMasterSecret(otherSecret, psk []byte) []byte {
+	if otherSecret == nil {
+		otherSecret = make([]byte, len(psk))
+	}
+	return append(opaque16(otherSecret), opaque16(psk)...)
+}
@@ -0,0 +1,144 @@
+package dtls
+
+import (
+	"crypto/aes"
+	"crypto/hmac"
+	"encoding/binary"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/hkdf"
+	"hash"
+	"io"
+)
+
+// The epochs of DTLS 1.3, RFC 9147 section 6.1. Every KeyUpdate starts the
+// next epoch after epochApplicationData.
+const (
+	epochHandshake       uint16 = 2
+	epochApplicationData uint16 = 3
+)
+
+// The labels of the DTLS 1.3 key schedule, RFC 8446 section 7.1 and RFC 9147
+// section 4.2.3.
+const (
+	labelDerived                = "derived"
+	labelClientHandshakeTraffic = "c hs traffic"
+	labelServerHandshakeTraffic = "s hs traffic"
+	labelClientTraffic          = "c ap traffic"
+	labelServerTraffic          = "s ap traffic"
+	labelFinished               = "finished"
+	labelTrafficUpdate          = "traffic upd"
+	labelKey                    = "key"
+	labelIV                     = "iv"
+	labelSequenceNumber         = "sn"
+)
+
+// The labels of the secrets in the key log, see Config.KeyLogWriter.
+const (
+	keyLogLabelMasterSecret          = "CLIENT_RANDOM"
+	keyLogLabelClientHandshakeSecret = "CLIENT_HANDSHAKE_TRAFFIC_SECRET"
+	keyLogLabelServerHandshakeSecret = "SERVER_HANDSHAKE_TRAFFIC_SECRET"
+	keyLogLabelClientTrafficSecret   = "CLIENT_TRAFFIC_SECRET_0"
+	keyLogLabelServerTrafficSecret   = "SERVER_TRAFFIC_SECRET_0"
+)
+
+// hkdfExpandLabel implements HKDF-Expand-Label of RFC 8446 section 7.1 with
+// the "dtls13" label prefix of RFC 9147 section 5.9.
+func hkdfExpandLabel(hash func() hash.Hash, secret []byte, label string, context []byte, length int) []byte {
+	hkdfLabel := make([]byte, 0, 10+len(label)+len(context))
+	hkdfLabel = binary.BigEndian.AppendUint16(hkdfLabel, uint16(length))
+	hkdfLabel = append(hkdfLabel, byte(len("dtls13")+len(label)))
+	hkdfLabel = append(hkdfLabel, "dtls13"...)
+	hkdfLabel = append(hkdfLabel, label...)
+	hkdfLabel = append(hkdfLabel, byte(len(context)))
+	hkdfLabel = append(hkdfLabel, context...)
+	out := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.Expand(hash, secret, hkdfLabel), out); err != nil {
+		panic(err)
+	}
+	return out
+}
+
+// extract is HKDF-Extract. A nil secret is a string of zeros, RFC 8446
+// section 7.1.
+func (cs *cipherSuite) extract(secret, salt []byte) []byte {
+	if secret == nil {
+		secret = make([]byte, cs.prfHash()().Size())
+	}
+	return hkdf.Extract(cs.prfHash(), secret, salt)
+}
+
+// deriveSecret is Derive-Secret of RFC 8446 section 7.1 with the hash of
+// the transcript. A nil hash is the hash of an empty transcript.
+func (cs *cipherSuite) deriveSecret(secret []byte, label string, transcriptHash []byte) []byte {
+	if transcriptHash == nil {
+		transcriptHash = cs.prfHash()().Sum(nil)
+	}
+	return hkdfExpandLabel(cs.prfHash(), secret, label, transcriptHash, len(transcriptHash))
+}
+
+// handshakeSecret returns the handshake secret of a handshake without a
+// pre-shared key, which starts from the shared secret of the key exchange.
+func (cs *cipherSuite) handshakeSecret(sharedSecret []byte) []byte {
+	earlySecret := cs.extract(nil, nil)
+	return cs.extract(sharedSecret, cs.deriveSecret(earlySecret, labelDerived, nil))
+}
+
+// masterSecret13 returns the master secret, which follows the handshake
+// secret.
+func (cs *cipherSuite) masterSecret13(handshakeSecret []byte) []byte {
+	return cs.extract(nil, cs.deriveSecret(handshakeSecret, labelDerived, nil))
+}
+
+// finishedMAC returns the verify data of a Finished message sent with the
+// handshake traffic secret, RFC 8446 section 4.4.4.
+func (cs *cipherSuite) finishedMAC(trafficSecret, transcriptHash []byte) []byte {
+	finishedKey := hkdfExpandLabel(cs.prfHash(), trafficSecret, labelFinished, nil, cs.prfHash()().Size())
+	mac := hmac.New(cs.prfHash(), finishedKey)
+	mac.Write(transcriptHash)
+	return mac.Sum(nil)
+}
+
+// nextTrafficSecret returns the traffic secret of the epoch after a
+// KeyUpdate, RFC 8446 section 7.2.
+func (cs *cipherSuite) nextTrafficSecret(trafficSecret []byte) []byte {
+	return hkdfExpandLabel(cs.prfHash(), trafficSecret, labelTrafficUpdate, nil, len(trafficSecret))
+}
+
+// sequenceNumberMask returns the function which computes the mask that
+// encrypts the sequence number of a record from its first 16 bytes of
+// ciphertext, RFC 9147 section 4.2.3.
+func (cs *cipherSuite) sequenceNumberMask(key []byte) func(ciphertext []byte) []byte {
+	if cs.flags&suiteChaCha20 != 0 {
+		return func(ciphertext []byte) []byte {
+			stream, err := chacha20.NewUnauthenticatedCipher(key, ciphertext[4:16])
+			if err != nil {
+				panic(err)
+			}
+			stream.SetCounter(binary.LittleEndian.Uint32(ciphertext[:4]))
+			mask := make([]byte, 2)
+			stream.XORKeyStream(mask, mask)
+			return mask
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	return func(ciphertext []byte) []byte {
+		mask := make([]byte, aes.BlockSize)
+		block.Encrypt(mask, ciphertext[:aes.BlockSize])
+		return mask
+	}
+}
+
+// setTrafficSecret installs the record protection derived from a DTLS 1.3
+// traffic secret, RFC 8446 section 7.3.
+func (sp *securityParameters) setTrafficSecret(suite *cipherSuite, trafficSecret []byte) {
+	key := hkdfExpandLabel(suite.prfHash(), trafficSecret, labelKey, nil, suite.keyLen)
+	iv := hkdfExpandLabel(suite.prfHash(), trafficSecret, labelIV, nil, suite.ivLen)
+	sequenceNumberKey := hkdfExpandLabel(suite.prfHash(), trafficSecret, labelSequenceNumber, nil, suite.keyLen)
+	sp.AEAD = suite.aead(key, iv)
+	sp.sequenceNumberMask = suite.sequenceNumberMask(sequenceNumberKey)
+	sp.trafficSecret = trafficSecret
+	sp.suite = suite
+}
@@ -0,0 +1,138 @@
+package dtls
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+)
+
+// A keyShare is the ephemeral public key of one group in the key_share
+// extension, RFC 8446 section 4.2.8.
+type keyShare struct {
+	group namedCurve
+	data  []byte
+}
+
+func (ks keyShare) Bytes() []byte {
+	return append(ks.group.Bytes(), opaque16(ks.data)...)
+}
+
+func readKeyShare(buffer *bytes.Buffer) (ks keyShare, err error) {
+	if buffer.Len() < 4 {
+		return ks, InvalidExtensionError
+	}
+	ks.group = namedCurve(readUint16(buffer))
+	if ks.data, err = readOpaque16(buffer); err != nil || len(ks.data) == 0 {
+		return ks, InvalidExtensionError
+	}
+	return
+}
+
+// newClientKeyShareExtension returns the key_share extension of a
+// ClientHello, which offers a key for each of shares.
+func newClientKeyShareExtension(shares []keyShare) extension {
+	data := bytes.Buffer{}
+	for _, share := range shares {
+		data.Write(share.Bytes())
+	}
+	return extension{Type: ExtensionKeyShare, Data: opaque16(data.Bytes())}
+}
+
+func readClientKeyShareExtension(data []byte) (shares []keyShare, err error) {
+	buffer := bytes.NewBuffer(data)
+	list, err := readOpaque16(buffer)
+	if err != nil || buffer.Len() != 0 {
+		return nil, InvalidExtensionError
+	}
+	listBuffer := bytes.NewBuffer(list)
+	for listBuffer.Len() > 0 {
+		share, err := readKeyShare(listBuffer)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+	return
+}
+
+// newServerKeyShareExtension returns the key_share extension of a
+// ServerHello with the server's key of the selected group.
+func newServerKeyShareExtension(share keyShare) extension {
+	return extension{Type: ExtensionKeyShare, Data: share.Bytes()}
+}
+
+func readServerKeyShareExtension(data []byte) (keyShare, error) {
+	buffer := bytes.NewBuffer(data)
+	share, err := readKeyShare(buffer)
+	if err != nil || buffer.Len() != 0 {
+		return share, InvalidExtensionError
+	}
+	return share, nil
+}
+
+// newHelloRetryKeyShareExtension returns the key_share extension of a
+// HelloRetryRequest, which names the group the client has to send a key
+// for.
+func newHelloRetryKeyShareExtension(group namedCurve) extension {
+	return extension{Type: ExtensionKeyShare, Data: group.Bytes()}
+}
+
+func readHelloRetryKeyShareExtension(data []byte) (namedCurve, error) {
+	if len(data) != 2 {
+		return 0, InvalidExtensionError
+	}
+	return namedCurve(binary.BigEndian.Uint16(data)), nil
+}
+
+// generateKeyShare returns a new ephemeral key of group, which has to be
+// one of supportedCurves, and its key share.
+func generateKeyShare(group namedCurve) (*ecdh.PrivateKey, keyShare) {
+	curve, err := group.curve()
+	if err != nil {
+		panic(err)
+	}
+	key, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return key, keyShare{group: group, data: key.PublicKey().Bytes()}
+}
+
+// sharedSecret returns the shared secret of our key and the peer's key
+// share of the same group.
+func sharedSecret(key *ecdh.PrivateKey, share keyShare) ([]byte, error) {
+	curve, err := share.group.curve()
+	if err != nil {
+		return nil, err
+	}
+	peerKey, err := curve.NewPublicKey(share.data)
+	if err != nil {
+		return nil, err
+	}
+	return key.ECDH(peerKey)
+}
+
+// helloRetryRequestRandom is the random of a ServerHello which is a
+// HelloRetryRequest, RFC 8446 section 4.1.3.
+var helloRetryRequestRandom = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
+func isHelloRetryRequest(serverHello handshakeServerHello) bool {
+	return bytes.Equal(serverHello.Random.Bytes(), helloRetryRequestRandom)
+}
+
+// newHelloRetryRandom returns the random of a HelloRetryRequest.
+func newHelloRetryRandom() random {
+	r, _ := readRandom(bytes.NewBuffer(helloRetryRequestRandom))
+	return r
+}
+
+// messageHashOf returns the synthetic message_hash message which replaces
+// the first ClientHello in the transcript after a HelloRetryRequest, RFC
+// 8446 section 4.4.1.
+func messageHashOf(clientHelloHash []byte) handshake {
+	return handshake{MsgType: messageHash, Length: uint32(len(clientHelloHash)), Fragment: clientHelloHash}
+}
@@ -0,0 +1,218 @@
+package dtls
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"time"
+)
+
+// The request_update values of a KeyUpdate, RFC 8446 section 4.6.3.
+const (
+	keyUpdateNotRequested byte = 0
+	keyUpdateRequested    byte = 1
+)
+
+var (
+	// KeyUpdateNotSupportedError is returned by UpdateKeys on connections
+	// which did not negotiate DTLS 1.3.
+	KeyUpdateNotSupportedError = errors.New("Key updates need DTLS 1.3")
+	// KeyUpdateTimeoutError is returned by UpdateKeys if the peer did not
+	// acknowledge the KeyUpdate in time. The connection stays usable.
+	KeyUpdateTimeoutError net.Error = timeoutError{"DTLS key update timed out"}
+)
+
+// A pendingKeyUpdate is a KeyUpdate we sent which the peer did not
+// acknowledge yet.
+type pendingKeyUpdate struct {
+	message *handshake
+	// records are the records the message was sent in, the peer
+	// acknowledges any of them.
+	records []recordNumber
+}
+
+// UpdateKeys replaces the keys that protect the records we send, RFC 9147
+// section 8. It sends a KeyUpdate and waits until the peer acknowledges
+// it, only then the new keys are used. The peer is asked to update its
+// keys as well. Like Renegotiate it reads the records of the peer, so it
+// waits for a concurrent Read to return, and application data that arrives
+// meanwhile is returned by later reads. Key updates need DTLS 1.3.
+func (c *Conn) UpdateKeys() error {
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+	if c.version != DTLS_13 {
+		return KeyUpdateNotSupportedError
+	}
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+	if c.isClosed() {
+		return ConnClosedError
+	}
+	if err := c.error(); err != nil {
+		return err
+	}
+	if c.keyUpdate == nil {
+		if err := c.sendKeyUpdate(keyUpdateRequested); err != nil {
+			return err
+		}
+	}
+	defer c.Conn.SetReadDeadline(c.getReadDeadline())
+	deadline := c.handshakeDeadline(time.Now().Add(c.config.handshakeTimeout()))
+	timeout := initialRetransmitTimeout
+	for c.keyUpdate != nil {
+		readDeadline := time.Now().Add(timeout)
+		if readDeadline.After(deadline) {
+			readDeadline = deadline
+		}
+		if err := c.Conn.SetReadDeadline(readDeadline); err != nil {
+			return err
+		}
+		typ, payload, err := c.readRecord()
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && !c.isClosed() {
+			if !time.Now().Before(deadline) {
+				return KeyUpdateTimeoutError
+			}
+			c.logf("Retransmission timer expired, resending key update")
+			if err := c.writeKeyUpdate(); err != nil {
+				return err
+			}
+			if timeout *= 2; timeout > maxRetransmitTimeout {
+				timeout = maxRetransmitTimeout
+			}
+			continue
+		}
+		if c.isClosed() {
+			return ConnClosedError
+		} else if _, ok := err.(*AlertError); ok {
+			return c.abort(err)
+		} else if err != nil {
+			return err
+		}
+		data, err := c.receivePostHandshakeRecord(typ, payload)
+		if err != nil {
+			return c.abort(err)
+		}
+		if data != nil && len(c.applicationData) < maxRenegotiationApplicationData {
+			c.applicationData = append(c.applicationData, data)
+		}
+	}
+	return nil
+}
+
+// sendKeyUpdate sends a KeyUpdate, which stays pending until the peer
+// acknowledges it. The caller holds the readMutex.
+func (c *Conn) sendKeyUpdate(request byte) error {
+	message := c.handshakeContext.base().buildNextHandshakeMessage(keyUpdate, []byte{request})
+	c.keyUpdate = &pendingKeyUpdate{message: message}
+	return c.writeKeyUpdate()
+}
+
+// writeKeyUpdate sends or retransmits the pending KeyUpdate.
+func (c *Conn) writeKeyUpdate() error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	number := recordNumber{epoch: uint64(c.epoch), sequenceNumber: c.currentWriteState.sequenceNumber}
+	c.keyUpdate.records = append(c.keyUpdate.records, number)
+	_, err := c.writeRecord(typeHandshake, c.epoch, &c.currentWriteState, c.keyUpdate.message.Bytes())
+	return err
+}
+
+// receivePostHandshakeRecord handles a record that arrives after a DTLS 1.3
+// handshake and returns the data of application data records.
+func (c *Conn) receivePostHandshakeRecord(typ contentType, payload []byte) ([]byte, error) {
+	switch typ {
+	case typeApplicationData:
+		if c.lastRecord.epoch < uint64(epochApplicationData) {
+			return nil, newAlertError(AlertUnexpectedMessage, "Received application data with the handshake keys")
+		}
+		return payload, nil
+	case typeACK:
+		numbers, err := readACK(payload)
+		if err != nil {
+			return nil, wrapAlertError(err, AlertDecodeError, "Invalid ACK: %s", err)
+		}
+		c.receiveACK(numbers)
+	case typeHandshake:
+		message, err := readHandshake(bytes.NewBuffer(payload))
+		if err != nil {
+			return nil, nil
+		}
+		return nil, c.receivePostHandshakeMessage(&message)
+	}
+	return nil, nil
+}
+
+// receivePostHandshakeMessage handles a handshake message after a DTLS 1.3
+// handshake. An old message means that the peer missed our last flight or
+// our ACK. Of the new messages only KeyUpdates are processed, session
+// tickets are acknowledged but ignored, since resumption is not supported
+// with DTLS 1.3.
+func (c *Conn) receivePostHandshakeMessage(message *handshake) error {
+	hc := c.handshakeContext.base()
+	if message.MessageSeq < hc.nextReceiveSequenceNumber {
+		if hc.isServer || message.MsgType == keyUpdate || message.MsgType == newSessionTicket {
+			return c.sendACK([]recordNumber{c.lastRecord})
+		}
+		hc.receiveMessage(message)
+		return nil
+	}
+	if message.MessageSeq > hc.nextReceiveSequenceNumber || message.FragmentOffset != 0 || message.FragmentLength != message.Length {
+		// The peer retransmits the message until we acknowledge it.
+		return nil
+	}
+	switch message.MsgType {
+	case keyUpdate:
+		if len(message.Fragment) != 1 || message.Fragment[0] > keyUpdateRequested {
+			return newAlertError(AlertIllegalParameter, "Invalid key update")
+		}
+	case newSessionTicket:
+	default:
+		return newAlertError(AlertUnexpectedMessage, "Received %s after the handshake", message.MsgType)
+	}
+	hc.nextReceiveSequenceNumber += 1
+	if err := c.sendACK([]recordNumber{c.lastRecord}); err != nil {
+		return err
+	}
+	if message.MsgType != keyUpdate {
+		return nil
+	}
+	c.logf("Peer updated its keys")
+	c.setReadEpoch(c.readEpoch+1, nextEpochState(&c.currentReadState))
+	if message.Fragment[0] == keyUpdateRequested && c.keyUpdate == nil {
+		return c.sendKeyUpdate(keyUpdateNotRequested)
+	}
+	return nil
+}
+
+// receiveACK switches to the next write epoch once the peer acknowledged
+// our KeyUpdate.
+func (c *Conn) receiveACK(numbers []recordNumber) {
+	if c.keyUpdate == nil {
+		return
+	}
+	for _, number := range numbers {
+		for _, record := range c.keyUpdate.records {
+			if number == record {
+				c.keyUpdate = nil
+				c.updateWriteKeys()
+				return
+			}
+		}
+	}
+}
+
+func (c *Conn) updateWriteKeys() {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.logf("Updating our keys")
+	c.epoch, c.currentWriteState = c.epoch+1, nextEpochState(&c.currentWriteState)
+}
+
+// nextEpochState returns the security parameters of the epoch that follows
+// a KeyUpdate, RFC 8446 section 7.2.
+func nextEpochState(state *securityParameters) securityParameters {
+	var next securityParameters
+	next.setTrafficSecret(state.suite, state.suite.nextTrafficSecret(state.trafficSecret))
+	return next
+}
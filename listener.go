@@ -1,47 +1,258 @@
 package dtls
 
 import (
-	"log"
+	"bytes"
+	"errors"
 	"net"
+	"sync"
 )
 
+// acceptQueueSize is the number of new connections buffered for Accept.
+// Further clients are ignored until Accept is called, they retransmit
+// their ClientHello anyway.
+const acceptQueueSize = 16
+
+var ListenerClosedError = errors.New("Listener closed")
+
 type Listener struct {
 	net.PacketConn
+	config  *Config
+	cookies cookieGenerator
+	// sessions holds the sessions of accepted connections for resumption
+	// by session ID.
+	sessions *lruCache
 
+	mutex       sync.Mutex
 	connections map[string]*virtualConn
+	// connectionIDs holds the connections by the connection ID we assigned
+	// them, RFC 9146.
+	connectionIDs map[string]*virtualConn
+
+	accepted  chan *Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+	err       error
 }
 
-func NewListener(c net.PacketConn) *Listener {
-	return &Listener{
+// NewListener creates a Listener which accepts DTLS connections on c. Every
+// accepted connection is a server connection configured by config. A nil
+// config is equivalent to the zero Config.
+func NewListener(c net.PacketConn, config *Config) *Listener {
+	if config == nil {
+		config = defaultConfig
+	}
+	l := &Listener{
 		PacketConn:  c,
+		config:      config,
+		sessions:    newLRUCache(serverSessionCacheSize),
 		connections: make(map[string]*virtualConn),
+		accepted:    make(chan *Conn, acceptQueueSize),
+		closed:      make(chan struct{}),
+
+		connectionIDs: make(map[string]*virtualConn),
 	}
+	go l.serve()
+	return l
 }
 
-func (l *Listener) Accept() (net.Conn, error) {
+func (l *Listener) logf(format string, v ...interface{}) {
+	l.config.logger().Printf(format, v...)
+}
+
+// serve reads datagrams from the socket and hands them to the connection of
+// their connection ID or, without one, of their source address. Connections
+// are only created for ClientHellos that carry a valid cookie.
+func (l *Listener) serve() {
 	for {
 		buffer := make([]byte, UDP_MAX_SIZE)
 		n, addr, err := l.ReadFrom(buffer)
-		log.Printf("Read new packet in listener")
+		l.logf("Read new packet in listener")
 		if err != nil {
-			log.Printf("Error while reading from socekt: %s", err)
-			return nil, err
+			l.logf("Error while reading from socket: %s", err)
+			l.shutdown(err)
+			return
+		}
+		if conn, ok := l.route(buffer[:n], addr); ok {
+			l.logf("Forwarding packet to virtual connection")
+			conn.Receive(buffer[:n], addr)
+			continue
 		}
-		if conn, ok := l.connections[addr.String()]; ok {
-			log.Printf("Forwarding packet to virtual connection")
-			conn.Receive(buffer[:n])
+		if !l.config.InsecureSkipHelloVerify && !l.verifyCookie(buffer[:n], addr) {
 			continue
 		}
-		log.Printf("Creating new connection for packet from %s", addr)
+		l.logf("Creating new connection for packet from %s", addr)
 		virtualConn := newVirtualConn(l, l.LocalAddr(), addr)
-		go virtualConn.Receive(buffer[:n])
-		l.connections[addr.String()] = virtualConn
-		return NewConn(virtualConn, true), nil
+		server := newServer(virtualConn, l.config, l.sessions, &l.cookies)
+		if !l.config.DisableConnectionIDs {
+			server.connectionID = newConnectionID()
+		}
+		virtualConn.onRelease = func() { l.release(virtualConn, server.connectionID) }
+		virtualConn.onMigrate = func(from net.Addr) { l.migrate(virtualConn, from) }
+		virtualConn.Receive(buffer[:n], addr)
+		select {
+		case l.accepted <- server:
+			l.mutex.Lock()
+			l.connections[addr.String()] = virtualConn
+			if server.connectionID != nil {
+				l.connectionIDs[string(server.connectionID)] = virtualConn
+			}
+			l.mutex.Unlock()
+		default:
+			l.logf("Accept queue is full, ignoring packet from %s", addr)
+		}
+	}
+}
+
+// route returns the connection of datagram. Records with a connection ID
+// lead to the connection that has it, wherever they come from. Other
+// records go to the connection of their source address.
+func (l *Listener) route(datagram []byte, addr net.Addr) (*virtualConn, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(datagram) > 0 && contentType(datagram[0]) == typeConnectionID {
+		if len(datagram) < 11+connectionIDLength {
+			return nil, false
+		}
+		conn, ok := l.connectionIDs[string(datagram[11:11+connectionIDLength])]
+		return conn, ok
+	}
+	conn, ok := l.connections[addr.String()]
+	return conn, ok
+}
+
+// verifyCookie checks whether datagram contains a ClientHello with a valid
+// cookie. If it contains a ClientHello without one, a HelloVerifyRequest or,
+// if the client offers DTLS 1.3, a HelloRetryRequest is sent. No state is
+// kept until the client proves it owns its address.
+func (l *Listener) verifyCookie(datagram []byte, addr net.Addr) bool {
+	rec, err := readRecord(bytes.NewBuffer(datagram), 0)
+	if err != nil || rec.Type != typeHandshake || rec.Epoch != 0 {
+		return false
+	}
+	message, err := readHandshake(bytes.NewBuffer(rec.Payload))
+	if err != nil || message.MsgType != clientHello ||
+		message.FragmentOffset != 0 || message.FragmentLength != message.Length {
+		return false
+	}
+	hello, err := readHandshakeClientHello(message.Fragment)
+	if err != nil {
+		l.logf("Ignoring invalid client hello from %s: %s", addr, err)
+		return false
+	}
+	if l.config.supportsVersion(DTLS_13) && offersVersion(hello, DTLS_13) {
+		return l.verifyRetryCookie(rec, &message, hello, addr)
+	}
+	if len(hello.Cookie) > 0 && l.cookies.verify(addr, &hello) {
+		return true
+	}
+	l.logf("Sending hello verify request to %s", addr)
+	// The server version is always DTLS 1.0, RFC 6347 section 4.2.1.
+	verifyRequest := handshakeHelloVerifyRequest{
+		ServerVersion: DTLS_10,
+		Cookie:        l.cookies.generate(addr, &hello),
+	}
+	l.sendStateless(rec, &message, helloVerifyRequest, DTLS_10, verifyRequest.Bytes(), addr)
+	return false
+}
+
+// verifyRetryCookie is verifyCookie for a ClientHello that offers DTLS 1.3,
+// which is answered with a HelloRetryRequest instead, RFC 9147 section 5.1.
+// Its cookie holds the state the connection continues the handshake with.
+func (l *Listener) verifyRetryCookie(rec *record, message *handshake, hello handshakeClientHello, addr net.Addr) bool {
+	if e, ok := findExtension(hello.Extensions, ExtensionCookie); ok {
+		if cookie, err := readCookieExtension(e.Data); err == nil {
+			if _, _, _, ok := l.cookies.verifyRetry(addr, cookie); ok {
+				return true
+			}
+		}
+		l.logf("Ignoring client hello with invalid cookie from %s", addr)
+		return false
+	}
+	suite, group, share, err := negotiateKeyExchange13(l.config, hello)
+	if err != nil {
+		l.logf("Ignoring client hello from %s: %s", addr, err)
+		return false
+	}
+	if share != nil {
+		// The client already sent a key share we can use.
+		group = 0
+	}
+	l.logf("Sending hello retry request to %s", addr)
+	cookie := l.cookies.generateRetry(addr, suite, group, suite.messageHash(message))
+	helloRetryRequest := newHelloRetryRequest(hello.SessionID, suite, group, cookie)
+	l.sendStateless(rec, message, serverHello, DTLS_12, helloRetryRequest.Bytes(), addr)
+	return false
+}
+
+// sendStateless answers the ClientHello in rec without creating a
+// connection. The sequence numbers mirror the ClientHello, RFC 6347 section
+// 4.2.1.
+func (l *Listener) sendStateless(rec *record, clientHello *handshake, typ handshakeType, version protocolVersion, fragment []byte, addr net.Addr) {
+	response := handshake{
+		MsgType:        typ,
+		Length:         uint32(len(fragment)),
+		MessageSeq:     clientHello.MessageSeq,
+		FragmentLength: uint32(len(fragment)),
+		Fragment:       fragment,
+	}
+	payload := response.Bytes()
+	header := buildRecordHeader(typeHandshake, version, 0, rec.SequenceNumber, nil, uint16(len(payload)))
+	if _, err := l.WriteTo(append(header, payload...), addr); err != nil {
+		l.logf("Error while sending %s: %s", typ, err)
+	}
+}
+
+// release forgets conn, so that the next datagram from its address starts a
+// new connection and its connection ID is unknown.
+func (l *Listener) release(conn *virtualConn, connectionID []byte) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	key := conn.RemoteAddr().String()
+	if l.connections[key] == conn {
+		delete(l.connections, key)
+	}
+	if l.connectionIDs[string(connectionID)] == conn {
+		delete(l.connectionIDs, string(connectionID))
+	}
+}
+
+// migrate moves conn from the address from to its new remote address, after
+// an authenticated record with its connection ID came from there. Another
+// connection of the new address is no longer reachable by address, the
+// peer left it.
+func (l *Listener) migrate(conn *virtualConn, from net.Addr) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.connections[from.String()] == conn {
+		delete(l.connections, from.String())
+	}
+	l.connections[conn.RemoteAddr().String()] = conn
+}
+
+func (l *Listener) shutdown(err error) {
+	l.closeOnce.Do(func() {
+		l.err = err
+		close(l.closed)
+	})
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accepted:
+		return conn, nil
+	case <-l.closed:
+		return nil, l.err
 	}
 }
 
 func (l *Listener) Close() error {
-	for _, conn := range l.connections {
+	l.shutdown(ListenerClosedError)
+	l.mutex.Lock()
+	connections := l.connections
+	l.connections = make(map[string]*virtualConn)
+	l.connectionIDs = make(map[string]*virtualConn)
+	l.mutex.Unlock()
+	for _, conn := range connections {
 		conn.Close()
 	}
 	return l.PacketConn.Close()
@@ -0,0 +1,112 @@
+package dtls
+
+// defaultMTU keeps the datagrams within the smallest MTU of IPv6 after the
+// IPv6 and UDP headers.
+const defaultMTU = 1200
+
+// mtuFallbacks are the MTUs a connection falls back to when its large
+// datagrams get lost, from Ethernet over IPv6 down to the minimum MTU of
+// IPv4, each minus the IP and UDP headers.
+var mtuFallbacks = []int{1452, 1232, 1024, 548}
+
+// mtuRetransmissions is the number of times a flight is retransmitted
+// before the connection assumes that its datagrams are too large for the
+// path, RFC 6347 section 4.1.1.1.
+const mtuRetransmissions = 2
+
+// minHandshakeFragment bounds the fragments of handshake messages if the
+// MTU leaves less room for them.
+const minHandshakeFragment = 64
+
+func (c *Config) mtu() int {
+	if c.MTU == 0 {
+		return defaultMTU
+	}
+	return c.MTU
+}
+
+// MaxPayloadSize returns the largest amount of application data that fits
+// into a single record within the current MTU of the connection. Larger
+// writes are sent anyway and are fragmented by IP, if at all, unless they
+// exceed the record size limit of the peer. Before the handshake completed
+// the size does not account for the protection of the records.
+func (c *Conn) MaxPayloadSize() int {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	size := c.mtu - c.recordOverhead(c.epoch, &c.currentWriteState)
+	if limit := c.sendLimitFor(c.epoch); limit > 0 && limit < size {
+		return limit
+	}
+	return size
+}
+
+// recordOverhead returns the maximum number of bytes the header and the
+// protection with state add to the payload of a record of epoch.
+func (c *Conn) recordOverhead(epoch uint16, state *securityParameters) int {
+	if c.version == DTLS_13 && epoch > 0 {
+		// The unified header we send, the encrypted content type and
+		// the tag.
+		return 5 + 1 + state.AEAD.Overhead()
+	}
+	overhead := 13 + len(state.connectionID)
+	if len(state.connectionID) > 0 {
+		overhead += 1
+	}
+	if state.AEAD != nil {
+		return overhead + state.AEAD.explicitNonceLen() + state.AEAD.Overhead()
+	}
+	if state.Cipher != nil {
+		// The IV and at most a block of padding.
+		overhead += 2 * state.Cipher.BlockSize()
+	}
+	if state.Mac != nil {
+		overhead += state.Mac.Size()
+	}
+	return overhead
+}
+
+// writeHandshake sends message in records of epoch protected with state.
+// A message that does not fit into a datagram of the MTU is split into
+// fragments, RFC 6347 section 4.2.3. The caller holds the writeMutex.
+func (c *Conn) writeHandshake(message *handshake, epoch uint16, state *securityParameters) error {
+	maxFragment := c.mtu - c.recordOverhead(epoch, state) - 12
+	if maxFragment < minHandshakeFragment {
+		maxFragment = minHandshakeFragment
+	}
+	if limit := c.sendLimitFor(epoch); limit > 0 && maxFragment > limit-12 {
+		maxFragment = limit - 12
+	}
+	for offset := 0; ; {
+		length := len(message.Fragment) - offset
+		if length > maxFragment {
+			length = maxFragment
+		}
+		fragment := *message
+		fragment.FragmentOffset = uint32(offset)
+		fragment.FragmentLength = uint32(length)
+		fragment.Fragment = message.Fragment[offset : offset+length]
+		if _, err := c.writeRecord(typeHandshake, epoch, state, fragment.Bytes()); err != nil {
+			return err
+		}
+		if offset += length; offset >= len(message.Fragment) {
+			return nil
+		}
+	}
+}
+
+// reduceMTU falls back to the next smaller MTU after a flight had to be
+// retransmitted repeatedly, unless the largest datagram of the flight
+// already fits into it and its loss is unrelated to its size.
+func (c *Conn) reduceMTU(largestDatagram int) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	for _, mtu := range mtuFallbacks {
+		if mtu < c.mtu {
+			if largestDatagram > mtu {
+				c.logf("Flight was lost repeatedly, reducing the MTU from %d to %d", c.mtu, mtu)
+				c.mtu = mtu
+			}
+			return
+		}
+	}
+}
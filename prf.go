@@ -9,7 +9,6 @@ import (
 	"crypto/hmac"
 	"crypto/md5"
 	"crypto/sha1"
-	"crypto/sha256"
 	"hash"
 )
 
@@ -64,11 +63,24 @@ func pRF10(result, secret, label, seed []byte) {
 	}
 }
 
-func pRF12(result, secret, label, seed []byte) {
-	labelAndSeed := make([]byte, len(label)+len(seed))
-	copy(labelAndSeed, label)
-	copy(labelAndSeed[len(label):], seed)
-	pHash(result, secret, labelAndSeed, sha256.New)
+// pRF12 returns the TLS 1.2 pseudo-random function with hashFunc, as
+// defined in RFC 5246, section 5.
+func pRF12(hashFunc func() hash.Hash) func(result, secret, label, seed []byte) {
+	return func(result, secret, label, seed []byte) {
+		labelAndSeed := make([]byte, len(label)+len(seed))
+		copy(labelAndSeed, label)
+		copy(labelAndSeed[len(label):], seed)
+		pHash(result, secret, labelAndSeed, hashFunc)
+	}
+}
+
+// prfForVersion returns the PRF of version. Since DTLS 1.2 the PRF uses the
+// hash of the cipher suite.
+func prfForVersion(version protocolVersion, suite *cipherSuite) func(result, secret, label, seed []byte) {
+	if version == DTLS_12 {
+		return pRF12(suite.prfHash())
+	}
+	return pRF10
 }
 
 const (
@@ -78,31 +90,44 @@ const (
 )
 
 var masterSecretLabel = []byte("master secret")
+var extendedMasterSecretLabel = []byte("extended master secret")
 var keyExpansionLabel = []byte("key expansion")
 var clientFinishedLabel = []byte("client finished")
 var serverFinishedLabel = []byte("server finished")
 
-// keysFromPreMasterSecret generates the connection keys from the pre master
-// secret, given the lengths of the MAC key, cipher key and IV, as defined in
-// RFC 2246, section 6.3.
-func keysFromPreMasterSecret(version protocolVersion, preMasterSecret, clientRandom, serverRandom []byte, macLen, keyLen int) (masterSecret, clientMAC, serverMAC, clientKey, serverKey []byte) {
-	prf := pRF10
-	if version == DTLS_12 {
-		prf = pRF12
-	}
-
+// masterFromPreMasterSecret generates the master secret from the pre master
+// secret, as defined in RFC 2246, section 8.1.
+func masterFromPreMasterSecret(version protocolVersion, suite *cipherSuite, preMasterSecret, clientRandom, serverRandom []byte) []byte {
 	var seed [tlsRandomLength * 2]byte
 	copy(seed[0:len(clientRandom)], clientRandom)
 	copy(seed[len(clientRandom):], serverRandom)
-	masterSecret = make([]byte, masterSecretLength)
-	prf(masterSecret, preMasterSecret, masterSecretLabel, seed[0:])
+	masterSecret := make([]byte, masterSecretLength)
+	prfForVersion(version, suite)(masterSecret, preMasterSecret, masterSecretLabel, seed[0:])
+	return masterSecret
+}
 
+// extendedMasterFromPreMasterSecret generates the master secret from the pre
+// master secret and the session hash, the hash of the handshake messages up
+// to the ClientKeyExchange, as defined in RFC 7627, section 4.
+func extendedMasterFromPreMasterSecret(version protocolVersion, suite *cipherSuite, preMasterSecret, sessionHash []byte) []byte {
+	masterSecret := make([]byte, masterSecretLength)
+	prfForVersion(version, suite)(masterSecret, preMasterSecret, extendedMasterSecretLabel, sessionHash)
+	return masterSecret
+}
+
+// keysFromMasterSecret generates the connection keys from the master
+// secret, given the lengths of the MAC key, cipher key and IV of suite, as
+// defined in RFC 2246, section 6.3. The IVs are the fixed part of the nonce
+// of AEAD suites, CBC suites send their IVs explicitly and ignore them.
+func keysFromMasterSecret(version protocolVersion, suite *cipherSuite, masterSecret, clientRandom, serverRandom []byte) (clientMAC, serverMAC, clientKey, serverKey, clientIV, serverIV []byte) {
+	var seed [tlsRandomLength * 2]byte
 	copy(seed[0:len(clientRandom)], serverRandom)
 	copy(seed[len(serverRandom):], clientRandom)
 
-	n := 2*macLen + 2*keyLen
+	macLen, keyLen, ivLen := suite.macLen, suite.keyLen, suite.ivLen
+	n := 2*macLen + 2*keyLen + 2*ivLen
 	keyMaterial := make([]byte, n)
-	prf(keyMaterial, masterSecret, keyExpansionLabel, seed[0:])
+	prfForVersion(version, suite)(keyMaterial, masterSecret, keyExpansionLabel, seed[0:])
 	clientMAC = keyMaterial[:macLen]
 	keyMaterial = keyMaterial[macLen:]
 	serverMAC = keyMaterial[:macLen]
@@ -110,17 +135,23 @@ func keysFromPreMasterSecret(version protocolVersion, preMasterSecret, clientRan
 	clientKey = keyMaterial[:keyLen]
 	keyMaterial = keyMaterial[keyLen:]
 	serverKey = keyMaterial[:keyLen]
+	keyMaterial = keyMaterial[keyLen:]
+	clientIV = keyMaterial[:ivLen]
+	keyMaterial = keyMaterial[ivLen:]
+	serverIV = keyMaterial[:ivLen]
 	return
 }
 
-func newFinishedHash() finishedHash {
-	return finishedHash{Buffer: bytes.Buffer{}}
+func newFinishedHash(suite *cipherSuite) finishedHash {
+	return finishedHash{Buffer: bytes.Buffer{}, prfHash: suite.prfHash()}
 }
 
 // A finishedHash calculates the hash of a set of handshake messages suitable
 // for including in a Finished message.
 type finishedHash struct {
 	bytes.Buffer
+	// prfHash is the hash used in DTLS 1.2.
+	prfHash func() hash.Hash
 }
 
 // finishedSum10 calculates the contents of the verify_data member of a TLSv1
@@ -135,46 +166,59 @@ func finishedSum10(md5, sha1, label, masterSecret []byte) []byte {
 	return out
 }
 
-func finishedSum12(hash, label, masterSecret []byte) []byte {
+func finishedSum12(hashFunc func() hash.Hash, hash, label, masterSecret []byte) []byte {
 	out := make([]byte, finishedVerifyLength)
-	pRF12(out, masterSecret, label, hash)
+	pRF12(hashFunc)(out, masterSecret, label, hash)
 	return out
 }
 
+// sum returns the hash of the messages so far, the concatenation of their
+// MD5 and SHA1 hashes before DTLS 1.2.
+func (h finishedHash) sum(version protocolVersion) []byte {
+	if version == DTLS_10 {
+		md5Digest := md5.Sum(h.Bytes())
+		sha1Digest := sha1.Sum(h.Bytes())
+		return append(md5Digest[:], sha1Digest[:]...)
+	}
+	digest := h.prfHash()
+	digest.Write(h.Bytes())
+	return digest.Sum(nil)
+}
+
 // clientSum10 returns the contents of the verify_data member of a client's
 // Finished message.
 func (h finishedHash) clientSum10(masterSecret []byte) []byte {
-	md5 := md5.New()
-	md5.Write(h.Bytes())
-	md5Digest := md5.Sum(nil)
-	sha1 := sha1.New()
-	sha1.Write(h.Bytes())
-	sha1Digest := sha1.Sum(nil)
-	return finishedSum10(md5Digest, sha1Digest, clientFinishedLabel, masterSecret)
+	sum := h.sum(DTLS_10)
+	return finishedSum10(sum[:md5.Size], sum[md5.Size:], clientFinishedLabel, masterSecret)
 }
 
 // serverSum10 returns the contents of the verify_data member of a server's
 // Finished message.
 func (h finishedHash) serverSum10(masterSecret []byte) []byte {
-	md5 := md5.New()
-	md5.Write(h.Bytes())
-	md5Digest := md5.Sum(nil)
-	sha1 := sha1.New()
-	sha1.Write(h.Bytes())
-	sha1Digest := sha1.Sum(nil)
-	return finishedSum10(md5Digest, sha1Digest, serverFinishedLabel, masterSecret)
+	sum := h.sum(DTLS_10)
+	return finishedSum10(sum[:md5.Size], sum[md5.Size:], serverFinishedLabel, masterSecret)
+}
+
+// clientSum returns the verify_data of the client's Finished message.
+func (h finishedHash) clientSum(version protocolVersion, masterSecret []byte) []byte {
+	if version == DTLS_10 {
+		return h.clientSum10(masterSecret)
+	}
+	return h.clientSum12(masterSecret)
+}
+
+// serverSum returns the verify_data of the server's Finished message.
+func (h finishedHash) serverSum(version protocolVersion, masterSecret []byte) []byte {
+	if version == DTLS_10 {
+		return h.serverSum10(masterSecret)
+	}
+	return h.serverSum12(masterSecret)
 }
 
 func (h finishedHash) clientSum12(masterSecret []byte) []byte {
-	sha256 := sha256.New()
-	sha256.Write(h.Bytes())
-	sha256Digest := sha256.Sum(nil)
-	return finishedSum12(sha256Digest, clientFinishedLabel, masterSecret)
+	return finishedSum12(h.prfHash, h.sum(DTLS_12), clientFinishedLabel, masterSecret)
 }
 
 func (h finishedHash) serverSum12(masterSecret []byte) []byte {
-	sha256 := sha256.New()
-	sha256.Write(h.Bytes())
-	sha256Digest := sha256.Sum(nil)
-	return finishedSum12(sha256Digest, serverFinishedLabel, masterSecret)
+	return finishedSum12(h.prfHash, h.sum(DTLS_12), serverFinishedLabel, masterSecret)
 }
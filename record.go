@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"net"
 )
 
 type contentType byte
@@ -14,6 +15,8 @@ const (
 	typeAlert                        = 21
 	typeHandshake                    = 22
 	typeApplicationData              = 23
+	typeConnectionID                 = 25 // tls12_cid, RFC 9146 section 4
+	typeACK                          = 26 // ack, RFC 9147 section 7
 )
 
 func (ct contentType) Bytes() []byte {
@@ -30,6 +33,10 @@ func (t contentType) String() string {
 		return "Handshake"
 	case typeApplicationData:
 		return "ApplicationData"
+	case typeConnectionID:
+		return "ConnectionID"
+	case typeACK:
+		return "ACK"
 	default:
 		return "xxx"
 	}
@@ -51,6 +58,10 @@ func readContentType(buffer *bytes.Buffer) (ct contentType, err error) {
 		return typeHandshake, nil
 	case 23:
 		return typeApplicationData, nil
+	case 25:
+		return typeConnectionID, nil
+	case 26:
+		return typeACK, nil
 	default:
 		return 255, ContentTypeError
 	}
@@ -64,12 +75,19 @@ type protocolVersion struct {
 var DTLS_10 = protocolVersion{major: 254, minor: 255}
 var DTLS_12 = protocolVersion{major: 254, minor: 253}
 
+// DTLS_13 is only negotiated with the supported_versions extension, the
+// version fields of records and hello messages say DTLS_12, RFC 9147
+// section 5.3.
+var DTLS_13 = protocolVersion{major: 254, minor: 252}
+
 func (v protocolVersion) String() string {
 	switch v {
 	case DTLS_10:
 		return "1.0"
 	case DTLS_12:
 		return "1.2"
+	case DTLS_13:
+		return "1.3"
 	default:
 		return "x.x"
 	}
@@ -79,6 +97,14 @@ func (v protocolVersion) Bytes() []byte {
 	return []byte{v.major, v.minor}
 }
 
+func (v protocolVersion) uint16() uint16 {
+	return uint16(v.major)<<8 | uint16(v.minor)
+}
+
+func versionFromUint16(v uint16) protocolVersion {
+	return protocolVersion{major: uint8(v >> 8), minor: uint8(v)}
+}
+
 var ProtocolVersionError error = errors.New("Unknown protocol version")
 
 func readProtocolVersion(buffer *bytes.Buffer) (pv protocolVersion, err error) {
@@ -103,17 +129,27 @@ type record struct {
 	Version        protocolVersion
 	Epoch          uint16
 	SequenceNumber uint64
+	ConnectionID   []byte
 	Length         uint16
 	Payload        []byte
+	// Header is the unified header of a DTLS 1.3 record, RFC 9147 section
+	// 4. Its Epoch and SequenceNumber are only the low bits of the real
+	// ones and the sequence number is still encrypted.
+	Header []byte
+	// from is the address the record came from, if the transport tells.
+	from net.Addr
 }
 
-func buildRecordHeader(typ contentType, version protocolVersion, epoch uint16, sequenceNumber uint64, length uint16) (header []byte) {
-	header = make([]byte, 13)
+// buildRecordHeader returns the header of a record. The connection ID is
+// only part of the header of typeConnectionID records.
+func buildRecordHeader(typ contentType, version protocolVersion, epoch uint16, sequenceNumber uint64, connectionID []byte, length uint16) (header []byte) {
+	header = make([]byte, 13+len(connectionID))
 	header[0] = byte(typ)
 	copy(header[1:], version.Bytes())
 	binary.BigEndian.PutUint64(header[3:], sequenceNumber)
 	binary.BigEndian.PutUint16(header[3:], epoch)
-	binary.BigEndian.PutUint16(header[11:], length)
+	copy(header[11:], connectionID)
+	binary.BigEndian.PutUint16(header[11+len(connectionID):], length)
 	return
 }
 
@@ -127,6 +163,7 @@ func (r record) Bytes() []byte {
 	b = make([]byte, 8)
 	binary.BigEndian.PutUint64(b, r.SequenceNumber)
 	buffer.Write(b[2:])
+	buffer.Write(r.ConnectionID)
 	b = make([]byte, 2)
 	binary.BigEndian.PutUint16(b, r.Length)
 	buffer.Write(b)
@@ -135,7 +172,12 @@ func (r record) Bytes() []byte {
 
 var InvalidRecordError = errors.New("InvalidRecord")
 
-func readRecord(buffer *bytes.Buffer) (r *record, err error) {
+// readRecord reads a record. The connection IDs of typeConnectionID records
+// have connectionIDLength bytes, the length of the ID the receiver chose.
+func readRecord(buffer *bytes.Buffer, connectionIDLength int) (r *record, err error) {
+	if buffer.Len() > 0 && buffer.Bytes()[0]&unifiedHeaderMask == unifiedHeaderFixedBits {
+		return readUnifiedRecord(buffer)
+	}
 	r = &record{}
 	if buffer.Len() < 13 {
 		return r, InvalidRecordError
@@ -148,6 +190,12 @@ func readRecord(buffer *bytes.Buffer) (r *record, err error) {
 	}
 	r.Epoch = readUint16(buffer)
 	r.SequenceNumber = readUint48(buffer)
+	if r.Type == typeConnectionID {
+		if connectionIDLength == 0 || buffer.Len() < connectionIDLength+2 {
+			return r, InvalidRecordError
+		}
+		r.ConnectionID = buffer.Next(connectionIDLength)
+	}
 	r.Length = readUint16(buffer)
 	if buffer.Len() < int(r.Length) {
 		return r, InvalidRecordError
@@ -156,6 +204,79 @@ func readRecord(buffer *bytes.Buffer) (r *record, err error) {
 	return
 }
 
+// The bits of the first byte of the unified header, RFC 9147 section 4.
+const (
+	unifiedHeaderMask         = 0xe0
+	unifiedHeaderFixedBits    = 0x20
+	unifiedHeaderConnectionID = 0x10
+	unifiedHeaderSequence16   = 0x08
+	unifiedHeaderLength       = 0x04
+	unifiedHeaderEpoch        = 0x03
+)
+
+// readUnifiedRecord reads a protected DTLS 1.3 record. Connection IDs are
+// not supported with DTLS 1.3, so records with one are invalid.
+func readUnifiedRecord(buffer *bytes.Buffer) (r *record, err error) {
+	r = &record{Type: typeApplicationData, Version: DTLS_12}
+	first := buffer.Bytes()[0]
+	headerLength := 2
+	if first&unifiedHeaderSequence16 != 0 {
+		headerLength++
+	}
+	if first&unifiedHeaderLength != 0 {
+		headerLength += 2
+	}
+	if first&unifiedHeaderConnectionID != 0 || buffer.Len() < headerLength {
+		return r, InvalidRecordError
+	}
+	r.Header = buffer.Next(headerLength)
+	r.Epoch = uint16(first & unifiedHeaderEpoch)
+	if first&unifiedHeaderSequence16 != 0 {
+		r.SequenceNumber = uint64(binary.BigEndian.Uint16(r.Header[1:]))
+	} else {
+		r.SequenceNumber = uint64(r.Header[1])
+	}
+	if first&unifiedHeaderLength != 0 {
+		r.Length = binary.BigEndian.Uint16(r.Header[headerLength-2:])
+	} else {
+		r.Length = uint16(buffer.Len())
+	}
+	if buffer.Len() < int(r.Length) {
+		return r, InvalidRecordError
+	}
+	r.Payload = buffer.Next(int(r.Length))
+	return
+}
+
+// buildUnifiedHeader returns the unified header of a DTLS 1.3 record with
+// the low bits of the epoch, a 16 bit sequence number and the length.
+func buildUnifiedHeader(epoch uint16, sequenceNumber uint64, length int) []byte {
+	header := make([]byte, 5)
+	header[0] = unifiedHeaderFixedBits | unifiedHeaderSequence16 | unifiedHeaderLength | byte(epoch)&unifiedHeaderEpoch
+	binary.BigEndian.PutUint16(header[1:], uint16(sequenceNumber))
+	binary.BigEndian.PutUint16(header[3:], uint16(length))
+	return header
+}
+
 func (r record) String() string {
 	return fmt.Sprintf("Record{ Type: %s, ProtocolVersion: %s, Epoch: %d, SequenceNumber: %d, Length: %d, \n\t%s\n }", r.Type, r.Version, r.Epoch, r.SequenceNumber, r.Length, r.Payload)
 }
+
+// readInnerPlaintext splits the decrypted payload of a typeConnectionID
+// record or a DTLS 1.3 record into its content and real content type, which
+// follows the content together with optional zero padding, RFC 9146 section
+// 4 and RFC 9147 section 4.
+func readInnerPlaintext(inner []byte) (contentType, []byte, error) {
+	i := len(inner) - 1
+	for i >= 0 && inner[i] == 0 {
+		i--
+	}
+	if i < 0 {
+		return 0, nil, newAlertError(AlertUnexpectedMessage, "Encrypted record has no content type")
+	}
+	typ, err := readContentType(bytes.NewBuffer(inner[i : i+1]))
+	if err != nil || typ == typeConnectionID {
+		return 0, nil, newAlertError(AlertUnexpectedMessage, "Encrypted record has invalid content type %d", inner[i])
+	}
+	return typ, inner[:i], nil
+}
@@ -0,0 +1,82 @@
+package dtls
+
+import (
+	"io"
+)
+
+// A recordBatch collects records which are sent together, so that they
+// share as few datagrams as the MTU allows, RFC 6347 section 4.1.1. The
+// peer unpacks the records of a datagram one by one.
+type recordBatch struct {
+	datagram []byte
+	// records is the number of records in datagram and sent the number of
+	// records in the datagrams written so far.
+	records int
+	sent    int
+	// largest is the size of the largest datagram written.
+	largest int
+}
+
+// writeDatagram sends a protected record, or adds it to the batch if one
+// is being collected. The caller holds the writeMutex.
+func (c *Conn) writeDatagram(record []byte) (int, error) {
+	if c.batch == nil {
+		return c.Conn.Write(record)
+	}
+	if len(c.batch.datagram) > 0 && len(c.batch.datagram)+len(record) > c.mtu {
+		if err := c.flushBatch(); err != nil {
+			return 0, err
+		}
+	}
+	c.batch.datagram = append(c.batch.datagram, record...)
+	c.batch.records += 1
+	return len(record), nil
+}
+
+// flushBatch writes the records of the batch that were not sent yet. The
+// caller holds the writeMutex.
+func (c *Conn) flushBatch() error {
+	if len(c.batch.datagram) == 0 {
+		return nil
+	}
+	n, err := c.Conn.Write(c.batch.datagram)
+	if err != nil {
+		return err
+	}
+	if n > c.batch.largest {
+		c.batch.largest = n
+	}
+	c.batch.sent += c.batch.records
+	c.batch.datagram, c.batch.records = nil, 0
+	return nil
+}
+
+// WriteBatch sends each of messages as application data like Write, but
+// packs the records into as few datagrams as the MTU allows. The peer
+// still reads every message on its own. It returns the number of messages
+// which were sent before an error occurred.
+func (c *Conn) WriteBatch(messages [][]byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	err := c.error()
+	if c.isClosed() || err == io.EOF {
+		return 0, ConnClosedError
+	}
+	if err != nil {
+		return 0, err
+	}
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.batch = &recordBatch{}
+	defer func() { c.batch = nil }()
+	for _, message := range messages {
+		if _, err := c.writeRecord(typeApplicationData, c.epoch, &c.currentWriteState, message); err != nil {
+			return c.batch.sent, err
+		}
+	}
+	if err := c.flushBatch(); err != nil {
+		return c.batch.sent, err
+	}
+	return len(messages), nil
+}
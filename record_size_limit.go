@@ -0,0 +1,208 @@
+package dtls
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// MessageTooLargeError is returned by writes of messages which exceed the
+// record size the peer is willing to receive.
+var MessageTooLargeError = errors.New("Message exceeds the record size limit of the peer")
+
+// maxPlaintextLength is the largest plaintext of a record, RFC 6347
+// section 4.1.
+const maxPlaintextLength = 16384
+
+// minRecordSizeLimit is the smallest record size limit, RFC 8449 section 4.
+const minRecordSizeLimit = 64
+
+// maxFragmentLengths are the lengths of the max_fragment_length extension,
+// RFC 6066 section 4, by their code.
+var maxFragmentLengths = map[byte]int{1: 512, 2: 1024, 3: 2048, 4: 4096}
+
+// maxFragmentLengthCode returns the code of the configured maximum fragment
+// length, if it is one of the lengths of the extension.
+func (c *Config) maxFragmentLengthCode() (byte, bool) {
+	for code, length := range maxFragmentLengths {
+		if length == c.MaxFragmentLength {
+			return code, true
+		}
+	}
+	return 0, false
+}
+
+func (c *Config) recordSizeLimit() int {
+	if c.RecordSizeLimit == 0 {
+		return 0
+	} else if c.RecordSizeLimit < minRecordSizeLimit {
+		return minRecordSizeLimit
+	} else if c.RecordSizeLimit > maxPlaintextLength {
+		return maxPlaintextLength
+	}
+	return c.RecordSizeLimit
+}
+
+func newMaxFragmentLengthExtension(code byte) extension {
+	return extension{Type: ExtensionMaxFragmentLength, Data: []byte{code}}
+}
+
+func readMaxFragmentLengthExtension(data []byte) (byte, error) {
+	if len(data) != 1 {
+		return 0, InvalidExtensionError
+	}
+	return data[0], nil
+}
+
+func newRecordSizeLimitExtension(limit int) extension {
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, uint16(limit))
+	return extension{Type: ExtensionRecordSizeLimit, Data: data}
+}
+
+func readRecordSizeLimitExtension(data []byte) (int, error) {
+	if len(data) != 2 {
+		return 0, InvalidExtensionError
+	}
+	return int(binary.BigEndian.Uint16(data)), nil
+}
+
+// recordLimitExtensions returns the extensions of a ClientHello which ask
+// for limits of the record size.
+func (c *Config) recordLimitExtensions() []extension {
+	var extensions []extension
+	if code, ok := c.maxFragmentLengthCode(); ok {
+		extensions = append(extensions, newMaxFragmentLengthExtension(code))
+	}
+	if limit := c.recordSizeLimit(); limit > 0 {
+		extensions = append(extensions, newRecordSizeLimitExtension(limit))
+	}
+	return extensions
+}
+
+// payloadLimit returns the largest payload of a record whose plaintext
+// may be as large as a record size limit. In DTLS 1.3 the limit includes
+// the content type, RFC 8449 section 4.
+func payloadLimit(limit int, version protocolVersion) int {
+	if version == DTLS_13 {
+		if limit > maxPlaintextLength+1 {
+			limit = maxPlaintextLength + 1
+		}
+		return limit - 1
+	}
+	if limit > maxPlaintextLength {
+		return maxPlaintextLength
+	}
+	return limit
+}
+
+// negotiateRecordLimits answers the client's record_size_limit or, without
+// one, its max_fragment_length. A server announces a record size limit in
+// answer to the client's, if it has none its limit is that of the
+// protocol, RFC 8449 section 4.
+func (sh *serverHandshake) negotiateRecordLimits(clientHello handshakeClientHello, version protocolVersion) error {
+	sh.recordLimit = nil
+	if e, ok := findExtension(clientHello.Extensions, ExtensionRecordSizeLimit); ok {
+		limit, err := readRecordSizeLimitExtension(e.Data)
+		if err != nil {
+			return newAlertError(AlertDecodeError, "Invalid record size limit extension")
+		}
+		if limit < minRecordSizeLimit {
+			return newAlertError(AlertIllegalParameter, "Client sent record size limit %d", limit)
+		}
+		ourLimit := sh.config.recordSizeLimit()
+		if ourLimit == 0 {
+			sh.Conn.setRecordLimits(payloadLimit(limit, version), 0, false)
+			ourLimit = maxPlaintextLength
+			if version == DTLS_13 {
+				ourLimit += 1
+			}
+		} else {
+			sh.Conn.setRecordLimits(payloadLimit(limit, version), payloadLimit(ourLimit, version), false)
+		}
+		e := newRecordSizeLimitExtension(ourLimit)
+		sh.recordLimit = &e
+		return nil
+	}
+	e, ok := findExtension(clientHello.Extensions, ExtensionMaxFragmentLength)
+	if !ok || version == DTLS_13 {
+		sh.Conn.setRecordLimits(0, 0, false)
+		return nil
+	}
+	code, err := readMaxFragmentLengthExtension(e.Data)
+	if err != nil {
+		return newAlertError(AlertDecodeError, "Invalid max fragment length extension")
+	}
+	length, ok := maxFragmentLengths[code]
+	if !ok {
+		return newAlertError(AlertIllegalParameter, "Client sent unknown max fragment length %d", code)
+	}
+	sh.Conn.setRecordLimits(length, length, true)
+	sh.recordLimit = &e
+	return nil
+}
+
+// processRecordLimits applies the record size limit or the maximum
+// fragment length the server accepted in its extensions.
+func (ch *clientHandshake) processRecordLimits(extensions []extension) error {
+	version := ch.Conn.version
+	recordSizeLimit, hasRecordSizeLimit := findExtension(extensions, ExtensionRecordSizeLimit)
+	maxFragmentLength, hasMaxFragmentLength := findExtension(extensions, ExtensionMaxFragmentLength)
+	if hasRecordSizeLimit && hasMaxFragmentLength {
+		return newAlertError(AlertIllegalParameter, "Server sent both a record size limit and a max fragment length")
+	}
+	if hasRecordSizeLimit {
+		if ch.config.recordSizeLimit() == 0 {
+			return newAlertError(AlertUnsupportedExtension, "Server sent a record size limit extension we did not offer")
+		}
+		limit, err := readRecordSizeLimitExtension(recordSizeLimit.Data)
+		if err != nil {
+			return newAlertError(AlertDecodeError, "Invalid record size limit extension")
+		}
+		if limit < minRecordSizeLimit {
+			return newAlertError(AlertIllegalParameter, "Server sent record size limit %d", limit)
+		}
+		ch.Conn.setRecordLimits(payloadLimit(limit, version), payloadLimit(ch.config.recordSizeLimit(), version), false)
+		return nil
+	}
+	if hasMaxFragmentLength {
+		offered, ok := ch.config.maxFragmentLengthCode()
+		if !ok {
+			return newAlertError(AlertUnsupportedExtension, "Server sent a max fragment length extension we did not offer")
+		}
+		if code, err := readMaxFragmentLengthExtension(maxFragmentLength.Data); err != nil || code != offered {
+			return newAlertError(AlertIllegalParameter, "Server sent a max fragment length we did not ask for")
+		}
+		ch.Conn.setRecordLimits(ch.config.MaxFragmentLength, ch.config.MaxFragmentLength, true)
+		return nil
+	}
+	ch.Conn.setRecordLimits(0, 0, false)
+	return nil
+}
+
+// setRecordLimits limits the payload of the protected records we send and
+// receive, zero means no limit. A maximum fragment length also limits the
+// plaintext records, RFC 6066 section 4, while a record size limit does
+// not, RFC 8449 section 4.
+func (c *Conn) setRecordLimits(send, receive int, plaintext bool) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.sendLimit, c.receiveLimit, c.limitPlaintext = send, receive, plaintext
+}
+
+// sendLimitFor returns the limit of the payload of the records we send in
+// epoch, zero if there is none. The caller holds the writeMutex.
+func (c *Conn) sendLimitFor(epoch uint16) int {
+	if epoch == 0 && !c.limitPlaintext {
+		return 0
+	}
+	return c.sendLimit
+}
+
+// checkRecordOverflow rejects the payload of a protected record that
+// exceeds the limit we announced.
+func (c *Conn) checkRecordOverflow(payload []byte) error {
+	if c.receiveLimit > 0 && len(payload) > c.receiveLimit {
+		return newAlertError(AlertRecordOverflow, "Received record of %d bytes, the limit is %d", len(payload), c.receiveLimit)
+	}
+	return nil
+}
@@ -7,7 +7,7 @@ import (
 )
 
 func TestBuildRecordHeader(t *testing.T) {
-	header := buildRecordHeader(typeHandshake, DTLS_10, 1, 4, 82)
+	header := buildRecordHeader(typeHandshake, DTLS_10, 1, 4, nil, 82)
 	reference, err := hex.DecodeString("16feff00010000000000040052")
 	if err != nil {
 		t.Fatalf("Could not decode reference header: %s", err)
@@ -16,3 +16,34 @@ func TestBuildRecordHeader(t *testing.T) {
 		t.Errorf("BuildRecordHeader expexted to return %x but returned %x", reference, header)
 	}
 }
+
+func TestReadInnerPlaintext(t *testing.T) {
+	typ, content, err := readInnerPlaintext([]byte{'h', 'i', 0, byte(typeApplicationData), 0, 0})
+	if err != nil {
+		t.Fatalf("Could not read inner plaintext: %s", err)
+	}
+	if typ != typeApplicationData || !bytes.Equal(content, []byte{'h', 'i', 0}) {
+		t.Errorf("Expected application data %q but read %s %q", "hi\x00", typ, content)
+	}
+	for _, inner := range [][]byte{{}, {0, 0}, {'h', 'i', byte(typeConnectionID)}} {
+		if _, _, err := readInnerPlaintext(inner); err == nil {
+			t.Errorf("Expected inner plaintext %x to be rejected", inner)
+		}
+	}
+}
+
+func TestReadUnifiedRecord(t *testing.T) {
+	header := buildUnifiedHeader(6, 0x10203, 3)
+	rec, err := readRecord(bytes.NewBuffer(append(header, 'a', 'b', 'c', 'x')), 0)
+	if err != nil {
+		t.Fatalf("Could not read unified record: %s", err)
+	}
+	if rec.Epoch != 2 || rec.SequenceNumber != 0x0203 || !bytes.Equal(rec.Header, header) || string(rec.Payload) != "abc" {
+		t.Errorf("Read unexpected unified record %s with header %x", rec, rec.Header)
+	}
+	// Records with a connection ID in the unified header are not supported.
+	header[0] |= unifiedHeaderConnectionID
+	if _, err := readRecord(bytes.NewBuffer(append(header, 'a', 'b', 'c')), 0); err == nil {
+		t.Errorf("Expected unified record with connection ID to be rejected")
+	}
+}
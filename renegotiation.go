@@ -0,0 +1,193 @@
+package dtls
+
+import (
+	"bytes"
+	"context"
+	"errors"
+)
+
+// RenegotiationSupport declares which renegotiations a connection takes
+// part in. Renegotiation needs the secure renegotiation of RFC 5746 on both
+// sides, which binds the new handshake to the connection.
+type RenegotiationSupport int
+
+const (
+	// RenegotiateNever refuses all renegotiations.
+	RenegotiateNever RenegotiationSupport = iota
+	// RenegotiateOnceAsClient allows one renegotiation per connection,
+	// whichever side starts it. Servers follow it the same way.
+	RenegotiateOnceAsClient
+	// RenegotiateFreelyAsClient allows any number of renegotiations.
+	RenegotiateFreelyAsClient
+)
+
+// maxRenegotiationApplicationData is the number of application data
+// records buffered while a renegotiation is in progress.
+const maxRenegotiationApplicationData = 64
+
+var (
+	// RenegotiationRefusedError is returned by Renegotiate if the peer
+	// declined with a no_renegotiation alert. The connection stays usable.
+	RenegotiationRefusedError = errors.New("Peer refused to renegotiate")
+	// RenegotiationNotAllowedError is returned by Renegotiate if
+	// Config.Renegotiation does not allow another renegotiation.
+	RenegotiationNotAllowedError = errors.New("Renegotiation is not allowed")
+	// InsecureRenegotiationError is returned by Renegotiate if the peer
+	// does not support secure renegotiation.
+	InsecureRenegotiationError = errors.New("Peer does not support secure renegotiation")
+)
+
+func newRenegotiationInfoExtension(renegotiatedConnection []byte) extension {
+	data := make([]byte, 0, 1+len(renegotiatedConnection))
+	data = append(data, byte(len(renegotiatedConnection)))
+	return extension{Type: ExtensionRenegotiationInfo, Data: append(data, renegotiatedConnection...)}
+}
+
+func readRenegotiationInfoExtension(data []byte) ([]byte, error) {
+	if len(data) == 0 || int(data[0]) != len(data)-1 {
+		return nil, InvalidExtensionError
+	}
+	return data[1:], nil
+}
+
+// renegotiatedConnection returns the renegotiated_connection of the
+// renegotiation_info extension in a renegotiation, the client's verify data
+// of the last handshake and, in the server's extension, its own.
+func (c *Conn) renegotiatedConnection(server bool) []byte {
+	info := append([]byte(nil), c.clientVerifyData...)
+	if server {
+		info = append(info, c.serverVerifyData...)
+	}
+	return info
+}
+
+// checkRenegotiationInfo compares the renegotiated_connection of the peer's
+// renegotiation_info extension with expected, RFC 5746 section 3.
+func checkRenegotiationInfo(extensions []extension, expected []byte) error {
+	e, ok := findExtension(extensions, ExtensionRenegotiationInfo)
+	if !ok {
+		return newAlertError(AlertHandshakeFailure, "Peer did not send the renegotiation info extension")
+	}
+	info, err := readRenegotiationInfoExtension(e.Data)
+	if err != nil || !bytes.Equal(info, expected) {
+		return newAlertError(AlertHandshakeFailure, "Peer sent invalid renegotiation info")
+	}
+	return nil
+}
+
+// Renegotiate runs a new handshake, which replaces the keys of the
+// connection. A client sends a new ClientHello, a server asks the client
+// for one with a HelloRequest. Both sides have to support secure
+// renegotiation and Config.Renegotiation has to allow it. If the peer
+// declines, RenegotiationRefusedError is returned and the connection is
+// kept. Writes continue during the renegotiation, but Renegotiate reads
+// the records of the peer, so it waits for a concurrent Read to return.
+// Application data that arrives meanwhile is returned by later reads.
+func (c *Conn) Renegotiate() error {
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+	if c.isClosed() {
+		return ConnClosedError
+	}
+	if err := c.error(); err != nil {
+		return err
+	}
+	if err := c.renegotiationAllowed(); err != nil {
+		return err
+	}
+	hc := c.newRenegotiationContext(0)
+	if sh, ok := hc.(*serverHandshake); ok {
+		sh.requestRenegotiation = true
+	}
+	return c.renegotiate(hc, nil)
+}
+
+func (c *Conn) renegotiationAllowed() error {
+	if c.version == DTLS_13 {
+		// DTLS 1.3 replaces renegotiation with key updates.
+		return RenegotiationNotAllowedError
+	}
+	if !c.secureRenegotiation {
+		return InsecureRenegotiationError
+	}
+	switch c.config.Renegotiation {
+	case RenegotiateFreelyAsClient:
+		return nil
+	case RenegotiateOnceAsClient:
+		if c.renegotiations == 0 {
+			return nil
+		}
+	}
+	return RenegotiationNotAllowedError
+}
+
+// isRenegotiationRequest reports whether message, received after the
+// handshake, starts a renegotiation. Servers receive a ClientHello,
+// clients a HelloRequest.
+func (c *Conn) isRenegotiationRequest(message *handshake) bool {
+	if _, ok := c.handshakeContext.(*serverHandshake); ok {
+		return message.MsgType == clientHello
+	}
+	return message.MsgType == helloRequest
+}
+
+// acceptRenegotiation answers the renegotiation the peer started with
+// message, or declines it with a no_renegotiation warning if the policy
+// does not allow it. The caller holds the readMutex.
+func (c *Conn) acceptRenegotiation(message *handshake) error {
+	if err := c.renegotiationAllowed(); err != nil {
+		c.logf("Refusing renegotiation: %s", err)
+		return c.sendAlert(AlertLevelWarning, AlertNoRenegotiation)
+	}
+	if message.MsgType == helloRequest {
+		// The HelloRequest is not part of the new handshake, the
+		// ServerHello follows it.
+		return c.renegotiate(c.newRenegotiationContext(message.MessageSeq+1), nil)
+	}
+	return c.renegotiate(c.newRenegotiationContext(0), message)
+}
+
+// newRenegotiationContext returns the context of a new handshake on the
+// established connection. The message sequence numbers start anew, RFC
+// 6347 section 4.2.2.
+func (c *Conn) newRenegotiationContext(nextReceiveSequenceNumber uint16) handshakeContext {
+	base := baseHandshakeContext{
+		Conn:                      c,
+		renegotiation:             true,
+		nextReceiveSequenceNumber: nextReceiveSequenceNumber,
+		handshakeMessageBuffer:    make(map[uint16]*handshakeFragmentList),
+	}
+	switch hc := c.handshakeContext.(type) {
+	case *serverHandshake:
+		base.isServer = true
+		return &serverHandshake{baseHandshakeContext: base, sessions: hc.sessions}
+	}
+	base.clientRandom = newRandom()
+	return &clientHandshake{baseHandshakeContext: base}
+}
+
+// renegotiate runs the handshake of hc, starting with first if the peer
+// already sent it. The caller holds the readMutex. If the peer declines,
+// the previous context is kept to answer its retransmissions.
+func (c *Conn) renegotiate(hc handshakeContext, first *handshake) error {
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+	previous := c.handshakeContext
+	c.handshakeContext = hc
+	err := c.runHandshake(context.Background(), first)
+	if err == RenegotiationRefusedError {
+		c.handshakeContext = previous
+		return err
+	}
+	if err != nil {
+		if c.isClosed() {
+			err = ConnClosedError
+		}
+		return c.abort(err)
+	}
+	c.renegotiations += 1
+	return nil
+}
@@ -0,0 +1,70 @@
+package dtls
+
+// replayWindowSize is the number of sequence numbers below the highest
+// received one that are tracked, RFC 6347 section 4.1.2.6.
+const replayWindowSize = 64
+
+// A replayWindow detects duplicated records of one epoch. Bit i of bitmap
+// is set if the record with sequence number latest - i was received.
+type replayWindow struct {
+	latest uint64
+	bitmap uint64
+}
+
+// isReplay reports whether a record with sequenceNumber was already
+// received or is too old to tell.
+func (w *replayWindow) isReplay(sequenceNumber uint64) bool {
+	if w.bitmap == 0 || sequenceNumber > w.latest {
+		return false
+	}
+	diff := w.latest - sequenceNumber
+	if diff >= replayWindowSize {
+		return true
+	}
+	return w.bitmap&(1<<diff) != 0
+}
+
+// isNewest reports whether sequenceNumber is higher than those of all
+// records received so far.
+func (w *replayWindow) isNewest(sequenceNumber uint64) bool {
+	return w.bitmap == 0 || sequenceNumber > w.latest
+}
+
+// update marks sequenceNumber as received. It must only be called for
+// records whose MAC was verified.
+func (w *replayWindow) update(sequenceNumber uint64) {
+	switch {
+	case w.bitmap == 0:
+		w.latest = sequenceNumber
+		w.bitmap = 1
+	case sequenceNumber > w.latest:
+		shift := sequenceNumber - w.latest
+		if shift >= replayWindowSize {
+			w.bitmap = 1
+		} else {
+			w.bitmap = w.bitmap<<shift | 1
+		}
+		w.latest = sequenceNumber
+	default:
+		w.bitmap |= 1 << (w.latest - sequenceNumber)
+	}
+}
+
+// expand returns the full sequence number of a DTLS 1.3 record from the
+// low bits in its header, the one closest to the record after the newest,
+// RFC 9147 section 4.2.2.
+func (w *replayWindow) expand(truncated uint64, bits uint) uint64 {
+	var next uint64
+	if w.bitmap != 0 {
+		next = w.latest + 1
+	}
+	span := uint64(1) << bits
+	candidate := next&^(span-1) | truncated
+	switch {
+	case candidate > next && candidate-next > span/2 && candidate >= span:
+		candidate -= span
+	case candidate < next && next-candidate > span/2:
+		candidate += span
+	}
+	return candidate
+}
@@ -0,0 +1,59 @@
+package dtls
+
+import (
+	"testing"
+)
+
+func TestReplayWindow(t *testing.T) {
+	window := &replayWindow{}
+	steps := []struct {
+		sequenceNumber uint64
+		replay         bool
+	}{
+		{5, false},
+		{5, true},
+		{3, false},
+		{3, true},
+		{100, false},
+		{5, true},
+		{37, false},
+		{36, true},
+		{100 + replayWindowSize, false},
+		{101, false},
+		{101, true},
+		{100, true},
+	}
+	for i, step := range steps {
+		if replay := window.isReplay(step.sequenceNumber); replay != step.replay {
+			t.Errorf("Step %d: expected replay %v for sequence number %d but got %v", i, step.replay, step.sequenceNumber, replay)
+		}
+		if !step.replay {
+			window.update(step.sequenceNumber)
+		}
+	}
+}
+
+func TestReplayWindowExpand(t *testing.T) {
+	for _, test := range []struct {
+		latest    uint64
+		truncated uint64
+		bits      uint
+		expected  uint64
+	}{
+		{0, 5, 8, 5},
+		{300, 302 & 0xff, 8, 302},
+		{300, 300 & 0xff, 8, 300},
+		{300, 0xff, 8, 255},
+		{510, 1, 8, 513},
+		{70000, 70001 & 0xffff, 16, 70001},
+		{70000, 0xfff0, 16, 65520},
+	} {
+		window := &replayWindow{}
+		if test.latest > 0 {
+			window.update(test.latest)
+		}
+		if sequenceNumber := window.expand(test.truncated, test.bits); sequenceNumber != test.expected {
+			t.Errorf("Expected %d bits %x after %d to expand to %d but got %d", test.bits, test.truncated, test.latest, test.expected, sequenceNumber)
+		}
+	}
+}
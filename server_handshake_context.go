@@ -2,43 +2,84 @@ package dtls
 
 import (
 	"bytes"
-	"errors"
-	"fmt"
-	"log"
+	"crypto/x509"
+	"time"
 )
 
 type serverHandshake struct {
 	baseHandshakeContext
+	// sessions caches the sessions of a Listener for resumption. It is nil
+	// if sessions are not resumable.
+	sessions *lruCache
+	// sendTicket is set if we issue a session ticket in this handshake.
+	sendTicket bool
+	// requestRenegotiation is set if we start a renegotiation, for which
+	// we ask the client with a HelloRequest.
+	requestRenegotiation bool
+	// cookies checks the cookies of the stateless HelloRetryRequests of a
+	// Listener, nil without one.
+	cookies *cookieGenerator
+	// receivedRecords are the records of the client's last DTLS 1.3 flight.
+	receivedRecords []recordNumber
+	// recordLimit is our answer to the client's record_size_limit or
+	// max_fragment_length extension, nil without one.
+	recordLimit *extension
 }
 
 func (sh *serverHandshake) beginHandshake() {
 	sh.currentFlight = 1
+	if sh.requestRenegotiation {
+		// The HelloRequest is not part of the handshake messages that
+		// the Finished messages cover, RFC 5246 section 7.4.1.1.
+		sh.sendFlight([]*handshake{sh.buildNextHandshakeMessage(helloRequest, []byte{})}, -1)
+	}
 }
 
 func (sh *serverHandshake) continueHandshake(message *handshake) (complete bool, err error) {
+	if !sh.renegotiation && sh.clientHello == nil && message.MsgType == clientHello && message.MessageSeq > sh.nextReceiveSequenceNumber {
+		// After a cookie exchange the ClientHello has message_seq 1 and the
+		// ServerHello has to use the same number, RFC 6347 section 4.2.2.
+		// Its record also continues the record sequence numbers of the
+		// HelloVerifyRequest, so the client does not take it for a replay.
+		sh.nextReceiveSequenceNumber = message.MessageSeq
+		sh.sequenceNumber = message.MessageSeq
+		sh.Conn.currentWriteState.sequenceNumber = sh.Conn.readSequenceNumber
+	}
+	if sh.currentFlight == 3 && sh.Conn.version == DTLS_13 {
+		sh.acknowledgeRecord()
+	}
 	sh.receiveMessage(message)
 	if sh.currentFlight == 1 && sh.isFlightOneComplete() {
 		err := sh.sendFlightTwo()
-		if err == nil {
+		if err != nil {
+			sh.logf("Error while sending flight two: %s", err)
+		} else if sh.clientHello != nil {
+			// After a HelloRetryRequest we wait for the next ClientHello.
 			sh.currentFlight = 3
-		} else {
-			log.Printf("Error while sending flight two: %s", err)
 		}
 		return false, err
 	}
+	if sh.currentFlight == 3 && sh.Conn.version == DTLS_13 {
+		return sh.isFlightThreeComplete13()
+	}
 	if sh.currentFlight == 3 {
-		log.Printf("We're in flight 3, state is\n%+v", sh.baseHandshakeContext)
+		sh.logf("We're in flight 3, state is\n%+v", sh.baseHandshakeContext)
 		if sh.clientKeyExchange != nil && sh.masterSecret == nil {
-			log.Printf("Handling client key exchange")
-			err := sh.handleKeyExchange()
-			if err != nil {
-				log.Printf("Error while handling client key exchange")
+			sh.logf("Handling client key exchange")
+			if err := sh.processClientCertificate(); err != nil {
+				return false, err
+			}
+			if err := sh.handleKeyExchange(); err != nil {
+				sh.logf("Error while handling client key exchange")
+				return false, err
 			}
-			return false, err
 		}
 		complete, err := sh.isFlightThreeComplete()
-		if complete && err == nil {
-			sh.sendFlightFour()
+		if complete && err == nil && !sh.Conn.didResume {
+			if err := sh.sendFlightFour(); err != nil {
+				return true, err
+			}
+			sh.storeSession()
 		}
 		return complete, err
 	}
@@ -52,33 +93,94 @@ func (sh *serverHandshake) isFlightOneComplete() bool {
 func (sh *serverHandshake) prepareFlightTwo() error {
 	clientHello, err := readHandshakeClientHello(sh.clientHello.Fragment)
 	if err != nil {
-		return errors.New(fmt.Sprintf("Failed to read client hello: %s", err))
+		return newAlertError(AlertDecodeError, "Failed to read client hello: %s", err)
+	}
+	version, err := sh.negotiateVersion(clientHello)
+	if err != nil {
+		return err
+	}
+	if err := sh.processRenegotiationInfo(clientHello, version); err != nil {
+		return err
+	}
+	if version == DTLS_13 {
+		return sh.prepareFlightTwo13(clientHello)
 	}
-	cipherSuite := findCommonCipherSuite(clientHello.CipherSuites, cipherSuites)
+	_, sh.Conn.extendedMasterSecret = findExtension(clientHello.Extensions, ExtensionExtendedMasterSecret)
+	if !sh.Conn.extendedMasterSecret && sh.config.RequireExtendedMasterSecret {
+		return newAlertError(AlertHandshakeFailure, "Client does not support the extended master secret")
+	}
+	if err := sh.processConnectionID(clientHello); err != nil {
+		return err
+	}
+	if err := sh.negotiateRecordLimits(clientHello, version); err != nil {
+		return err
+	}
+	if e, ok := findExtension(clientHello.Extensions, ExtensionSignatureAlgorithms); ok {
+		if sh.peerSignatureAlgorithms, err = readSignatureAlgorithmsExtension(e.Data); err != nil {
+			return newAlertError(AlertDecodeError, "Invalid signature algorithms extension")
+		}
+	}
+	sh.clientRandom = clientHello.Random
+	sh.serverRandom = newRandom()
+	if sh.config.supportsVersion(DTLS_13) {
+		setDowngradeSentinel(&sh.serverRandom, version)
+	}
+	if session, renewTicket := sh.resumableSession(clientHello); session != nil {
+		sh.sendTicket = renewTicket
+		return sh.prepareAbbreviatedFlightTwo(clientHello, session)
+	}
+	_, ticketsRequested := findExtension(clientHello.Extensions, ExtensionSessionTicket)
+	sh.sendTicket = ticketsRequested && sh.ticketsEnabled()
+	elliptic, err := sh.selectClientCurve(clientHello.Extensions)
+	if err != nil {
+		return err
+	}
+	sh.logf("Client supports ciphersuites: %+v", clientHello.CipherSuites)
+	cipherSuite := findCommonCipherSuite(clientHello.CipherSuites, sh.usableCipherSuites(elliptic))
 	if cipherSuite == nil {
-		return errors.New("Client does not support any cipher suites we support")
+		return newAlertError(AlertHandshakeFailure, "Client does not support any cipher suites we support")
 	}
 	sh.cipherSuite = *cipherSuite
 	sh.keyAgreement = cipherSuite.KeyAgreement()
+	if err := sh.negotiateEncryptThenMAC(clientHello); err != nil {
+		return err
+	}
+	sh.certificate = sh.config.certificateFor(cipherSuite)
 	compressionMethod, ok := findCommonCompressionMethod(clientHello.CompressionMethods)
 	if !ok {
-		return errors.New("Client does not support any compression methods we support")
+		return newAlertError(AlertIllegalParameter, "Client does not support any compression methods we support")
+	}
+	if sh.sessions != nil {
+		sh.sessionID = newSessionID()
 	}
-	sh.clientRandom = clientHello.Random
-	sh.serverRandom = newRandom()
 
 	srvHello := handshakeServerHello{
 		ServerVersion:     sh.Conn.version,
 		Random:            sh.serverRandom,
+		SessionID:         sh.sessionID,
 		CipherSuite:       cipherSuite,
 		CompressionMethod: compressionMethod,
 	}
+	if _, ok := findExtension(clientHello.Extensions, ExtensionECPointFormats); ok && cipherSuite.elliptic {
+		srvHello.Extensions = append(srvHello.Extensions, newECPointFormatsExtension())
+	}
+	srvHello.Extensions = append(srvHello.Extensions, sh.serverHelloExtensions()...)
 	sh.serverHello = sh.buildNextHandshakeMessage(serverHello, srvHello.Bytes())
-	srvKeyExchange, err := sh.keyAgreement.generateServerKeyExchange()
+	if sh.certificate != nil {
+		sh.serverCertificate = sh.buildNextHandshakeMessage(certificate, handshakeCertificate{Certificates: sh.certificate.Certificate}.Bytes(sh.Conn.version))
+	}
+	srvKeyExchange, err := sh.keyAgreement.generateServerKeyExchange(&sh.baseHandshakeContext)
 	if err != nil {
-		return err
+		return wrapAlertError(err, AlertInternalError, "Error while generating server key exchange: %s", err)
+	}
+	if srvKeyExchange != nil {
+		sh.serverKeyExchange = sh.buildNextHandshakeMessage(serverKeyExchange, srvKeyExchange)
+	}
+	// Only servers which authenticate themselves may request a client
+	// certificate, RFC 5246 section 7.4.4.
+	if sh.config.ClientAuth != NoClientCert && sh.certificate != nil {
+		sh.certificateRequest = sh.buildNextHandshakeMessage(certificateRequest, sh.newCertificateRequest().Bytes(sh.Conn.version))
 	}
-	sh.serverKeyExchange = sh.buildNextHandshakeMessage(serverKeyExchange, srvKeyExchange)
 	sh.serverHelloDone = sh.buildNextHandshakeMessage(serverHelloDone, []byte{})
 	return nil
 }
@@ -87,19 +189,341 @@ func (sh *serverHandshake) sendFlightTwo() error {
 	if err := sh.prepareFlightTwo(); err != nil {
 		return err
 	}
-	sh.sendHandshakeMessage(sh.serverHello)
-	sh.sendHandshakeMessage(sh.serverKeyExchange)
-	sh.sendHandshakeMessage(sh.serverHelloDone)
+	if sh.Conn.version == DTLS_13 {
+		sh.sendFlightTwo13()
+		return nil
+	}
+	if sh.Conn.didResume {
+		messages := presentMessages(sh.serverHello, sh.newSessionTicket, sh.serverFinished)
+		sh.sendFlight(messages, len(messages)-1)
+		return nil
+	}
+	sh.sendFlight(presentMessages(sh.serverHello, sh.serverCertificate, sh.serverKeyExchange, sh.certificateRequest, sh.serverHelloDone), -1)
 	return nil
 }
 
+// serverHelloExtensions returns the extensions of the ServerHello that
+// answer the client's in both full and abbreviated handshakes.
+func (sh *serverHandshake) serverHelloExtensions() []extension {
+	var extensions []extension
+	if sh.sendTicket {
+		extensions = append(extensions, extension{Type: ExtensionSessionTicket})
+	}
+	if sh.Conn.secureRenegotiation {
+		extensions = append(extensions, sh.renegotiationInfoExtension())
+	}
+	if sh.Conn.extendedMasterSecret {
+		extensions = append(extensions, extension{Type: ExtensionExtendedMasterSecret})
+	}
+	if sh.encryptThenMAC {
+		extensions = append(extensions, extension{Type: ExtensionEncryptThenMAC})
+	}
+	if sh.useConnectionID {
+		extensions = append(extensions, newConnectionIDExtension(sh.Conn.connectionID))
+	}
+	if sh.recordLimit != nil {
+		extensions = append(extensions, *sh.recordLimit)
+	}
+	return extensions
+}
+
+// negotiateVersion selects the version of the connection. A client which
+// offers DTLS 1.3 lists the versions it supports in the supported_versions
+// extension instead of client_version, RFC 9147 section 5.3. A
+// renegotiation keeps the version, so the extension is ignored then.
+func (sh *serverHandshake) negotiateVersion(clientHello handshakeClientHello) (protocolVersion, error) {
+	if e, ok := findExtension(clientHello.Extensions, ExtensionSupportedVersions); ok && !sh.renegotiation {
+		versions, err := readClientSupportedVersionsExtension(e.Data)
+		if err != nil {
+			return protocolVersion{}, newAlertError(AlertDecodeError, "Invalid supported versions extension")
+		}
+		version, ok := sh.config.selectVersion(versions)
+		if !ok {
+			return protocolVersion{}, newAlertError(AlertProtocolVersion, "Client offered no version we support")
+		}
+		return version, nil
+	}
+	version, ok := sh.config.mutualVersion(clientHello.ClientVersion)
+	if version == DTLS_13 {
+		// DTLS 1.3 is only negotiated with the extension.
+		version, ok = DTLS_12, sh.config.supportsVersion(DTLS_12)
+	}
+	if !ok {
+		return protocolVersion{}, newAlertError(AlertProtocolVersion, "Client offered unsupported version %s", clientHello.ClientVersion)
+	}
+	return version, nil
+}
+
+// processRenegotiationInfo checks whether the client supports secure
+// renegotiation, RFC 5746 section 3.6, and in a renegotiation that it
+// proves to renegotiate this connection, section 3.7. The version of the
+// connection must not change in a renegotiation.
+func (sh *serverHandshake) processRenegotiationInfo(clientHello handshakeClientHello, version protocolVersion) error {
+	if sh.renegotiation {
+		if version != sh.Conn.version {
+			return newAlertError(AlertProtocolVersion, "Client changed the version in a renegotiation")
+		}
+		if clientHello.RenegotiationSCSV {
+			return newAlertError(AlertHandshakeFailure, "Client sent the renegotiation SCSV in a renegotiation")
+		}
+		return checkRenegotiationInfo(clientHello.Extensions, sh.Conn.renegotiatedConnection(false))
+	}
+	if e, ok := findExtension(clientHello.Extensions, ExtensionRenegotiationInfo); ok {
+		if info, err := readRenegotiationInfoExtension(e.Data); err != nil || len(info) != 0 {
+			return newAlertError(AlertHandshakeFailure, "Client sent invalid renegotiation info")
+		}
+		sh.Conn.secureRenegotiation = true
+	}
+	if clientHello.RenegotiationSCSV {
+		sh.Conn.secureRenegotiation = true
+	}
+	sh.Conn.version = version
+	return nil
+}
+
+// processConnectionID agrees to use connection IDs if the client offers
+// them, RFC 9146 section 3. The client gets our connection ID, which is
+// empty unless we were accepted by a Listener.
+func (sh *serverHandshake) processConnectionID(clientHello handshakeClientHello) error {
+	e, ok := findExtension(clientHello.Extensions, ExtensionConnectionID)
+	if !ok || !sh.Conn.connectionIDsEnabled(sh.Conn.version) {
+		return nil
+	}
+	connectionID, err := readConnectionIDExtension(e.Data)
+	if err != nil {
+		return newAlertError(AlertDecodeError, "Invalid connection ID extension")
+	}
+	sh.useConnectionID = true
+	sh.peerConnectionID = connectionID
+	return nil
+}
+
+// negotiateEncryptThenMAC uses encrypt-then-MAC if the client offers it and
+// the selected cipher suite is a CBC suite, RFC 7366 section 3. A
+// renegotiation must not turn it off again, section 3.1.
+func (sh *serverHandshake) negotiateEncryptThenMAC(clientHello handshakeClientHello) error {
+	_, offered := findExtension(clientHello.Extensions, ExtensionEncryptThenMAC)
+	if sh.renegotiation && sh.Conn.currentReadState.encryptThenMAC && !offered {
+		return newAlertError(AlertHandshakeFailure, "Client turned off encrypt-then-MAC in a renegotiation")
+	}
+	sh.encryptThenMAC = offered && sh.cipherSuite.aead == nil
+	return nil
+}
+
+// renegotiationInfoExtension returns our renegotiation_info extension,
+// which is empty in the initial handshake.
+func (sh *serverHandshake) renegotiationInfoExtension() extension {
+	if !sh.renegotiation {
+		return newRenegotiationInfoExtension(nil)
+	}
+	return newRenegotiationInfoExtension(sh.Conn.renegotiatedConnection(true))
+}
+
+// resumableSession returns the session the client offered, if it can be
+// resumed with the version of this handshake and a cipher suite both sides
+// still accept. A session is only resumed if it used the extended master
+// secret exactly when the client offers it now, RFC 7627 section 5.3. It
+// reports whether the session came in a ticket which we should replace,
+// because it was not sealed with the current ticket key.
+func (sh *serverHandshake) resumableSession(clientHello handshakeClientHello) (session *sessionState, renewTicket bool) {
+	session, renewTicket = sh.offeredSession(clientHello)
+	if session == nil || session.expired() {
+		return nil, false
+	}
+	if session.version != sh.Conn.version ||
+		session.extendedMasterSecret != sh.Conn.extendedMasterSecret ||
+		!containsCipherSuite(clientHello.CipherSuites, session.cipherSuite) ||
+		!containsCipherSuite(sh.config.cipherSuites(), session.cipherSuite) {
+		return nil, false
+	}
+	return session, renewTicket
+}
+
+// offeredSession returns the session of the client's session ticket or, if
+// it sent none, the cached session of its session ID. A ticket we cannot
+// open leads to a full handshake, RFC 5077 section 3.4.
+func (sh *serverHandshake) offeredSession(clientHello handshakeClientHello) (*sessionState, bool) {
+	if e, ok := findExtension(clientHello.Extensions, ExtensionSessionTicket); ok && len(e.Data) > 0 && sh.ticketsEnabled() {
+		state, renew := sh.config.decryptTicket(e.Data)
+		if state == nil {
+			sh.logf("Unable to decrypt session ticket")
+			return nil, false
+		}
+		session, err := unmarshalSessionState(state)
+		if err != nil {
+			sh.logf("Unable to read session ticket: %s", err)
+			return nil, false
+		}
+		return session, renew
+	}
+	if sh.sessions == nil || len(clientHello.SessionID) == 0 {
+		return nil, false
+	}
+	value, ok := sh.sessions.get(string(clientHello.SessionID))
+	if !ok {
+		return nil, false
+	}
+	session := value.(*sessionState)
+	if session.expired() {
+		sh.sessions.remove(string(clientHello.SessionID))
+		return nil, false
+	}
+	return session, false
+}
+
+// ticketsEnabled reports whether we issue and accept session tickets.
+func (sh *serverHandshake) ticketsEnabled() bool {
+	return !sh.config.SessionTicketsDisabled && len(sh.config.sessionTicketKeys()) > 0
+}
+
+// prepareAbbreviatedFlightTwo resumes session with the abbreviated
+// handshake of RFC 5246 section 7.3, where our Finished message follows the
+// ServerHello and the client finishes the handshake.
+func (sh *serverHandshake) prepareAbbreviatedFlightTwo(clientHello handshakeClientHello, session *sessionState) error {
+	compressionMethod, ok := findCommonCompressionMethod(clientHello.CompressionMethods)
+	if !ok {
+		return newAlertError(AlertIllegalParameter, "Client does not support any compression methods we support")
+	}
+	cipherSuite := cipherSuiteByID(session.cipherSuite)
+	sh.cipherSuite = *cipherSuite
+	if err := sh.negotiateEncryptThenMAC(clientHello); err != nil {
+		return err
+	}
+	sh.sessionID = clientHello.SessionID
+	sh.peerCertificates = session.peerCertificates
+	sh.pskIdentity = session.pskIdentity
+	sh.Conn.didResume = true
+	srvHello := handshakeServerHello{
+		ServerVersion:     sh.Conn.version,
+		Random:            sh.serverRandom,
+		SessionID:         sh.sessionID,
+		CipherSuite:       cipherSuite,
+		CompressionMethod: compressionMethod,
+		Extensions:        sh.serverHelloExtensions(),
+	}
+	sh.serverHello = sh.buildNextHandshakeMessage(serverHello, srvHello.Bytes())
+	if sh.sendTicket {
+		if err := sh.prepareNewSessionTicket(session); err != nil {
+			return err
+		}
+	}
+	sh.establishKeys(session.masterSecret)
+	sh.finishedHash = newFinishedHash(&sh.cipherSuite)
+	for _, message := range presentMessages(sh.clientHello, sh.serverHello, sh.newSessionTicket) {
+		sh.finishedHash.Write(message.Bytes())
+	}
+	serverFinished := handshakeFinished{VerifyData: sh.finishedHash.serverSum(sh.Conn.version, sh.masterSecret)}
+	sh.serverFinished = sh.buildNextHandshakeMessage(finished, serverFinished.Bytes())
+	return nil
+}
+
+// newSessionState returns the session negotiated in a full handshake.
+func (sh *serverHandshake) newSessionState() *sessionState {
+	return &sessionState{
+		version:              sh.Conn.version,
+		cipherSuite:          sh.cipherSuite.id,
+		masterSecret:         sh.masterSecret,
+		peerCertificates:     sh.peerCertificates,
+		pskIdentity:          sh.pskIdentity,
+		createdAt:            time.Now(),
+		extendedMasterSecret: sh.Conn.extendedMasterSecret,
+	}
+}
+
+// storeSession caches the session of a full handshake for resumption.
+func (sh *serverHandshake) storeSession() {
+	if sh.sessions == nil || len(sh.sessionID) == 0 {
+		return
+	}
+	sh.sessions.put(string(sh.sessionID), sh.newSessionState())
+}
+
+// prepareNewSessionTicket hands session to the client in a ticket sealed
+// with our current ticket key.
+func (sh *serverHandshake) prepareNewSessionTicket(session *sessionState) error {
+	ticket, err := sh.config.encryptTicket(session.marshal())
+	if err != nil {
+		return newAlertError(AlertInternalError, "Unable to create session ticket: %s", err)
+	}
+	message := handshakeNewSessionTicket{LifetimeHint: uint32(sessionLifetime / time.Second), Ticket: ticket}
+	sh.newSessionTicket = sh.buildNextHandshakeMessage(newSessionTicket, message.Bytes())
+	return nil
+}
+
+func (sh *serverHandshake) newCertificateRequest() handshakeCertificateRequest {
+	request := handshakeCertificateRequest{
+		CertificateTypes:    []clientCertificateType{certificateTypeECDSASign, certificateTypeRSASign},
+		SignatureAlgorithms: supportedSignatureAlgorithms,
+	}
+	if sh.Conn.version == DTLS_13 {
+		request.SignatureAlgorithms = signatureAlgorithms13
+	}
+	if sh.config.ClientCAs != nil {
+		request.CertificateAuthorities = sh.config.ClientCAs.Subjects()
+	}
+	return request
+}
+
+// selectClientCurve selects the curve for ECDHE from the client's
+// supported_groups extension. It reports whether there is a curve and
+// point format both sides support.
+func (sh *serverHandshake) selectClientCurve(extensions []extension) (bool, error) {
+	e, ok := findExtension(extensions, ExtensionSupportedGroups)
+	if !ok {
+		return false, nil
+	}
+	curves, err := readSupportedGroupsExtension(e.Data)
+	if err != nil {
+		return false, newAlertError(AlertDecodeError, "Invalid supported groups extension")
+	}
+	if e, ok := findExtension(extensions, ExtensionECPointFormats); ok {
+		uncompressed, err := readECPointFormatsExtension(e.Data)
+		if err != nil {
+			return false, newAlertError(AlertDecodeError, "Invalid EC point formats extension")
+		}
+		if !uncompressed {
+			return false, nil
+		}
+	}
+	sh.curve, ok = selectCurve(curves)
+	return ok, nil
+}
+
+// usableCipherSuites returns the configured cipher suites without the ones
+// that need a certificate or pre-shared keys we do not have, that do not
+// work with the negotiated version, and without the elliptic curve suites
+// unless elliptic is set.
+func (sh *serverHandshake) usableCipherSuites(elliptic bool) []*cipherSuite {
+	var suites []*cipherSuite
+	for _, suite := range sh.config.cipherSuites() {
+		if _, ok := suite.signatureType(); ok && sh.config.certificateFor(suite) == nil {
+			continue
+		}
+		if suite.flags&suitePSK != 0 && sh.config.GetPSK == nil {
+			continue
+		}
+		if suite.elliptic && !elliptic {
+			continue
+		}
+		if !suite.supportsVersion(sh.Conn.version) {
+			continue
+		}
+		suites = append(suites, suite)
+	}
+	return suites
+}
+
+// findCommonCipherSuite returns the first suite in the server's order of
+// preference the client supports. A client that prefers ChaCha20-Poly1305
+// probably lacks AES hardware, so those suites are tried first then.
 func findCommonCipherSuite(client, server []*cipherSuite) *cipherSuite {
-	log.Printf("Client supports ciphersuites: %+v", client)
-	log.Printf("We support: %+v", server)
-	for _, suiteA := range client {
-		for _, suiteB := range server {
+	if prefersChaCha20(client) {
+		server = chaCha20First(server)
+	}
+	for _, suiteB := range server {
+		for _, suiteA := range client {
 			if suiteA.id == suiteB.id {
-				return suiteA
+				return suiteB
 			}
 		}
 	}
@@ -116,26 +540,71 @@ func findCommonCompressionMethod(methods []compressionMethod) (compressionMethod
 }
 
 func (sh *serverHandshake) handleKeyExchange() error {
-	clientKeyExchange, err := readClientKeyExchange(sh.clientKeyExchange.Fragment)
+	preMasterSecret, err := sh.keyAgreement.processClientKeyExchange(&sh.baseHandshakeContext, sh.clientKeyExchange.Fragment)
 	if err != nil {
-		log.Printf("Error while reading client key exchange: %v", err)
-		return err
+		return wrapAlertError(err, AlertIllegalParameter, "Error while processing client key exchange: %v", err)
 	}
-	preMasterSecret, err := sh.keyAgreement.processClientKeyExchange(clientKeyExchange)
-	log.Printf("Premaster secret is %x", preMasterSecret)
-	if err != nil {
-		log.Printf("Error while processing client key exchange: %v", err)
-		return err
+	sh.establishKeys(sh.deriveMasterSecret(preMasterSecret))
+	return nil
+}
+
+// processClientCertificate checks the client's certificate chain according
+// to the ClientAuth policy.
+func (sh *serverHandshake) processClientCertificate() error {
+	if sh.certificateRequest == nil {
+		if sh.clientCertificate != nil {
+			return newAlertError(AlertUnexpectedMessage, "Client sent a certificate we did not request")
+		}
+		return nil
+	}
+	var certs []*x509.Certificate
+	if sh.clientCertificate != nil {
+		var err error
+		if certs, err = parseCertificates(sh.clientCertificate, sh.Conn.version); err != nil {
+			return err
+		}
+	}
+	if len(certs) == 0 {
+		if sh.config.ClientAuth == RequireAnyClientCert || sh.config.ClientAuth == RequireAndVerifyClientCert {
+			return newAlertError(AlertHandshakeFailure, "Client did not send a certificate")
+		}
+		return nil
+	}
+	if _, err := signatureTypeOf(certs[0].PublicKey); err != nil {
+		return newAlertError(AlertUnsupportedCertificate, "Client certificate has an unsupported key type")
+	}
+	if sh.config.ClientAuth == VerifyClientCertIfGiven || sh.config.ClientAuth == RequireAndVerifyClientCert {
+		if err := verifyCertificateChain(certs, sh.config.ClientCAs, "", x509.ExtKeyUsageClientAuth); err != nil {
+			return err
+		}
+	}
+	sh.peerCertificates = certs
+	return nil
+}
+
+// verifyCertificateVerify checks that the client owns the key of the
+// certificate it sent.
+func (sh *serverHandshake) verifyCertificateVerify() error {
+	if len(sh.peerCertificates) == 0 {
+		if sh.certificateVerify != nil {
+			return newAlertError(AlertUnexpectedMessage, "Client sent CertificateVerify without a certificate")
+		}
+		return nil
+	}
+	if sh.certificateVerify == nil {
+		return newAlertError(AlertUnexpectedMessage, "Client did not send CertificateVerify")
+	}
+	buffer := bytes.NewBuffer(sh.certificateVerify.Fragment)
+	signature, err := readDigitallySigned(buffer, sh.Conn.version)
+	if err != nil || buffer.Len() != 0 {
+		return newAlertError(AlertDecodeError, "Error while reading certificate verify")
+	}
+	if sh.Conn.version == DTLS_12 && !isSupportedSignatureAlgorithm(signature.Algorithm, supportedSignatureAlgorithms) {
+		return newAlertError(AlertIllegalParameter, "Client used signature algorithm %s which we did not offer", signature.Algorithm)
+	}
+	if err := verifySignature(sh.Conn.version, sh.peerCertificates[0].PublicKey, signature.Algorithm, signature.Signature, sh.certificateVerifyTranscript()); err != nil {
+		return newAlertError(AlertDecryptError, "Invalid certificate verify signature: %s", err)
 	}
-	masterSecret, clientMAC, serverMAC, clientKey, serverKey :=
-		keysFromPreMasterSecret(sh.Conn.version, preMasterSecret, sh.clientRandom.Bytes(), sh.serverRandom.Bytes(),
-			sh.cipherSuite.macLen, sh.cipherSuite.keyLen)
-	sh.masterSecret = masterSecret
-	sh.Conn.pendingWriteState.Cipher = sh.cipherSuite.cipher(serverKey)
-	sh.Conn.pendingWriteState.Mac = sh.cipherSuite.mac(serverMAC)
-	sh.Conn.pendingReadState.Cipher = sh.cipherSuite.cipher(clientKey)
-	sh.Conn.pendingReadState.Mac = sh.cipherSuite.mac(clientMAC)
-	logMasterSecret(sh.clientRandom.Bytes(), masterSecret)
 	return nil
 }
 
@@ -143,36 +612,58 @@ func (sh *serverHandshake) isFlightThreeComplete() (complete bool, err error) {
 	if sh.clientFinished == nil {
 		return false, nil
 	}
+	if sh.Conn.didResume {
+		return true, sh.verifyAbbreviatedClientFinished()
+	}
+	if err := sh.verifyCertificateVerify(); err != nil {
+		return true, err
+	}
 	clientFinished, err := readHandshakeFinished(sh.clientFinished.Fragment)
 	if err != nil {
-		return true, err
+		return true, newAlertError(AlertDecodeError, "Error while reading client finished: %s", err)
 	}
-	sh.finishedHash = newFinishedHash()
-	sh.finishedHash.Write(sh.clientHello.Bytes())
-	sh.finishedHash.Write(sh.serverHello.Bytes())
-	sh.finishedHash.Write(sh.serverKeyExchange.Bytes())
-	sh.finishedHash.Write(sh.serverHelloDone.Bytes())
-	sh.finishedHash.Write(sh.clientKeyExchange.Bytes())
-	if sh.Conn.version == DTLS_10 && !bytes.Equal(clientFinished.VerifyData, sh.finishedHash.clientSum10(sh.masterSecret)) {
-		err = errors.New("Client sent incorrect verify data")
-	} else if sh.Conn.version == DTLS_12 && !bytes.Equal(clientFinished.VerifyData, sh.finishedHash.clientSum12(sh.masterSecret)) {
-		err = errors.New("Client sent incorrect verify data")
+	sh.finishedHash = sh.clientFinishedHash()
+	if !bytes.Equal(clientFinished.VerifyData, sh.finishedHash.clientSum(sh.Conn.version, sh.masterSecret)) {
+		return true, newAlertError(AlertDecryptError, "Client sent incorrect verify data")
 	}
-	return true, err
+	return true, nil
 }
 
-func (sh *serverHandshake) prepareFlightFour() {
+// verifyAbbreviatedClientFinished checks the client's Finished message,
+// which completes an abbreviated handshake.
+func (sh *serverHandshake) verifyAbbreviatedClientFinished() error {
+	if sh.clientKeyExchange != nil || sh.clientCertificate != nil || sh.certificateVerify != nil {
+		return newAlertError(AlertUnexpectedMessage, "Client sent key exchange messages in an abbreviated handshake")
+	}
+	clientFinished, err := readHandshakeFinished(sh.clientFinished.Fragment)
+	if err != nil {
+		return newAlertError(AlertDecodeError, "Error while reading client finished: %s", err)
+	}
+	sh.finishedHash.Write(sh.serverFinished.Bytes())
+	if !bytes.Equal(clientFinished.VerifyData, sh.finishedHash.clientSum(sh.Conn.version, sh.masterSecret)) {
+		return newAlertError(AlertDecryptError, "Client sent incorrect verify data")
+	}
+	return nil
+}
+
+func (sh *serverHandshake) prepareFlightFour() error {
 	sh.finishedHash.Write(sh.clientFinished.Bytes())
-	if sh.Conn.version == DTLS_10 {
-		serverFinished := &handshakeFinished{VerifyData: sh.finishedHash.serverSum10(sh.masterSecret)}
-	} else if sh.Conn.version == DTLS_12 {
-		serverFinished := &handshakeFinished{VerifyData: sh.finishedHash.serverSum12(sh.masterSecret)}
+	if sh.sendTicket {
+		if err := sh.prepareNewSessionTicket(sh.newSessionState()); err != nil {
+			return err
+		}
+		sh.finishedHash.Write(sh.newSessionTicket.Bytes())
 	}
+	serverFinished := handshakeFinished{VerifyData: sh.finishedHash.serverSum(sh.Conn.version, sh.masterSecret)}
 	sh.serverFinished = sh.buildNextHandshakeMessage(finished, serverFinished.Bytes())
+	return nil
 }
 
-func (sh *serverHandshake) sendFlightFour() {
-	sh.prepareFlightFour()
-	sh.Conn.sendChangeCipherSpec()
-	sh.sendHandshakeMessage(sh.serverFinished)
+func (sh *serverHandshake) sendFlightFour() error {
+	if err := sh.prepareFlightFour(); err != nil {
+		return err
+	}
+	messages := presentMessages(sh.newSessionTicket, sh.serverFinished)
+	sh.sendFlight(messages, len(messages)-1)
+	return nil
 }
@@ -0,0 +1,251 @@
+package dtls
+
+// cipherSuites13 returns the configured cipher suites of DTLS 1.3.
+func (c *Config) cipherSuites13() []*cipherSuite {
+	var suites []*cipherSuite
+	for _, suite := range c.cipherSuites() {
+		if suite.supportsVersion(DTLS_13) {
+			suites = append(suites, suite)
+		}
+	}
+	return suites
+}
+
+// negotiateKeyExchange13 selects the cipher suite and the group of a DTLS
+// 1.3 handshake. share is the client's key share of the group, or nil if the
+// client has to be asked for one with a HelloRetryRequest.
+func negotiateKeyExchange13(config *Config, clientHello handshakeClientHello) (suite *cipherSuite, group namedCurve, share *keyShare, err error) {
+	if suite = findCommonCipherSuite(clientHello.CipherSuites, config.cipherSuites13()); suite == nil {
+		return nil, 0, nil, newAlertError(AlertHandshakeFailure, "Client does not support any DTLS 1.3 cipher suites we support")
+	}
+	e, ok := findExtension(clientHello.Extensions, ExtensionSupportedGroups)
+	if !ok {
+		return nil, 0, nil, newAlertError(AlertMissingExtension, "Client did not send the supported groups extension")
+	}
+	groups, err := readSupportedGroupsExtension(e.Data)
+	if err != nil {
+		return nil, 0, nil, newAlertError(AlertDecodeError, "Invalid supported groups extension")
+	}
+	if e, ok = findExtension(clientHello.Extensions, ExtensionKeyShare); !ok {
+		return nil, 0, nil, newAlertError(AlertMissingExtension, "Client did not send the key share extension")
+	}
+	shares, err := readClientKeyShareExtension(e.Data)
+	if err != nil {
+		return nil, 0, nil, newAlertError(AlertDecodeError, "Invalid key share extension")
+	}
+	for _, curve := range supportedCurves {
+		for i := range shares {
+			if shares[i].group == curve && isSupportedCurve(curve, groups) {
+				return suite, curve, &shares[i], nil
+			}
+		}
+	}
+	if group, ok = selectCurve(groups); !ok {
+		return nil, 0, nil, newAlertError(AlertHandshakeFailure, "Client does not support any groups we support")
+	}
+	return suite, group, nil, nil
+}
+
+// newHelloRetryRequest returns a HelloRetryRequest, which asks the client
+// for a key share of group unless it is zero and to repeat cookie unless it
+// is nil, RFC 8446 section 4.1.4.
+func newHelloRetryRequest(sessionID []byte, suite *cipherSuite, group namedCurve, cookie []byte) handshakeServerHello {
+	hrr := handshakeServerHello{
+		ServerVersion:     DTLS_12,
+		Random:            newHelloRetryRandom(),
+		SessionID:         sessionID,
+		CipherSuite:       suite,
+		CompressionMethod: compressionNone,
+		Extensions:        []extension{newServerSupportedVersionsExtension(DTLS_13)},
+	}
+	if group != 0 {
+		hrr.Extensions = append(hrr.Extensions, newHelloRetryKeyShareExtension(group))
+	}
+	if cookie != nil {
+		hrr.Extensions = append(hrr.Extensions, newCookieExtension(cookie))
+	}
+	return hrr
+}
+
+// messageHash returns the hash of message as it is part of the transcript.
+func (cs *cipherSuite) messageHash(message *handshake) []byte {
+	hash := cs.prfHash()()
+	hash.Write(message.transcriptBytes())
+	return hash.Sum(nil)
+}
+
+// prepareFlightTwo13 answers a ClientHello with DTLS 1.3, RFC 9147 section
+// 5. Without a key share we can use, the client is asked for one with a
+// HelloRetryRequest and the handshake continues with its next ClientHello.
+// Otherwise the ServerHello is followed by the rest of the flight, which is
+// protected with the handshake traffic keys.
+func (sh *serverHandshake) prepareFlightTwo13(clientHello handshakeClientHello) error {
+	if len(clientHello.Cookie) > 0 || len(clientHello.CompressionMethods) != 1 || clientHello.CompressionMethods[0] != compressionNone {
+		return newAlertError(AlertIllegalParameter, "Client sent a legacy cookie or compression methods with DTLS 1.3")
+	}
+	if e, ok := findExtension(clientHello.Extensions, ExtensionCookie); ok && sh.helloRetryRequest == nil {
+		if err := sh.restoreHelloRetryRequest(clientHello, e); err != nil {
+			return err
+		}
+	}
+	e, ok := findExtension(clientHello.Extensions, ExtensionSignatureAlgorithms)
+	if !ok {
+		return newAlertError(AlertMissingExtension, "Client did not send the signature algorithms extension")
+	}
+	var err error
+	if sh.peerSignatureAlgorithms, err = readSignatureAlgorithmsExtension(e.Data); err != nil {
+		return newAlertError(AlertDecodeError, "Invalid signature algorithms extension")
+	}
+	if sh.certificate = sh.config.certificate13(sh.peerSignatureAlgorithms); sh.certificate == nil {
+		return newAlertError(AlertHandshakeFailure, "No certificate fits the client's signature algorithms")
+	}
+	if err := sh.negotiateRecordLimits(clientHello, DTLS_13); err != nil {
+		return err
+	}
+	suite, group, share, err := negotiateKeyExchange13(sh.config, clientHello)
+	if err != nil {
+		return err
+	}
+	if sh.helloRetryRequest != nil {
+		// The second ClientHello has to follow the HelloRetryRequest,
+		// RFC 8446 section 4.1.2.
+		if suite.id != sh.cipherSuite.id {
+			return newAlertError(AlertIllegalParameter, "Client changed the cipher suite after the hello retry request")
+		}
+		if share == nil || sh.curve != 0 && share.group != sh.curve {
+			return newAlertError(AlertIllegalParameter, "Client did not send the key share we asked for")
+		}
+	}
+	sh.cipherSuite = *suite
+	if share == nil {
+		sh.prepareHelloRetryRequest(clientHello, group)
+		return nil
+	}
+	sh.curve = group
+	key, ourShare := generateKeyShare(group)
+	secret, err := sharedSecret(key, *share)
+	if err != nil {
+		return newAlertError(AlertIllegalParameter, "Invalid client key share: %s", err)
+	}
+	sh.clientRandom = clientHello.Random
+	sh.serverRandom = newRandom()
+	srvHello := handshakeServerHello{
+		ServerVersion:     DTLS_12,
+		Random:            sh.serverRandom,
+		SessionID:         clientHello.SessionID,
+		CipherSuite:       suite,
+		CompressionMethod: compressionNone,
+		Extensions:        []extension{newServerSupportedVersionsExtension(DTLS_13), newServerKeyShareExtension(ourShare)},
+	}
+	sh.serverHello = sh.buildNextHandshakeMessage(serverHello, srvHello.Bytes())
+	sh.establishHandshakeKeys(secret)
+
+	var ee handshakeEncryptedExtensions
+	if sh.recordLimit != nil {
+		ee.Extensions = append(ee.Extensions, *sh.recordLimit)
+	}
+	sh.encryptedExtensions = sh.buildNextHandshakeMessage(encryptedExtensions, ee.Bytes())
+	if sh.config.ClientAuth != NoClientCert {
+		sh.certificateRequest = sh.buildNextHandshakeMessage(certificateRequest, sh.newCertificateRequest().Bytes(DTLS_13))
+	}
+	sh.serverCertificate = sh.buildNextHandshakeMessage(certificate, handshakeCertificate{Certificates: sh.certificate.Certificate}.Bytes(DTLS_13))
+	if sh.serverCertificateVerify, err = sh.newCertificateVerify13(serverSignatureContext, sh.serverCertificate); err != nil {
+		return err
+	}
+	verifyData := suite.finishedMAC(sh.serverHandshakeSecret, sh.transcriptHash13(sh.serverCertificateVerify))
+	sh.serverFinished = sh.buildNextHandshakeMessage(finished, handshakeFinished{VerifyData: verifyData}.Bytes())
+	sh.establishApplicationKeys()
+	return nil
+}
+
+// prepareHelloRetryRequest asks the client for a key share of group. The
+// first ClientHello is only kept as its hash, the handshake starts over
+// with the next one.
+func (sh *serverHandshake) prepareHelloRetryRequest(clientHello handshakeClientHello, group namedCurve) {
+	sh.logf("Asking the client for a key share of group %d", group)
+	sh.curve = group
+	sh.clientHelloHash = sh.cipherSuite.messageHash(sh.clientHello)
+	hrr := newHelloRetryRequest(clientHello.SessionID, &sh.cipherSuite, group, nil)
+	sh.helloRetryRequest = sh.buildNextHandshakeMessage(serverHello, hrr.Bytes())
+	sh.clientHello = nil
+}
+
+// restoreHelloRetryRequest recovers the state of the stateless
+// HelloRetryRequest a Listener sent from the cookie the client repeats, RFC
+// 9147 section 5.1.
+func (sh *serverHandshake) restoreHelloRetryRequest(clientHello handshakeClientHello, e extension) error {
+	cookie, err := readCookieExtension(e.Data)
+	if err != nil {
+		return newAlertError(AlertDecodeError, "Invalid cookie extension")
+	}
+	if sh.cookies == nil {
+		return newAlertError(AlertIllegalParameter, "Client sent a cookie we did not issue")
+	}
+	suite, group, clientHelloHash, ok := sh.cookies.verifyRetry(sh.Conn.RemoteAddr(), cookie)
+	if !ok {
+		return newAlertError(AlertIllegalParameter, "Client sent an invalid cookie")
+	}
+	sh.cipherSuite = *suite
+	sh.curve = group
+	sh.clientHelloHash = clientHelloHash
+	fragment := newHelloRetryRequest(clientHello.SessionID, suite, group, cookie).Bytes()
+	sh.helloRetryRequest = &handshake{
+		MsgType:        serverHello,
+		Length:         uint32(len(fragment)),
+		FragmentLength: uint32(len(fragment)),
+		Fragment:       fragment,
+	}
+	return nil
+}
+
+// sendFlightTwo13 sends the HelloRetryRequest or the server's flight of a
+// DTLS 1.3 handshake. All messages after the ServerHello are protected
+// with the handshake traffic keys.
+func (sh *serverHandshake) sendFlightTwo13() {
+	if sh.serverHello == nil {
+		sh.sendFlight([]*handshake{sh.helloRetryRequest}, -1)
+		return
+	}
+	sh.sendFlight13(presentMessages(sh.serverHello, sh.encryptedExtensions, sh.certificateRequest,
+		sh.serverCertificate, sh.serverCertificateVerify, sh.serverFinished), 1)
+}
+
+// isFlightThreeComplete13 checks the client's last flight once its
+// Finished message arrived. Then both sides use the application data keys
+// and the records of the flight are acknowledged, RFC 9147 section 7.
+func (sh *serverHandshake) isFlightThreeComplete13() (bool, error) {
+	if sh.clientFinished == nil {
+		return false, nil
+	}
+	if err := sh.processClientCertificate(); err != nil {
+		return true, err
+	}
+	if len(sh.peerCertificates) > 0 {
+		if err := verifyCertificateVerify13(sh.certificateVerify, sh.peerCertificates[0].PublicKey, clientSignatureContext, sh.transcriptHash13(sh.clientCertificate)); err != nil {
+			return true, err
+		}
+	} else if sh.certificateVerify != nil {
+		return true, newAlertError(AlertUnexpectedMessage, "Client sent CertificateVerify without a certificate")
+	}
+	transcriptHash := sh.transcriptHash13(lastMessage(sh.serverFinished, sh.clientCertificate, sh.certificateVerify))
+	if err := verifyFinished13(sh.clientFinished, &sh.cipherSuite, sh.clientHandshakeSecret, transcriptHash); err != nil {
+		return true, err
+	}
+	sh.Conn.setReadEpoch(epochApplicationData, sh.Conn.pendingReadState)
+	sh.Conn.setWriteEpoch(epochApplicationData, sh.Conn.pendingWriteState)
+	return true, sh.Conn.sendACK(sh.receivedRecords)
+}
+
+// acknowledgeRecord remembers the last record read if it belongs to the
+// client's last flight, which is acknowledged once it is complete.
+func (sh *serverHandshake) acknowledgeRecord() {
+	if sh.Conn.lastRecord.epoch != uint64(epochHandshake) {
+		return
+	}
+	for _, number := range sh.receivedRecords {
+		if number == sh.Conn.lastRecord {
+			return
+		}
+	}
+	sh.receivedRecords = append(sh.receivedRecords, sh.Conn.lastRecord)
+}
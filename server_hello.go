@@ -27,9 +27,7 @@ func (sh handshakeServerHello) Bytes() []byte {
 	buffer.Write(sh.SessionID)
 	buffer.Write(sh.CipherSuite.Bytes())
 	buffer.Write(sh.CompressionMethod.Bytes())
-	for _, extension := range sh.Extensions {
-		buffer.Write(extension.Bytes())
-	}
+	writeExtensions(buffer, sh.Extensions)
 	return buffer.Bytes()
 }
 
@@ -58,15 +56,6 @@ func readHandshakeServerHello(byts []byte) (hsh handshakeServerHello, err error)
 	if hsh.CompressionMethod, err = readCompressionMethod(buffer); err != nil {
 		return
 	}
-	if buffer.Len() > 2 {
-		// TODO: does this field exist if there are no extensions?
-		numExtensions := readUint16(buffer)
-		hsh.Extensions = make([]extension, int(numExtensions))
-		for i := 0; i < int(numExtensions); i++ {
-			if hsh.Extensions[i], err = readExtension(buffer); err != nil {
-				return
-			}
-		}
-	}
+	hsh.Extensions, err = readExtensions(buffer)
 	return
 }
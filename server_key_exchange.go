@@ -13,12 +13,13 @@ type serverDHParams struct {
 }
 
 func readServerDHParams(buffer *bytes.Buffer) (sdhp serverDHParams, err error) {
-	pLength := readUint16(buffer)
-	sdhp.P = buffer.Next(int(pLength))
-	gLength := readUint16(buffer)
-	sdhp.G = buffer.Next(int(gLength))
-	pubKeyLength := readUint16(buffer)
-	sdhp.PublicKey = buffer.Next(int(pubKeyLength))
+	if sdhp.P, err = readOpaque16(buffer); err != nil {
+		return
+	}
+	if sdhp.G, err = readOpaque16(buffer); err != nil {
+		return
+	}
+	sdhp.PublicKey, err = readOpaque16(buffer)
 	return
 }
 
@@ -43,6 +44,44 @@ func (sdhp serverDHParams) Bytes() []byte {
 	return buffer.Bytes()
 }
 
+// ecCurveTypeNamedCurve is the only ECCurveType we support, RFC 4492
+// section 5.4.
+const ecCurveTypeNamedCurve = 3
+
+type serverECDHParams struct {
+	NamedCurve namedCurve
+	PublicKey  []byte
+}
+
+func readServerECDHParams(buffer *bytes.Buffer) (p serverECDHParams, err error) {
+	if buffer.Len() < 4 {
+		return p, InsufficentBytesError
+	}
+	if curveType, _ := buffer.ReadByte(); curveType != ecCurveTypeNamedCurve {
+		return p, UnsupportedCurveError
+	}
+	p.NamedCurve = namedCurve(readUint16(buffer))
+	publicKeyLength, _ := buffer.ReadByte()
+	if buffer.Len() < int(publicKeyLength) {
+		return p, InsufficentBytesError
+	}
+	p.PublicKey = buffer.Next(int(publicKeyLength))
+	return
+}
+
+func (p serverECDHParams) String() string {
+	return fmt.Sprintf("ServerECDHParams{ NamedCurve: %d, PublicKey: %x }", p.NamedCurve, p.PublicKey)
+}
+
+func (p serverECDHParams) Bytes() []byte {
+	buffer := &bytes.Buffer{}
+	buffer.WriteByte(ecCurveTypeNamedCurve)
+	buffer.Write(p.NamedCurve.Bytes())
+	buffer.WriteByte(byte(len(p.PublicKey)))
+	buffer.Write(p.PublicKey)
+	return buffer.Bytes()
+}
+
 type handshakeServerKeyExchange struct {
 	Params serverDHParams
 }
@@ -50,9 +89,6 @@ type handshakeServerKeyExchange struct {
 func readHandshakeServerKeyExchange(byts []byte) (ske handshakeServerKeyExchange, err error) {
 	buffer := bytes.NewBuffer(byts)
 	ske.Params, err = readServerDHParams(buffer)
-	if err != nil {
-		panic("Unparsable server key exchange message")
-	}
 	return
 }
 
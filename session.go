@@ -0,0 +1,244 @@
+package dtls
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// sessionLifetime is how long a session may be resumed, the upper limit
+// recommended by RFC 5246 appendix F.1.4.
+const sessionLifetime = 24 * time.Hour
+
+// serverSessionCacheSize is the number of sessions a Listener keeps for
+// resumption by session ID.
+const serverSessionCacheSize = 1024
+
+// sessionState is what both sides need to resume a session with an
+// abbreviated handshake.
+type sessionState struct {
+	version      protocolVersion
+	cipherSuite  cipherSuiteId
+	masterSecret []byte
+	// peerCertificates and pskIdentity restore what the full handshake
+	// learned about the peer.
+	peerCertificates []*x509.Certificate
+	pskIdentity      []byte
+	createdAt        time.Time
+	// extendedMasterSecret is set if masterSecret is an extended master
+	// secret, RFC 7627. It has to match in the resumed handshake.
+	extendedMasterSecret bool
+}
+
+func (s *sessionState) expired() bool {
+	return time.Since(s.createdAt) > sessionLifetime
+}
+
+// sessionStateFormat is the first byte of a serialised sessionState. It has
+// to change with the format, so that servers reject tickets they would
+// misread.
+const sessionStateFormat = 2
+
+var InvalidSessionStateError = errors.New("Invalid session state")
+
+// marshal serialises the session for a session ticket. The format is kept
+// stable, so that servers sharing their ticket keys resume each other's
+// sessions:
+//
+//	uint8  format
+//	uint16 protocol version
+//	uint16 cipher suite
+//	uint64 creation time in seconds since the Unix epoch
+//	uint8  1 for an extended master secret, else 0
+//	opaque master_secret<1..2^8-1>
+//	opaque psk_identity<0..2^16-1>
+//	ASN.1Cert peer_certificates<0..2^24-1>
+func (s *sessionState) marshal() []byte {
+	buffer := bytes.Buffer{}
+	buffer.WriteByte(sessionStateFormat)
+	buffer.Write(s.version.Bytes())
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint16(b, uint16(s.cipherSuite))
+	buffer.Write(b[:2])
+	binary.BigEndian.PutUint64(b, uint64(s.createdAt.Unix()))
+	buffer.Write(b)
+	if s.extendedMasterSecret {
+		buffer.WriteByte(1)
+	} else {
+		buffer.WriteByte(0)
+	}
+	buffer.WriteByte(byte(len(s.masterSecret)))
+	buffer.Write(s.masterSecret)
+	buffer.Write(opaque16(s.pskIdentity))
+	chain := make([][]byte, 0, len(s.peerCertificates))
+	for _, cert := range s.peerCertificates {
+		chain = append(chain, cert.Raw)
+	}
+	buffer.Write(handshakeCertificate{Certificates: chain}.Bytes(DTLS_12))
+	return buffer.Bytes()
+}
+
+func unmarshalSessionState(data []byte) (*sessionState, error) {
+	buffer := bytes.NewBuffer(data)
+	if buffer.Len() < 15 {
+		return nil, InvalidSessionStateError
+	}
+	if format, _ := buffer.ReadByte(); format != sessionStateFormat {
+		return nil, InvalidSessionStateError
+	}
+	s := &sessionState{}
+	var err error
+	if s.version, err = readProtocolVersion(buffer); err != nil {
+		return nil, err
+	}
+	s.cipherSuite = cipherSuiteId(readUint16(buffer))
+	s.createdAt = time.Unix(int64(binary.BigEndian.Uint64(buffer.Next(8))), 0)
+	switch ems, _ := buffer.ReadByte(); ems {
+	case 0:
+	case 1:
+		s.extendedMasterSecret = true
+	default:
+		return nil, InvalidSessionStateError
+	}
+	length, _ := buffer.ReadByte()
+	if length == 0 || buffer.Len() < int(length) {
+		return nil, InvalidSessionStateError
+	}
+	s.masterSecret = append([]byte(nil), buffer.Next(int(length))...)
+	identity, err := readOpaque16(buffer)
+	if err != nil {
+		return nil, InvalidSessionStateError
+	}
+	if len(identity) > 0 {
+		s.pskIdentity = append([]byte(nil), identity...)
+	}
+	chain, err := readHandshakeCertificate(buffer.Bytes(), DTLS_12)
+	if err != nil {
+		return nil, InvalidSessionStateError
+	}
+	for _, der := range chain.Certificates {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		s.peerCertificates = append(s.peerCertificates, cert)
+	}
+	return s, nil
+}
+
+// newSessionID returns a random session ID of the maximum length.
+func newSessionID() []byte {
+	id := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return id
+}
+
+// ClientSessionState contains the state a client needs to resume a
+// session. It is opaque to the application.
+type ClientSessionState struct {
+	sessionID []byte
+	// ticket is the session ticket the server issued, if any.
+	ticket  []byte
+	session sessionState
+}
+
+// ClientSessionCache is a cache of ClientSessionState objects that clients
+// use to resume sessions with a server. The keys are the ServerName of the
+// config or, without one, the address of the server. Implementations must
+// be safe for concurrent use.
+type ClientSessionCache interface {
+	// Get returns the session stored for sessionKey.
+	Get(sessionKey string) (session *ClientSessionState, ok bool)
+	// Put stores session for sessionKey. A nil session removes the entry.
+	Put(sessionKey string, session *ClientSessionState)
+}
+
+// NewLRUClientSessionCache returns a ClientSessionCache which keeps the
+// capacity most recently used sessions. If capacity is less than one, a
+// default capacity of 64 is used.
+func NewLRUClientSessionCache(capacity int) ClientSessionCache {
+	if capacity < 1 {
+		capacity = 64
+	}
+	return &lruClientSessionCache{newLRUCache(capacity)}
+}
+
+type lruClientSessionCache struct {
+	*lruCache
+}
+
+func (c *lruClientSessionCache) Get(sessionKey string) (*ClientSessionState, bool) {
+	if value, ok := c.get(sessionKey); ok {
+		return value.(*ClientSessionState), true
+	}
+	return nil, false
+}
+
+func (c *lruClientSessionCache) Put(sessionKey string, session *ClientSessionState) {
+	if session == nil {
+		c.remove(sessionKey)
+		return
+	}
+	c.put(sessionKey, session)
+}
+
+// lruCache is a map limited to the capacity most recently used entries. It
+// is safe for concurrent use.
+type lruCache struct {
+	mutex    sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+}
+
+func newLRUCache(capacity int) *lruCache {
+	return &lruCache{capacity: capacity, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+func (c *lruCache) get(key string) (interface{}, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*lruEntry).value, true
+}
+
+func (c *lruCache) put(key string, value interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*lruEntry).value = value
+		c.order.MoveToFront(element)
+		return
+	}
+	if c.order.Len() >= c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, value: value})
+}
+
+func (c *lruCache) remove(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.order.Remove(element)
+		delete(c.entries, key)
+	}
+}
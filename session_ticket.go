@@ -0,0 +1,109 @@
+package dtls
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+type handshakeNewSessionTicket struct {
+	LifetimeHint uint32
+	Ticket       []byte
+}
+
+func (nst handshakeNewSessionTicket) Bytes() []byte {
+	b := make([]byte, 4, 6+len(nst.Ticket))
+	binary.BigEndian.PutUint32(b, nst.LifetimeHint)
+	return append(b, opaque16(nst.Ticket)...)
+}
+
+func (nst handshakeNewSessionTicket) String() string {
+	return fmt.Sprintf("NewSessionTicket{ LifetimeHint: %d, Ticket: %x }", nst.LifetimeHint, nst.Ticket)
+}
+
+func readHandshakeNewSessionTicket(byts []byte) (nst handshakeNewSessionTicket, err error) {
+	buffer := bytes.NewBuffer(byts)
+	if buffer.Len() < 6 {
+		return nst, InvalidHandshakeError
+	}
+	nst.LifetimeHint = readUint32(buffer)
+	if nst.Ticket, err = readOpaque16(buffer); err != nil {
+		return
+	}
+	if buffer.Len() != 0 {
+		return nst, InvalidHandshakeError
+	}
+	return
+}
+
+// ticketKey encrypts and authenticates session tickets. Its name is sent in
+// front of the ticket, so the server finds the key of a ticket among the
+// keys it still accepts.
+type ticketKey struct {
+	name [16]byte
+	aead cipher.AEAD
+}
+
+// newTicketKey derives the name and the AES-256-GCM key of a ticket key
+// from the key set in the config.
+func newTicketKey(key [32]byte) ticketKey {
+	hash := sha512.Sum512(key[:])
+	k := ticketKey{}
+	copy(k.name[:], hash[:16])
+	block, err := aes.NewCipher(hash[16:48])
+	if err != nil {
+		panic(err)
+	}
+	if k.aead, err = cipher.NewGCM(block); err != nil {
+		panic(err)
+	}
+	return k
+}
+
+var NoTicketKeysError = errors.New("No session ticket keys set")
+
+// encryptTicket seals state with the first ticket key. A ticket is the key
+// name, a random nonce and the sealed state, authenticated together with
+// the key name.
+func (c *Config) encryptTicket(state []byte) ([]byte, error) {
+	keys := c.sessionTicketKeys()
+	if len(keys) == 0 {
+		return nil, NoTicketKeysError
+	}
+	key := keys[0]
+	ticket := make([]byte, len(key.name), len(key.name)+key.aead.NonceSize()+len(state)+key.aead.Overhead())
+	copy(ticket, key.name[:])
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	ticket = append(ticket, nonce...)
+	return key.aead.Seal(ticket, nonce, state, key.name[:]), nil
+}
+
+// decryptTicket opens a ticket sealed with any of the ticket keys. It
+// returns nil if no key opens it and reports whether the ticket should be
+// replaced because it was not sealed with the first key.
+func (c *Config) decryptTicket(ticket []byte) (state []byte, renew bool) {
+	for i, key := range c.sessionTicketKeys() {
+		if len(ticket) < len(key.name)+key.aead.NonceSize()+key.aead.Overhead() {
+			return nil, false
+		}
+		if subtle.ConstantTimeCompare(ticket[:len(key.name)], key.name[:]) != 1 {
+			continue
+		}
+		nonce := ticket[len(key.name) : len(key.name)+key.aead.NonceSize()]
+		state, err := key.aead.Open(nil, nonce, ticket[len(nonce)+len(key.name):], key.name[:])
+		if err != nil {
+			return nil, false
+		}
+		return state, i > 0
+	}
+	return nil, false
+}
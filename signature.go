@@ -0,0 +1,315 @@
+package dtls
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Hash and signature algorithms from RFC 5246, section 7.4.1.4.1. The
+// RSASSA-PSS schemes of RFC 8446 section 4.2.3 are encoded with
+// hashIntrinsic, they name their hash in the signature byte.
+type hashAlgorithm uint8
+
+const (
+	hashSHA1      hashAlgorithm = 2
+	hashSHA256    hashAlgorithm = 4
+	hashSHA384    hashAlgorithm = 5
+	hashIntrinsic hashAlgorithm = 8
+)
+
+type signatureAlgorithm uint8
+
+const (
+	signatureRSA              signatureAlgorithm = 1
+	signatureECDSA            signatureAlgorithm = 3
+	signatureRSAPSSRSAESHA256 signatureAlgorithm = 4
+	signatureRSAPSSRSAESHA384 signatureAlgorithm = 5
+)
+
+type signatureAndHash struct {
+	Hash      hashAlgorithm
+	Signature signatureAlgorithm
+}
+
+// supportedSignatureAlgorithms are the algorithms we offer in the
+// signature_algorithms extension, in order of preference.
+var supportedSignatureAlgorithms = []signatureAndHash{
+	{hashSHA256, signatureECDSA},
+	{hashSHA256, signatureRSA},
+	{hashSHA384, signatureECDSA},
+	{hashSHA384, signatureRSA},
+	{hashSHA1, signatureECDSA},
+	{hashSHA1, signatureRSA},
+}
+
+// signatureAlgorithms13 are the signature schemes of DTLS 1.3 we offer and
+// accept, in order of preference. ECDSA schemes are bound to a curve there.
+var signatureAlgorithms13 = []signatureAndHash{
+	{hashSHA256, signatureECDSA},
+	{hashSHA384, signatureECDSA},
+	{hashIntrinsic, signatureRSAPSSRSAESHA256},
+	{hashIntrinsic, signatureRSAPSSRSAESHA384},
+}
+
+// The context strings of the CertificateVerify signatures of DTLS 1.3, RFC
+// 8446 section 4.4.3.
+const (
+	serverSignatureContext = "TLS 1.3, server CertificateVerify"
+	clientSignatureContext = "TLS 1.3, client CertificateVerify"
+)
+
+var UnsupportedSignatureAlgorithmError = errors.New("Unsupported signature algorithm")
+
+func (h hashAlgorithm) cryptoHash() (crypto.Hash, error) {
+	switch h {
+	case hashSHA1:
+		return crypto.SHA1, nil
+	case hashSHA256:
+		return crypto.SHA256, nil
+	case hashSHA384:
+		return crypto.SHA384, nil
+	default:
+		return 0, UnsupportedSignatureAlgorithmError
+	}
+}
+
+// cryptoHash returns the hash of the algorithm.
+func (sh signatureAndHash) cryptoHash() (crypto.Hash, error) {
+	if sh.Hash != hashIntrinsic {
+		return sh.Hash.cryptoHash()
+	}
+	switch sh.Signature {
+	case signatureRSAPSSRSAESHA256:
+		return crypto.SHA256, nil
+	case signatureRSAPSSRSAESHA384:
+		return crypto.SHA384, nil
+	default:
+		return 0, UnsupportedSignatureAlgorithmError
+	}
+}
+
+// keyType returns the type of key that signs with the algorithm.
+func (sh signatureAndHash) keyType() signatureAlgorithm {
+	if sh.isPSS() {
+		return signatureRSA
+	}
+	return sh.Signature
+}
+
+func (sh signatureAndHash) isPSS() bool {
+	return sh.Hash == hashIntrinsic && (sh.Signature == signatureRSAPSSRSAESHA256 || sh.Signature == signatureRSAPSSRSAESHA384)
+}
+
+// matchesCurve reports whether an ECDSA key may sign with the algorithm in
+// DTLS 1.3, where ecdsa_secp256r1_sha256 and ecdsa_secp384r1_sha384 are
+// only used with their curve.
+func (sh signatureAndHash) matchesCurve(key crypto.PublicKey) bool {
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return true
+	}
+	switch sh.Hash {
+	case hashSHA256:
+		return ecKey.Curve == elliptic.P256()
+	case hashSHA384:
+		return ecKey.Curve == elliptic.P384()
+	}
+	return false
+}
+
+func (sh signatureAndHash) Bytes() []byte {
+	return []byte{byte(sh.Hash), byte(sh.Signature)}
+}
+
+func (sh signatureAndHash) String() string {
+	return fmt.Sprintf("SignatureAndHash{ Hash: %d, Signature: %d }", sh.Hash, sh.Signature)
+}
+
+func isSupportedSignatureAlgorithm(algorithm signatureAndHash, algorithms []signatureAndHash) bool {
+	for _, a := range algorithms {
+		if a == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+func newSignatureAlgorithmsExtension(algorithms []signatureAndHash) extension {
+	data := make([]byte, 2, 2+2*len(algorithms))
+	binary.BigEndian.PutUint16(data, uint16(2*len(algorithms)))
+	for _, algorithm := range algorithms {
+		data = append(data, algorithm.Bytes()...)
+	}
+	return extension{Type: ExtensionSignatureAlgorithms, Data: data}
+}
+
+func readSignatureAlgorithmsExtension(data []byte) (algorithms []signatureAndHash, err error) {
+	buffer := bytes.NewBuffer(data)
+	list, err := readOpaque16(buffer)
+	if err != nil || len(list)%2 != 0 || buffer.Len() != 0 {
+		return nil, InvalidExtensionError
+	}
+	for i := 0; i < len(list); i += 2 {
+		algorithms = append(algorithms, signatureAndHash{hashAlgorithm(list[i]), signatureAlgorithm(list[i+1])})
+	}
+	return
+}
+
+// signatureTypeOf returns the signature algorithm that is used with key.
+func signatureTypeOf(key crypto.PublicKey) (signatureAlgorithm, error) {
+	switch key.(type) {
+	case *ecdsa.PublicKey:
+		return signatureECDSA, nil
+	case *rsa.PublicKey:
+		return signatureRSA, nil
+	default:
+		return 0, UnsupportedSignatureAlgorithmError
+	}
+}
+
+// selectSignatureAlgorithm picks the algorithm to sign with key. Before
+// DTLS 1.2 the algorithm is implied by the key. In DTLS 1.2 the first hash
+// the peer offered for our key type is used, SHA1 if it did not send the
+// signature_algorithms extension. DTLS 1.3 requires the extension and
+// signs with the first of our schemes that fits the key.
+func selectSignatureAlgorithm(version protocolVersion, key crypto.PublicKey, peerAlgorithms []signatureAndHash) (signatureAndHash, error) {
+	typ, err := signatureTypeOf(key)
+	if err != nil {
+		return signatureAndHash{}, err
+	}
+	if version == DTLS_13 {
+		for _, algorithm := range peerAlgorithms {
+			if algorithm.keyType() == typ && algorithm.matchesCurve(key) && isSupportedSignatureAlgorithm(algorithm, signatureAlgorithms13) {
+				return algorithm, nil
+			}
+		}
+		return signatureAndHash{}, UnsupportedSignatureAlgorithmError
+	}
+	if version == DTLS_10 || peerAlgorithms == nil {
+		return signatureAndHash{hashSHA1, typ}, nil
+	}
+	for _, algorithm := range peerAlgorithms {
+		if algorithm.Signature == typ && isSupportedSignatureAlgorithm(algorithm, supportedSignatureAlgorithms) {
+			return algorithm, nil
+		}
+	}
+	return signatureAndHash{}, UnsupportedSignatureAlgorithmError
+}
+
+// signatureDigest hashes data for a signature. Before DTLS 1.2, RSA
+// signatures are made over the concatenation of an MD5 and a SHA1 hash.
+func signatureDigest(version protocolVersion, algorithm signatureAndHash, data ...[]byte) ([]byte, crypto.Hash, error) {
+	if version == DTLS_10 && algorithm.Signature == signatureRSA {
+		md5Hash := md5.New()
+		sha1Hash := sha1.New()
+		for _, d := range data {
+			md5Hash.Write(d)
+			sha1Hash.Write(d)
+		}
+		return sha1Hash.Sum(md5Hash.Sum(nil)), crypto.MD5SHA1, nil
+	}
+	hashFunc, err := algorithm.cryptoHash()
+	if err != nil {
+		return nil, 0, err
+	}
+	h := hashFunc.New()
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil), hashFunc, nil
+}
+
+func signData(version protocolVersion, key crypto.PrivateKey, algorithm signatureAndHash, data ...[]byte) ([]byte, error) {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("Private key does not implement crypto.Signer")
+	}
+	digest, hashFunc, err := signatureDigest(version, algorithm, data...)
+	if err != nil {
+		return nil, err
+	}
+	if algorithm.isPSS() {
+		return signer.Sign(rand.Reader, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: hashFunc})
+	}
+	return signer.Sign(rand.Reader, digest, hashFunc)
+}
+
+// verifySignature checks a signature made by the owner of key. Before
+// DTLS 1.2 algorithm is ignored, it is implied by the key.
+func verifySignature(version protocolVersion, key crypto.PublicKey, algorithm signatureAndHash, signature []byte, data ...[]byte) error {
+	typ, err := signatureTypeOf(key)
+	if err != nil {
+		return err
+	}
+	if version == DTLS_10 {
+		algorithm = signatureAndHash{hashSHA1, typ}
+	} else if typ != algorithm.keyType() || version == DTLS_13 && !algorithm.matchesCurve(key) {
+		return errors.New("Signature algorithm does not match the key")
+	}
+	digest, hashFunc, err := signatureDigest(version, algorithm, data...)
+	if err != nil {
+		return err
+	}
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest, signature) {
+			return errors.New("Invalid ECDSA signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		if algorithm.isPSS() {
+			return rsa.VerifyPSS(key, hashFunc, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+		return rsa.VerifyPKCS1v15(key, hashFunc, digest, signature)
+	}
+	return UnsupportedSignatureAlgorithmError
+}
+
+// A digitallySigned is a signature as it is sent in handshake messages. The
+// algorithm is only sent explicitly since DTLS 1.2.
+type digitallySigned struct {
+	Algorithm signatureAndHash
+	Signature []byte
+}
+
+func readDigitallySigned(buffer *bytes.Buffer, version protocolVersion) (ds digitallySigned, err error) {
+	if version != DTLS_10 {
+		if buffer.Len() < 2 {
+			return ds, InsufficentBytesError
+		}
+		ds.Algorithm.Hash = hashAlgorithm(buffer.Next(1)[0])
+		ds.Algorithm.Signature = signatureAlgorithm(buffer.Next(1)[0])
+	}
+	ds.Signature, err = readOpaque16(buffer)
+	return
+}
+
+func (ds digitallySigned) Bytes(version protocolVersion) []byte {
+	buffer := bytes.Buffer{}
+	if version != DTLS_10 {
+		buffer.Write(ds.Algorithm.Bytes())
+	}
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(len(ds.Signature)))
+	buffer.Write(b)
+	buffer.Write(ds.Signature)
+	return buffer.Bytes()
+}
+
+// signedContent13 returns what a DTLS 1.3 CertificateVerify signs, the
+// transcript hash behind a context string, RFC 8446 section 4.4.3.
+func signedContent13(context string, transcriptHash []byte) []byte {
+	content := bytes.Repeat([]byte{0x20}, 64)
+	content = append(content, context...)
+	content = append(content, 0)
+	return append(content, transcriptHash...)
+}
@@ -0,0 +1,107 @@
+package dtls
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// newClientSupportedVersionsExtension returns the supported_versions
+// extension of a ClientHello, which lists the versions the client offers in
+// order of preference, RFC 8446 section 4.2.1.
+func newClientSupportedVersionsExtension(versions []protocolVersion) extension {
+	data := make([]byte, 1, 1+2*len(versions))
+	data[0] = byte(2 * len(versions))
+	for _, version := range versions {
+		data = append(data, version.Bytes()...)
+	}
+	return extension{Type: ExtensionSupportedVersions, Data: data}
+}
+
+func readClientSupportedVersionsExtension(data []byte) (versions []protocolVersion, err error) {
+	if len(data) < 3 || int(data[0]) != len(data)-1 || data[0]%2 != 0 {
+		return nil, InvalidExtensionError
+	}
+	for i := 1; i < len(data); i += 2 {
+		versions = append(versions, versionFromUint16(binary.BigEndian.Uint16(data[i:])))
+	}
+	return
+}
+
+// newServerSupportedVersionsExtension returns the supported_versions
+// extension of a ServerHello, which holds the selected version.
+func newServerSupportedVersionsExtension(version protocolVersion) extension {
+	return extension{Type: ExtensionSupportedVersions, Data: version.Bytes()}
+}
+
+func readServerSupportedVersionsExtension(data []byte) (protocolVersion, error) {
+	if len(data) != 2 {
+		return protocolVersion{}, InvalidExtensionError
+	}
+	return versionFromUint16(binary.BigEndian.Uint16(data)), nil
+}
+
+// offeredVersions returns the versions a client offers in order of
+// preference. DTLS 1.3 can not be negotiated in a renegotiation.
+func (c *Config) offeredVersions(renegotiation bool) (versions []protocolVersion) {
+	for _, version := range []protocolVersion{DTLS_13, DTLS_12, DTLS_10} {
+		if c.supportsVersion(version) && !(renegotiation && version == DTLS_13) {
+			versions = append(versions, version)
+		}
+	}
+	return
+}
+
+// selectVersion returns the highest version in the client's
+// supported_versions extension that the config supports.
+func (c *Config) selectVersion(peerVersions []protocolVersion) (protocolVersion, bool) {
+	for _, version := range []protocolVersion{DTLS_13, DTLS_12, DTLS_10} {
+		if c.supportsVersion(version) && containsVersion(peerVersions, version) {
+			return version, true
+		}
+	}
+	return protocolVersion{}, false
+}
+
+// offersVersion reports whether the supported_versions extension of a
+// ClientHello contains version.
+func offersVersion(hello handshakeClientHello, version protocolVersion) bool {
+	e, ok := findExtension(hello.Extensions, ExtensionSupportedVersions)
+	if !ok {
+		return false
+	}
+	versions, err := readClientSupportedVersionsExtension(e.Data)
+	return err == nil && containsVersion(versions, version)
+}
+
+func containsVersion(versions []protocolVersion, version protocolVersion) bool {
+	for _, v := range versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// The last eight bytes of the random of a server which supports DTLS 1.3
+// but negotiates an older version, RFC 8446 section 4.1.3. A client which
+// offered DTLS 1.3 detects a downgrade by an attacker with them.
+var (
+	downgradeDTLS12 = []byte("DOWNGRD\x01")
+	downgradeDTLS10 = []byte("DOWNGRD\x00")
+)
+
+// setDowngradeSentinel marks the server random of a handshake which
+// negotiated version although the server supports DTLS 1.3.
+func setDowngradeSentinel(r *random, version protocolVersion) {
+	if version == DTLS_12 {
+		copy(r.Opaque[20:], downgradeDTLS12)
+	} else {
+		copy(r.Opaque[20:], downgradeDTLS10)
+	}
+}
+
+// hasDowngradeSentinel reports whether a server random carries one of the
+// downgrade sentinels.
+func hasDowngradeSentinel(r random) bool {
+	return bytes.Equal(r.Opaque[20:], downgradeDTLS12) || bytes.Equal(r.Opaque[20:], downgradeDTLS10)
+}
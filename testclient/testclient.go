@@ -16,7 +16,9 @@ func main() {
 	if err != nil {
 		log.Fatalf("Unable to connect to remote addr: %v\n", err)
 	}
-	dtlsConn := dtls.NewConn(conn, false)
+	// The test server has no certificate, so the anonymous suite has to be
+	// enabled explicitly.
+	dtlsConn := dtls.Client(conn, &dtls.Config{CipherSuites: []uint16{dtls.TLS_DH_anon_WITH_AES_128_CBC_SHA}})
 	for {
 		_, err := dtlsConn.Write([]byte("Hello World"))
 		if err != nil {
@@ -15,7 +15,7 @@ func main() {
 	if err != nil {
 		log.Fatalf("Unable to listen on adress: %v\n", err)
 	}
-	listener := dtls.NewListener(conn)
+	listener := dtls.NewListener(conn, &dtls.Config{CipherSuites: []uint16{dtls.TLS_DH_anon_WITH_AES_128_CBC_SHA}})
 	for {
 		log.Printf("Listening for new connection")
 		conn, err := listener.Accept()
@@ -39,5 +39,4 @@ func main() {
 			}
 		})()
 	}
-	log.Printf("Server shutting down")
 }
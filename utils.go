@@ -31,3 +31,23 @@ func readUint48(buffer *bytes.Buffer) uint64 {
 	t := buffer.Next(6)
 	return binary.BigEndian.Uint64(append([]byte{0, 0}, t...))
 }
+
+// readOpaque16 reads a byte vector with a two byte length prefix.
+func readOpaque16(buffer *bytes.Buffer) ([]byte, error) {
+	if buffer.Len() < 2 {
+		return nil, InsufficentBytesError
+	}
+	length := int(readUint16(buffer))
+	if buffer.Len() < length {
+		return nil, InsufficentBytesError
+	}
+	return buffer.Next(length), nil
+}
+
+// opaque16 returns data with a two byte length prefix.
+func opaque16(data []byte) []byte {
+	buffer := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(buffer, uint16(len(data)))
+	copy(buffer[2:], data)
+	return buffer
+}
@@ -1,50 +1,147 @@
 package dtls
 
 import (
+	"io"
 	"net"
+	"sync"
 	"time"
 )
 
+// virtualConnQueueSize is the number of datagrams buffered for a virtual
+// connection before further datagrams are dropped.
+const virtualConnQueueSize = 64
+
+// A packet is a datagram received by a virtual connection.
+type packet struct {
+	data []byte
+	from net.Addr
+}
+
 type virtualConn struct {
-	in            chan []byte
-	out           net.PacketConn
-	localAddress  net.Addr
+	in           chan packet
+	closed       chan struct{}
+	closeOnce    sync.Once
+	out          net.PacketConn
+	localAddress net.Addr
+	// remoteAddress changes if the peer moves to another address.
+	addressMutex  sync.Mutex
 	remoteAddress net.Addr
+	// onRelease is called when the connection no longer needs the packets
+	// from its remote address.
+	onRelease func()
+	// onMigrate is called with the previous address when the remote
+	// address changed.
+	onMigrate func(from net.Addr)
+
+	deadlineMutex sync.Mutex
 	readDeadline  time.Time
+	// deadlineChanged is closed and replaced whenever the read deadline
+	// changes, so that a blocked Read picks up the new deadline.
+	deadlineChanged chan struct{}
 }
 
 func newVirtualConn(conn net.PacketConn, local, remote net.Addr) *virtualConn {
 	return &virtualConn{
-		in:            make(chan []byte),
-		out:           conn,
-		localAddress:  local,
-		remoteAddress: remote,
+		in:              make(chan packet, virtualConnQueueSize),
+		closed:          make(chan struct{}),
+		out:             conn,
+		localAddress:    local,
+		remoteAddress:   remote,
+		deadlineChanged: make(chan struct{}),
 	}
 }
 
-func (c *virtualConn) Receive(b []byte) {
-	c.in <- b
+// Receive queues a datagram from the address from for Read. Like a UDP
+// socket it drops the datagram if the queue is full or the connection is
+// closed.
+func (c *virtualConn) Receive(b []byte, from net.Addr) {
+	select {
+	case <-c.closed:
+	case c.in <- packet{data: b, from: from}:
+	default:
+	}
 }
 
 func (c *virtualConn) Read(b []byte) (n int, err error) {
-	record := <-c.in
-	return copy(b, record), nil
+	n, _, err = c.readFrom(b)
+	return
+}
+
+// readFrom reads a datagram like Read and returns its source, which is not
+// the remote address if the peer moved.
+func (c *virtualConn) readFrom(b []byte) (n int, from net.Addr, err error) {
+	for {
+		c.deadlineMutex.Lock()
+		deadline := c.readDeadline
+		deadlineChanged := c.deadlineChanged
+		c.deadlineMutex.Unlock()
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return 0, nil, timeoutError{"i/o timeout"}
+			}
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		done := true
+		select {
+		case p := <-c.in:
+			n, from = copy(b, p.data), p.from
+		case <-c.closed:
+			err = io.EOF
+		case <-timeout:
+			err = timeoutError{"i/o timeout"}
+		case <-deadlineChanged:
+			// Start over with the new deadline.
+			done = false
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if done {
+			return n, from, err
+		}
+	}
 }
 
 func (c *virtualConn) Write(b []byte) (n int, err error) {
-	return c.out.WriteTo(b, c.remoteAddress)
+	return c.out.WriteTo(b, c.RemoteAddr())
+}
+
+// setRemoteAddr sends all further datagrams to addr.
+func (c *virtualConn) setRemoteAddr(addr net.Addr) {
+	c.addressMutex.Lock()
+	from := c.remoteAddress
+	c.remoteAddress = addr
+	c.addressMutex.Unlock()
+	if c.onMigrate != nil {
+		c.onMigrate(from)
+	}
 }
 
 func (c *virtualConn) Close() error {
-	close(c.in)
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	c.release()
 	return nil
 }
 
+func (c *virtualConn) release() {
+	if c.onRelease != nil {
+		c.onRelease()
+	}
+}
+
 func (c *virtualConn) LocalAddr() net.Addr {
 	return c.localAddress
 }
 
 func (c *virtualConn) RemoteAddr() net.Addr {
+	c.addressMutex.Lock()
+	defer c.addressMutex.Unlock()
 	return c.remoteAddress
 }
 
@@ -53,10 +150,32 @@ func (c *virtualConn) SetDeadline(t time.Time) (err error) {
 }
 
 func (c *virtualConn) SetReadDeadline(t time.Time) (err error) {
+	c.deadlineMutex.Lock()
+	defer c.deadlineMutex.Unlock()
 	c.readDeadline = t
+	close(c.deadlineChanged)
+	c.deadlineChanged = make(chan struct{})
 	return
 }
 
 func (c *virtualConn) SetWriteDeadline(t time.Time) (err error) {
 	return
 }
+
+// timeoutError is returned when a deadline passes. It implements
+// net.Error so callers can recognise timeouts.
+type timeoutError struct {
+	message string
+}
+
+func (e timeoutError) Error() string {
+	return e.message
+}
+
+func (e timeoutError) Timeout() bool {
+	return true
+}
+
+func (e timeoutError) Temporary() bool {
+	return true
+}